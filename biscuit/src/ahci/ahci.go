@@ -9,6 +9,9 @@ import "container/list"
 
 import "apic"
 
+import "defs"
+import "dev"
+import "fdops"
 import "fs"
 import "mem"
 import "msi"
@@ -37,6 +40,19 @@ func dbg(x string, args ...interface{}) {
 /// It is assigned during Ahci_init and referenced by the filesystem layer.
 var Ahci fs.Disk_i
 
+/// Rawfs is the file system on the disk. The raw disk devices read and write
+/// through it so that they agree with it; they cannot be opened until it is
+/// set.
+var Rawfs *fs.Fs_t
+
+// the raw disk device of an attached port is /dev/rsdNc, where N is its minor
+func rawopen(maj, min int) (fdops.Fdops_i, defs.Err_t) {
+	if Rawfs == nil {
+		return nil, -defs.ENODEV
+	}
+	return Rawfs.Rawdisk(maj, min), 0
+}
+
 type blockmem_t struct {
 }
 
@@ -69,13 +85,18 @@ func (bm *blockmem_t) Refup(pa mem.Pa_t) {
 ///   req - block device request to issue.
 ///
 /// Return value:
-///   bool - always true since requests are asynchronous.
+///   bool - true since requests are asynchronous, except for discards,
+///   which are finished when Start returns false.
 ///
 /// No global variables are referenced.
 func (ahci *ahci_disk_t) Start(req *fs.Bdev_req_t) bool {
 	if ahci.port == nil {
 		panic("nil port")
 	}
+	if req.Cmd == fs.BDEV_DISCARD {
+		ahci.port.discard(req)
+		return false
+	}
 	ahci.port.start(req)
 	return true
 }
@@ -205,6 +226,18 @@ func attach_ahci(vid, did int, t pci.Pcitag_t) {
 
 	go d.int_handler(vec)
 	Ahci = d
+	if d.port != nil {
+		rawdisk_add()
+	}
+}
+
+// registers the raw disk driver and adds the device of the attached port.
+// only one port is attached.
+func rawdisk_add() {
+	dev.RegisterAt("rawdisk", dev.D_RAWDISK, rawopen)
+	if min, err := dev.Add("rsd0c", dev.D_RAWDISK); err != 0 || min != 0 {
+		panic("rawdisk add failed")
+	}
 }
 
 //
@@ -348,6 +381,7 @@ type ahci_port_stat_t struct {
 	Nnoslot   stats.Counter_t
 	Ncoalesce stats.Counter_t
 	Nintr     stats.Counter_t
+	Ntrim     stats.Counter_t
 }
 
 type ahci_port_t struct {
@@ -363,6 +397,8 @@ type ahci_port_t struct {
 	queued    *list.List
 	nwaiting  int
 	nflush    int
+	// whether the disk supports TRIM
+	trim bool
 
 	block_pa [32]uintptr
 	block    [32]*[512]uint8
@@ -401,6 +437,8 @@ type identify_device_t struct {
 	lba48_sectors uint64     // Words 100-103, assuming little-endian
 	_             [15]uint16 // Words 104-118
 	features119   uint16     // Word 119
+	_             [49]uint16 // Words 120-168
+	support169    uint16     // Word 169
 }
 
 const (
@@ -438,6 +476,7 @@ const (
 	SATA_FIS_TYPE_REG_D2H uint8 = 0x34
 	SATA_FIS_REG_CFLAG    uint8 = (1 << 7) // issuing new command
 
+	IDE_CMD_DSM             uint8 = 0x06
 	IDE_CMD_READ_DMA_EXT    uint8 = 0x25
 	IDE_CMD_WRITE_DMA_EXT   uint8 = 0x35
 	IDE_CMD_FLUSH_CACHE_EXT       = 0xea
@@ -455,6 +494,11 @@ const (
 
 	IDE_FEATURE_WCACHE_ENA = 0x02
 	IDE_FEATURE_RLA_ENA    = 0xAA
+
+	IDE_SUPPORT169_TRIM uint16 = (1 << 0)
+	IDE_DSM_TRIM               = 0x01
+	IDE_DSM_NRANGE             = 64     // ranges in a sector of DSM ranges
+	IDE_DSM_MAXSECTOR          = 0xffff // sectors in a DSM range
 )
 
 /// LD atomically loads a 32-bit value from a MMIO register.
@@ -894,32 +938,15 @@ func (p *ahci_port_t) queuemgr() {
 	}
 }
 
+// queues req behind the requests that wait for a slot, combining it with one
+// of them if it can.
 func (p *ahci_port_t) queue_coalesce(req *fs.Bdev_req_t) {
-	ok := false
-	for e := p.queued.Front(); e != nil; e = e.Next() {
-		r := e.Value.(*fs.Bdev_req_t)
-		if r.Cmd == fs.BDEV_FLUSH || req.Cmd == fs.BDEV_FLUSH {
-			break
-		}
-		if r.Blks.Len() == 0 {
-			panic("queue_coalesce")
-		}
-		if r.Cmd == req.Cmd { // combine reads with reads, and writes with writes
-			last := r.Blks.BackBlock()
-			first := req.Blks.FrontBlock()
-			if first.Block == last.Block+1 {
-				dbg("collapse %d %d %d\n", first.Block, last.Block, r.Blks.Len())
-				p.stat.Ncoalesce++
-				r.Blks.Append(req.Blks)
-				ok = true
-				break
-			}
-		}
-	}
-
-	if !ok {
-		p.queued.PushBack(req)
+	if fs.Coalesce(p.queued, req) {
+		dbg("collapse %d\n", req.Blks.Len())
+		p.stat.Ncoalesce++
+		return
 	}
+	p.queued.PushBack(req)
 }
 
 func (p *ahci_port_t) start(req *fs.Bdev_req_t) {
@@ -980,6 +1007,9 @@ func (p *ahci_port_t) startslot(req *fs.Bdev_req_t, s int) {
 	case fs.BDEV_FLUSH:
 		p.stat.Nbarrier++
 		p.issue(s, nil, IDE_CMD_FLUSH_CACHE_EXT)
+	case fs.BDEV_DISCARD:
+		p.stat.Ntrim++
+		p.issue_trim(s, req.Blks)
 	}
 	p.inflight[s] = req
 	dbg("AHCI start: issued slot %v req %v sync %v ci %#x\n",
@@ -1037,6 +1067,94 @@ func (p *ahci_port_t) issue(s int, blks *fs.BlkList_t, cmd uint8) {
 	ST(&p.port.ci, (1 << uint(s)))
 }
 
+// reports whether block blkno starts a new DSM range after the range of n
+// blocks that ends with block last.
+func dsmbreak(blkno, last, n int) bool {
+	return blkno != last+1 || n == IDE_DSM_MAXSECTOR/(fs.BSIZE/512)
+}
+
+// trims the sorted blocks of a discard request with as many DATA SET
+// MANAGEMENT commands as their ranges need and waits for them. a disk without
+// TRIM ignores discards.
+func (p *ahci_port_t) discard(req *fs.Bdev_req_t) {
+	if !p.trim {
+		return
+	}
+	trim := func(l *fs.BlkList_t) {
+		r := fs.MkRequest(l, fs.BDEV_DISCARD, true)
+		p.start(r)
+		<-r.AckCh
+	}
+	l := fs.MkBlkList()
+	last, n, nrange := 0, 0, 0
+	for b := req.Blks.FrontBlock(); b != nil; b = req.Blks.NextBlock() {
+		if nrange == 0 || dsmbreak(b.Block, last, n) {
+			if nrange == IDE_DSM_NRANGE {
+				trim(l)
+				l = fs.MkBlkList()
+				nrange = 0
+			}
+			nrange++
+			n = 0
+		}
+		n++
+		last = b.Block
+		l.PushBack(b)
+	}
+	if l.Len() > 0 {
+		trim(l)
+	}
+}
+
+// issues a DATA SET MANAGEMENT command in slot s that trims blks, which are
+// sorted and make at most IDE_DSM_NRANGE ranges. the command reads the ranges
+// from the slot's sector buffer; each is a 48-bit LBA and a 16-bit count of
+// sectors.
+func (p *ahci_port_t) issue_trim(s int, blks *fs.BlkList_t) {
+	buf := p.block[s]
+	for i := range buf {
+		buf[i] = 0
+	}
+	spb := uint64(fs.BSIZE / 512)
+	i, last, n := -1, 0, 0
+	for b := blks.FrontBlock(); b != nil; b = blks.NextBlock() {
+		if i < 0 || dsmbreak(b.Block, last, n) {
+			i++
+			n = 0
+			if i == IDE_DSM_NRANGE {
+				panic("too many DSM ranges")
+			}
+		}
+		n++
+		last = b.Block
+		e := uint64(last-n+1)*spb | (uint64(n)*spb)<<48
+		for k := 0; k < 8; k++ {
+			buf[i*8+k] = uint8(e >> uint(8*k))
+		}
+	}
+
+	fis := &sata_fis_reg_h2d{}
+	fis.fis_type = SATA_FIS_TYPE_REG_H2D
+	fis.cflag = SATA_FIS_REG_CFLAG
+	fis.command = IDE_CMD_DSM
+	fis.features = IDE_DSM_TRIM
+	fis.dev_head = IDE_DEV_LBA
+	fis.control = IDE_CTL_LBA48
+	fis.sector_count = 1
+
+	cmd := &p.cmdt[s]
+	ST64(&cmd.prdt[0].dba, uint64(p.block_pa[s]))
+	ST(&cmd.prdt[0].dbc, uint32(len(buf)-1))
+	ST16(&p.cmdh[s].prdtl, 1)
+	ST(&p.cmdh[s].prdbc, 0)
+
+	p.fill_fis(s, fis)
+	SET16(&p.cmdh[s].flags, AHCI_CMD_FLAGS_WRITE)
+
+	// issue command
+	ST(&p.port.ci, (1 << uint(s)))
+}
+
 // Clear interrupt status
 func (ahci *ahci_disk_t) clear_is() {
 	// AHCI 1.3, section 10.7.2.1 says we need to first clear the
@@ -1081,6 +1199,8 @@ func (ahci *ahci_disk_t) probe_port(pid int) bool {
 				fmt.Printf("AHCI: SATA Native Command Queuing not supported\n")
 				return false
 			}
+			p.trim = LD16(&id.support169)&IDE_SUPPORT169_TRIM != 0
+			dbg("AHCI: trim %v\n", p.trim)
 			p.nslot = uint32(1 + (id.queue_depth & IDE_SATA_NCQ_QUEUE_DEPTH))
 			dbg("AHCI: slots %v\n", p.nslot)
 			if p.nslot < ahci.ncs {
@@ -1121,6 +1241,12 @@ func (p *ahci_port_t) port_intr(ahci *ahci_disk_t) {
 				p.inflight[s].Blks.Apply(func(b *fs.Bdev_block_t) {
 					b.Done("interrupt")
 				})
+			} else if p.inflight[s].Cmd == fs.BDEV_READ && !p.inflight[s].Sync {
+				// nobody waits for an asynchronous read (read-ahead);
+				// the blocks' callbacks make them available instead.
+				p.inflight[s].Blks.Apply(func(b *fs.Bdev_block_t) {
+					b.Done("interrupt")
+				})
 			}
 			if p.inflight[s].Sync {
 				dbg("port_intr: ack inflight %v\n", s)
@@ -1224,6 +1350,7 @@ func ata_verify() {
 	chk(&f.features83, 83*2)
 	chk(&f.features86, 86*2)
 	chk(&f.features119, 119*2)
+	chk(&f.support169, 169*2)
 }
 
 /// Ahci_init registers the AHCI driver with the PCI subsystem.
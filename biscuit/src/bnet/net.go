@@ -3088,6 +3088,21 @@ func (tf *Tcpfops_t) Pwrite(src fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
 
+/// Getdents is unsupported for sockets and returns ENOTDIR.
+func (tf *Tcpfops_t) Getdents(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.ENOTDIR
+}
+
+/// Fsync is unsupported for sockets and returns EINVAL.
+func (tf *Tcpfops_t) Fsync(bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
+/// Fallocate is unsupported for sockets and returns ESPIPE.
+func (tf *Tcpfops_t) Fallocate(int, int, int) defs.Err_t {
+	return -defs.ESPIPE
+}
+
 /// Accept is not implemented for TCP client sockets and panics.
 func (tf *Tcpfops_t) Accept(fdops.Userio_i) (fdops.Fdops_i, int, defs.Err_t) {
 	panic("no imp")
@@ -3428,8 +3443,10 @@ func (tl *tcplfops_t) Close() defs.Err_t {
 	return 0
 }
 
-func (tl *tcplfops_t) Fstat(*stat.Stat_t) defs.Err_t {
-	panic("no imp")
+func (tl *tcplfops_t) Fstat(st *stat.Stat_t) defs.Err_t {
+	sockmode := defs.Mkdev(2, 0)
+	st.Wmode(sockmode)
+	return 0
 }
 
 func (tl *tcplfops_t) Lseek(int, int) (int, defs.Err_t) {
@@ -3471,6 +3488,18 @@ func (tl *tcplfops_t) Pwrite(src fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
 
+func (tl *tcplfops_t) Getdents(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.ENOTDIR
+}
+
+func (tl *tcplfops_t) Fsync(bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (tl *tcplfops_t) Fallocate(int, int, int) defs.Err_t {
+	return -defs.ESPIPE
+}
+
 func (tl *tcplfops_t) Accept(saddr fdops.Userio_i) (fdops.Fdops_i,
 	int, defs.Err_t) {
 	tl.tcl.l.Lock()
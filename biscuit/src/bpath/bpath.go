@@ -78,6 +78,51 @@ func Sdirname(path ustr.Ustr) (ustr.Ustr, ustr.Ustr) {
 	return s, fn
 }
 
+/// Splice replaces a component of path with the target of a symbolic link,
+/// yielding the path that the lookup continues with. A relative target is
+/// resolved in the directory containing the link; an absolute target discards
+/// the components before the link.
+///
+/// Parameters:
+///   path   - path being resolved.
+///   comp   - the link's component, a slice of path returned by Next.
+///   target - contents of the link.
+///
+/// Return value:
+///   ustr.Ustr - newly allocated path.
+func Splice(path, comp, target ustr.Ustr) ustr.Ustr {
+	off := compoff(path, comp)
+	rest := path[off+len(comp):]
+	ret := make(ustr.Ustr, 0, off+len(target)+len(rest))
+	if !target.IsAbsolute() {
+		ret = append(ret, path[:off]...)
+	}
+	ret = append(ret, target...)
+	return append(ret, rest...)
+}
+
+/// Rest returns the part of path after a component.
+///
+/// Parameters:
+///   path - path being resolved.
+///   comp - a component, a slice of path returned by Next.
+///
+/// Return value:
+///   ustr.Ustr - the rest of path, which shares path's backing array.
+func Rest(path, comp ustr.Ustr) ustr.Ustr {
+	return path[compoff(path, comp)+len(comp):]
+}
+
+// returns the offset of component comp in path.
+func compoff(path, comp ustr.Ustr) int {
+	// comp shares path's backing array
+	off := cap(path) - cap(comp)
+	if off < 0 || off+len(comp) > len(path) {
+		panic("component not in path")
+	}
+	return off
+}
+
 const MaxSlash = 60
 
 type canonicalize_t struct {
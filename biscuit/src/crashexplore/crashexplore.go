@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"biscuit/biscuit/src/ufs"
+)
+
+// usage prints the command line syntax and exits.
+func usage() {
+	fmt.Printf("Usage: crashexplore [flags] <script>\n")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+// main is the entry point for the crash-consistency explorer. It runs the
+// workload of a crash script on a fresh image, boots every crash state that
+// the recorded block writes allow and checks the script's invariants. It
+// exits with status 0 if all checks hold, 1 if one fails, after printing a
+// minimized counterexample, and 2 on usage or script errors.
+func main() {
+	opts := &ufs.Crashopts_t{}
+	flag.IntVar(&opts.Nlog, "nlog", 32, "log blocks of the image")
+	flag.IntVar(&opts.Ninode, "ninode", 4, "inode blocks of the image")
+	flag.IntVar(&opts.Ndata, "ndata", 200, "data blocks of the image")
+	flag.IntVar(&opts.Max, "max", 4096, "most crash states per epoch; larger epochs are sampled")
+	flag.Int64Var(&opts.Seed, "seed", 0, "seed for sampling crash states")
+	flag.StringVar(&opts.Out, "o", "", "write the image of a counterexample to this file")
+	verbose := flag.Bool("v", false, "show the file system's messages")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+	}
+
+	f, err := os.Open(flag.Arg(0))
+	if err != nil {
+		fmt.Printf("crashexplore: %v\n", err)
+		os.Exit(2)
+	}
+	cs, err := ufs.ParseCrashScript(f)
+	f.Close()
+	if err != nil {
+		fmt.Printf("crashexplore: %v: %v\n", flag.Arg(0), err)
+		os.Exit(2)
+	}
+	opts.Dir, err = os.MkdirTemp("", "crashexplore")
+	if err != nil {
+		fmt.Printf("crashexplore: %v\n", err)
+		os.Exit(2)
+	}
+	defer os.RemoveAll(opts.Dir)
+
+	// the file system prints on every boot
+	out := os.Stdout
+	opts.Log = out
+	if !*verbose {
+		os.Stdout, _ = os.Open(os.DevNull)
+	}
+	rep, err := ufs.ExploreCrashes(cs, opts)
+	os.Stdout = out
+	if err != nil {
+		fmt.Printf("crashexplore: %v: %v\n", flag.Arg(0), err)
+		os.RemoveAll(opts.Dir)
+		os.Exit(2)
+	}
+	fmt.Printf("%d trace records, %d epochs, %d crash states", rep.Nrecords,
+		rep.Nepochs, rep.Nstates)
+	if rep.Nsampled > 0 {
+		fmt.Printf(" (%d epochs sampled)", rep.Nsampled)
+	}
+	fmt.Printf("\n")
+	if rep.Fail != nil {
+		fmt.Printf("%v", rep.Fail)
+		if opts.Out != "" {
+			fmt.Printf("counterexample image written to %v\n", opts.Out)
+		}
+		os.RemoveAll(opts.Dir)
+		os.Exit(1)
+	}
+}
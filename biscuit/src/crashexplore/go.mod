@@ -0,0 +1,3 @@
+module crashexplore
+
+go 1.24.0
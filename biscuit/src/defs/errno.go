@@ -18,13 +18,16 @@ const (
 	EFAULT        Err_t = 14
 	EBUSY         Err_t = 16
 	EEXIST        Err_t = 17
+	EXDEV         Err_t = 18
 	ENODEV        Err_t = 19
 	ENOTDIR       Err_t = 20
 	EISDIR        Err_t = 21
 	EINVAL        Err_t = 22
 	EMFILE        Err_t = 24
+	EFBIG         Err_t = 27
 	ENOSPC        Err_t = 28
 	ESPIPE        Err_t = 29
+	EROFS         Err_t = 30
 	EPIPE         Err_t = 32
 	ERANGE        Err_t = 34
 	ENAMETOOLONG  Err_t = 36
@@ -36,6 +39,7 @@ const (
 	EADDRNOTAVAIL Err_t = 49
 	ENETDOWN      Err_t = 50
 	ENETUNREACH   Err_t = 51
+	ELOOP         Err_t = 62
 	EHOSTUNREACH  Err_t = 65
 	ENOTSOCK      Err_t = 88
 	EMSGSIZE      Err_t = 90
@@ -46,6 +50,7 @@ const (
 	ETIMEDOUT     Err_t = 110
 	ECONNREFUSED  Err_t = 111
 	EINPROGRESS   Err_t = 115
+	ECROSS        Err_t = 510 // internal: a lookup left its file system
 	ENOHEAP       Err_t = 511
 )
 
@@ -23,6 +23,7 @@ const (
 	SYS_CLOSE           = 3
 	SYS_STAT            = 4
 	SYS_FSTAT           = 5
+	SYS_LSTAT           = 6
 	SYS_POLL            = 7
 	POLLRDNORM          = 0x1
 	POLLRDBAND          = 0x2
@@ -53,6 +54,9 @@ const (
 	SYS_READV           = 19
 	SYS_WRITEV          = 20
 	SYS_ACCESS          = 21
+	R_OK                = 1 << 0
+	W_OK                = 1 << 1
+	X_OK                = 1 << 2
 	SYS_DUP2            = 33
 	SYS_PAUSE           = 34
 	SYS_GETPID          = 39
@@ -115,6 +119,8 @@ const (
 	F_SETFL          = 2
 	F_GETFD          = 3
 	F_SETFD          = 4
+	SYS_FSYNC        = 74
+	SYS_FDATASYNC    = 75
 	SYS_TRUNC        = 76
 	SYS_FTRUNC       = 77
 	SYS_GETCWD       = 79
@@ -123,6 +129,12 @@ const (
 	SYS_MKDIR        = 83
 	SYS_LINK         = 86
 	SYS_UNLINK       = 87
+	SYS_SYMLINK      = 88
+	SYS_READLINK     = 89
+	SYS_CHMOD        = 90
+	SYS_FCHMOD       = 91
+	SYS_CHOWN        = 92
+	SYS_FCHOWN       = 93
 	SYS_GETTOD       = 96
 	SYS_GETRLMT      = 97
 	RLIMIT_NOFILE    = 1
@@ -130,11 +142,31 @@ const (
 	SYS_GETRUSG      = 98
 	RUSAGE_SELF      = 1
 	RUSAGE_CHILDREN  = 2
+	SYS_GETUID       = 102
+	SYS_GETGID       = 104
+	SYS_SETUID       = 105
+	SYS_SETGID       = 106
 	SYS_MKNOD        = 133
+	SYS_STATFS       = 137
+	SYS_FSTATFS      = 138
 	SYS_SETRLMT      = 160
 	SYS_SYNC         = 162
+	SYS_MOUNT        = 165
+	SYS_UMOUNT2      = 166
 	SYS_REBOOT       = 169
+	SYS_GETDENTS64   = 217
+	// directory entry types
+	DT_UNKNOWN       = 0
+	DT_CHR           = 2
+	DT_DIR           = 4
+	DT_REG           = 8
+	DT_LNK           = 10
 	SYS_NANOSLEEP    = 230
+	SYS_UTIMENSAT    = 280
+	AT_FDCWD         = -100
+	UTIME_NOW        = (1 << 30) - 1
+	UTIME_OMIT       = (1 << 30) - 2
+	SYS_FALLOCATE    = 285
 	SYS_PIPE2        = 293
 	SYS_PROF         = 31337
 	PROF_DISABLE     = 1 << 0
@@ -173,6 +205,12 @@ const (
 	SIGKILL = 9
 )
 
+// fallocate(2) modes
+const (
+	FALLOC_FL_KEEP_SIZE  = 0x1
+	FALLOC_FL_PUNCH_HOLE = 0x2
+)
+
 /// Mkexitsig converts a signal number to the encoded exit status form.
 func Mkexitsig(sig int) int {
 	if sig < 0 || sig > 32 {
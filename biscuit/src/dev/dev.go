@@ -0,0 +1,176 @@
+package dev
+
+import "sort"
+import "sync"
+
+import "defs"
+import "fdops"
+
+/// Open_t opens the device with major maj and minor min of a driver.
+type Open_t func(maj, min int) (fdops.Fdops_i, defs.Err_t)
+
+/// Node_t is a device file that a devfs shows.
+type Node_t struct {
+	Name string
+	Maj  int
+	Min  int
+}
+
+/// The majors of the kernel's own drivers are fixed rather than depending on
+/// the order in which they register, so that the device files that mknod(2)
+/// made on disk keep naming the same device. Register allocates majors
+/// above D_LAST.
+const (
+	D_CONSOLE = 1 /// console device
+	// UNIX domain sockets
+	D_SUD     = 2      /// datagram socket device
+	D_SUS     = 3      /// stream socket device
+	D_DEVNULL = 4      /// /dev/null sink
+	D_RAWDISK = 5      /// raw disk interface
+	D_STAT    = 6      /// statistics device
+	D_PROF    = 7      /// profiling device
+	D_ZERO    = 8      /// /dev/zero source
+	D_LAST    = D_ZERO /// highest fixed major
+)
+
+// a registered driver
+type driver_t struct {
+	name string
+	open Open_t
+	// the next minor number to allocate
+	nextmin int
+}
+
+// the registry. the driver with major maj is drivers[maj-1], which is nil if
+// no driver has the major, so that major zero, which file systems use for
+// regular files, is never allocated.
+var reg struct {
+	sync.Mutex
+	drivers []*driver_t
+	nodes   map[string]Node_t
+}
+
+// adds the driver name with major maj. caller holds the registry lock.
+func add(name string, maj int, open Open_t) {
+	for _, d := range reg.drivers {
+		if d != nil && d.name == name {
+			panic("driver registered twice")
+		}
+	}
+	for len(reg.drivers) < maj {
+		reg.drivers = append(reg.drivers, nil)
+	}
+	if reg.drivers[maj-1] != nil {
+		panic("major registered twice")
+	}
+	reg.drivers[maj-1] = &driver_t{name: name, open: open}
+}
+
+/// Register allocates a major number above D_LAST for the driver name and
+/// returns it. open opens the driver's devices; the devices of a driver whose
+/// open is nil, such as sockets, cannot be opened.
+func Register(name string, open Open_t) int {
+	reg.Lock()
+	defer reg.Unlock()
+	maj := D_LAST + 1
+	if len(reg.drivers) >= maj {
+		maj = len(reg.drivers) + 1
+	}
+	add(name, maj, open)
+	return maj
+}
+
+/// RegisterAt is Register for a driver of the kernel, which has the fixed
+/// major maj.
+func RegisterAt(name string, maj int, open Open_t) {
+	if maj <= 0 || maj > D_LAST {
+		panic("bad fixed major")
+	}
+	reg.Lock()
+	defer reg.Unlock()
+	add(name, maj, open)
+}
+
+// caller holds the registry lock
+func driver(maj int) (*driver_t, bool) {
+	if maj <= 0 || maj > len(reg.drivers) || reg.drivers[maj-1] == nil {
+		return nil, false
+	}
+	return reg.drivers[maj-1], true
+}
+
+/// Major returns the major number of the driver name or false if no such
+/// driver is registered.
+func Major(name string) (int, bool) {
+	reg.Lock()
+	defer reg.Unlock()
+	for i, d := range reg.drivers {
+		if d != nil && d.name == name {
+			return i + 1, true
+		}
+	}
+	return 0, false
+}
+
+/// Add allocates the next minor number of the driver with major maj and
+/// makes a devfs show the device as name. The minors of a driver are
+/// allocated in order, starting with zero.
+func Add(name string, maj int) (int, defs.Err_t) {
+	reg.Lock()
+	defer reg.Unlock()
+	d, ok := driver(maj)
+	if !ok {
+		return 0, -defs.ENODEV
+	}
+	if _, ok := reg.nodes[name]; ok {
+		return 0, -defs.EEXIST
+	}
+	if d.nextmin > 0xff {
+		return 0, -defs.ENOSPC
+	}
+	if reg.nodes == nil {
+		reg.nodes = make(map[string]Node_t)
+	}
+	min := d.nextmin
+	d.nextmin++
+	reg.nodes[name] = Node_t{Name: name, Maj: maj, Min: min}
+	return min, 0
+}
+
+/// Lookup returns the device file name or false if there is none.
+func Lookup(name string) (Node_t, bool) {
+	reg.Lock()
+	defer reg.Unlock()
+	n, ok := reg.nodes[name]
+	return n, ok
+}
+
+/// Nodes returns every device file sorted by name.
+func Nodes() []Node_t {
+	reg.Lock()
+	ret := make([]Node_t, 0, len(reg.nodes))
+	for _, n := range reg.nodes {
+		ret = append(ret, n)
+	}
+	reg.Unlock()
+	sort.Slice(ret, func(i, j int) bool {
+		return ret[i].Name < ret[j].Name
+	})
+	return ret
+}
+
+/// Open opens the device with major maj and minor min. It fails with ENODEV
+/// if no driver has the major and with EPERM if the driver's devices cannot
+/// be opened.
+func Open(maj, min int) (fdops.Fdops_i, defs.Err_t) {
+	reg.Lock()
+	d, ok := driver(maj)
+	reg.Unlock()
+	if !ok {
+		return nil, -defs.ENODEV
+	}
+	if d.open == nil {
+		return nil, -defs.EPERM
+	}
+	return d.open(maj, min)
+}
@@ -0,0 +1,3 @@
+module dev
+
+go 1.24.0
@@ -0,0 +1,308 @@
+package devfs
+
+import "time"
+
+import "bpath"
+import "defs"
+import "dev"
+import "fd"
+import "fs"
+import "mem"
+import "stat"
+import "stats"
+import "ustr"
+
+/// Devfs_t is a file system whose root holds a device file for every device
+/// in the device registry. Devices appear as soon as their drivers add them,
+/// so nothing needs to mknod(2) them. The names and numbers of the device
+/// files are fixed by their drivers; they cannot be created, removed,
+/// renamed or changed through the file system.
+type Devfs_t struct {
+	// when the file system was made, which is the time of every file
+	made  time.Time
+	stats devstats_t
+}
+
+type devstats_t struct {
+	Nopen    stats.Counter_t
+	Nnamei   stats.Counter_t
+	Ndevopen stats.Counter_t
+}
+
+/// MkDevfs returns a devfs.
+func MkDevfs() *Devfs_t {
+	return &Devfs_t{made: time.Now()}
+}
+
+/// MkRootCwd returns a cwd for the root of the file system.
+func (dfs *Devfs_t) MkRootCwd() *fd.Cwd_t {
+	f := &fd.Fd_t{Fops: &rootfops_t{dfs: dfs}}
+	return fd.MkRootCwd(f)
+}
+
+// the root's inode number. a device file's inode number is made of its major
+// and minor, which is never the root's since majors start at one.
+const iroot = defs.Inum_t(1)
+
+// a devfs file: the root or a device file
+type dnode_t struct {
+	root bool
+	node dev.Node_t
+}
+
+func (dn dnode_t) inum() defs.Inum_t {
+	if dn.root {
+		return iroot
+	}
+	return defs.Inum_t(dn.node.Maj<<8 | dn.node.Min)
+}
+
+// returns the file at paths. the root is the only directory and there are no
+// symbolic links. if the path leaves the file system, fails with ECROSS and
+// cwd.Mnt records where the path continues.
+func (dfs *Devfs_t) namei(paths ustr.Ustr, cwd *fd.Cwd_t) (dnode_t, defs.Err_t) {
+	dfs.stats.Nnamei.Inc()
+	dn := dnode_t{root: true}
+	if len(paths) == 0 || paths[0] != '/' {
+		// the root is the only directory a cwd can be
+		if cwd.Fd.Fops.Pathi() != iroot {
+			panic("devfs cwd is not the root")
+		}
+	}
+	var pp bpath.Pathparts_t
+	pp.Pp_init(paths)
+	for cp, ok := pp.Next(); ok; cp, ok = pp.Next() {
+		if !dn.root {
+			return dnode_t{}, -defs.ENOTDIR
+		}
+		if cp.Isdotdot() && cwd.Mnt.Up(paths, cp) {
+			return dnode_t{}, -defs.ECROSS
+		}
+		if cp.Isdot() || cp.Isdotdot() {
+			continue
+		}
+		n, ok := dev.Lookup(cp.String())
+		if !ok {
+			return dnode_t{}, -defs.ENOENT
+		}
+		dn = dnode_t{node: n}
+	}
+	cwd.Mnt.Resolved(paths)
+	return dn, 0
+}
+
+// fills st with the attributes of dn. everything belongs to root; anyone may
+// read and write the devices.
+func (dfs *Devfs_t) stat(dn dnode_t, st *stat.Stat_t) {
+	mode := uint(fs.I_DIR<<16 | 0755)
+	rdev := uint(0)
+	if !dn.root {
+		rdev = defs.Mkdev(dn.node.Maj, dn.node.Min)
+		mode = rdev | 0666
+	}
+	made := uint(dfs.made.UnixNano())
+	st.Wdev(0)
+	st.Wino(uint(dn.inum()))
+	st.Wmode(mode)
+	st.Wsize(0)
+	st.Wrdev(rdev)
+	st.Wuid(0)
+	st.Wgid(0)
+	st.Watime(made/1e9, made%1e9)
+	st.Wmtime(made/1e9, made%1e9)
+	st.Wctime(made/1e9, made%1e9)
+}
+
+/// Fs_open opens a path and returns a new file descriptor. Device files are
+/// opened by their drivers.
+func (dfs *Devfs_t) Fs_open(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, major, minor int) (*fd.Fd_t, defs.Err_t) {
+	dfs.stats.Nopen.Inc()
+	dn, err := dfs.namei(paths, cwd)
+	if err != 0 {
+		if err == -defs.ENOENT && flags&defs.O_CREAT != 0 {
+			return nil, -defs.EPERM
+		}
+		return nil, err
+	}
+	if flags&defs.O_CREAT != 0 && flags&defs.O_EXCL != 0 {
+		return nil, -defs.EEXIST
+	}
+	if dn.root {
+		if flags&(defs.O_WRONLY|defs.O_RDWR|defs.O_TRUNC) != 0 {
+			return nil, -defs.EISDIR
+		}
+		return &fd.Fd_t{Fops: &rootfops_t{dfs: dfs, count: 1}}, 0
+	}
+	if flags&defs.O_DIRECTORY != 0 {
+		return nil, -defs.ENOTDIR
+	}
+	dfs.stats.Ndevopen.Inc()
+	fops, err := dev.Open(dn.node.Maj, dn.node.Min)
+	if err != 0 {
+		return nil, err
+	}
+	return &fd.Fd_t{Fops: fops}, 0
+}
+
+// fails with the error of resolving paths or, if it exists, with EPERM.
+func (dfs *Devfs_t) fixed(paths ustr.Ustr, cwd *fd.Cwd_t) defs.Err_t {
+	if _, err := dfs.namei(paths, cwd); err != 0 {
+		return err
+	}
+	return -defs.EPERM
+}
+
+// fails with EEXIST to create paths if it exists and with EPERM otherwise,
+// unless paths leads out of the file system.
+func (dfs *Devfs_t) create(paths ustr.Ustr, cwd *fd.Cwd_t) defs.Err_t {
+	switch _, err := dfs.namei(paths, cwd); err {
+	case 0:
+		return -defs.EEXIST
+	case -defs.ECROSS:
+		return err
+	}
+	return -defs.EPERM
+}
+
+/// Fs_mknod fails since drivers add the devices of a devfs.
+func (dfs *Devfs_t) Fs_mknod(paths ustr.Ustr, flags defs.Fdopt_t, cwd *fd.Cwd_t, major, minor int) (defs.Inum_t, defs.Err_t) {
+	return 0, dfs.create(paths, cwd)
+}
+
+/// Fs_access checks whether the credentials of cwd grant the access want to
+/// the file at path. Any access to a device is allowed; the root may be read
+/// and searched.
+func (dfs *Devfs_t) Fs_access(paths ustr.Ustr, cwd *fd.Cwd_t, want int) defs.Err_t {
+	dn, err := dfs.namei(paths, cwd)
+	if err != 0 {
+		return err
+	}
+	if dn.root && want&fs.A_WRITE != 0 {
+		return -defs.EACCES
+	}
+	if !dn.root && want&fs.A_EXEC != 0 {
+		return -defs.EACCES
+	}
+	return 0
+}
+
+/// Fs_stat retrieves file information for the provided path.
+func (dfs *Devfs_t) Fs_stat(paths ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t) defs.Err_t {
+	dn, err := dfs.namei(paths, cwd)
+	if err != 0 {
+		return err
+	}
+	dfs.stat(dn, st)
+	return 0
+}
+
+/// Fs_lstat is Fs_stat; a devfs has no symbolic links.
+func (dfs *Devfs_t) Fs_lstat(paths ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t) defs.Err_t {
+	return dfs.Fs_stat(paths, st, cwd)
+}
+
+/// Fs_statfs fills st with the statistics of the file system if path exists.
+func (dfs *Devfs_t) Fs_statfs(paths ustr.Ustr, st *stat.Statfs_t, cwd *fd.Cwd_t) defs.Err_t {
+	if _, err := dfs.namei(paths, cwd); err != 0 {
+		return err
+	}
+	dfs.Statfs(st)
+	return 0
+}
+
+/// Statfs fills st with the file system's statistics. A devfs has neither
+/// blocks nor a log.
+func (dfs *Devfs_t) Statfs(st *stat.Statfs_t) {
+	st.Wbsize(uint(mem.PGSIZE))
+	st.Wblocks(0)
+	st.Wbfree(0)
+	st.Wbavail(0)
+	st.Wfiles(uint(len(dev.Nodes()) + 1))
+	st.Wffree(0)
+	st.Wnamelen(uint(fs.NAME_MAX))
+	st.Wloglen(0)
+}
+
+/// Fs_utimens fails since the files of a devfs cannot be changed.
+func (dfs *Devfs_t) Fs_utimens(paths ustr.Ustr, cwd *fd.Cwd_t, atime, mtime int) defs.Err_t {
+	return dfs.fixed(paths, cwd)
+}
+
+/// Fs_futimens fails since the files of a devfs cannot be changed.
+func (dfs *Devfs_t) Fs_futimens(f *fd.Fd_t, atime, mtime int) defs.Err_t {
+	return -defs.EPERM
+}
+
+/// Fs_chmod fails since the files of a devfs cannot be changed.
+func (dfs *Devfs_t) Fs_chmod(paths ustr.Ustr, cwd *fd.Cwd_t, mode int) defs.Err_t {
+	return dfs.fixed(paths, cwd)
+}
+
+/// Fs_fchmod fails since the files of a devfs cannot be changed.
+func (dfs *Devfs_t) Fs_fchmod(f *fd.Fd_t, cred *fd.Cred_t, mode int) defs.Err_t {
+	return -defs.EPERM
+}
+
+/// Fs_chown fails since the files of a devfs cannot be changed.
+func (dfs *Devfs_t) Fs_chown(paths ustr.Ustr, cwd *fd.Cwd_t, uid, gid int) defs.Err_t {
+	return dfs.fixed(paths, cwd)
+}
+
+/// Fs_fchown fails since the files of a devfs cannot be changed.
+func (dfs *Devfs_t) Fs_fchown(f *fd.Fd_t, cred *fd.Cred_t, uid, gid int) defs.Err_t {
+	return -defs.EPERM
+}
+
+/// Fs_mkdir fails since a devfs has only its root directory.
+func (dfs *Devfs_t) Fs_mkdir(paths ustr.Ustr, mode int, cwd *fd.Cwd_t) defs.Err_t {
+	return dfs.create(paths, cwd)
+}
+
+/// Fs_unlink fails since the devices of a devfs belong to their drivers.
+func (dfs *Devfs_t) Fs_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, wantdir bool) defs.Err_t {
+	return dfs.fixed(paths, cwd)
+}
+
+/// Fs_link fails since the files of a devfs cannot be linked.
+func (dfs *Devfs_t) Fs_link(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) defs.Err_t {
+	return dfs.fixed(oldp, cwd)
+}
+
+/// Fs_rename fails since drivers name the devices of a devfs.
+func (dfs *Devfs_t) Fs_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) defs.Err_t {
+	return dfs.fixed(oldp, cwd)
+}
+
+/// Fs_symlink fails since a devfs has no symbolic links.
+func (dfs *Devfs_t) Fs_symlink(target, linkp ustr.Ustr, cwd *fd.Cwd_t) defs.Err_t {
+	return dfs.create(linkp, cwd)
+}
+
+/// Fs_readlink fails with EINVAL for any existing path since a devfs has no
+/// symbolic links.
+func (dfs *Devfs_t) Fs_readlink(paths ustr.Ustr, cwd *fd.Cwd_t) (ustr.Ustr, defs.Err_t) {
+	if _, err := dfs.namei(paths, cwd); err != 0 {
+		return nil, err
+	}
+	return nil, -defs.EINVAL
+}
+
+/// Fs_sync does nothing since a devfs has no backing store.
+func (dfs *Devfs_t) Fs_sync() defs.Err_t {
+	return 0
+}
+
+/// Unpin does nothing; devfs files cannot be mapped.
+func (dfs *Devfs_t) Unpin(pa mem.Pa_t) {
+}
+
+/// Fs_statistics returns the file system's statistics and resets them.
+func (dfs *Devfs_t) Fs_statistics() string {
+	s := "devfs" + stats.Stats2String(dfs.stats)
+	dfs.stats = devstats_t{}
+	return s
+}
+
+/// StopFS does nothing; a devfs holds no resources.
+func (dfs *Devfs_t) StopFS() {
+}
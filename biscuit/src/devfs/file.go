@@ -0,0 +1,227 @@
+package devfs
+
+import "sync"
+
+import "defs"
+import "dev"
+import "fdops"
+import "fs"
+import "mem"
+import "stat"
+import "ustr"
+
+// returns the entries of the root, including "." and "..", as getdents64
+// records whose offsets are the index of the next record.
+func dirents() []fs.Dirent64_t {
+	ret := []fs.Dirent64_t{
+		{Inum: iroot, Type: defs.DT_DIR, Name: ustr.MkUstrDot()},
+		{Inum: iroot, Type: defs.DT_DIR, Name: ustr.DotDot},
+	}
+	for _, n := range dev.Nodes() {
+		dn := dnode_t{node: n}
+		ret = append(ret, fs.Dirent64_t{Inum: dn.inum(),
+			Type: defs.DT_CHR, Name: ustr.Ustr(n.Name)})
+	}
+	for i := range ret {
+		ret[i].Off = i + 1
+	}
+	return ret
+}
+
+// the open root directory. devices are opened by their drivers.
+type rootfops_t struct {
+	dfs *Devfs_t
+	// protects ents, offset and count
+	sync.Mutex
+	// the entries as of the first getdents after the offset was reset
+	ents   []fs.Dirent64_t
+	offset int
+	count  int
+}
+
+func (rf *rootfops_t) Read(dst fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.EISDIR
+}
+
+func (rf *rootfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
+	return 0, -defs.EISDIR
+}
+
+func (rf *rootfops_t) Write(src fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.EISDIR
+}
+
+func (rf *rootfops_t) Pwrite(src fdops.Userio_i, offset int) (int, defs.Err_t) {
+	return 0, -defs.EISDIR
+}
+
+func (rf *rootfops_t) Truncate(newlen uint) defs.Err_t {
+	return -defs.EISDIR
+}
+
+func (rf *rootfops_t) Fallocate(mode, off, len int) defs.Err_t {
+	return -defs.EISDIR
+}
+
+func (rf *rootfops_t) Getdents(dst fdops.Userio_i) (int, defs.Err_t) {
+	rf.Lock()
+	defer rf.Unlock()
+	if rf.count <= 0 {
+		return 0, -defs.EBADF
+	}
+	// devices come and go; take a new snapshot when reading starts over
+	if rf.ents == nil || rf.offset == 0 {
+		rf.ents = dirents()
+	}
+	if rf.offset >= len(rf.ents) {
+		return 0, 0
+	}
+	des := rf.ents[rf.offset:]
+	space := dst.Remain()
+	used := 0
+	fit := 0
+	for ; fit < len(des); fit++ {
+		l := fs.Dirent64len(len(des[fit].Name))
+		if used+l > space {
+			break
+		}
+		used += l
+	}
+	if fit == 0 {
+		// the next entry does not fit
+		return 0, -defs.EINVAL
+	}
+	buf := make([]uint8, used)
+	p := 0
+	for _, d := range des[:fit] {
+		p += d.Put(buf[p:])
+	}
+	did, err := dst.Uiowrite(buf)
+	if err != 0 {
+		return 0, err
+	}
+	rf.offset = des[fit-1].Off
+	return did, 0
+}
+
+// there is nothing to write back
+func (rf *rootfops_t) Fsync(datasync bool) defs.Err_t {
+	rf.Lock()
+	defer rf.Unlock()
+	if rf.count <= 0 {
+		return -defs.EBADF
+	}
+	return 0
+}
+
+func (rf *rootfops_t) Fstat(st *stat.Stat_t) defs.Err_t {
+	rf.Lock()
+	defer rf.Unlock()
+	if rf.count <= 0 {
+		return -defs.EBADF
+	}
+	rf.dfs.stat(dnode_t{root: true}, st)
+	return 0
+}
+
+func (rf *rootfops_t) Close() defs.Err_t {
+	rf.Lock()
+	defer rf.Unlock()
+	if rf.count <= 0 {
+		return -defs.EBADF
+	}
+	rf.count--
+	return 0
+}
+
+func (rf *rootfops_t) Pathi() defs.Inum_t {
+	return iroot
+}
+
+func (rf *rootfops_t) Reopen() defs.Err_t {
+	rf.Lock()
+	defer rf.Unlock()
+	if rf.count <= 0 {
+		return -defs.EBADF
+	}
+	rf.count++
+	return 0
+}
+
+// the offset is the index of the next entry
+func (rf *rootfops_t) Lseek(off, whence int) (int, defs.Err_t) {
+	rf.Lock()
+	defer rf.Unlock()
+	if rf.count <= 0 {
+		return 0, -defs.EBADF
+	}
+
+	switch whence {
+	case defs.SEEK_SET:
+		rf.offset = off
+	case defs.SEEK_CUR:
+		rf.offset += off
+	case defs.SEEK_END:
+		if rf.ents == nil {
+			rf.ents = dirents()
+		}
+		rf.offset = len(rf.ents) + off
+	default:
+		return 0, -defs.EINVAL
+	}
+	if rf.offset < 0 {
+		rf.offset = 0
+	}
+	return rf.offset, 0
+}
+
+func (rf *rootfops_t) Mmapi(offset, len int, inc bool) ([]mem.Mmapinfo_t, defs.Err_t) {
+	return nil, -defs.ENODEV
+}
+
+func (rf *rootfops_t) Accept(fdops.Userio_i) (fdops.Fdops_i, int, defs.Err_t) {
+	return nil, 0, -defs.ENOTSOCK
+}
+
+func (rf *rootfops_t) Bind([]uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (rf *rootfops_t) Connect(sabuf []uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (rf *rootfops_t) Listen(int) (fdops.Fdops_i, defs.Err_t) {
+	return nil, -defs.ENOTSOCK
+}
+
+func (rf *rootfops_t) Sendmsg(fdops.Userio_i, []uint8, []uint8,
+	int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (rf *rootfops_t) Recvmsg(fdops.Userio_i,
+	fdops.Userio_i, fdops.Userio_i, int) (int, int, int, defs.Msgfl_t, defs.Err_t) {
+	return 0, 0, 0, 0, -defs.ENOTSOCK
+}
+
+func (rf *rootfops_t) Pollone(pm fdops.Pollmsg_t) (fdops.Ready_t, defs.Err_t) {
+	return pm.Events & fdops.R_READ, 0
+}
+
+func (rf *rootfops_t) Fcntl(cmd, opt int) int {
+	return int(-defs.ENOSYS)
+}
+
+func (rf *rootfops_t) Getsockopt(opt int, bufarg fdops.Userio_i,
+	intarg int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (rf *rootfops_t) Setsockopt(int, int, fdops.Userio_i, int) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (rf *rootfops_t) Shutdown(read, write bool) defs.Err_t {
+	return -defs.ENOTSOCK
+}
@@ -0,0 +1,3 @@
+module devfs
+
+go 1.24.0
@@ -40,11 +40,24 @@ func Close_panic(f *Fd_t) {
 	}
 }
 
+/// Cred_t holds the user and group ids used for file permission checks.
+type Cred_t struct {
+	Uid int /// user id
+	Gid int /// group id
+}
+
+/// Root reports whether the credentials belong to the superuser.
+func (c *Cred_t) Root() bool {
+	return c.Uid == 0
+}
+
 /// Cwd_t tracks the current working directory for a process.
 type Cwd_t struct {
-       sync.Mutex // to serialize chdirs
-       Fd   *Fd_t    /// current directory fd
-       Path ustr.Ustr /// canonical path
+       sync.Mutex // to serialize chdirs and credential changes
+       Fd   *Fd_t      /// current directory fd
+       Path ustr.Ustr  /// canonical path
+       Cred Cred_t     /// credentials for paths resolved from this cwd
+       Mnt  *Mntwalk_t /// mount crossings of a lookup; nil outside the VFS
 }
 
 /// Fullpath joins cwd with p if p is not already absolute.
@@ -70,3 +83,89 @@ func MkRootCwd(fd *Fd_t) *Cwd_t {
 	c.Path = ustr.MkUstrRoot()
 	return c
 }
+
+/// Kinds of crossings out of a file system that Mntwalk_t records.
+const (
+	MNT_DOWN = iota + 1 /// into the file system mounted on a directory
+	MNT_UP              /// out of a mounted file system via ".."
+	MNT_ROOT            /// to "/" via an absolute symbolic link
+)
+
+/// Mntwalk_t lets the lookups of a file system stop where a path leaves the
+/// file system, so that the mount table can continue the lookup in the next
+/// one. Such a lookup fails with ECROSS and records how it left and the path
+/// that remains. Its methods may be called on a nil Mntwalk_t, which never
+/// leaves the file system.
+type Mntwalk_t struct {
+	Mntpts map[defs.Inum_t]bool /// directories covered by a mount
+	Sub    bool                 /// whether the file system is not the root
+	How    int                  /// kind of the crossing
+	Inum   defs.Inum_t          /// mount point crossed by MNT_DOWN
+	Rest   ustr.Ustr            /// path that remains after the crossing
+	Nlinks int                  /// symbolic links followed so far
+	Path   ustr.Ustr            /// path resolved, with links replaced
+}
+
+/// Mntpt reports whether the directory inum is covered by a mount.
+func (mw *Mntwalk_t) Mntpt(inum defs.Inum_t) bool {
+	return mw != nil && mw.Mntpts[inum]
+}
+
+/// Down reports whether the lookup of path, which reached directory inum via
+/// component comp, continues in the file system mounted on inum.
+func (mw *Mntwalk_t) Down(inum defs.Inum_t, path, comp ustr.Ustr) bool {
+	if !mw.Mntpt(inum) {
+		return false
+	}
+	mw.How = MNT_DOWN
+	mw.Inum = inum
+	mw.Rest = bpath.Rest(path, comp)
+	return true
+}
+
+/// Up reports whether component comp of path, a ".." in the root directory,
+/// leaves the file system for the one it is mounted on.
+func (mw *Mntwalk_t) Up(path, comp ustr.Ustr) bool {
+	if mw == nil || !mw.Sub {
+		return false
+	}
+	mw.How = MNT_UP
+	mw.Rest = bpath.Rest(path, comp)
+	return true
+}
+
+/// Follow counts a symbolic link to target, reached via component comp of
+/// path, and reports whether the link leads to the root of another file
+/// system.
+func (mw *Mntwalk_t) Follow(path, comp, target ustr.Ustr) bool {
+	if mw == nil {
+		return false
+	}
+	mw.Nlinks++
+	if !mw.Sub || !target.IsAbsolute() {
+		return false
+	}
+	mw.How = MNT_ROOT
+	mw.Rest = bpath.Splice(path, comp, target)
+	return true
+}
+
+/// Resolved records the path of a successful lookup.
+func (mw *Mntwalk_t) Resolved(path ustr.Ustr) {
+	if mw != nil {
+		mw.Path = path
+	}
+}
+
+/// Dirs returns err, the error of looking up the directories of a path whose
+/// last component is fn. If the lookup left the file system, fn is appended
+/// to the path that remains.
+func (mw *Mntwalk_t) Dirs(err defs.Err_t, fn ustr.Ustr) defs.Err_t {
+	if err == -defs.ECROSS {
+		rest := make(ustr.Ustr, 0, len(mw.Rest)+1+len(fn))
+		rest = append(rest, mw.Rest...)
+		rest = append(rest, '/')
+		mw.Rest = append(rest, fn...)
+	}
+	return err
+}
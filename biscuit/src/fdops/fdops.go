@@ -44,10 +44,22 @@ type Fdops_i interface {
 	Reopen() defs.Err_t
 	Write(Userio_i) (int, defs.Err_t)
 	Truncate(uint) defs.Err_t
+	// waits until the file's data, and its metadata unless the argument
+	// is true, is on stable storage.
+	Fsync(bool) defs.Err_t
+	// fallocate(2) with the given mode, offset, and length
+	Fallocate(int, int, int) defs.Err_t
 
 	Pread(Userio_i, int) (int, defs.Err_t)
 	Pwrite(Userio_i, int) (int, defs.Err_t)
 
+	// directory ops
+	// copies the directory entries at the fd's offset to user memory as
+	// getdents64(2) records and advances the offset past them. the offset
+	// is an opaque cookie that stays valid while entries are inserted and
+	// removed.
+	Getdents(Userio_i) (int, defs.Err_t)
+
 	// socket ops
 	// returns fops of new fd, size of connector's address written to user
 	// space, and error
@@ -41,21 +41,26 @@ type bcache_t struct {
 	disk  Disk_i
 	sync.Mutex
 	pins map[mem.Pa_t]*Bdev_block_t
+	racb racb_t
 }
 
 func mkBcache(m Blockmem_i, disk Disk_i) *bcache_t {
 	bcache := &bcache_t{}
 	bcache.mem = m
 	bcache.disk = disk
-	bcache.cache = mkCache(limits.Syslimit.Blocks)
+	bcache.racb.bcache = bcache
+	bcache.cache = mkCache(&limits.Syslimit.Blocks)
 	bcache.pins = make(map[mem.Pa_t]*Bdev_block_t)
 	return bcache
 }
 
 /// Get_fill returns a locked block buffer populated from disk.
 /// The block's page reference count is incremented and the caller must
-/// subsequently invoke Relse.
-func (bcache *bcache_t) Get_fill(blkn int, s string, lock bool) *Bdev_block_t {
+/// subsequently invoke Relse. If the disk cannot read the block, Get_fill
+/// returns the error along with the block, whose data is zeroed; the block
+/// leaves the cache on its last release so that the next Get_fill reads it
+/// again.
+func (bcache *bcache_t) Get_fill(blkn int, s string, lock bool) (*Bdev_block_t, defs.Err_t) {
 	b, created := bcache.bref(blkn, s)
 	if b.Evictnow() {
 		runtime.Cacheaccount()
@@ -67,12 +72,15 @@ func (bcache *bcache_t) Get_fill(blkn int, s string, lock bool) *Bdev_block_t {
 
 	if created {
 		b.New_page()
-		b.Read() // fill in new bdev_cache entry
+		if b.Read() != 0 { // fill in new bdev_cache entry
+			bcache.failed(b)
+		}
 	}
+	err := b.Err
 	if !lock {
 		b.Unlock()
 	}
-	return b
+	return b, err
 }
 
 /// Get_zero returns a locked zero-filled block buffer.
@@ -107,10 +115,50 @@ func (bcache *bcache_t) Get_nofill(blkn int, s string, lock bool) *Bdev_block_t
 	return b
 }
 
+/// Read_ahead starts reading the blocks blks that are not cached from disk
+/// without waiting for them, with one request for each run of consecutive
+/// blocks. A block stays locked until the disk has filled it, so that a
+/// reader that finds it in the cache waits for its contents. It returns the
+/// number of blocks it started reading.
+func (bcache *bcache_t) Read_ahead(blks []int) int {
+	n := 0
+	l := MkBlkList()
+	start := func() {
+		if l.Len() == 0 {
+			return
+		}
+		// the disk releases the blocks when it has read them
+		req := MkRequest(l, BDEV_READ, false)
+		bcache.disk.Start(req)
+		l = MkBlkList()
+	}
+	for _, blkn := range blks {
+		ref, created := bcache.cache.Lookup(blkn, func(_ int) Obj_t {
+			ret := MkBlock(blkn, "readahead", bcache.mem, bcache.disk, &bcache.racb)
+			ret.Lock()
+			return ret
+		})
+		b := ref.Obj.(*Bdev_block_t)
+		if !created {
+			bcache.Relse(b, "readahead")
+			continue
+		}
+		b.Ref = ref
+		b.New_page()
+		if l.Len() > 0 && l.BackBlock().Block+1 != blkn {
+			start()
+		}
+		l.PushBack(b)
+		n++
+	}
+	start()
+	return n
+}
+
 /// Write synchronously writes a block to disk.
-func (bcache *bcache_t) Write(b *Bdev_block_t) {
+func (bcache *bcache_t) Write(b *Bdev_block_t) defs.Err_t {
 	bcache.Refup(b, "write")
-	b.Write()
+	return b.Write()
 }
 
 /// Write_async writes a block to disk without waiting for completion.
@@ -231,6 +279,30 @@ func (bcache *bcache_t) bref(blk int, s string) (*Bdev_block_t, bool) {
 	return b, created
 }
 
+// the release callback of a block that is being read ahead. when the disk has
+// filled the block, the block gets the cache's callback back and is unlocked
+// and released.
+type racb_t struct {
+	bcache *bcache_t
+}
+
+func (ra *racb_t) Relse(b *Bdev_block_t, s string) {
+	b.Cb = ra.bcache
+	if b.Err != 0 {
+		ra.bcache.failed(b)
+	}
+	b.Unlock()
+	ra.bcache.Relse(b, s)
+}
+
+// zeroes the locked block b, which the disk could not read, and marks it for
+// eviction.
+func (bcache *bcache_t) failed(b *Bdev_block_t) {
+	fmt.Printf("bcache: cannot read block %v: %v\n", b.Block, b.Err)
+	*b.Data = mem.Bytepg_t{}
+	b.Tryevict()
+}
+
 type _nop_relse_t struct {
 }
 
@@ -293,7 +365,7 @@ func bdev_test(mem Blockmem_i, disk Disk_i, bcache *bcache_t) {
 			<-ider.AckCh
 		}
 		for b := 0; b < N; b++ {
-			rbuf := bcache.Get_fill(b, "read test", false)
+			rbuf, _ := bcache.Get_fill(b, "read test", false)
 			for i, v := range rbuf.Data {
 				if v != uint8(b) {
 					fmt.Printf("buf %v i %v v %v\n", j, i, v)
@@ -344,6 +416,7 @@ func (balloc *bbitmap_t) Balloc(opid opid_t) (int, defs.Err_t) {
 		fmt.Printf("blkn %v last %v\n", ret, balloc.fs.superb.Lastblock())
 		return 0, -defs.ENOMEM
 	}
+	balloc.fs.fslog.Reuse(opid, ret)
 	blk := balloc.fs.bcache.Get_zero(ret, "balloc", true)
 	if bdev_debug {
 		fmt.Printf("balloc: %v free %d\n", ret, balloc.alloc.nfreebits)
@@ -370,6 +443,12 @@ func (balloc *bbitmap_t) Bfree(opid opid_t, blkno int) {
 		panic("bfree too large")
 	}
 	balloc.alloc.Unmark(opid, blkno)
+	balloc.fs.fslog.Free(opid, blkno+balloc.first)
+}
+
+// returns the number of the block map block that records data block blkno.
+func (balloc *bbitmap_t) mapblock(blkno int) int {
+	return balloc.alloc.bitmapblkno(blkno - balloc.first)
 }
 
 /// Stats reports allocator statistics in string form.
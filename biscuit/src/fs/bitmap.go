@@ -15,7 +15,7 @@ const bitsperblk = BSIZE * 8
 
 type storage_i interface {
 	Write(opid_t, *Bdev_block_t)
-	Get_fill(int, string, bool) *Bdev_block_t
+	Get_meta(int, string, bool) *Bdev_block_t
 	Relse(*Bdev_block_t, string)
 }
 
@@ -83,7 +83,7 @@ func (alloc *bitmap_t) Fbread(blockno int) *Bdev_block_t {
 	if blockno < 0 || blockno >= alloc.freelen {
 		panic("naughty blockno")
 	}
-	return alloc.storage.Get_fill(alloc.freestart+blockno, "fbread", true)
+	return alloc.storage.Get_meta(alloc.freestart+blockno, "fbread", true)
 }
 
 // apply f to every bit starting from start, until f is false.  return true if
@@ -170,6 +170,7 @@ func (alloc *bitmap_t) FindFreeMap(opid opid_t) (int, defs.Err_t) {
 				v := alloc.freemap[i] & (1 << uint(j))
 				if v == 0 {
 					alloc.freemap[i] |= (1 << uint(j))
+					alloc.stats.Nalloc++
 					alloc.nfreebits--
 					alloc.Unlock()
 					return (i*8 + j), 0
@@ -210,7 +211,7 @@ func (alloc *bitmap_t) FindDiskMap(opid opid_t) (int, defs.Err_t) {
 			panic("FindAndMark")
 		}
 	}
-	alloc.stats.Nalloc.Inc()
+	alloc.stats.Nalloc++
 	alloc.nfreebits--
 	alloc.Unlock()
 	return bit, 0
@@ -239,6 +240,7 @@ func (alloc *bitmap_t) Unmark(opid opid_t, bit int) {
 		i := bit / 8
 		j := bit % 8
 		alloc.freemap[i] &= ^(1 << uint(j))
+		alloc.stats.Nfree++
 		alloc.nfreebits++
 		alloc.Unlock()
 		return
@@ -252,7 +254,7 @@ func (alloc *bitmap_t) Unmark(opid opid_t, bit int) {
 	fblk.Unlock()
 	alloc.storage.Write(opid, fblk)
 	alloc.storage.Relse(fblk, "Unmark")
-	alloc.stats.Nfree.Inc()
+	alloc.stats.Nfree++
 	alloc.nfreebits++
 	alloc.Unlock()
 }
@@ -357,5 +359,15 @@ func (alloc *bitmap_t) Stats() string {
 }
 
 func (alloc *bitmap_t) ResetStats() {
+	alloc.Lock()
 	alloc.stats = bitmapstats_t{}
+	alloc.Unlock()
+}
+
+// returns the counters of the bitmap and the number of free bits.
+func (alloc *bitmap_t) snapshot() Allocstats_t {
+	alloc.Lock()
+	defer alloc.Unlock()
+	return Allocstats_t{Nalloc: alloc.stats.Nalloc, Nfree: alloc.stats.Nfree,
+		Free: int(alloc.nfreebits)}
 }
@@ -4,6 +4,7 @@ import "sync"
 import "fmt"
 import "container/list"
 
+import "defs"
 import "mem"
 
 // If you change this, you must change corresponding constants in litc.c
@@ -44,6 +45,7 @@ type Bdev_block_t struct {
         Mem        Blockmem_i /// memory allocator
         Disk       Disk_i     /// disk device
         Cb         Block_cb_i /// release callback
+        Err        defs.Err_t /// error of the last read
 }
 
 /// Bdevcmd_t enumerates disk request types.
@@ -53,6 +55,7 @@ const (
 	BDEV_WRITE Bdevcmd_t = 1 /// write a block
 	BDEV_READ            = 2 /// read a block
 	BDEV_FLUSH           = 3 /// flush outstanding writes
+	BDEV_DISCARD         = 4 /// discard blocks that hold no data anymore
 )
 
 /// BlkList_t wraps a list.List of block pointers.
@@ -167,6 +170,7 @@ type Bdev_req_t struct {
 	Blks  *BlkList_t
 	AckCh chan bool
 	Sync  bool
+	Err   defs.Err_t /// error of a failed write or flush
 }
 
 /// MkRequest allocates a new block request structure.
@@ -179,7 +183,40 @@ func MkRequest(blks *BlkList_t, cmd Bdevcmd_t, sync bool) *Bdev_req_t {
 	return ret
 }
 
-/// Disk_i represents a physical disk interface.
+/// Coalesce appends the blocks of the asynchronous read or write req to a
+/// request in queued, a list of *Bdev_req_t in the order in which they were
+/// started, whose blocks they continue, so that the disk transfers both with
+/// one command. It reports whether it did; otherwise the caller queues req.
+/// Only asynchronous requests are combined, since the disk acknowledges just
+/// the request that it carries out, and none across a flush.
+func Coalesce(queued *list.List, req *Bdev_req_t) bool {
+	if req.Sync || (req.Cmd != BDEV_READ && req.Cmd != BDEV_WRITE) {
+		return false
+	}
+	for e := queued.Front(); e != nil; e = e.Next() {
+		r := e.Value.(*Bdev_req_t)
+		if r.Cmd == BDEV_FLUSH {
+			return false
+		}
+		if r.Blks.Len() == 0 {
+			panic("Coalesce")
+		}
+		if r.Cmd == req.Cmd && !r.Sync &&
+			req.Blks.FrontBlock().Block == r.Blks.BackBlock().Block+1 {
+			r.Blks.Append(req.Blks)
+			return true
+		}
+	}
+	return false
+}
+
+/// Disk_i represents a physical disk interface. A disk that cannot read a
+/// block sets the block's Err before it acknowledges the request or releases
+/// the block; one that cannot write a synchronous request or flush sets the
+/// request's Err. Since nobody waits for an asynchronous write, the disk
+/// reports its failure with the next flush instead. The blocks of a discard
+/// have no pages and the disk does not release them; a disk that cannot
+/// discard ignores the request.
 type Disk_i interface {
 	Start(*Bdev_req_t) bool
 	Stats() string
@@ -203,6 +240,12 @@ func (blk *Bdev_block_t) EvictDone() {
 	blk.Mem.Free(blk.Pa)
 }
 
+/// Evictable reports whether the cache may evict the unused block. A block
+/// marked for eviction is removed by its last release instead.
+func (blk *Bdev_block_t) Evictable() bool {
+	return !blk._try_evict
+}
+
 /// Tryevict marks the block for eviction on release.
 func (blk *Bdev_block_t) Tryevict() {
 	blk._try_evict = true
@@ -222,7 +265,7 @@ func (blk *Bdev_block_t) Done(s string) {
 }
 
 /// Write synchronously writes the block to disk.
-func (b *Bdev_block_t) Write() {
+func (b *Bdev_block_t) Write() defs.Err_t {
 	if bdev_debug {
 		fmt.Printf("bdev_write %v %v\n", b.Block, b.Name)
 	}
@@ -235,6 +278,7 @@ func (b *Bdev_block_t) Write() {
 	if b.Disk.Start(req) {
 		<-req.AckCh
 	}
+	return req.Err
 }
 
 /// Write_async writes the block to disk without waiting for completion.
@@ -252,7 +296,8 @@ func (b *Bdev_block_t) Write_async() {
 }
 
 /// Read reads the block from disk synchronously.
-func (b *Bdev_block_t) Read() {
+func (b *Bdev_block_t) Read() defs.Err_t {
+	b.Err = 0
 	l := MkBlkList()
 	l.PushBack(b)
 	ider := MkRequest(l, BDEV_READ, true)
@@ -267,7 +312,7 @@ func (b *Bdev_block_t) Read() {
 	if b.Data[0] == 0xc && b.Data[1] == 0xc {
 		fmt.Printf("WARNING: %v %v\n", b.Name, b.Block)
 	}
-
+	return b.Err
 }
 
 /// New_page allocates backing memory for the block.
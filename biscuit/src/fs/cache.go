@@ -1,8 +1,6 @@
 package fs
 
 //import "fmt"
-import "runtime"
-import "sort"
 import "sync"
 import "sync/atomic"
 
@@ -20,21 +18,46 @@ import "stats"
 // refcache_t that an object isn't in use anymore.  Refcache itself would use a
 // weak reference to an object, so that the GC could collect the object, if it
 // is low on memory.
+//
+// The cache chooses which unused objects to evict with CLOCK-Pro (Jiang, Chen
+// and Zhang, USENIX ATC 2005). The objects are on a circular list, the clock,
+// and are either hot or cold. A hit only sets the object's reference bit, so
+// that lookups of cached objects stay lock-free. When the cache must shrink,
+// a hand sweeps the clock: it clears the reference bits of hot objects and
+// turns unreferenced hot objects cold if there are too many hot ones; it makes
+// referenced cold objects hot and evicts unreferenced cold objects. A cold
+// object is in its test period from when it is added until the hand finds it
+// unreferenced; the cache remembers the keys of objects evicted during their
+// test period, and an object whose key is remembered when it is added again
+// starts hot, since it was reused within the test period. How many cold
+// objects the cache keeps adapts: it grows when remembered keys are reused and
+// shrinks when they are forgotten.
+//
+// Once started, an evictor goroutine evicts in the background whenever the
+// cache grows beyond 7/8 of its limit until it is down to 3/4 of its limit, so
+// that the cache shrinks in small steps instead of all at once when memory runs
+// out.
 
 const REMOVE = uint32(0xF0000000)
 
 type cstats_t struct {
-	Nevict stats.Counter_t
-	Nhit   stats.Counter_t
-	Nadd   stats.Counter_t
+	Nevict  stats.Counter_t
+	Nhit    stats.Counter_t
+	Nadd    stats.Counter_t
+	Nreuse  stats.Counter_t
+	Nbgscan stats.Counter_t
 }
 
 /// Obj_t is implemented by objects managed by cache_t.
 /// EvictFromCache is called before removal when the refcount reaches zero.
 /// EvictDone is called once the object has been dropped from the cache.
+/// Evictable reports whether the cache may evict the object while it is
+/// unused; an object that its owner removes from the cache once it is unused,
+/// such as an unlinked inode, is not evictable.
 type Obj_t interface {
 	EvictFromCache()
 	EvictDone()
+	Evictable() bool
 }
 
 /// Objref_t wraps a cached object with reference tracking information.
@@ -42,7 +65,12 @@ type Objref_t struct {
        Key    int    /// lookup key
        Obj    Obj_t  /// cached object
        refcnt uint32 /// reference count
-       tstamp uint64 /// last use timestamp
+       refbit uint32 /// set by lookups, cleared by the clock hand
+       // the clock, protected by the cache's lock
+       next   *Objref_t
+       prev   *Objref_t
+       hot    bool
+       test   bool
 }
 
 /// MkObjref creates a new object reference with refcount one.
@@ -51,7 +79,6 @@ func MkObjref(obj Obj_t, key int) *Objref_t {
 	e.Obj = obj
 	e.Key = key
 	e.refcnt = uint32(1)
-	e.tstamp = runtime.Rdtsc()
 	return e
 }
 
@@ -99,15 +126,45 @@ func (ref *Objref_t) Down() uint32 {
 	return v
 }
 
+// remembered keys of objects evicted during their test period
+type ghost_t struct {
+	key int
+	seq uint64
+}
+
 type cache_t struct {
 	sync.Mutex
 	cache *hashtable.Hashtable_t
 	stats cstats_t
+	// the configured limit on the number of objects
+	limit *int
+	// the clock: hand is the next object to examine, nres the number of
+	// objects on the clock, nhot how many of them are hot and mcold how
+	// many cold objects the cache aims to keep.
+	hand  *Objref_t
+	nres  int
+	nhot  int
+	mcold int
+	// remembered keys; a key is remembered if it maps to the sequence
+	// number of its newest entry in ghostq.
+	ghosts map[int]uint64
+	ghostq []ghost_t
+	gseq   uint64
+	// the evictor
+	kick  chan bool
+	stopc chan bool
+	done  chan bool
 }
 
-func mkCache(size int) *cache_t {
+func mkCache(limit *int) *cache_t {
 	c := &cache_t{}
-	c.cache = hashtable.MkHash(size)
+	c.cache = hashtable.MkHash(*limit)
+	c.limit = limit
+	c.mcold = *limit / 16
+	if c.mcold < 1 {
+		c.mcold = 1
+	}
+	c.ghosts = make(map[int]uint64)
 	return c
 }
 
@@ -150,13 +207,18 @@ func (c *cache_t) Lookup(key int, mkobj func(int) Obj_t) (*Objref_t, bool) {
 		e, ok := c.lookupinc(key)
 		if ok {
 			c.stats.Nhit.Inc()
-			atomic.StoreUint64(&e.tstamp, runtime.Rdtsc())
+			if atomic.LoadUint32(&e.refbit) == 0 {
+				atomic.StoreUint32(&e.refbit, 1)
+			}
 			return e, false
 		}
 		e = MkObjref(mkobj(key), key)
 		_, ok = c.cache.Set(key, e)
 		if ok {
-			c.stats.Nadd.Inc()
+			c.Lock()
+			c.stats.Nadd++
+			c.link(e)
+			c.Unlock()
 			return e, true
 		}
 		// someone else created it, try lookup again
@@ -179,6 +241,8 @@ func (c *cache_t) TryRemove(key int) bool {
 }
 
 func (c *cache_t) _remove(key int, mustexist bool) bool {
+	c.Lock()
+	defer c.Unlock()
 	if v, ok := c.cache.Get(key); ok {
 		e := v.(*Objref_t)
 		cnt := e.Refcnt()
@@ -202,45 +266,249 @@ func (c *cache_t) Stats() string {
 	return s
 }
 
-/// ByStamp sorts cache entries by timestamp.
-type ByStamp []hashtable.Pair_t
+// returns the cache's part of the file system's statistics.
+func (c *cache_t) snapshot() Cachestats_t {
+	c.Lock()
+	defer c.Unlock()
+	return Cachestats_t{Nhit: c.stats.Nhit, Nmiss: c.stats.Nadd,
+		Nevict: c.stats.Nevict, Nobj: c.Len(), Limit: *c.limit}
+}
 
-func (a ByStamp) Len() int      { return len(a) }
-func (a ByStamp) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
-func (a ByStamp) Less(i, j int) bool {
-	e1 := a[i].Value.(*Objref_t)
-	e2 := a[j].Value.(*Objref_t)
-	v1 := atomic.LoadUint64(&e1.tstamp)
-	v2 := atomic.LoadUint64(&e2.tstamp)
-	return v1 < v2
+func (c *cache_t) resetstats() {
+	c.Lock()
+	c.stats = cstats_t{}
+	c.Unlock()
 }
 
-/// Evict_half removes up to half of the cached objects.
-/// It returns the number of entries left and the number evicted.
-func (c *cache_t) Evict_half() (int, int) {
+/// Evict evicts up to n unused objects, choosing them with the clock. It
+/// returns the number of objects left and the number evicted.
+func (c *cache_t) Evict(n int) (int, int) {
 	c.Lock()
-	defer c.Unlock()
+	vs := c.victims(n)
+	c.Unlock()
 
-	upto := c.cache.Size()
-	did := 0
-	elems := c.cache.Elems()
-	sort.Sort(ByStamp(elems))
-	for _, p := range elems { // XXX only need the keys, not complete elems
-		e := p.Value.(*Objref_t)
-		// evict each inode's dcache before setting REMOVE to ensure
-		// that a concurrent lock-free namei can't succeed on an
-		// evicted inode
+	// evict each inode's dcache before setting REMOVE to ensure that a
+	// concurrent lock-free namei can't succeed on an evicted inode. this
+	// may take the object's lock, which a thread may hold while it waits
+	// for the cache's lock, so it is done without the cache's lock.
+	for _, e := range vs {
 		e.Obj.EvictFromCache()
-		if !c.TryRemove(e.Key) {
+	}
+
+	var did []*Objref_t
+	c.Lock()
+	for _, e := range vs {
+		if !atomic.CompareAndSwapUint32(&e.refcnt, 0, REMOVE) {
+			// in use again or already removed
+			continue
+		}
+		// the object cannot change while REMOVE is set. Remove, which
+		// the owner of an object that is not evictable calls once the
+		// object is unused, waits for the cache's lock and then finds
+		// the object as it was.
+		if !e.Obj.Evictable() {
+			atomic.StoreUint32(&e.refcnt, 0)
 			continue
 		}
+		if e.test {
+			c.remember(e.Key)
+		}
+		c.delete(e)
+		did = append(did, e)
+	}
+	left := c.nres
+	c.Unlock()
+
+	for _, e := range did {
 		e.Obj.EvictDone()
-		did++
 	}
-	return upto - did, did
+	return left, len(did)
+}
+
+// returns up to n unused objects to evict, advancing the hand. the returned
+// objects may be in use again by the time they are evicted. caller holds the
+// cache's lock.
+func (c *cache_t) victims(n int) []*Objref_t {
+	var ret []*Objref_t
+	for i := 0; len(ret) < n && i < 3*c.nres; i++ {
+		e := c.hand
+		c.hand = e.next
+		ref := atomic.LoadUint32(&e.refbit) != 0
+		if ref {
+			atomic.StoreUint32(&e.refbit, 0)
+		}
+		if e.hot {
+			if !ref && c.nhot > c.nres-c.mcold {
+				e.hot = false
+				c.nhot--
+			}
+			continue
+		}
+		if ref {
+			if e.test {
+				// reused during its test period
+				e.hot = true
+				c.nhot++
+			}
+			e.test = !e.hot
+			continue
+		}
+		if e.Refcnt() == 0 {
+			ret = append(ret, e)
+		} else {
+			e.test = false
+		}
+	}
+	return ret
+}
+
+// adds e to the clock just behind the hand, so that the hand reaches it last.
+// e starts hot if its key is remembered. caller holds the cache's lock.
+func (c *cache_t) link(e *Objref_t) {
+	if e.Refcnt()&REMOVE != 0 {
+		// removed before it got on the clock
+		return
+	}
+	if _, ok := c.ghosts[e.Key]; ok {
+		delete(c.ghosts, e.Key)
+		c.stats.Nreuse.Inc()
+		if c.mcold < *c.limit-1 {
+			c.mcold++
+		}
+		e.hot = true
+		c.nhot++
+	} else {
+		e.test = true
+	}
+	if c.hand == nil {
+		e.next = e
+		e.prev = e
+		c.hand = e
+	} else {
+		e.next = c.hand
+		e.prev = c.hand.prev
+		e.prev.next = e
+		c.hand.prev = e
+	}
+	c.nres++
+	if c.nres > *c.limit*7/8 {
+		select {
+		case c.kick <- true:
+		default:
+		}
+	}
+}
+
+// caller holds the cache's lock
+func (c *cache_t) unlink(e *Objref_t) {
+	if e.next == nil {
+		// never got on the clock
+		return
+	}
+	if e.next == e {
+		c.hand = nil
+	} else {
+		if c.hand == e {
+			c.hand = e.next
+		}
+		e.prev.next = e.next
+		e.next.prev = e.prev
+	}
+	e.next = nil
+	e.prev = nil
+	if e.hot {
+		c.nhot--
+	}
+	c.nres--
+}
+
+// remembers key, forgetting the oldest remembered key if as many keys are
+// remembered as the cache may hold objects. caller holds the cache's lock.
+func (c *cache_t) remember(key int) {
+	c.gseq++
+	c.ghosts[key] = c.gseq
+	c.ghostq = append(c.ghostq, ghost_t{key, c.gseq})
+	for len(c.ghosts) > *c.limit && len(c.ghostq) > 0 {
+		g := c.ghostq[0]
+		c.ghostq = c.ghostq[1:]
+		if seq, ok := c.ghosts[g.key]; ok && seq == g.seq {
+			// not reused during its test period
+			delete(c.ghosts, g.key)
+			if c.mcold > 1 {
+				c.mcold--
+			}
+		}
+	}
+	if len(c.ghostq) > 2*len(c.ghosts)+16 {
+		// drop the entries of reused keys
+		q := make([]ghost_t, 0, len(c.ghosts))
+		for _, g := range c.ghostq {
+			if seq, ok := c.ghosts[g.key]; ok && seq == g.seq {
+				q = append(q, g)
+			}
+		}
+		c.ghostq = q
+	}
+}
+
+// starts a goroutine that evicts objects whenever the cache grows beyond 7/8 of
+// its limit until it is down to 3/4 of its limit.
+func (c *cache_t) startEvictor() {
+	c.Lock()
+	c.kick = make(chan bool, 1)
+	c.Unlock()
+	c.stopc = make(chan bool)
+	c.done = make(chan bool)
+	go c.evictor()
+}
+
+// stops the goroutine started by startEvictor, if any
+func (c *cache_t) stopEvictor() {
+	if c.stopc == nil {
+		return
+	}
+	close(c.stopc)
+	<-c.done
+	c.Lock()
+	c.kick = nil
+	c.Unlock()
+}
+
+// evict in small batches so that lookups that add objects are not held up
+const evictbatch = 64
+
+func (c *cache_t) evictor() {
+	defer close(c.done)
+	for {
+		select {
+		case <-c.kick:
+		case <-c.stopc:
+			return
+		}
+		c.stats.Nbgscan.Inc()
+		for {
+			c.Lock()
+			over := c.nres - *c.limit*3/4
+			c.Unlock()
+			if over <= 0 {
+				break
+			}
+			if _, did := c.Evict(min(over, evictbatch)); did == 0 {
+				// everything is in use
+				break
+			}
+			select {
+			case <-c.stopc:
+				return
+			default:
+			}
+		}
+	}
 }
 
+// caller holds the cache's lock
 func (c *cache_t) delete(o *Objref_t) {
 	c.cache.Del(o.Key)
-	c.stats.Nevict.Inc()
+	c.unlink(o)
+	c.stats.Nevict++
 }
@@ -0,0 +1,281 @@
+package fs
+
+import "crypto/aes"
+import "crypto/cipher"
+import "crypto/hmac"
+import "crypto/sha256"
+
+import "defs"
+import "mem"
+import "stats"
+import "util"
+
+// an encrypting disk. the blocks after the superblock are encrypted with
+// AES-XTS (IEEE 1619): a block is one data unit and its block number is the
+// tweak, so that equal blocks at different places encrypt differently and a
+// block can be read and written on its own. the boot blocks stay plain for the
+// boot loader, and so does the superblock, which records the cipher, the salt
+// and the iterations of the key derivation and a check value of the key. the
+// data of the file system is kept secret, but not its size or which blocks
+// change.
+
+// ciphers of the superblock
+const (
+	CRYPT_NONE   = 0
+	CRYPT_AESXTS = 1 // AES-256-XTS with a key derived from a passphrase
+)
+
+// /       CRYPT_KEYLEN is the length of the two AES-256 keys of AES-XTS.
+const CRYPT_KEYLEN = 64
+
+// /       CRYPT_SALTLEN is the length of the salt of a key.
+const CRYPT_SALTLEN = 16
+
+// /       CRYPT_ITERS is the number of iterations of the key derivation of new
+// /       encrypted file systems unless their maker chooses another.
+const CRYPT_ITERS = 600000
+
+// /       Cryptdisk_t encrypts the blocks that it writes to the disk it wraps and
+// /       decrypts those it reads, except for the blocks before first.
+type Cryptdisk_t struct {
+	disk  Disk_i
+	first int
+	// encrypts the data and the tweaks
+	data  cipher.Block
+	tweak cipher.Block
+	stats cryptstat_t
+}
+
+type cryptstat_t struct {
+	Nencrypt stats.Counter_t
+	Ndecrypt stats.Counter_t
+}
+
+// /       MkCryptdisk returns a Cryptdisk_t that encrypts the blocks of disk from
+// /       block first on with key, which has CRYPT_KEYLEN bytes.
+func MkCryptdisk(disk Disk_i, key []uint8, first int) (*Cryptdisk_t, defs.Err_t) {
+	if len(key) != CRYPT_KEYLEN {
+		return nil, -defs.EINVAL
+	}
+	data, err := aes.NewCipher(key[:CRYPT_KEYLEN/2])
+	if err != nil {
+		return nil, -defs.EINVAL
+	}
+	tweak, err := aes.NewCipher(key[CRYPT_KEYLEN/2:])
+	if err != nil {
+		return nil, -defs.EINVAL
+	}
+	return &Cryptdisk_t{disk: disk, first: first, data: data, tweak: tweak}, 0
+}
+
+// /       Cryptkey derives a key for MkCryptdisk and its check value, which
+// /       the superblock records to tell a wrong passphrase from a right one,
+// /       from a passphrase, a salt of CRYPT_SALTLEN random bytes and a number
+// /       of iterations. It runs PBKDF2-HMAC-SHA256 (RFC 8018) and expands its
+// /       output into the key and the check value with HMAC-SHA256, so that the
+// /       check value reveals nothing about the key and testing a guess of the
+// /       passphrase against it costs as many iterations as unlocking the disk.
+func Cryptkey(pass, salt []uint8, iters int) ([]uint8, []uint8) {
+	m := pbkdf2(pass, salt, iters)
+	key := append(expand(m, "biscuit data key"), expand(m, "biscuit tweak key")...)
+	return key, expand(m, "biscuit key check")[:CRYPT_SALTLEN]
+}
+
+// PBKDF2 with HMAC-SHA256 as the pseudorandom function and one block of
+// output.
+func pbkdf2(pass, salt []uint8, iters int) []uint8 {
+	prf := hmac.New(sha256.New, pass)
+	prf.Write(salt)
+	prf.Write([]uint8{0, 0, 0, 1})
+	u := prf.Sum(nil)
+	t := append([]uint8{}, u...)
+	for i := 1; i < iters; i++ {
+		prf.Reset()
+		prf.Write(u)
+		u = prf.Sum(u[:0])
+		for j := range t {
+			t[j] ^= u[j]
+		}
+	}
+	return t
+}
+
+// derives the 32 bytes named by label from the secret m.
+func expand(m []uint8, label string) []uint8 {
+	h := hmac.New(sha256.New, m)
+	h.Write([]uint8(label))
+	return h.Sum(nil)
+}
+
+// /       Unlockdisk returns the disk through which the file system on disk is
+// /       read: disk itself for a plain file system and a Cryptdisk_t for an
+// /       encrypted one, whose key it derives from the passphrase that pass
+// /       returns. It fails with EACCES if the passphrase is wrong.
+func Unlockdisk(mem Blockmem_i, disk Disk_i, pass func() []uint8) (Disk_i, defs.Err_t) {
+	b := MkBlock_newpage(0, "unlock", mem, disk, &_nop_relse)
+	defer b.Free_page()
+	if err := b.Read(); err != 0 {
+		return nil, err
+	}
+	start := util.Readn(b.Data[:], 4, FSOFF)
+	if start <= 0 {
+		return nil, -defs.EINVAL
+	}
+	b.Block = start
+	if err := b.Read(); err != 0 {
+		return nil, err
+	}
+	sb := Superblock_t{b.Data}
+	switch sb.Crypt() {
+	case CRYPT_NONE:
+		return disk, 0
+	case CRYPT_AESXTS:
+	default:
+		return nil, -defs.EINVAL
+	}
+	if sb.Cryptiters() <= 0 {
+		return nil, -defs.EINVAL
+	}
+	key, check := Cryptkey(pass(), sb.Cryptsalt(), sb.Cryptiters())
+	if !hmac.Equal(check, sb.Cryptcheck()) {
+		return nil, -defs.EACCES
+	}
+	return MkCryptdisk(disk, key, start+1)
+}
+
+// multiplies the tweak t by the primitive element of GF(2^128), in which the
+// bytes of t are little endian.
+func xtsmul(t *[aes.BlockSize]uint8) {
+	carry := uint8(0)
+	for i := range t {
+		c := t[i] >> 7
+		t[i] = t[i]<<1 | carry
+		carry = c
+	}
+	if carry != 0 {
+		t[0] ^= 0x87
+	}
+}
+
+// encrypts or decrypts src, the data of block blkno, into dst.
+func (cd *Cryptdisk_t) xts(dst, src *mem.Bytepg_t, blkno int, encrypt bool) {
+	var t [aes.BlockSize]uint8
+	for i := 0; i < 8; i++ {
+		t[i] = uint8(uint64(blkno) >> uint(8*i))
+	}
+	cd.tweak.Encrypt(t[:], t[:])
+	var x [aes.BlockSize]uint8
+	for off := 0; off < len(src); off += aes.BlockSize {
+		for i := range x {
+			x[i] = src[off+i] ^ t[i]
+		}
+		if encrypt {
+			cd.data.Encrypt(x[:], x[:])
+		} else {
+			cd.data.Decrypt(x[:], x[:])
+		}
+		for i := range x {
+			dst[off+i] = x[i] ^ t[i]
+		}
+		xtsmul(&t)
+	}
+}
+
+// the release callback of the encrypted copies of written blocks, which
+// releases the original when the disk is done with the copy
+type cryptwrite_t struct {
+	b *Bdev_block_t
+}
+
+func (cw *cryptwrite_t) Relse(c *Bdev_block_t, s string) {
+	c.Free_page()
+	cw.b.Done(s)
+}
+
+// the release callback of the blocks that read ahead into the pages of other
+// blocks, which decrypts the data before the original is released
+type cryptread_t struct {
+	cd *Cryptdisk_t
+	b  *Bdev_block_t
+}
+
+func (cr *cryptread_t) Relse(r *Bdev_block_t, s string) {
+	cr.b.Data = r.Data
+	cr.b.Err = r.Err
+	if r.Err == 0 {
+		cr.cd.decrypt(cr.b)
+	}
+	cr.b.Done(s)
+}
+
+func (cd *Cryptdisk_t) decrypt(b *Bdev_block_t) {
+	if b.Block < cd.first {
+		return
+	}
+	cd.xts(b.Data, b.Data, b.Block, false)
+	cd.stats.Ndecrypt.Inc()
+}
+
+// /       Start services a block device request. It writes encrypted copies of
+// /       the blocks of a write, so that the cached blocks stay plain, and
+// /       decrypts the blocks of a read in place. It finishes a synchronous
+// /       read or write before it returns; flushes and discards go to the
+// /       wrapped disk as they are.
+func (cd *Cryptdisk_t) Start(req *Bdev_req_t) bool {
+	switch req.Cmd {
+	case BDEV_WRITE:
+		l := MkBlkList()
+		for b := req.Blks.FrontBlock(); b != nil; b = req.Blks.NextBlock() {
+			if b.Block < cd.first {
+				l.PushBack(b)
+				continue
+			}
+			c := MkBlock_newpage(b.Block, "cryptwrite", b.Mem, cd.disk, &cryptwrite_t{b})
+			cd.xts(c.Data, b.Data, b.Block, true)
+			cd.stats.Nencrypt.Inc()
+			l.PushBack(c)
+		}
+		r := MkRequest(l, BDEV_WRITE, req.Sync)
+		if cd.disk.Start(r) && req.Sync {
+			<-r.AckCh
+		}
+		req.Err = r.Err
+		return false
+	case BDEV_READ:
+		if req.Sync {
+			r := MkRequest(req.Blks, BDEV_READ, true)
+			if cd.disk.Start(r) {
+				<-r.AckCh
+			}
+			for b := req.Blks.FrontBlock(); b != nil; b = req.Blks.NextBlock() {
+				if b.Err == 0 {
+					cd.decrypt(b)
+				}
+			}
+			return false
+		}
+		// nobody waits for read-ahead; the blocks are decrypted when
+		// the disk releases them
+		l := MkBlkList()
+		for b := req.Blks.FrontBlock(); b != nil; b = req.Blks.NextBlock() {
+			if b.Block < cd.first {
+				l.PushBack(b)
+				continue
+			}
+			r := MkBlock(b.Block, "cryptread", b.Mem, cd.disk, &cryptread_t{cd, b})
+			r.Data = b.Data
+			r.Pa = b.Pa
+			l.PushBack(r)
+		}
+		cd.disk.Start(MkRequest(l, BDEV_READ, false))
+		return false
+	}
+	return cd.disk.Start(req)
+}
+
+// /       Stats returns the encryption statistics and those of the wrapped disk.
+func (cd *Cryptdisk_t) Stats() string {
+	s := "cryptdisk:" + stats.Stats2String(cd.stats)
+	cd.stats = cryptstat_t{}
+	return s + cd.disk.Stats()
+}
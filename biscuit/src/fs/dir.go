@@ -6,8 +6,8 @@ import "unsafe"
 
 import "bounds"
 import "defs"
+import "fdops"
 import "hashtable"
-import "mem"
 import "res"
 import "ustr"
 import "util"
@@ -26,94 +26,235 @@ func crname(path ustr.Ustr, nilpatherr defs.Err_t) (defs.Err_t, bool) {
 	return 0, true
 }
 
-// directory data format
-// 0-13,  file name characters
-// 14-21, inode block/offset
-// ...repeated, totaling 23 times
+// directory data format. each directory block holds variable-length records,
+// none of which spans a block boundary:
+// 0-7,   inode number
+// 8-9,   record length
+// 10-11, file name length (0 for a free record) in the low 12 bits and the
+//        getdents64 type of the entry's inode in the high 4 bits
+// 12-,   file name characters
+// record lengths are multiples of DIRALIGN and the records in a block add up
+// to exactly BSIZE bytes. images made before the type was recorded have
+// DT_UNKNOWN there.
 /// Dirdata_t describes the on-disk directory entry layout.
 type Dirdata_t struct {
         Data []uint8 /// raw directory data
 }
 
 const (
-        DNAMELEN = 14            /// maximum name length
-        NDBYTES  = 22            /// directory entry size
-        NDIRENTS = BSIZE / NDBYTES /// entries per block
+        DIRHDR   = 12 /// size of a directory record header
+        DIRALIGN = 8  /// alignment of directory records
+        DIRMIN   = (DIRHDR + DIRALIGN - 1) / DIRALIGN * DIRALIGN /// smallest record
 )
 
-func doffset(didx int, off int) int {
-	if didx < 0 || didx >= NDIRENTS {
-		panic("bad dirent index")
-	}
-	return NDBYTES*didx + off
+/// Direclen returns the record length needed for a name of length namelen.
+func Direclen(namelen int) int {
+	return util.Roundup(DIRHDR+namelen, DIRALIGN)
 }
 
-/// Filename returns the name stored at the given directory index.
-func (dir *Dirdata_t) Filename(didx int) ustr.Ustr {
-	st := doffset(didx, 0)
-	sl := dir.Data[st : st+DNAMELEN]
-	ret := make([]byte, 0, 14)
-	for _, c := range sl {
-		if c == 0 {
-			break
-		}
-		ret = append(ret, c)
+func (dir *Dirdata_t) doffset(off int, field int) int {
+	if off < 0 || off%DIRALIGN != 0 || off+DIRHDR > len(dir.Data) {
+		panic("bad dirent offset")
 	}
+	return off + field
+}
+
+/// Reclen returns the length of the record at byte offset off.
+func (dir *Dirdata_t) Reclen(off int) int {
+	return util.Readn(dir.Data, 2, dir.doffset(off, 8))
+}
+
+/// Namelen returns the length of the name stored in the record at off.
+func (dir *Dirdata_t) Namelen(off int) int {
+	return util.Readn(dir.Data, 2, dir.doffset(off, 10)) & 0xfff
+}
+
+/// Dtype returns the getdents64 type stored in the record at off.
+func (dir *Dirdata_t) Dtype(off int) int {
+	return util.Readn(dir.Data, 2, dir.doffset(off, 10)) >> 12
+}
+
+/// Filename returns the name stored in the record at byte offset off.
+func (dir *Dirdata_t) Filename(off int) ustr.Ustr {
+	st := dir.doffset(off, DIRHDR)
+	l := dir.Namelen(off)
+	ret := make([]byte, l)
+	copy(ret, dir.Data[st:st+l])
 	return ustr.Ustr(ret)
 }
 
-func (dir *Dirdata_t) inodenext(didx int) defs.Inum_t {
-	st := doffset(didx, 14)
-	v := util.Readn(dir.Data[:], 8, st)
+func (dir *Dirdata_t) inodenext(off int) defs.Inum_t {
+	v := util.Readn(dir.Data, 8, dir.doffset(off, 0))
 	return defs.Inum_t(v)
 }
 
-/// W_filename writes a filename into the directory entry.
-func (dir *Dirdata_t) W_filename(didx int, fn ustr.Ustr) {
-	st := doffset(didx, 0)
-	sl := dir.Data[st : st+DNAMELEN]
-	l := len(fn)
-	for i := range sl {
-		if i >= l {
-			sl[i] = 0
-		} else {
-			sl[i] = fn[i]
-		}
+/// W_reclen writes the length of the record at byte offset off.
+func (dir *Dirdata_t) W_reclen(off int, reclen int) {
+	if reclen < DIRMIN || reclen%DIRALIGN != 0 {
+		panic("bad reclen")
 	}
+	util.Writen(dir.Data, 2, dir.doffset(off, 8), reclen)
 }
 
-/// W_inodenext writes the inode number for the entry.
-func (dir *Dirdata_t) W_inodenext(didx int, inum defs.Inum_t) {
-	st := doffset(didx, 14)
-	util.Writen(dir.Data[:], 8, st, int(inum))
+/// W_filename writes a filename into the record at byte offset off and sets
+/// its type to DT_UNKNOWN. the record's length must already be large enough
+/// to hold the name.
+func (dir *Dirdata_t) W_filename(off int, fn ustr.Ustr) {
+	if Direclen(len(fn)) > dir.Reclen(off) {
+		panic("name does not fit")
+	}
+	util.Writen(dir.Data, 2, dir.doffset(off, 10), len(fn))
+	st := dir.doffset(off, DIRHDR)
+	copy(dir.Data[st:st+len(fn)], fn)
+}
+
+/// W_dtype writes the getdents64 type of the record at byte offset off.
+func (dir *Dirdata_t) W_dtype(off int, dt int) {
+	if dt < 0 || dt > 0xf {
+		panic("bad dtype")
+	}
+	util.Writen(dir.Data, 2, dir.doffset(off, 10), dir.Namelen(off)|dt<<12)
+}
+
+/// W_inodenext writes the inode number for the record at byte offset off.
+func (dir *Dirdata_t) W_inodenext(off int, inum defs.Inum_t) {
+	util.Writen(dir.Data, 8, dir.doffset(off, 0), int(inum))
+}
+
+/// W_dirent writes a complete record at byte offset off. an empty name makes
+/// the record free.
+func (dir *Dirdata_t) W_dirent(off int, reclen int, fn ustr.Ustr, inum defs.Inum_t) {
+	dir.W_reclen(off, reclen)
+	dir.W_filename(off, fn)
+	dir.W_inodenext(off, inum)
+}
+
+/// Valid reports whether the record at byte offset off of a block is well
+/// formed.
+func (dir *Dirdata_t) Valid(off int) bool {
+	if off < 0 || off%DIRALIGN != 0 || off+DIRHDR > BSIZE {
+		return false
+	}
+	rl := dir.Reclen(off)
+	return rl >= DIRMIN && rl%DIRALIGN == 0 && off+rl <= BSIZE &&
+		Direclen(dir.Namelen(off)) <= rl
+}
+
+// records returned by getdents64(2), laid out like Linux's struct
+// linux_dirent64:
+// 0-7,   inode number
+// 8-15,  cookie of the next record
+// 16-17, record length
+// 18,    entry type (defs.DT_*)
+// 19-,   NUL-terminated file name
+/// Dirent64_t is a directory entry as returned by getdents64.
+type Dirent64_t struct {
+	Inum defs.Inum_t /// inode number
+	Off  int         /// cookie of the next entry
+	Type int         /// entry type, one of defs.DT_*
+	Name ustr.Ustr   /// file name
+}
+
+/// DENT64HDR is the size of a getdents64 record header.
+const DENT64HDR = 19
+
+/// Dirent64len returns the getdents64 record length for a name of length
+/// namelen.
+func Dirent64len(namelen int) int {
+	return util.Roundup(DENT64HDR+namelen+1, 8)
+}
+
+/// Put encodes de at the start of b, which must hold Dirent64len(len(de.Name))
+/// bytes, and returns the record length.
+func (de *Dirent64_t) Put(b []uint8) int {
+	l := Dirent64len(len(de.Name))
+	util.Writen(b, 8, 0, int(de.Inum))
+	util.Writen(b, 8, 8, de.Off)
+	util.Writen(b, 2, 16, l)
+	b[18] = uint8(de.Type)
+	n := copy(b[DENT64HDR:], de.Name)
+	for i := DENT64HDR + n; i < l; i++ {
+		b[i] = 0
+	}
+	return l
+}
+
+/// Dirent64 decodes the getdents64 record at the start of b and returns it
+/// with its length. ok is false if b does not start with a whole record.
+func Dirent64(b []uint8) (de Dirent64_t, l int, ok bool) {
+	if len(b) < DENT64HDR+1 {
+		return de, 0, false
+	}
+	l = util.Readn(b, 2, 16)
+	if l < DENT64HDR+1 || l > len(b) {
+		return de, 0, false
+	}
+	de.Inum = defs.Inum_t(util.Readn(b, 8, 0))
+	de.Off = util.Readn(b, 8, 8)
+	de.Type = int(b[18])
+	n := 0
+	for DENT64HDR+n < l && b[DENT64HDR+n] != 0 {
+		n++
+	}
+	de.Name = ustr.Ustr(append([]uint8{}, b[DENT64HDR:DENT64HDR+n]...))
+	return de, l, true
+}
+
+// returns the getdents64 entry type for inode type itype.
+func dtype(itype int) int {
+	switch itype {
+	case I_FILE:
+		return defs.DT_REG
+	case I_DIR:
+		return defs.DT_DIR
+	case I_DEV:
+		return defs.DT_CHR
+	case I_SYMLINK:
+		return defs.DT_LNK
+	}
+	return defs.DT_UNKNOWN
 }
 
 type fdent_t struct {
 	offset int
+	reclen int
 	next   *fdent_t
 }
 
-// linked list of free directory entries
+// linked list of free directory records
 type fdelist_t struct {
 	head *fdent_t
 	n    int
 }
 
-func (il *fdelist_t) addhead(off int) {
-	d := &fdent_t{offset: off}
+func (il *fdelist_t) addhead(off, reclen int) {
+	d := &fdent_t{offset: off, reclen: reclen}
 	d.next = il.head
 	il.head = d
 	il.n++
 }
 
-func (il *fdelist_t) remhead() (*fdent_t, bool) {
-	var ret *fdent_t
-	if il.head != nil {
-		ret = il.head
-		il.head = ret.next
-		il.n--
+// removes and returns the first free record that is at least need bytes long.
+func (il *fdelist_t) remfit(need int) (*fdent_t, bool) {
+	for p := &il.head; *p != nil; p = &(*p).next {
+		if d := *p; d.reclen >= need {
+			*p = d.next
+			il.n--
+			return d, true
+		}
+	}
+	return nil, false
+}
+
+// removes the free record at offset off, if it is on the list.
+func (il *fdelist_t) remove(off int) {
+	for p := &il.head; *p != nil; p = &(*p).next {
+		if (*p).offset == off {
+			*p = (*p).next
+			il.n--
+			return
+		}
 	}
-	return ret, ret != nil
 }
 
 func (il *fdelist_t) count() int {
@@ -123,7 +264,10 @@ func (il *fdelist_t) count() int {
 // struct to hold the offset, inum of directory entry slots
 type icdent_t struct {
 	offset int
+	reclen int
 	inum   defs.Inum_t
+	// the getdents64 type recorded in the entry
+	dtype int
 	// idm may be nil since it is lazily filled on ilookup
 	idm  *imemnode_t
 	name ustr.Ustr
@@ -135,83 +279,133 @@ func (de *icdent_t) String() string {
 	return s
 }
 
-// returns the offset of an empty directory entry. returns error if failed to
-// allocate page for the new directory entry.
-func (idm *imemnode_t) _denextempty(opid opid_t) (int, defs.Err_t) {
+// returns the offset and length of a free directory record that can hold at
+// least need bytes. returns error if failed to allocate page for the new
+// directory record.
+func (idm *imemnode_t) _denextempty(opid opid_t, need int) (int, int, defs.Err_t) {
 	dc := &idm.dentc
-	if ret, ok := dc.freel.remhead(); ok {
-		return ret.offset, 0
+	if ret, ok := dc.freel.remfit(need); ok {
+		return ret.offset, ret.reclen, 0
 	}
 
-	// see if we have an empty slot before expanding the directory
-	if !idm.dentc.scanned {
+	// see if we have a large enough free record before expanding the
+	// directory. an indexed directory knows which blocks have one.
+	if idm._ndxbuilt() {
+		off, reclen, ok, err := idm._ndxfindfree(opid, need)
+		if err != 0 {
+			return 0, 0, err
+		}
+		if ok {
+			return off, reclen, 0
+		}
+	} else if !idm.dentc.scanned {
 		var de *icdent_t
+		var frees []*icdent_t
 		found, err := idm._descan(opid, func(fn ustr.Ustr, tde *icdent_t) bool {
-			if len(fn) == 0 {
+			if len(fn) != 0 {
+				return false
+			}
+			if tde.reclen >= need {
 				de = tde
 				return true
 			}
+			frees = append(frees, tde)
 			return false
 		})
 		if err != 0 {
-			return 0, err
+			return 0, 0, err
 		}
 		if found {
-			return de.offset, 0
+			dc.freel.remove(de.offset)
+			return de.offset, de.reclen, 0
+		}
+		// the scan saw every free record, so the free list can be
+		// rebuilt from it and there is no need to scan the blocks ever
+		// again.
+		dc.freel.head = nil
+		dc.freel.n = 0
+		for _, tde := range frees {
+			dc.freel.addhead(tde.offset, tde.reclen)
 		}
 	}
-	// there are no free directory entries. there is no need to scan the
-	// blocks even again since we can allocate all free directory entries
-	// from the free list.
 	idm.dentc.scanned = true
 
-	// current dir blocks are full -- allocate new dirdata block. because
+	// a directory that outgrows its first block gets an index
+	if idm.diridx == DIRIDX_EMPTY && idm.size >= BSIZE {
+		if err := idm._ndxbuild(opid); err != 0 {
+			return 0, 0, err
+		}
+	}
+
+	// no free record is large enough -- allocate new dirdata block. because
 	// the offset of the new block is larger than idm.size, off2buf will
 	// zero-fill the block.
 	newsz := idm.size + BSIZE
 	b, err := idm.off2buf(opid, idm.size, BSIZE, true, true, "_denextempty")
 	if err != 0 {
-		return 0, err
+		return 0, 0, err
 	}
 	newoff := idm.size
-	// skip 0 since we will allocate it immediately
-	for i := NDIRENTS - 1; i > 0; i-- {
-		noff := newoff + NDBYTES*i
-		idm._deaddempty(noff)
-	}
+	// the whole block is a single free record
+	ddata := Dirdata_t{b.Data[:]}
+	ddata.W_dirent(0, BSIZE, ustr.MkUstr(), 0)
+	idm._ndxhint(opid, newoff, &ddata)
 
 	b.Unlock()
 	idm.fs.fslog.Write(opid, b) // log empty dir block, later writes absorpt it hopefully
 	idm.fs.fslog.Relse(b, "_denextempty")
 
 	idm.size = newsz
-	return newoff, 0
+	return newoff, BSIZE, 0
 }
 
-// if _deinsert fails to allocate a page, idm is left unchanged.
-func (idm *imemnode_t) _deinsert(opid opid_t, name ustr.Ustr, inum defs.Inum_t) defs.Err_t {
+// inserts an entry for inode inum, whose type is itype. if _deinsert fails to
+// allocate a page, idm is left unchanged.
+func (idm *imemnode_t) _deinsert(opid opid_t, name ustr.Ustr, inum defs.Inum_t, itype int) defs.Err_t {
 	if !idm._amlocked {
 		panic("laksdj")
 	}
-	noff, err := idm._denextempty(opid)
+	if len(name) > NAME_MAX {
+		return -defs.ENAMETOOLONG
+	}
+	need := Direclen(len(name))
+	noff, avail, err := idm._denextempty(opid, need)
 	if err != 0 {
 		return err
 	}
+	if err := idm._ndxprepare(opid, name); err != 0 {
+		idm._deaddempty(noff, avail)
+		return err
+	}
 	// dennextempty() made the slot so we won't fill
-	b, err := idm.off2buf(opid, noff, NDBYTES, true, true, "_deinsert")
+	b, err := idm.off2buf(opid, noff, avail, true, true, "_deinsert")
 	if err != 0 {
+		idm._deaddempty(noff, avail)
 		return err
 	}
-	ddata := Dirdata_t{b.Data[noff%mem.PGSIZE:]}
+	ddata := Dirdata_t{b.Data[:]}
+	boff := noff % BSIZE
 
-	ddata.W_filename(0, name)
-	ddata.W_inodenext(0, inum)
+	// split off the unused tail of the free record
+	reclen := avail
+	if avail-need >= DIRMIN {
+		reclen = need
+		ddata.W_dirent(boff+need, avail-need, ustr.MkUstr(), 0)
+		idm._deaddempty(noff+need, avail-need)
+	}
+	ddata.W_dirent(boff, reclen, name, inum)
+	ddata.W_dtype(boff, dtype(itype))
+	idm._ndxinsert(opid, name, noff)
+	idm._ndxhint(opid, noff-boff, &ddata)
+	idm.mtime = now()
+	idm.ctime = idm.mtime
 
 	b.Unlock()
 	idm.fs.fslog.Write(opid, b)
 	idm.fs.fslog.Relse(b, "_deinsert")
 
-	icd := &icdent_t{offset: noff, inum: inum, name: name}
+	icd := &icdent_t{offset: noff, reclen: reclen, inum: inum,
+		dtype: dtype(itype), name: name}
 	ok := idm._dceadd(name, icd)
 	dc := &idm.dentc
 	dc.haveall = dc.haveall && ok
@@ -222,11 +416,17 @@ func (idm *imemnode_t) _deinsert(opid opid_t, name ustr.Ustr, inum defs.Inum_t)
 // or it has been called on all directory entries. _descan returns true if f
 // returned true.
 func (idm *imemnode_t) _descan(opid opid_t, f func(fn ustr.Ustr, de *icdent_t) bool) (bool, defs.Err_t) {
+	return idm._descanfrom(opid, 0, f)
+}
+
+// like _descan, but skips the entries that start before directory offset
+// start. returns -EIO if a record of the directory is malformed.
+func (idm *imemnode_t) _descanfrom(opid opid_t, start int, f func(fn ustr.Ustr, de *icdent_t) bool) (bool, defs.Err_t) {
 	if !idm._amlocked {
 		panic("lsjdf")
 	}
 	found := false
-	for i := 0; i < idm.size; i += BSIZE {
+	for i := start - start%BSIZE; i < idm.size && !found; i += BSIZE {
 		if !res.Resadd_noblock(bounds.Bounds(bounds.B_IMEMNODE_T__DESCAN)) {
 			return false, -defs.ENOHEAP
 		}
@@ -235,10 +435,20 @@ func (idm *imemnode_t) _descan(opid opid_t, f func(fn ustr.Ustr, de *icdent_t) b
 			return false, err
 		}
 		dd := Dirdata_t{b.Data[:]}
-		for j := 0; j < NDIRENTS; j++ {
+		for j := 0; j < BSIZE; j += dd.Reclen(j) {
+			if !dd.Valid(j) {
+				fmt.Printf("dir %v: bad record at %v\n", idm.inum, i+j)
+				b.Unlock()
+				idm.fs.fslog.Relse(b, "_descan")
+				return false, -defs.EIO
+			}
+			if i+j < start {
+				continue
+			}
 			tfn := dd.Filename(j)
 			tpriv := dd.inodenext(j)
-			tde := &icdent_t{offset: i + j*NDBYTES, inum: tpriv, name: tfn}
+			tde := &icdent_t{offset: i + j, reclen: dd.Reclen(j),
+				inum: tpriv, dtype: dd.Dtype(j), name: tfn}
 			if f(tfn, tde) {
 				found = true
 				break
@@ -269,9 +479,19 @@ func (idm *imemnode_t) _delookup(opid opid_t, fn ustr.Ustr) (*icdent_t, defs.Err
 		return zi, -defs.ENOENT
 	}
 
-	// not in cached dirents
+	if idm._ndxindexed(fn) {
+		de, err := idm._ndxlookup(opid, fn)
+		if err == 0 {
+			idm._dceadd(fn, de)
+		}
+		return de, err
+	}
+
+	// not in cached dirents. an indexed directory is only scanned for "."
+	// and "..", which are in the first block, so the scan stops there.
 	found := false
 	haveall := true
+	indexed := idm._ndxbuilt()
 	var de *icdent_t
 	_, err := idm._descan(opid, func(tfn ustr.Ustr, tde *icdent_t) bool {
 		if len(tfn) == 0 {
@@ -284,12 +504,14 @@ func (idm *imemnode_t) _delookup(opid opid_t, fn ustr.Ustr) (*icdent_t, defs.Err
 		if !idm._dceadd(tfn, tde) {
 			haveall = false
 		}
-		return found && !haveall
+		return found && (indexed || !haveall)
 	})
 	if err != 0 {
 		return zi, err
 	}
-	idm.dentc.haveall = haveall
+	if !indexed || !found {
+		idm.dentc.haveall = haveall
+	}
 	if !found {
 		return zi, -defs.ENOENT
 	}
@@ -306,23 +528,48 @@ func (idm *imemnode_t) _deremove(opid opid_t, fn ustr.Ustr) (*icdent_t, defs.Err
 	// blocks, but our implementation of readdir(3) requires it (because it
 	// reads the directory's contents from the data blocks). therefore,
 	// make the data block update unconditional.
-	if true || idm.fs.diskfs {
-		b, err := idm.off2buf(opid, de.offset, NDBYTES, true, true, "_deremove")
-		if err != 0 {
-			return zi, err
-		}
-		dirdata := Dirdata_t{b.Data[de.offset%mem.PGSIZE:]}
-		dirdata.W_filename(0, ustr.MkUstr())
-		dirdata.W_inodenext(0, defs.Inum_t(0))
-		b.Unlock()
-		idm.fs.fslog.Write(opid, b)
-		idm.fs.fslog.Relse(b, "_deremove")
+	blkoff := de.offset - de.offset%BSIZE
+	b, err := idm.off2buf(opid, blkoff, BSIZE, true, true, "_deremove")
+	if err != 0 {
+		return zi, err
 	}
+	dirdata := Dirdata_t{b.Data[:]}
+	off, reclen := idm._decoalesce(&dirdata, blkoff, de.offset%BSIZE)
+	dirdata.W_dirent(off, reclen, ustr.MkUstr(), 0)
+	idm._ndxremove(opid, fn, de.offset)
+	idm._ndxhint(opid, blkoff, &dirdata)
+	idm.mtime = now()
+	idm.ctime = idm.mtime
+	b.Unlock()
+	idm.fs.fslog.Write(opid, b)
+	idm.fs.fslog.Relse(b, "_deremove")
+
 	idm._deremove_dent(de)
-	idm._deaddempty(de.offset)
+	idm._deaddempty(blkoff+off, reclen)
 	return de, 0
 }
 
+// merges the record at offset off of directory block dd, which is about to be
+// freed, with the free records adjacent to it. returns the offset and length of
+// the resulting free record.
+func (idm *imemnode_t) _decoalesce(dd *Dirdata_t, blkoff, off int) (int, int) {
+	reclen := dd.Reclen(off)
+	if next := off + reclen; next < BSIZE && dd.Namelen(next) == 0 {
+		idm.dentc.freel.remove(blkoff + next)
+		reclen += dd.Reclen(next)
+	}
+	prev := -1
+	for o := 0; o < off; o += dd.Reclen(o) {
+		prev = o
+	}
+	if prev != -1 && dd.Namelen(prev) == 0 {
+		idm.dentc.freel.remove(blkoff + prev)
+		reclen += off - prev
+		off = prev
+	}
+	return off, reclen
+}
+
 func (idm *imemnode_t) _deremove_dent(de *icdent_t) {
 	if idm.dentc.dents != nil {
 		idm.dentc.dents.Del(de.name)
@@ -356,36 +603,44 @@ func (idm *imemnode_t) _derelease() int {
 	dc := &idm.dentc
 	dc.haveall = false
 	dc.dents = nil
+	// free records are only cached on the list, so they must be found by
+	// scanning again
+	dc.scanned = false
 	dc.freel.head = nil
+	dc.freel.n = 0
 	ret := dc.max
 	dc.max = 0
 	return ret
 }
 
 // ensure that an insert/unlink cannot fail i.e. fail to allocate a page. if fn
-// == "", look for an empty dirent, otherwise make sure the page containing fn
-// is in the page cache.
-func (idm *imemnode_t) _deprobe(opid opid_t, fn ustr.Ustr) (*Bdev_block_t, defs.Err_t) {
+// == "", look for a free record of at least need bytes, otherwise make sure the
+// page containing fn is in the page cache.
+func (idm *imemnode_t) _deprobe(opid opid_t, fn ustr.Ustr, need int) (*Bdev_block_t, defs.Err_t) {
 	if len(fn) != 0 {
 		de, err := idm._delookup(opid, fn)
 		if err != 0 {
 			return nil, err
 		}
 		noff := de.offset
-		b, err := idm.off2buf(opid, noff, NDBYTES, true, true, "_deprobe_fn")
+		b, err := idm.off2buf(opid, noff, de.reclen, true, true, "_deprobe_fn")
+		if err != 0 {
+			return nil, err
+		}
 		b.Unlock()
-		return b, err
+		return b, 0
 	}
-	noff, err := idm._denextempty(opid)
+	noff, avail, err := idm._denextempty(opid, need)
 	if err != 0 {
 		return nil, err
 	}
-	b, err := idm.off2buf(opid, noff, NDBYTES, true, true, "_deprobe_nil")
+	b, err := idm.off2buf(opid, noff, avail, true, true, "_deprobe_nil")
 	if err != 0 {
+		idm._deaddempty(noff, avail)
 		return nil, err
 	}
 	b.Unlock()
-	idm._deaddempty(noff)
+	idm._deaddempty(noff, avail)
 	return b, 0
 }
 
@@ -396,33 +651,99 @@ func (idm *imemnode_t) _dceadd(fn ustr.Ustr, de *icdent_t) bool {
 	return true
 }
 
-func (idm *imemnode_t) _deaddempty(off int) {
+func (idm *imemnode_t) _deaddempty(off, reclen int) {
 	dc := &idm.dentc
-	dc.freel.addhead(off)
+	dc.freel.addhead(off, reclen)
 }
 
-// guarantee that there is enough memory to insert at least one directory
-// entry.
-func (idm *imemnode_t) probe_insert(opid opid_t) (*Bdev_block_t, defs.Err_t) {
+// guarantee that there is enough memory to insert a directory entry for name.
+func (idm *imemnode_t) probe_insert(opid opid_t, name ustr.Ustr) (*Bdev_block_t, defs.Err_t) {
+	if len(name) > NAME_MAX {
+		return nil, -defs.ENAMETOOLONG
+	}
 	// insert and remove a fake directory entry, forcing a page allocation
 	// if necessary.
-	b, err := idm._deprobe(opid, ustr.MkUstr())
+	b, err := idm._deprobe(opid, ustr.MkUstr(), Direclen(len(name)))
 	if err != 0 {
 		return nil, err
 	}
+	// the index must be able to take the name, too
+	if err := idm._ndxprepare(opid, name); err != 0 {
+		idm.fs.fslog.Relse(b, "probe_insert")
+		return nil, err
+	}
 	return b, 0
 }
 
 // guarantee that there is enough memory to unlink a dirent (which may require
 // allocating a page to load the dirents from disk).
 func (idm *imemnode_t) probe_unlink(opid opid_t, fn ustr.Ustr) (*Bdev_block_t, defs.Err_t) {
-	b, err := idm._deprobe(opid, fn)
+	b, err := idm._deprobe(opid, fn, 0)
 	if err != 0 {
 		return nil, err
 	}
 	return b, 0
 }
 
+// copies the entries of directory idm, starting with the one at cookie off, to
+// dst as getdents64 records. returns the number of bytes copied and the cookie
+// of the next entry. a cookie is the directory offset of an entry; entries
+// never move once written, so entries that exist for the whole iteration are
+// returned exactly once, however many are inserted and removed meanwhile.
+// idm must be locked.
+func (idm *imemnode_t) do_getdents(dst fdops.Userio_i, off int) (int, int, defs.Err_t) {
+	if idm.itype != I_DIR {
+		return 0, off, -defs.ENOTDIR
+	}
+	space := dst.Remain()
+	used := 0
+	var des []*icdent_t
+	full, err := idm._descanfrom(opid_t(0), off, func(fn ustr.Ustr, de *icdent_t) bool {
+		if len(fn) == 0 {
+			return false
+		}
+		l := Dirent64len(len(fn))
+		if used+l > space {
+			return true
+		}
+		used += l
+		des = append(des, de)
+		return false
+	})
+	if err != 0 {
+		return 0, off, err
+	}
+	if len(des) == 0 {
+		if full {
+			// the next entry does not fit
+			return 0, off, -defs.EINVAL
+		}
+		return 0, off, 0
+	}
+	buf := make([]uint8, used)
+	p := 0
+	for _, de := range des {
+		d := Dirent64_t{Inum: de.inum, Off: de.offset + de.reclen,
+			Type: idm._detype(de), Name: de.name}
+		p += d.Put(buf[p:])
+	}
+	n, err := dst.Uiowrite(buf)
+	if err != 0 {
+		return 0, off, err
+	}
+	last := des[len(des)-1]
+	return n, last.offset + last.reclen, 0
+}
+
+// returns the getdents64 type of the entry de of directory idm, which is
+// DT_UNKNOWN for entries of images that predate recording it.
+func (idm *imemnode_t) _detype(de *icdent_t) int {
+	if de.name.Isdot() || de.name.Isdotdot() {
+		return defs.DT_DIR
+	}
+	return de.dtype
+}
+
 // idm must be locked. if ilookup succeeds, it increments the refcount of the
 // target imemnode and returns it unlocked (even for ".")
 func (idm *imemnode_t) ilookup(opid opid_t, name ustr.Ustr) (*imemnode_t, defs.Err_t) {
@@ -446,12 +767,20 @@ func (idm *imemnode_t) ilookup(opid opid_t, name ustr.Ustr) (*imemnode_t, defs.E
 			}
 		} else {
 			im = idm.fs.icache.Iref(de.inum, "ilookup")
+			if err := im.ioerr; err != 0 {
+				im.Refdown("ilookup")
+				return nil, err
+			}
 		}
 		atomic.StorePointer((*unsafe.Pointer)(unsafe.Pointer(&de.idm)), unsafe.Pointer(im))
 	} else {
 		if _, ok := de.idm.Refup("ilookup"); !ok {
 			// target imemnode was evicted
 			i := idm.fs.icache.Iref(de.inum, "ilookup")
+			if err := i.ioerr; err != 0 {
+				i.Refdown("ilookup")
+				return nil, err
+			}
 			atomic.StorePointer((*unsafe.Pointer)(unsafe.Pointer(&de.idm)), unsafe.Pointer(i))
 		}
 	}
@@ -521,8 +850,9 @@ func (idm *imemnode_t) ilookup_lockfree(name ustr.Ustr, verify bool) (*imemnode_
 	return nil, false
 }
 
-// creates a new directory entry with name "name" and inode number priv
-func (idm *imemnode_t) iinsert(opid opid_t, name ustr.Ustr, inum defs.Inum_t) defs.Err_t {
+// creates a new directory entry with name "name" and inode number inum, whose
+// type is itype
+func (idm *imemnode_t) iinsert(opid opid_t, name ustr.Ustr, inum defs.Inum_t, itype int) defs.Err_t {
 	if idm.itype != I_DIR {
 		return -defs.ENOTDIR
 	}
@@ -534,7 +864,7 @@ func (idm *imemnode_t) iinsert(opid opid_t, name ustr.Ustr, inum defs.Inum_t) de
 	if inum < 0 {
 		panic("iinsert")
 	}
-	err := idm._deinsert(opid, name, inum)
+	err := idm._deinsert(opid, name, inum, itype)
 	return err
 }
 
@@ -0,0 +1,562 @@
+package fs
+
+import "fmt"
+
+import "defs"
+import "ustr"
+import "util"
+
+// on-disk directory index. the records of a directory stay where they are (so
+// getdents cookies remain stable); the index only maps names to the directory
+// offsets of their records and tracks free space, so that lookup, insert and
+// remove no longer scan the directory after its dcache has been dropped.
+//
+// the inode's index word is DIRIDX_NONE for directories without an index,
+// DIRIDX_EMPTY for directories that are indexed once they outgrow their first
+// block, and the block number of the index root otherwise. names are found by
+// extendible hashing; the root is laid out as follows (in words):
+// 0-63,    addresses of the hint blocks
+// 64,      global depth g of the bucket table
+// 128-383, bucket table: the bucket of hash h is at word 128 + h%2^g
+//
+// hint block i holds one byte for each of the directory blocks
+// [i*BSIZE, (i+1)*BSIZE): the length of the largest free record in the block
+// in units of DIRALIGN, capped at 255. a missing hint block means that the free
+// space of its blocks is unknown.
+//
+// a bucket is a chain of blocks; only the first one is in the bucket table.
+// a full bucket is split in two unless its depth is already NDXMAXDEPTH or the
+// split did not make room, in which case a block is added to its chain.
+// 0-7,   block number of the next block of the chain
+// 8-15,  number of entries
+// 16-23, local depth: the number of low hash bits that the entries share
+// 24-,   entries: 4-byte name hash, 4-byte directory offset of the record
+//
+// "." and ".." are never indexed; they are always in the first block.
+const (
+	DIRIDX_NONE  = 0 /// directory has no index
+	DIRIDX_EMPTY = 1 /// directory to be indexed when it grows
+	NDXHINT      = 64
+	NDXDEPTH     = NDXHINT
+	NDXTABLE     = 128
+	NDXMAXDEPTH  = 8
+	NDXSLOTS     = NDXTABLE + 1<<NDXMAXDEPTH
+	NDXHDR       = 24
+	NDXENTS      = (BSIZE - NDXHDR) / 8
+	NDXHINTMAX   = 255
+)
+
+// 32-bit FNV-1a
+func ndxhash(name ustr.Ustr) int {
+	h := uint32(2166136261)
+	for _, c := range name {
+		h ^= uint32(c)
+		h *= 16777619
+	}
+	return int(h)
+}
+
+// returns the root word that holds the bucket of hash h.
+func ndxslot(root *Bdev_block_t, h int) int {
+	g := util.Readn(root.Data[:], 8, NDXDEPTH*8)
+	return NDXTABLE + h&(1<<uint(g)-1)
+}
+
+func ndxent(b *Bdev_block_t, i int) (int, int) {
+	o := NDXHDR + i*8
+	return util.Readn(b.Data[:], 4, o), util.Readn(b.Data[:], 4, o+4)
+}
+
+func ndxwent(b *Bdev_block_t, i, h, off int) {
+	o := NDXHDR + i*8
+	util.Writen(b.Data[:], 4, o, h)
+	util.Writen(b.Data[:], 4, o+4, off)
+}
+
+// returns the length of the largest free record in dd in units of DIRALIGN,
+// as stored in a hint block.
+func ndxmaxfree(dd *Dirdata_t) int {
+	m := 0
+	for off := 0; off < BSIZE && dd.Valid(off); off += dd.Reclen(off) {
+		if dd.Namelen(off) == 0 && dd.Reclen(off) > m {
+			m = dd.Reclen(off)
+		}
+	}
+	return util.Min(m/DIRALIGN, NDXHINTMAX)
+}
+
+// reports whether a record starts at byte off of directory block dd.
+func ndxisrec(dd *Dirdata_t, off int) bool {
+	for o := 0; o < BSIZE && dd.Valid(o); o += dd.Reclen(o) {
+		if o >= off {
+			return o == off
+		}
+	}
+	return false
+}
+
+// reports whether the directory has an index.
+func (idm *imemnode_t) _ndxbuilt() bool {
+	return idm.diridx != DIRIDX_NONE && idm.diridx != DIRIDX_EMPTY
+}
+
+// reports whether the index has an entry for name.
+func (idm *imemnode_t) _ndxindexed(name ustr.Ustr) bool {
+	return idm._ndxbuilt() && !name.Isdot() && !name.Isdotdot()
+}
+
+// indexes the names and free space of a directory that is about to outgrow its
+// first block. on failure, the directory is left without index blocks.
+func (idm *imemnode_t) _ndxbuild(opid opid_t) defs.Err_t {
+	blkno, err := idm.fs.balloc.Balloc(opid)
+	if err != 0 {
+		return err
+	}
+	// written to the log by iupdate()
+	idm.diridx = blkno
+	var des []*icdent_t
+	_, err = idm._descan(opid, func(fn ustr.Ustr, de *icdent_t) bool {
+		if len(fn) != 0 && idm._ndxindexed(fn) {
+			des = append(des, de)
+		}
+		return false
+	})
+	for _, de := range des {
+		if err != 0 {
+			break
+		}
+		if err = idm._ndxprepare(opid, de.name); err == 0 {
+			idm._ndxinsert(opid, de.name, de.offset)
+		}
+	}
+	if err != 0 {
+		for !idm._ndxfree(opid, map[int]bool{}, MaxBlkPerOp) {
+		}
+		idm.diridx = DIRIDX_EMPTY
+		return err
+	}
+	for off := 0; off < idm.size; off += BSIZE {
+		b, err := idm.off2buf(opid, off, BSIZE, false, true, "_ndxbuild")
+		if err != 0 {
+			// the hint stays unknown
+			continue
+		}
+		idm._ndxhint(opid, off, &Dirdata_t{b.Data[:]})
+		b.Unlock()
+		idm.fs.fslog.Relse(b, "_ndxbuild")
+	}
+	return 0
+}
+
+// returns the index root, or nil if the directory has no index.
+func (idm *imemnode_t) _ndxroot() *Bdev_block_t {
+	if !idm._ndxbuilt() {
+		return nil
+	}
+	return idm.mbread(idm.diridx)
+}
+
+// returns the first block of the chain starting at blkno that has room for
+// another entry, or 0 and the last block of the chain if there is none.
+func (idm *imemnode_t) _ndxroom(blkno int) (int, int) {
+	last := 0
+	for blkno != 0 {
+		b := idm.mbread(blkno)
+		n := util.Readn(b.Data[:], 8, 8)
+		next := util.Readn(b.Data[:], 8, 0)
+		idm.fs.fslog.Relse(b, "_ndxroom")
+		if n < NDXENTS {
+			return blkno, 0
+		}
+		last = blkno
+		blkno = next
+	}
+	return 0, last
+}
+
+// makes sure that the index can take an entry for name without allocating
+// blocks, so that the insert itself cannot fail.
+func (idm *imemnode_t) _ndxprepare(opid opid_t, name ustr.Ustr) defs.Err_t {
+	if !idm._ndxindexed(name) {
+		return 0
+	}
+	root := idm._ndxroot()
+	defer idm.fs.fslog.Relse(root, "_ndxprepare")
+	h := ndxhash(name)
+	head := util.Readn(root.Data[:], 8, ndxslot(root, h)*8)
+	if head == 0 {
+		// the first bucket of the index
+		blkno, err := idm.fs.balloc.Balloc(opid)
+		if err != 0 {
+			return err
+		}
+		util.Writen(root.Data[:], 8, NDXTABLE*8, blkno)
+		idm.fs.fslog.Write(opid, root)
+		return 0
+	}
+	if room, _ := idm._ndxroom(head); room != 0 {
+		return 0
+	}
+	split, err := idm._ndxsplit(opid, root, head)
+	if err != 0 {
+		return err
+	}
+	if split {
+		head = util.Readn(root.Data[:], 8, ndxslot(root, h)*8)
+	}
+	room, last := idm._ndxroom(head)
+	if room != 0 {
+		return 0
+	}
+	// all entries of the bucket share the hash bits; chain another block
+	blkno, err := idm.fs.balloc.Balloc(opid)
+	if err != 0 {
+		return err
+	}
+	b := idm.mbread(last)
+	util.Writen(b.Data[:], 8, 0, blkno)
+	idm.fs.fslog.Write(opid, b)
+	idm.fs.fslog.Relse(b, "_ndxprepare")
+	return 0
+}
+
+// splits the full bucket head by the next hash bit, doubling the bucket table
+// if necessary. returns false if the bucket cannot be split.
+func (idm *imemnode_t) _ndxsplit(opid opid_t, root *Bdev_block_t, head int) (bool, defs.Err_t) {
+	b := idm.mbread(head)
+	defer idm.fs.fslog.Relse(b, "_ndxsplit")
+	l := util.Readn(b.Data[:], 8, 16)
+	if l >= NDXMAXDEPTH || util.Readn(b.Data[:], 8, 0) != 0 {
+		return false, 0
+	}
+	nblkno, err := idm.fs.balloc.Balloc(opid)
+	if err != 0 {
+		return false, err
+	}
+	g := util.Readn(root.Data[:], 8, NDXDEPTH*8)
+	if l == g {
+		for i := 0; i < 1<<uint(g); i++ {
+			v := util.Readn(root.Data[:], 8, (NDXTABLE+i)*8)
+			util.Writen(root.Data[:], 8, (NDXTABLE+i+1<<uint(g))*8, v)
+		}
+		g++
+		util.Writen(root.Data[:], 8, NDXDEPTH*8, g)
+	}
+	nb := idm.mbread(nblkno)
+	n := util.Readn(b.Data[:], 8, 8)
+	k, m := 0, 0
+	for i := 0; i < n; i++ {
+		h, off := ndxent(b, i)
+		if h&(1<<uint(l)) != 0 {
+			ndxwent(nb, m, h, off)
+			m++
+		} else {
+			ndxwent(b, k, h, off)
+			k++
+		}
+	}
+	for i := k; i < n; i++ {
+		ndxwent(b, i, 0, 0)
+	}
+	util.Writen(b.Data[:], 8, 8, k)
+	util.Writen(b.Data[:], 8, 16, l+1)
+	util.Writen(nb.Data[:], 8, 8, m)
+	util.Writen(nb.Data[:], 8, 16, l+1)
+	for i := 0; i < 1<<uint(g); i++ {
+		w := (NDXTABLE + i) * 8
+		if i&(1<<uint(l)) != 0 && util.Readn(root.Data[:], 8, w) == head {
+			util.Writen(root.Data[:], 8, w, nblkno)
+		}
+	}
+	idm.fs.fslog.Write(opid, nb)
+	idm.fs.fslog.Relse(nb, "_ndxsplit")
+	idm.fs.fslog.Write(opid, b)
+	idm.fs.fslog.Write(opid, root)
+	return true, 0
+}
+
+// returns the first block of the bucket of hash h, or 0.
+func (idm *imemnode_t) _ndxbucket(h int) int {
+	root := idm._ndxroot()
+	if root == nil {
+		return 0
+	}
+	head := util.Readn(root.Data[:], 8, ndxslot(root, h)*8)
+	idm.fs.fslog.Relse(root, "_ndxbucket")
+	return head
+}
+
+// records that name's record is at directory offset off. the caller has
+// called _ndxprepare.
+func (idm *imemnode_t) _ndxinsert(opid opid_t, name ustr.Ustr, off int) {
+	if !idm._ndxindexed(name) {
+		return
+	}
+	h := ndxhash(name)
+	blkno, _ := idm._ndxroom(idm._ndxbucket(h))
+	if blkno == 0 {
+		panic("not prepared")
+	}
+	b := idm.mbread(blkno)
+	n := util.Readn(b.Data[:], 8, 8)
+	ndxwent(b, n, h, off)
+	util.Writen(b.Data[:], 8, 8, n+1)
+	idm.fs.fslog.Write(opid, b)
+	idm.fs.fslog.Relse(b, "_ndxinsert")
+}
+
+// removes the entry for name's record at directory offset off.
+func (idm *imemnode_t) _ndxremove(opid opid_t, name ustr.Ustr, off int) {
+	if !idm._ndxindexed(name) {
+		return
+	}
+	h := ndxhash(name)
+	for blkno := idm._ndxbucket(h); blkno != 0; {
+		b := idm.mbread(blkno)
+		n := util.Readn(b.Data[:], 8, 8)
+		for i := 0; i < n; i++ {
+			if eh, eoff := ndxent(b, i); eh != h || eoff != off {
+				continue
+			}
+			// move the last entry into the hole
+			lh, loff := ndxent(b, n-1)
+			ndxwent(b, i, lh, loff)
+			ndxwent(b, n-1, 0, 0)
+			util.Writen(b.Data[:], 8, 8, n-1)
+			idm.fs.fslog.Write(opid, b)
+			idm.fs.fslog.Relse(b, "_ndxremove")
+			return
+		}
+		blkno = util.Readn(b.Data[:], 8, 0)
+		idm.fs.fslog.Relse(b, "_ndxremove")
+	}
+}
+
+// looks name up in the index. entries are only hints: the record they point
+// to is checked, so stale entries are skipped.
+func (idm *imemnode_t) _ndxlookup(opid opid_t, name ustr.Ustr) (*icdent_t, defs.Err_t) {
+	var zi *icdent_t
+	h := ndxhash(name)
+	for blkno := idm._ndxbucket(h); blkno != 0; {
+		b := idm.mbread(blkno)
+		n := util.Readn(b.Data[:], 8, 8)
+		var offs []int
+		for i := 0; i < n; i++ {
+			if eh, eoff := ndxent(b, i); eh == h {
+				offs = append(offs, eoff)
+			}
+		}
+		blkno = util.Readn(b.Data[:], 8, 0)
+		idm.fs.fslog.Relse(b, "_ndxlookup")
+		for _, off := range offs {
+			de, err := idm._ndxcheck(opid, name, off)
+			if err != 0 || de != nil {
+				return de, err
+			}
+		}
+	}
+	return zi, -defs.ENOENT
+}
+
+// returns the entry for name if its record is at directory offset off.
+func (idm *imemnode_t) _ndxcheck(opid opid_t, name ustr.Ustr, off int) (*icdent_t, defs.Err_t) {
+	var zi *icdent_t
+	if off >= idm.size || off%DIRALIGN != 0 {
+		return zi, 0
+	}
+	b, err := idm.off2buf(opid, off-off%BSIZE, BSIZE, false, true, "_ndxcheck")
+	if err != 0 {
+		return zi, err
+	}
+	defer idm.fs.fslog.Relse(b, "_ndxcheck")
+	defer b.Unlock()
+	dd := &Dirdata_t{b.Data[:]}
+	boff := off % BSIZE
+	if !ndxisrec(dd, boff) || !dd.Filename(boff).Eq(name) {
+		return zi, 0
+	}
+	return &icdent_t{offset: off, reclen: dd.Reclen(boff),
+		inum: dd.inodenext(boff), dtype: dd.Dtype(boff), name: name}, 0
+}
+
+// records the free space of directory block dd at directory offset blkoff.
+// best effort: if the hint block is missing and cannot be allocated, the
+// block's free space stays unknown.
+func (idm *imemnode_t) _ndxhint(opid opid_t, blkoff int, dd *Dirdata_t) {
+	root := idm._ndxroot()
+	if root == nil {
+		return
+	}
+	defer idm.fs.fslog.Relse(root, "_ndxhint")
+	bn := blkoff / BSIZE
+	slot := bn / BSIZE
+	if slot >= NDXHINT {
+		return
+	}
+	hint := ndxmaxfree(dd)
+	hblkno := util.Readn(root.Data[:], 8, slot*8)
+	if hblkno == 0 {
+		var err defs.Err_t
+		hblkno, err = idm.fs.balloc.Balloc(opid)
+		if err != 0 {
+			return
+		}
+		hb := idm.mbread(hblkno)
+		idm._ndxhintinit(hb, slot, bn)
+		idm.fs.fslog.Write(opid, hb)
+		idm.fs.fslog.Relse(hb, "_ndxhint")
+		util.Writen(root.Data[:], 8, slot*8, hblkno)
+		idm.fs.fslog.Write(opid, root)
+	}
+	hb := idm.mbread(hblkno)
+	if int(hb.Data[bn%BSIZE]) != hint {
+		hb.Data[bn%BSIZE] = uint8(hint)
+		idm.fs.fslog.Write(opid, hb)
+	}
+	idm.fs.fslog.Relse(hb, "_ndxhint")
+}
+
+// fills a new hint block from the existing directory blocks that it covers,
+// except block skip, which the caller is about to record.
+func (idm *imemnode_t) _ndxhintinit(hb *Bdev_block_t, slot, skip int) {
+	for i := 0; i < BSIZE; i++ {
+		bn := slot*BSIZE + i
+		if bn*BSIZE >= idm.size {
+			break
+		}
+		if bn == skip {
+			continue
+		}
+		b, err := idm.off2buf(opid_t(0), bn*BSIZE, BSIZE, false, true, "_ndxhintinit")
+		if err != 0 {
+			// unknown free space reads as none
+			continue
+		}
+		hb.Data[i] = uint8(ndxmaxfree(&Dirdata_t{b.Data[:]}))
+		b.Unlock()
+		idm.fs.fslog.Relse(b, "_ndxhintinit")
+	}
+}
+
+// finds a free record of at least need bytes using the hint blocks. blocks
+// without hints are searched directly. returns the offset and length of the
+// record, or ok false if the directory has none.
+func (idm *imemnode_t) _ndxfindfree(opid opid_t, need int) (int, int, bool, defs.Err_t) {
+	root := idm._ndxroot()
+	nblk := idm.size / BSIZE
+	var hints [NDXHINT]int
+	if root != nil {
+		for i := range hints {
+			hints[i] = util.Readn(root.Data[:], 8, i*8)
+		}
+		idm.fs.fslog.Relse(root, "_ndxfindfree")
+	}
+	for slot := 0; slot < NDXHINT && slot*BSIZE < nblk; slot++ {
+		var hb *Bdev_block_t
+		if hints[slot] != 0 {
+			hb = idm.mbread(hints[slot])
+		}
+		for i := 0; i < BSIZE && slot*BSIZE+i < nblk; i++ {
+			if hb != nil && int(hb.Data[i])*DIRALIGN < need {
+				continue
+			}
+			blkoff := (slot*BSIZE + i) * BSIZE
+			off, reclen, err := idm._ndxfit(opid, blkoff, need)
+			if err != 0 {
+				if hb != nil {
+					idm.fs.fslog.Relse(hb, "_ndxfindfree")
+				}
+				return 0, 0, false, err
+			}
+			if reclen != 0 {
+				if hb != nil {
+					idm.fs.fslog.Relse(hb, "_ndxfindfree")
+				}
+				return off, reclen, true, 0
+			}
+		}
+		if hb != nil {
+			idm.fs.fslog.Relse(hb, "_ndxfindfree")
+		}
+	}
+	return 0, 0, false, 0
+}
+
+// returns the first free record of at least need bytes in the directory block
+// at directory offset blkoff, or a zero length if there is none.
+func (idm *imemnode_t) _ndxfit(opid opid_t, blkoff, need int) (int, int, defs.Err_t) {
+	b, err := idm.off2buf(opid, blkoff, BSIZE, false, true, "_ndxfit")
+	if err != 0 {
+		return 0, 0, err
+	}
+	defer idm.fs.fslog.Relse(b, "_ndxfit")
+	defer b.Unlock()
+	dd := &Dirdata_t{b.Data[:]}
+	for off := 0; off < BSIZE; off += dd.Reclen(off) {
+		if !dd.Valid(off) {
+			fmt.Printf("dir %v: bad record at %v\n", idm.inum, blkoff+off)
+			return 0, 0, -defs.EIO
+		}
+		if dd.Namelen(off) == 0 && dd.Reclen(off) >= need {
+			idm.dentc.freel.remove(blkoff + off)
+			return blkoff + off, dd.Reclen(off), 0
+		}
+	}
+	return 0, 0, 0
+}
+
+// frees the index blocks of a directory that is being freed. distinct holds
+// the numbers of the blocks that the operation writes; this stops once it
+// holds max of them. the progress is recorded in the root itself, so that a
+// crash in between resumes where it stopped. returns true once the whole
+// index has been freed.
+func (idm *imemnode_t) _ndxfree(opid opid_t, distinct map[int]bool, max int) bool {
+	root := idm._ndxroot()
+	if root == nil {
+		return true
+	}
+	// the root is written, unless it is freed below
+	distinct[idm.diridx] = true
+	word := func(i int) int {
+		return util.Readn(root.Data[:], 8, i*8)
+	}
+	dirty := false
+	for slot := 0; slot < NDXSLOTS && len(distinct) < max; slot++ {
+		if slot == NDXDEPTH {
+			continue
+		}
+		for len(distinct) < max && word(slot) != 0 {
+			blkno := word(slot)
+			next := 0
+			if slot >= NDXTABLE {
+				b := idm.mbread(blkno)
+				next = util.Readn(b.Data[:], 8, 0)
+				idm.fs.fslog.Relse(b, "_ndxfree")
+			}
+			idm.fs.balloc.Bfree(opid, blkno)
+			distinct[idm.fs.balloc.mapblock(blkno)] = true
+			// buckets may be in several slots of the table
+			for i := slot; i < NDXSLOTS; i++ {
+				if i != NDXDEPTH && word(i) == blkno {
+					util.Writen(root.Data[:], 8, i*8, next)
+				}
+			}
+			dirty = true
+		}
+	}
+	for slot := 0; slot < NDXSLOTS; slot++ {
+		if slot != NDXDEPTH && word(slot) != 0 {
+			if dirty {
+				idm.fs.fslog.Write(opid, root)
+			}
+			idm.fs.fslog.Relse(root, "_ndxfree")
+			return false
+		}
+	}
+	idm.fs.fslog.Relse(root, "_ndxfree")
+	idm.fs.balloc.Bfree(opid, idm.diridx)
+	distinct[idm.fs.balloc.mapblock(idm.diridx)] = true
+	// written by the caller with the rest of the inode
+	idm.diridx = DIRIDX_NONE
+	return true
+}
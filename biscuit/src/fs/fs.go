@@ -6,6 +6,7 @@ import "sync"
 import "bounds"
 import "bpath"
 import "defs"
+import "dev"
 import "fd"
 import "fdops"
 import "limits"
@@ -63,7 +64,10 @@ func StartFS(mem Blockmem_i, disk Disk_i, console proc.Cons_i, diskfs bool) (*fd
 
 	// find the first fs block; the build system installs it in block 0 for
 	// us
-	b := fs.bcache.Get_fill(0, "fsoff", false)
+	b, err := fs.bcache.Get_fill(0, "fsoff", false)
+	if err != 0 {
+		panic("cannot read fs offset")
+	}
 	fs.superb_start = util.Readn(b.Data[:], 4, FSOFF)
 	//fmt.Printf("fs.superb_start %v\n", fs.superb_start)
 	if fs.superb_start <= 0 {
@@ -72,7 +76,10 @@ func StartFS(mem Blockmem_i, disk Disk_i, console proc.Cons_i, diskfs bool) (*fd
 	fs.bcache.Relse(b, "fs_init")
 
 	// superblock is never changed, so reading before recovery is fine
-	b = fs.bcache.Get_fill(fs.superb_start, "super", false) // don't relse b, because superb is global
+	b, err = fs.bcache.Get_fill(fs.superb_start, "super", false) // don't relse b, because superb is global
+	if err != 0 {
+		panic("cannot read superblock")
+	}
 
 	fs.superb = Superblock_t{b.Data}
 
@@ -110,16 +117,34 @@ func StartFS(mem Blockmem_i, disk Disk_i, console proc.Cons_i, diskfs bool) (*fd
 
 	fs.root = fs.icache.Iref(iroot, "fs_namei_root")
 
+	// the blocks of an in-memory file system are its only copy
+	if fs.diskfs {
+		fs.bcache.cache.startEvictor()
+		fs.icache.cache.startEvictor()
+	}
+
 	return &fd.Fd_t{Fops: &fsfops_t{priv: iroot, fs: fs, count: 1}}, fs
 }
 
+// returns EROFS for operations that change the file system once the disk has
+// failed and the log has stopped writing.
+func (fs *Fs_t) rdonly() defs.Err_t {
+	if fs.fslog.Err() != 0 {
+		return -defs.EROFS
+	}
+	return 0
+}
+
 // /       Sizes returns the number of cached inodes and blocks.
 func (fs *Fs_t) Sizes() (int, int) {
 	return fs.icache.cache.Len(), fs.bcache.cache.Len()
 }
 
-// /       StopFS shuts down the log associated with the filesystem.
+// /       StopFS stops evicting in the background and shuts down the log
+// /       associated with the filesystem.
 func (fs *Fs_t) StopFS() {
+	fs.icache.cache.stopEvictor()
+	fs.bcache.cache.stopEvictor()
 	fs.fslog.StopLog()
 }
 
@@ -128,6 +153,22 @@ func (fs *Fs_t) Fs_size() (uint, uint) {
 	return fs.ialloc.alloc.nfreebits, fs.balloc.alloc.nfreebits
 }
 
+// /       Statfs fills st with the block size, the number of data blocks and
+// /       inodes and how many of them are free, the maximum name length and the
+// /       log size.
+func (fs *Fs_t) Statfs(st *stat.Statfs_t) {
+	ifree, bfree := fs.Fs_size()
+	st.Wbsize(uint(BSIZE))
+	st.Wblocks(uint(fs.superb.Lastblock() - fs.balloc.first))
+	st.Wbfree(bfree)
+	// no blocks are reserved for the superuser
+	st.Wbavail(bfree)
+	st.Wfiles(uint(fs.ialloc.maxinode))
+	st.Wffree(ifree)
+	st.Wnamelen(uint(NAME_MAX))
+	st.Wloglen(uint(fs.superb.Loglen()))
+}
+
 // /       IrefRoot increments the reference count on the root inode.
 func (fs *Fs_t) IrefRoot() *imemnode_t {
 	r := fs.root
@@ -150,6 +191,9 @@ func (fs *Fs_t) Unpin(pa mem.Pa_t) {
 // /       Fs_op_link performs the actual filesystem link operation and returns any
 // /       inodes that must be freed by the caller.
 func (fs *Fs_t) Fs_op_link(old ustr.Ustr, new ustr.Ustr, cwd *fd.Cwd_t) ([]*imemnode_t, defs.Err_t) {
+	if err := fs.rdonly(); err != 0 {
+		return nil, err
+	}
 	opid := fs.fslog.Op_begin("Fs_link")
 	defer fs.fslog.Op_end(opid)
 
@@ -173,7 +217,7 @@ func (fs *Fs_t) Fs_op_link(old ustr.Ustr, new ustr.Ustr, cwd *fd.Cwd_t) ([]*imem
 		}
 		return deads, -defs.EINVAL
 	}
-	inum := orig.inum
+	inum, itype := orig.inum, orig.itype
 	orig._linkup(opid)
 	orig.iunlock("fs_link_orig")
 
@@ -185,7 +229,10 @@ func (fs *Fs_t) Fs_op_link(old ustr.Ustr, new ustr.Ustr, cwd *fd.Cwd_t) ([]*imem
 		}
 		goto undo
 	}
-	err = newd.do_insert(opid, fn, inum)
+	err = newd.iaccess(&cwd.Cred, A_WRITE|A_EXEC)
+	if err == 0 {
+		err = newd.do_insert(opid, fn, inum, itype)
+	}
 	newd.iunlock_refdown("fs_link_newd")
 	if err != 0 {
 		goto undo
@@ -214,6 +261,9 @@ func (fs *Fs_t) Fs_link(old ustr.Ustr, new ustr.Ustr, cwd *fd.Cwd_t) defs.Err_t
 
 // /       Fs_op_unlink performs the unlink operation and returns a possibly dead inode.
 func (fs *Fs_t) Fs_op_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, wantdir bool) (*imemnode_t, defs.Err_t) {
+	if err := fs.rdonly(); err != 0 {
+		return nil, err
+	}
 	opid := fs.fslog.Op_begin("fs_unlink")
 	defer fs.fslog.Op_end(opid)
 
@@ -234,7 +284,7 @@ func (fs *Fs_t) Fs_op_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, wantdir bool) (*ime
 
 	par, dead, err := fs.fs_namei_locked(opid, dirs, cwd, "fs_unlink_par")
 	if err != 0 {
-		return dead, err
+		return dead, cwd.Mnt.Dirs(err, fn)
 	}
 	child, err = par.ilookup(opid, fn)
 	if err != 0 {
@@ -266,7 +316,16 @@ func (fs *Fs_t) Fs_op_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, wantdir bool) (*ime
 
 	}
 
-	err = child.do_dirchk(opid, wantdir)
+	err = par.iaccess(&cwd.Cred, A_WRITE|A_EXEC)
+	if err == 0 {
+		err = par.isticky(&cwd.Cred, child)
+	}
+	if err == 0 && cwd.Mnt.Mntpt(child.inum) {
+		err = -defs.EBUSY
+	}
+	if err == 0 {
+		err = child.do_dirchk(opid, wantdir)
+	}
 	if err != 0 {
 		del := child.iunlock_refdown("fs_unlink_child")
 		if del {
@@ -321,6 +380,9 @@ func (fs *Fs_t) Fs_op_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) ([]*imemnode_t
 		return refs, nil, err
 	}
 
+	if err := fs.rdonly(); err != 0 {
+		return refs, nil, err
+	}
 	opid := fs.fslog.Op_begin("fs_rename")
 	defer fs.fslog.Op_end(opid)
 
@@ -347,6 +409,12 @@ func (fs *Fs_t) Fs_op_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) ([]*imemnode_t
 	// unlock par after we have ref to child
 	opar.iunlock("fs_rename_par")
 
+	if err = fs._mntbusy(opid, ochild, cwd.Mnt); err != 0 {
+		opar.Refdown("fs_rename_opar")
+		ochild.Refdown("fs_rename_ochild")
+		return refs, nil, err
+	}
+
 	npar, dead, err := fs.fs_namei_locked(opid, ndirs, cwd, "")
 	if err != 0 {
 		return []*imemnode_t{opar, ochild}, dead, err
@@ -454,6 +522,33 @@ func (fs *Fs_t) Fs_op_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) ([]*imemnode_t
 		}
 	}
 
+	// a mount point cannot be replaced
+	if nchild != nil && cwd.Mnt.Mntpt(nchild.inum) {
+		return refs, nil, -defs.EBUSY
+	}
+
+	// both parents are modified. moving a directory to a new parent also
+	// modifies the directory's "..".
+	cred := &cwd.Cred
+	for _, par := range []*imemnode_t{opar, npar} {
+		if err := par.iaccess(cred, A_WRITE|A_EXEC); err != 0 {
+			return refs, nil, err
+		}
+	}
+	if err := opar.isticky(cred, ochild); err != 0 {
+		return refs, nil, err
+	}
+	if nchild != nil {
+		if err := npar.isticky(cred, nchild); err != 0 {
+			return refs, nil, err
+		}
+	}
+	if ochild.itype == I_DIR && opar != npar {
+		if err := ochild.iaccess(cred, A_WRITE); err != 0 {
+			return refs, nil, err
+		}
+	}
+
 	// if src and dst are the same file, we are done
 	if nchild != nil && ochild.inum == nchild.inum {
 		return refs, nil, 0
@@ -461,7 +556,7 @@ func (fs *Fs_t) Fs_op_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) ([]*imemnode_t
 
 	// guarantee that any page allocations will succeed before starting the
 	// operation, which will be messy to piece-wise undo.
-	b1, err := npar.probe_insert(opid)
+	b1, err := npar.probe_insert(opid, nfn)
 	if err != 0 {
 		return refs, nil, err
 	}
@@ -501,17 +596,21 @@ func (fs *Fs_t) Fs_op_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) ([]*imemnode_t
 	if opar.do_unlink(opid, ofn) != 0 {
 		panic("probed")
 	}
-	if npar.do_insert(opid, nfn, ochild.inum) != 0 {
+	if npar.do_insert(opid, nfn, ochild.inum, ochild.itype) != 0 {
 		panic("probed")
 	}
 
+	// the rename changes ochild's status, even if only its name moved
+	ochild.ctime = now()
+	ochild._iupdate(opid)
+
 	// update '..'
 	if odir {
 		dotdot := ustr.DotDot
 		if ochild.do_unlink(opid, dotdot) != 0 {
 			panic("probed")
 		}
-		if ochild.do_insert(opid, dotdot, npar.inum) != 0 {
+		if ochild.do_insert(opid, dotdot, npar.inum, I_DIR) != 0 {
 			panic("insert after unlink must succeed")
 		}
 	}
@@ -533,6 +632,33 @@ func (fs *Fs_t) Fs_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) defs.Err_t {
 	return err
 }
 
+// returns EBUSY if ochild, which is reffed but not locked, is a mount point or
+// a directory that holds one, since the mount table names mounts by the path
+// of their mount point.
+func (fs *Fs_t) _mntbusy(opid opid_t, ochild *imemnode_t, mw *fd.Mntwalk_t) defs.Err_t {
+	if mw.Mntpt(ochild.inum) {
+		return -defs.EBUSY
+	}
+	if mw == nil || ochild.itype != I_DIR {
+		return 0
+	}
+	for inum := range mw.Mntpts {
+		mp := fs.icache.Iref(inum, "_mntbusy")
+		mp.ilock("_mntbusy")
+		// _isancestor unlocks mp
+		err := fs._isancestor(opid, ochild, mp)
+		if mp.Refdown("_mntbusy") {
+			panic("mount point unlinked")
+		}
+		if err == -defs.EINVAL {
+			return -defs.EBUSY
+		} else if err != 0 {
+			return err
+		}
+	}
+	return 0
+}
+
 // returns an error if anc is an ancestor directory of directory start. anc and
 // start are reffed, but only start is locked. _isancestor unlocks start before
 // returning.
@@ -649,6 +775,9 @@ func (fo *fsfops_t) _write(src fdops.Userio_i, toff int) (int, defs.Err_t) {
 	if fo.count <= 0 {
 		return 0, -defs.EBADF
 	}
+	if err := fo.fs.rdonly(); err != 0 {
+		return 0, err
+	}
 
 	useoffset := toff != -1
 	offset := fo.offset
@@ -685,6 +814,9 @@ func (fo *fsfops_t) Truncate(newlen uint) defs.Err_t {
 		return -defs.EBADF
 	}
 
+	if err := fo.fs.rdonly(); err != 0 {
+		return err
+	}
 	opid := fo.fs.fslog.Op_begin("truncate")
 	defer fo.fs.fslog.Op_end(opid)
 
@@ -702,6 +834,52 @@ func (fo *fsfops_t) Pwrite(src fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return fo._write(src, offset)
 }
 
+func (fo *fsfops_t) Getdents(dst fdops.Userio_i) (int, defs.Err_t) {
+	// lock the file to prevent races on offset and closing
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return 0, -defs.EBADF
+	}
+
+	idm := fo.fs.icache.Iref_locked(fo.priv, "getdents")
+	did, off, err := idm.do_getdents(dst, fo.offset)
+	if err == 0 {
+		fo.offset = off
+	}
+	idm.iunlock_refdown("getdents")
+	return did, err
+}
+
+func (fo *fsfops_t) Fsync(datasync bool) defs.Err_t {
+	fo.Lock()
+	if fo.count <= 0 {
+		fo.Unlock()
+		return -defs.EBADF
+	}
+	idm := fo.fs.icache.Iref(fo.priv, "fsync")
+	fo.Unlock()
+	// don't hold the fd's lock while waiting for the disk
+	err := idm.do_fsync(datasync)
+	idm.Refdown("fsync")
+	return err
+}
+
+func (fo *fsfops_t) Fallocate(mode, off, len int) defs.Err_t {
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return -defs.EBADF
+	}
+	if err := fo.fs.rdonly(); err != 0 {
+		return err
+	}
+	idm := fo.fs.icache.Iref(fo.priv, "fallocate")
+	err := idm.do_fallocate(mode, off, len)
+	idm.Refdown("fallocate")
+	return err
+}
+
 // caller holds fo lock
 func (fo *fsfops_t) fstat(st *stat.Stat_t) defs.Err_t {
 	if fs_debug {
@@ -804,6 +982,19 @@ func (fo *fsfops_t) Mmapi(offset, len int, inc bool) ([]mem.Mmapinfo_t, defs.Err
 
 	idm := fo.fs.icache.Iref_locked(fo.priv, "mmapi")
 	mmi, err := idm.do_mmapi(offset, len, inc)
+	if err == -defs.EAGAIN {
+		// the range has holes; back them with blocks and try again
+		end := idm.size
+		if len != -1 && offset+len < end {
+			end = offset + len
+		}
+		idm.iunlock("mmapi")
+		err = idm.iprealloc(offset, end, false)
+		idm.ilock("mmapi")
+		if err == 0 {
+			mmi, err = idm.do_mmapi(offset, len, inc)
+		}
+	}
 	idm.iunlock_refdown("mmapi")
 
 	fo.Unlock()
@@ -857,24 +1048,61 @@ func (fo *fsfops_t) Shutdown(read, write bool) defs.Err_t {
 	return -defs.ENOTSOCK
 }
 
-// /       Devfops_t identifies a special device handled by the filesystem.
+// /       Devfops_t is an open console, null, zero, stat or prof device.
 type Devfops_t struct {
 	Maj int
 	Min int
 }
 
+// registers the drivers of the devices that Devfops_t implements and adds
+// their device files
+func init() {
+	mkdevfops("console", dev.D_CONSOLE, "console")
+	mkdevfops("null", dev.D_DEVNULL, "null")
+	mkdevfops("zero", dev.D_ZERO, "zero")
+	mkdevfops("stat", dev.D_STAT, "stats")
+	mkdevfops("prof", dev.D_PROF, "prof")
+}
+
+// registers the driver name with major maj, which opens its devices as
+// Devfops_t, and adds its only device as the file node.
+func mkdevfops(name string, maj int, node string) {
+	dev.RegisterAt(name, maj, devopen)
+	if _, err := dev.Add(node, maj); err != 0 {
+		panic("dev add failed")
+	}
+}
+
+func devopen(maj, min int) (fdops.Fdops_i, defs.Err_t) {
+	if maj == dev.D_STAT {
+		stats_string = ""
+		if Devstats != nil {
+			stats_string = Devstats()
+		}
+	}
+	return &Devfops_t{Maj: maj, Min: min}, 0
+}
+
+// /       Console returns fops for the console.
+func Console() *Devfops_t {
+	return &Devfops_t{Maj: dev.D_CONSOLE, Min: 0}
+}
+
 func (df *Devfops_t) _sane() {
-	// make sure this maj/min pair is handled by Devfops_t. to handle more
-	// devices, we can either do dispatch in Devfops_t or we can return
-	// device-specific fdops.Fdops_i in fs_open()
-	if df.Maj != defs.D_CONSOLE && df.Maj != defs.D_DEVNULL &&
-		df.Maj != defs.D_STAT && df.Maj != defs.D_PROF {
+	// make sure this maj/min pair is handled by Devfops_t. devices that
+	// need per-open state, like the raw disk, have their own fops
+	if df.Maj != dev.D_CONSOLE && df.Maj != dev.D_DEVNULL && df.Maj != dev.D_ZERO &&
+		df.Maj != dev.D_STAT && df.Maj != dev.D_PROF {
 		panic("bad dev")
 	}
 }
 
 var stats_string = ""
 
+// /       Devstats, if set, returns the statistics that reading the stat
+// /       device shows.
+var Devstats func() string
+
 func stat_read(ub fdops.Userio_i, offset int) (int, defs.Err_t) {
 	sz := ub.Remain()
 	s := stats_string
@@ -978,20 +1206,37 @@ func _prof_read(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 
 func (df *Devfops_t) Read(dst fdops.Userio_i) (int, defs.Err_t) {
 	df._sane()
-	if df.Maj == defs.D_CONSOLE {
+	if df.Maj == dev.D_CONSOLE {
 		return cons.Cons_read(dst, 0)
-	} else if df.Maj == defs.D_STAT {
+	} else if df.Maj == dev.D_STAT {
 		return stat_read(dst, 0)
-	} else if df.Maj == defs.D_PROF {
+	} else if df.Maj == dev.D_PROF {
 		return _prof_read(dst, 0)
+	} else if df.Maj == dev.D_ZERO {
+		return zero_read(dst)
 	} else {
 		return 0, 0
 	}
 }
 
+var zeros = make([]uint8, 512)
+
+// fills dst with zeros
+func zero_read(dst fdops.Userio_i) (int, defs.Err_t) {
+	did := 0
+	for dst.Remain() > 0 {
+		c, err := dst.Uiowrite(zeros)
+		did += c
+		if err != 0 {
+			return did, err
+		}
+	}
+	return did, 0
+}
+
 func (df *Devfops_t) Write(src fdops.Userio_i) (int, defs.Err_t) {
 	df._sane()
-	if df.Maj == defs.D_CONSOLE {
+	if df.Maj == dev.D_CONSOLE {
 		return cons.Cons_write(src, 0)
 	} else {
 		return src.Totalsz(), 0
@@ -1012,6 +1257,21 @@ func (df *Devfops_t) Pwrite(src fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
 
+func (df *Devfops_t) Getdents(fdops.Userio_i) (int, defs.Err_t) {
+	df._sane()
+	return 0, -defs.ENOTDIR
+}
+
+func (df *Devfops_t) Fsync(bool) defs.Err_t {
+	df._sane()
+	return -defs.EINVAL
+}
+
+func (df *Devfops_t) Fallocate(int, int, int) defs.Err_t {
+	df._sane()
+	return -defs.ENODEV
+}
+
 func (df *Devfops_t) Fstat(st *stat.Stat_t) defs.Err_t {
 	df._sane()
 	st.Wmode(defs.Mkdev(df.Maj, df.Min))
@@ -1071,12 +1331,12 @@ func (df *Devfops_t) Recvmsg(fdops.Userio_i,
 
 func (df *Devfops_t) Pollone(pm fdops.Pollmsg_t) (fdops.Ready_t, defs.Err_t) {
 	switch df.Maj {
-	case defs.D_CONSOLE:
+	case dev.D_CONSOLE:
 		return cons.Cons_poll(pm)
-	case defs.D_PROF:
+	case dev.D_PROF, dev.D_STAT:
 		// XXX
 		return pm.Events & fdops.R_READ, 0
-	case defs.D_DEVNULL:
+	case dev.D_DEVNULL, dev.D_ZERO:
 		return pm.Events & (fdops.R_READ | fdops.R_WRITE), 0
 	default:
 		panic("which dev")
@@ -1100,8 +1360,17 @@ func (df *Devfops_t) Shutdown(read, write bool) defs.Err_t {
 	return -defs.ENOTSOCK
 }
 
+// /       Rawdisk returns fops that read and write the disk that holds the
+// /       file system as the raw disk device with major maj and minor min.
+// /       They go through the log and the block cache so that they agree
+// /       with the file system.
+func (fs *Fs_t) Rawdisk(maj, min int) fdops.Fdops_i {
+	return &rawdfops_t{major: maj, minor: min, fs: fs}
+}
+
 type rawdfops_t struct {
 	sync.Mutex
+	major  int
 	minor  int
 	offset int
 	fs     *Fs_t
@@ -1113,7 +1382,11 @@ func (raw *rawdfops_t) Read(dst fdops.Userio_i) (int, defs.Err_t) {
 	var did int
 	for dst.Remain() != 0 {
 		blkno := raw.offset / BSIZE
-		b := raw.fs.fslog.Get_fill(blkno, "read", false)
+		b, err := raw.fs.fslog.Get_fill(blkno, "read", false)
+		if err != 0 {
+			raw.fs.fslog.Relse(b, "read")
+			return did, err
+		}
 		boff := raw.offset % BSIZE
 		c, err := dst.Uiowrite(b.Data[boff:])
 		if err != 0 {
@@ -1139,14 +1412,20 @@ func (raw *rawdfops_t) Write(src fdops.Userio_i) (int, defs.Err_t) {
 			return 0, err
 		}
 		if boff != 0 || src.Remain() < BSIZE {
-			buf.Read()
+			if err := buf.Read(); err != 0 {
+				buf.EvictDone()
+				return did, err
+			}
 		}
 		c, err := src.Uioread(buf.Data[boff:])
 		if err != 0 {
 			buf.EvictDone()
 			return 0, err
 		}
-		buf.Write()
+		if err := buf.Write(); err != 0 {
+			buf.EvictDone()
+			return did, err
+		}
 		raw.offset += c
 		did += c
 		buf.EvictDone()
@@ -1166,10 +1445,23 @@ func (raw *rawdfops_t) Pwrite(src fdops.Userio_i, offset int) (int, defs.Err_t)
 	return 0, -defs.ESPIPE
 }
 
+func (raw *rawdfops_t) Getdents(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.ENOTDIR
+}
+
+func (raw *rawdfops_t) Fsync(bool) defs.Err_t {
+	// writes go straight to the disk
+	return 0
+}
+
+func (raw *rawdfops_t) Fallocate(int, int, int) defs.Err_t {
+	return -defs.ENODEV
+}
+
 func (raw *rawdfops_t) Fstat(st *stat.Stat_t) defs.Err_t {
 	raw.Lock()
 	defer raw.Unlock()
-	st.Wmode(defs.Mkdev(defs.D_RAWDISK, raw.minor))
+	st.Wmode(defs.Mkdev(raw.major, raw.minor))
 	return 0
 }
 
@@ -1273,6 +1565,9 @@ func (fs *Fs_t) Fs_mkdir(paths ustr.Ustr, mode int, cwd *fd.Cwd_t) defs.Err_t {
 // /       Fs_op_mkdir creates a directory and returns references that need dropping
 // /       by the caller.
 func (fs *Fs_t) Fs_op_mkdir(paths ustr.Ustr, mode int, cwd *fd.Cwd_t) ([]*imemnode_t, *imemnode_t, defs.Err_t) {
+	if err := fs.rdonly(); err != 0 {
+		return nil, nil, err
+	}
 	opid := fs.fslog.Op_begin("fs_mkdir")
 	defer fs.fslog.Op_end(opid)
 
@@ -1286,16 +1581,16 @@ func (fs *Fs_t) Fs_op_mkdir(paths ustr.Ustr, mode int, cwd *fd.Cwd_t) ([]*imemno
 	if err, ok := crname(fn, -defs.EINVAL); !ok {
 		return nil, nil, err
 	}
-	if len(fn) > DNAMELEN {
+	if len(fn) > NAME_MAX {
 		return nil, nil, -defs.ENAMETOOLONG
 	}
 
 	par, dead, err := fs.fs_namei_locked(opid, dirs, cwd, "mkdir")
 	if err != 0 {
-		return nil, dead, err
+		return nil, dead, cwd.Mnt.Dirs(err, fn)
 	}
 
-	child, err := par.do_createdir(opid, fn)
+	child, err := par.do_createdir(opid, fn, mode, &cwd.Cred)
 	if err != 0 {
 		par.iunlock("fs_mkdir_par")
 		return []*imemnode_t{par}, nil, err
@@ -1306,10 +1601,10 @@ func (fs *Fs_t) Fs_op_mkdir(paths ustr.Ustr, mode int, cwd *fd.Cwd_t) ([]*imemno
 	child.ilock("")
 	defer child.iunlock("")
 
-	if err = child.do_insert(opid, ustr.MkUstrDot(), child.inum); err != 0 {
+	if err = child.do_insert(opid, ustr.MkUstrDot(), child.inum, I_DIR); err != 0 {
 		goto outunlink
 	}
-	if err = child.do_insert(opid, ustr.DotDot, par.inum); err != 0 {
+	if err = child.do_insert(opid, ustr.DotDot, par.inum, I_DIR); err != 0 {
 		goto outunlink
 	}
 	return []*imemnode_t{par, child}, nil, 0
@@ -1341,11 +1636,25 @@ func (fs *Fs_t) Fs_open_inner(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd
 	return ret, err
 }
 
+// /       Fs_mknod creates the special file paths for the device major and
+// /       minor and returns its inode number.
+func (fs *Fs_t) Fs_mknod(paths ustr.Ustr, flags defs.Fdopt_t, cwd *fd.Cwd_t, major, minor int) (defs.Inum_t, defs.Err_t) {
+	fsf, err := fs.Fs_open_inner(paths, flags|defs.O_CREAT, 0, cwd, major, minor)
+	if err != 0 {
+		return 0, err
+	}
+	if fs.Fs_close(fsf.Inum) != 0 {
+		panic("must succeed")
+	}
+	return fsf.Inum, 0
+}
+
 // returns the file, a dead inode (non-nil only on error) and error
 func (fs *Fs_t) _fs_open_inner(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, major, minor int) (Fsfile_t, *imemnode_t, defs.Err_t) {
 	trunc := flags&defs.O_TRUNC != 0
 	creat := flags&defs.O_CREAT != 0
 	nodir := false
+	created := false
 
 	if fs_debug {
 		fmt.Printf("fs_open: %v %v %v\n", paths, cwd, creat)
@@ -1354,12 +1663,17 @@ func (fs *Fs_t) _fs_open_inner(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cw
 	// open with O_TRUNC is not read-only
 	var opid opid_t
 	if trunc || creat {
+		if err := fs.rdonly(); err != 0 {
+			return Fsfile_t{}, nil, err
+		}
 		opid = fs.fslog.Op_begin("fs_open")
 		defer fs.fslog.Op_end(opid)
 	}
 	var ret Fsfile_t
 	var idm *imemnode_t
-	if creat {
+	// with O_CREAT, a symbolic link in the last component is followed and
+	// its target created if it does not exist, as POSIX requires
+	for nlinks := 0; creat; nlinks++ {
 		nodir = true
 		// creat w/execl; must atomically create and open the new file.
 		isdev := major != 0 || minor != 0
@@ -1370,19 +1684,19 @@ func (fs *Fs_t) _fs_open_inner(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cw
 			return ret, nil, err
 		}
 
-		if len(fn) > DNAMELEN {
+		if len(fn) > NAME_MAX {
 			return ret, nil, -defs.ENAMETOOLONG
 		}
 
 		// with O_CREAT, the file may exist.
 		par, dead, err := fs.fs_namei_locked(opid, dirs, cwd, "Fs_open_inner")
 		if err != 0 {
-			return ret, dead, err
+			return ret, dead, cwd.Mnt.Dirs(err, fn)
 		}
 		if isdev {
-			idm, err = par.do_createnod(opid, fn, major, minor)
+			idm, err = par.do_createnod(opid, fn, major, minor, mode, &cwd.Cred)
 		} else {
-			idm, err = par.do_createfile(opid, fn)
+			idm, err = par.do_createfile(opid, fn, mode, &cwd.Cred)
 		}
 		if err != 0 && err != -defs.EEXIST {
 			// XXX must check dead
@@ -1390,17 +1704,39 @@ func (fs *Fs_t) _fs_open_inner(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cw
 			return ret, nil, err
 		}
 		exists := err == -defs.EEXIST
+		created = !exists
 		par.iunlock_refdown("Fs_open_inner_par")
 		idm.ilock("child")
 
 		oexcl := flags&defs.O_EXCL != 0
-		if exists {
-			if oexcl || isdev {
-				idm.iunlock_refdown("Fs_open_inner2")
-				return ret, nil, -defs.EEXIST
-			}
+		if !exists {
+			break
 		}
-	} else {
+		if oexcl || isdev {
+			idm.iunlock_refdown("Fs_open_inner2")
+			return ret, nil, -defs.EEXIST
+		}
+		if idm.itype != I_SYMLINK {
+			break
+		}
+		// retry the creation at the link's target
+		target, err := idm.ireadlink()
+		if idm.iunlock_refdown("Fs_open_inner_link") {
+			return ret, idm, -defs.ENOENT
+		}
+		idm = nil
+		if err != 0 {
+			return ret, nil, err
+		}
+		if nlinks == MAXSYMLINKS {
+			return ret, nil, -defs.ELOOP
+		}
+		if cwd.Mnt.Follow(paths, fn, target) {
+			return ret, nil, -defs.ECROSS
+		}
+		paths = bpath.Splice(paths, fn, target)
+	}
+	if idm == nil {
 		// open existing file
 		var err defs.Err_t
 		var dead *imemnode_t
@@ -1431,6 +1767,13 @@ func (fs *Fs_t) _fs_open_inner(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cw
 		}
 	}
 
+	// a newly created file is opened regardless of its mode
+	if !created {
+		if err := idm.iaccess(&cwd.Cred, openaccess(flags)); err != 0 {
+			return ret, nil, err
+		}
+	}
+
 	if nodir && trunc {
 		idm.do_trunc(opid, 0)
 	}
@@ -1443,6 +1786,23 @@ func (fs *Fs_t) _fs_open_inner(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cw
 	return ret, nil, 0
 }
 
+// returns the access to a file that open flags require
+func openaccess(flags defs.Fdopt_t) int {
+	var want int
+	switch flags & (defs.O_WRONLY | defs.O_RDWR) {
+	case defs.O_WRONLY:
+		want = A_WRITE
+	case defs.O_RDWR:
+		want = A_READ | A_WRITE
+	default:
+		want = A_READ
+	}
+	if flags&defs.O_TRUNC != 0 {
+		want |= A_WRITE
+	}
+	return want
+}
+
 // /       Makefake returns a dummy file descriptor for testing.
 func (fs *Fs_t) Makefake() *fd.Fd_t {
 	return nil
@@ -1462,9 +1822,6 @@ func (fs *Fs_t) Makefake() *fd.Fd_t {
 	//return ret
 }
 
-// socket files cannot be open(2)'ed (must use connect(2)/sendto(2) etc.)
-var _denyopen = map[int]bool{defs.D_SUD: true, defs.D_SUS: true}
-
 // /       Fs_open opens a path and returns a new file descriptor.
 func (fs *Fs_t) Fs_open(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, major, minor int) (*fd.Fd_t, defs.Err_t) {
 	fs.istats.Nopen.Inc()
@@ -1473,35 +1830,21 @@ func (fs *Fs_t) Fs_open(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.C
 		return nil, err
 	}
 
-	// some special files (sockets) cannot be opened with fops this way
-	if denied := _denyopen[fsf.Major]; denied {
-		if fs.Fs_close(fsf.Inum) != 0 {
-			panic("must succeed")
-		}
-		return nil, -defs.EPERM
-	}
-
 	// convert on-disk file to fd with fops
 	priv := fsf.Inum
-	maj := fsf.Major
-	min := fsf.Minor
 	ret := &fd.Fd_t{}
-	if maj != 0 {
+	if fsf.Major != 0 {
 		// don't need underlying file open
 		if fs.Fs_close(fsf.Inum) != 0 {
 			panic("must succeed")
 		}
-		switch maj {
-		case defs.D_CONSOLE, defs.D_DEVNULL, defs.D_STAT, defs.D_PROF:
-			if maj == defs.D_STAT {
-				stats_string = fs.Fs_statistics()
-			}
-			ret.Fops = &Devfops_t{Maj: maj, Min: min}
-		case defs.D_RAWDISK:
-			ret.Fops = &rawdfops_t{minor: min, fs: fs}
-		default:
-			panic("bad dev")
+		// some special files (sockets) cannot be opened with fops this
+		// way
+		fops, err := dev.Open(fsf.Major, fsf.Minor)
+		if err != 0 {
+			return nil, err
 		}
+		ret.Fops = fops
 	} else {
 		apnd := flags&defs.O_APPEND != 0
 		ret.Fops = &fsfops_t{priv: priv, fs: fs, append: apnd, count: 1}
@@ -1554,16 +1897,236 @@ func (fs *Fs_t) Fs_stat(path ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t) defs.Err
 	return err
 }
 
-// Sync the file system to disk. XXX If Biscuit supported fsync, we could be
-// smarter and flush only the dirty blocks of particular inode.
+// /       Fs_statfs fills st with the statistics of the file system that
+// /       contains path.
+func (fs *Fs_t) Fs_statfs(path ustr.Ustr, st *stat.Statfs_t, cwd *fd.Cwd_t) defs.Err_t {
+	opid := opid_t(0)
+	idm, dead, err := fs.fs_namei_locked(opid, path, cwd, "Fs_statfs")
+	if err != 0 {
+		if dead != nil {
+			dead.Free()
+		}
+		return err
+	}
+	del := idm.iunlock_refdown("Fs_statfs")
+	if del {
+		idm.Free()
+	}
+	fs.Statfs(st)
+	return 0
+}
+
+// /       Fs_lstat is Fs_stat, but a symbolic link in the last component is not
+// /       followed.
+func (fs *Fs_t) Fs_lstat(path ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t) defs.Err_t {
+	opid := opid_t(0)
+	idm, dead, err := fs.fs_namei_nofollow(opid, path, cwd, "Fs_lstat")
+	if err != 0 {
+		if dead != nil {
+			dead.Free()
+		}
+		return err
+	}
+	err = idm.do_stat(st)
+	if idm.iunlock_refdown("Fs_lstat") {
+		idm.Free()
+	}
+	return err
+}
+
+// /       Fs_symlink creates a symbolic link at linkp that refers to target.
+func (fs *Fs_t) Fs_symlink(target, linkp ustr.Ustr, cwd *fd.Cwd_t) defs.Err_t {
+	child, dead, err := fs.fs_symlink(target, linkp, cwd)
+	if child != nil && child.Refdown("Fs_symlink") {
+		child.Free()
+	}
+	if dead != nil {
+		dead.Free()
+	}
+	return err
+}
+
+// returns the reffed link (also on some errors), a dead inode and error
+func (fs *Fs_t) fs_symlink(target, linkp ustr.Ustr, cwd *fd.Cwd_t) (*imemnode_t, *imemnode_t, defs.Err_t) {
+	if len(target) == 0 {
+		return nil, nil, -defs.ENOENT
+	}
+	if len(target) > SYMLINK_MAX {
+		return nil, nil, -defs.ENAMETOOLONG
+	}
+	dirs, fn := bpath.Sdirname(linkp)
+	if err, ok := crname(fn, -defs.EEXIST); !ok {
+		return nil, nil, err
+	}
+	if len(fn) > NAME_MAX {
+		return nil, nil, -defs.ENAMETOOLONG
+	}
+
+	if err := fs.rdonly(); err != 0 {
+		return nil, nil, err
+	}
+	opid := fs.fslog.Op_begin("fs_symlink")
+	defer fs.fslog.Op_end(opid)
+
+	par, dead, err := fs.fs_namei_locked(opid, dirs, cwd, "fs_symlink")
+	if err != 0 {
+		return nil, dead, cwd.Mnt.Dirs(err, fn)
+	}
+	child, err := par.do_createsymlink(opid, fn, target, &cwd.Cred)
+	par.iunlock_refdown("fs_symlink_par")
+	return child, nil, err
+}
+
+// /       Fs_readlink returns the target of the symbolic link at path.
+func (fs *Fs_t) Fs_readlink(path ustr.Ustr, cwd *fd.Cwd_t) (ustr.Ustr, defs.Err_t) {
+	opid := opid_t(0)
+	idm, dead, err := fs.fs_namei_nofollow(opid, path, cwd, "Fs_readlink")
+	if err != 0 {
+		if dead != nil {
+			dead.Free()
+		}
+		return nil, err
+	}
+	target, err := idm.ireadlink()
+	if idm.iunlock_refdown("Fs_readlink") {
+		idm.Free()
+	}
+	return target, err
+}
+
+// /       Fs_utimens sets the access and modification times, in nanoseconds since
+// /       the epoch, of the file at path. a negative time leaves that timestamp
+// /       unchanged.
+func (fs *Fs_t) Fs_utimens(path ustr.Ustr, cwd *fd.Cwd_t, atime, mtime int) defs.Err_t {
+	return fs.fs_setattr(path, cwd, "Fs_utimens", func(opid opid_t, idm *imemnode_t) defs.Err_t {
+		return idm.do_utimens(opid, atime, mtime)
+	})
+}
+
+// /       Fs_chmod sets the permission bits of the file at path.
+func (fs *Fs_t) Fs_chmod(path ustr.Ustr, cwd *fd.Cwd_t, mode int) defs.Err_t {
+	return fs.fs_setattr(path, cwd, "Fs_chmod", func(opid opid_t, idm *imemnode_t) defs.Err_t {
+		return idm.do_chmod(opid, mode, &cwd.Cred)
+	})
+}
+
+// /       Fs_chown sets the owner and group of the file at path. a negative id
+// /       leaves it unchanged.
+func (fs *Fs_t) Fs_chown(path ustr.Ustr, cwd *fd.Cwd_t, uid, gid int) defs.Err_t {
+	return fs.fs_setattr(path, cwd, "Fs_chown", func(opid opid_t, idm *imemnode_t) defs.Err_t {
+		return idm.do_chown(opid, uid, gid, &cwd.Cred)
+	})
+}
+
+// applies set to the locked inode at path in a single transaction.
+func (fs *Fs_t) fs_setattr(path ustr.Ustr, cwd *fd.Cwd_t, s string, set func(opid_t, *imemnode_t) defs.Err_t) defs.Err_t {
+	idm, dead, err := fs._fs_setattr(path, cwd, s, set)
+	if idm != nil && idm.Refdown(s) {
+		idm.Free()
+	}
+	if dead != nil {
+		dead.Free()
+	}
+	return err
+}
+
+// returns the reffed inode, a dead inode (non-nil only on error) and error
+func (fs *Fs_t) _fs_setattr(path ustr.Ustr, cwd *fd.Cwd_t, s string, set func(opid_t, *imemnode_t) defs.Err_t) (*imemnode_t, *imemnode_t, defs.Err_t) {
+	if err := fs.rdonly(); err != 0 {
+		return nil, nil, err
+	}
+	opid := fs.fslog.Op_begin(s)
+	defer fs.fslog.Op_end(opid)
+
+	idm, dead, err := fs.fs_namei_locked(opid, path, cwd, s)
+	if err != 0 {
+		return nil, dead, err
+	}
+	err = set(opid, idm)
+	idm.iunlock(s)
+	return idm, nil, err
+}
+
+// returns the fops of f if f is an open file of this file system.
+func (fs *Fs_t) fd2fsfops(f *fd.Fd_t) (*fsfops_t, defs.Err_t) {
+	fo, ok := f.Fops.(*fsfops_t)
+	if !ok || fo.fs != fs {
+		return nil, -defs.EINVAL
+	}
+	return fo, 0
+}
+
+// /       Fs_futimens is Fs_utimens for an open file descriptor.
+func (fs *Fs_t) Fs_futimens(f *fd.Fd_t, atime, mtime int) defs.Err_t {
+	return fs.fs_fsetattr(f, "Fs_futimens", func(opid opid_t, idm *imemnode_t) defs.Err_t {
+		return idm.do_utimens(opid, atime, mtime)
+	})
+}
+
+// /       Fs_fchmod is Fs_chmod for an open file descriptor.
+func (fs *Fs_t) Fs_fchmod(f *fd.Fd_t, cred *fd.Cred_t, mode int) defs.Err_t {
+	return fs.fs_fsetattr(f, "Fs_fchmod", func(opid opid_t, idm *imemnode_t) defs.Err_t {
+		return idm.do_chmod(opid, mode, cred)
+	})
+}
+
+// /       Fs_fchown is Fs_chown for an open file descriptor.
+func (fs *Fs_t) Fs_fchown(f *fd.Fd_t, cred *fd.Cred_t, uid, gid int) defs.Err_t {
+	return fs.fs_fsetattr(f, "Fs_fchown", func(opid opid_t, idm *imemnode_t) defs.Err_t {
+		return idm.do_chown(opid, uid, gid, cred)
+	})
+}
+
+// applies set to the locked inode of the open file f in a single transaction.
+func (fs *Fs_t) fs_fsetattr(f *fd.Fd_t, s string, set func(opid_t, *imemnode_t) defs.Err_t) defs.Err_t {
+	fo, err := fs.fd2fsfops(f)
+	if err != 0 {
+		return err
+	}
+	fo.Lock()
+	defer fo.Unlock()
+	if fo.count <= 0 {
+		return -defs.EBADF
+	}
+	if err := fs.rdonly(); err != 0 {
+		return err
+	}
+	opid := fs.fslog.Op_begin(s)
+	defer fs.fslog.Op_end(opid)
+
+	idm := fs.icache.Iref_locked(fo.priv, s)
+	err = set(opid, idm)
+	idm.iunlock_refdown(s)
+	return err
+}
+
+// /       Fs_access checks whether the credentials of cwd grant the access want,
+// /       a combination of A_READ, A_WRITE and A_EXEC, to the file at path.
+func (fs *Fs_t) Fs_access(path ustr.Ustr, cwd *fd.Cwd_t, want int) defs.Err_t {
+	opid := opid_t(0)
+	idm, dead, err := fs.fs_namei_locked(opid, path, cwd, "Fs_access")
+	if err != 0 {
+		if dead != nil {
+			dead.Free()
+		}
+		return err
+	}
+	err = idm.iaccess(&cwd.Cred, want)
+	if idm.iunlock_refdown("Fs_access") {
+		idm.Free()
+	}
+	return err
+}
+
+// Sync the file system to disk. fsync(2) waits only for the transactions that
+// changed a particular inode instead.
 // /       Fs_sync flushes all filesystem metadata to stable storage.
 func (fs *Fs_t) Fs_sync() defs.Err_t {
 	if !fs.diskfs {
 		return 0
 	}
 	fs.istats.Nsync.Inc()
-	fs.fslog.Force(false)
-	return 0
+	return fs.fslog.Force(false)
 }
 
 // /       Fs_syncapply flushes metadata and applies the log immediately.
@@ -1572,18 +2135,45 @@ func (fs *Fs_t) Fs_syncapply() defs.Err_t {
 		return 0
 	}
 	fs.istats.Nsync.Inc()
-	fs.fslog.Force(true)
-	return 0
+	return fs.fslog.Force(true)
 }
 
+// the most symbolic links that one lookup follows
+const MAXSYMLINKS = 40
+
 // if the path resolves successfully, returns target inode with incremented
 // refcount and locked. the caller must always be prepared to free the returned
 // imemnode after calling Refdown. if the lookup fails, the second returned
 // inode may be non-nil and must be freed by the caller. since the slow path
 // acquires locks on inodes, the caller must not have any other inode locked,
-// otherwise namei may deadlock.
-func (fs *Fs_t) _fs_namei_locked(opid opid_t, paths ustr.Ustr, cwd *fd.Cwd_t) (*imemnode_t, *imemnode_t, defs.Err_t) {
+// otherwise namei may deadlock. every directory that is searched must grant
+// search permission to the credentials of cwd. symbolic links are followed,
+// except for the last component if follow is false. if the path leaves the
+// file system for another mount, the lookup fails with ECROSS and cwd.Mnt
+// records where the path continues.
+func (fs *Fs_t) _fs_namei_locked(opid opid_t, paths ustr.Ustr, cwd *fd.Cwd_t, follow bool) (*imemnode_t, *imemnode_t, defs.Err_t) {
+	for nlinks := 0; ; nlinks++ {
+		idm, dead, npaths, err := fs._fs_namei_walk(opid, paths, cwd, follow)
+		if err != 0 || npaths == nil {
+			if err == 0 {
+				cwd.Mnt.Resolved(paths)
+			}
+			return idm, dead, err
+		}
+		if nlinks == MAXSYMLINKS {
+			return nil, nil, -defs.ELOOP
+		}
+		paths = npaths
+	}
+}
+
+// walks paths until it resolves or reaches a symbolic link that must be
+// followed, in which case the third return value is the path with the link
+// replaced by its target.
+func (fs *Fs_t) _fs_namei_walk(opid opid_t, paths ustr.Ustr, cwd *fd.Cwd_t, follow bool) (*imemnode_t, *imemnode_t, ustr.Ustr, defs.Err_t) {
 	var start *imemnode_t
+	cred := &cwd.Cred
+	mw := cwd.Mnt
 	fs.istats.Nnamei.Inc()
 	// ref lookup directory
 	if len(paths) == 0 || paths[0] != '/' {
@@ -1602,10 +2192,28 @@ func (fs *Fs_t) _fs_namei_locked(opid opid_t, paths ustr.Ustr, cwd *fd.Cwd_t) (*
 		// lock-free lookup fails
 		next, nextok = pp.Next()
 		lastc := !nextok
+		// the slow path reports the error under the lock
+		if idm.iaccess(cred, A_EXEC) != 0 {
+			break
+		}
+		// the slow path leaves the file system, here and at mount points
+		if cp.Isdotdot() && idm == fs.root && mw != nil && mw.Sub {
+			break
+		}
 		n, found := idm.ilookup_lockfree(cp, lastc)
 		if !found {
 			break
 		}
+		if mw.Mntpt(n.inum) {
+			if lastc && n.iunlock_refdown("") {
+				panic("mount point unlinked")
+			}
+			break
+		}
+		// the slow path follows links in the middle of the path
+		if !lastc && n.itype == I_SYMLINK {
+			break
+		}
 		idm = n
 		if lastc {
 			// ilookup_lockfree already locked n
@@ -1616,37 +2224,51 @@ func (fs *Fs_t) _fs_namei_locked(opid opid_t, paths ustr.Ustr, cwd *fd.Cwd_t) (*
 					if n.iunlock_refdown("") {
 						panic("huh?")
 					}
-					return nil, start, -defs.ENOENT
+					return nil, start, nil, -defs.ENOENT
 				}
 			}
-			return n, nil, 0
+			if follow && n.itype == I_SYMLINK {
+				dead, npaths, err := n.namei_follow(paths, cp, mw)
+				return nil, dead, npaths, err
+			}
+			return n, nil, nil, 0
 		}
 		// "start" is the only imemnode whose refcount is incremented
 		if !res.Resadd_noblock(bounds.Bounds(bounds.B_FS_T_FS_NAMEI)) {
 			err := -defs.ENOHEAP
 			if start.Refdown("") {
-				return nil, start, err
+				return nil, start, nil, err
 			}
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 	}
 	// couldn't ref idm; restart completely
 	idm = start
 	pp.Pp_init(paths)
+	// the component through which idm was reached
+	var prev ustr.Ustr
 
 	// lock-full slow path
 	for cp, ok := pp.Next(); ok; cp, ok = next, nextok {
 		next, nextok = pp.Next()
 
 		idm.ilock("fs_namei")
+		if idm.itype == I_SYMLINK {
+			dead, npaths, err := idm.namei_follow(paths, prev, mw)
+			return nil, dead, npaths, err
+		}
 		// for simplicity, conservatively fail the lookup if links==0
 		// so that namei can return at most one dead inode.
 		var n *imemnode_t
 		var err defs.Err_t
-		if idm.links != 0 {
-			n, err = idm.ilookup(opid, cp)
-		} else {
+		if idm.links == 0 {
 			err = -defs.ENOENT
+		} else if err = idm.iaccess(cred, A_EXEC); err == 0 {
+			if cp.Isdotdot() && idm == fs.root && mw.Up(paths, cp) {
+				err = -defs.ECROSS
+			} else {
+				n, err = idm.ilookup(opid, cp)
+			}
 		}
 		var dead *imemnode_t
 		// ilookup always increments the refcnt, even on "."
@@ -1662,32 +2284,68 @@ func (fs *Fs_t) _fs_namei_locked(opid opid_t, paths ustr.Ustr, cwd *fd.Cwd_t) (*
 			}
 		}
 		if err != 0 {
-			return nil, dead, err
+			return nil, dead, nil, err
 		}
 		idm = n
+		prev = cp
+		if mw.Down(idm.inum, paths, cp) {
+			if idm.Refdown("") {
+				return nil, idm, nil, -defs.ECROSS
+			}
+			return nil, nil, nil, -defs.ECROSS
+		}
 		if !res.Resadd_noblock(bounds.Bounds(bounds.B_FS_T_FS_NAMEI)) {
 			err := -defs.ENOHEAP
 			if idm.Refdown("") {
-				return nil, idm, err
+				return nil, idm, nil, err
 			}
-			return nil, nil, err
+			return nil, nil, nil, err
 		}
 	}
 	idm.ilock("")
-	return idm, nil, 0
+	if follow && idm.itype == I_SYMLINK {
+		dead, npaths, err := idm.namei_follow(paths, prev, mw)
+		return nil, dead, npaths, err
+	}
+	return idm, nil, nil, 0
+}
+
+// returns the path that continues a lookup of paths through the symbolic link
+// idm, which is locked and reffed and was reached via component comp. idm is
+// unlocked and its reference dropped; if it died, it is returned. fails with
+// ECROSS if the link leads out of the file system.
+func (idm *imemnode_t) namei_follow(paths, comp ustr.Ustr, mw *fd.Mntwalk_t) (*imemnode_t, ustr.Ustr, defs.Err_t) {
+	target, err := idm.ireadlink()
+	if idm.iunlock_refdown("namei_follow") {
+		return idm, nil, -defs.ENOENT
+	}
+	if err != 0 {
+		return nil, nil, err
+	}
+	if mw.Follow(paths, comp, target) {
+		return nil, nil, -defs.ECROSS
+	}
+	return nil, bpath.Splice(paths, comp, target), 0
 }
 
 func (fs *Fs_t) fs_namei_locked(opid opid_t, paths ustr.Ustr, cwd *fd.Cwd_t, s string) (*imemnode_t, *imemnode_t, defs.Err_t) {
-	return fs._fs_namei_locked(opid, paths, cwd)
+	return fs._fs_namei_locked(opid, paths, cwd, true)
+}
+
+// like fs_namei_locked, but returns a symbolic link in the last component
+// instead of following it.
+func (fs *Fs_t) fs_namei_nofollow(opid opid_t, paths ustr.Ustr, cwd *fd.Cwd_t, s string) (*imemnode_t, *imemnode_t, defs.Err_t) {
+	return fs._fs_namei_locked(opid, paths, cwd, false)
 }
 
-// /       Fs_evict drops half of the cache entries and returns the new sizes.
+// /       Fs_evict drops up to half of the cache entries, chosen by the caches'
+// /       replacement policy, and returns the new sizes.
 func (fs *Fs_t) Fs_evict() (int, int) {
 	if !fs.diskfs {
 		panic("no evict")
 	}
-	_, a := fs.bcache.cache.Evict_half()
-	_, b := fs.icache.cache.Evict_half()
+	_, a := fs.bcache.cache.Evict(fs.bcache.cache.Len() / 2)
+	_, b := fs.icache.cache.Evict(fs.icache.cache.Len() / 2)
 	fmt.Printf("FS EVICT blk %v imem %v\n", a, b)
 	return fs.Sizes()
 }
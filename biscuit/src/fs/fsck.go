@@ -0,0 +1,710 @@
+//go:build !kernel
+// +build !kernel
+
+package fs
+
+import "fmt"
+
+import "defs"
+import "ustr"
+import "util"
+
+// an offline consistency checker for file system images. it reads the on-disk
+// structures directly through a private block cache, without starting the log
+// or recovering orphans, so that it observes the image exactly as a crash left
+// it. only the host tools use it, so the kernel is built with the kernel tag
+// to leave it out.
+
+// /       Fsckkind_t identifies the invariant that an inconsistency violates.
+type Fsckkind_t int
+
+const (
+	FSCK_SUPER   Fsckkind_t = iota // superblock describes an impossible layout
+	FSCK_LOG                       // log holds committed but uninstalled blocks
+	FSCK_IMAP                      // inode map disagrees with the inodes in use
+	FSCK_ORPHAN                    // orphan map disagrees with the unlinked inodes
+	FSCK_BADBLK                    // block address outside of the data region
+	FSCK_DUPBLK                    // block referenced more than once
+	FSCK_LEAKBLK                   // block allocated in the block map but unused
+	FSCK_FREEBLK                   // block in use but free in the block map
+	FSCK_LINKS                     // link count differs from the directory entries
+	FSCK_LOST                      // linked inode that no directory refers to
+	FSCK_DANGLE                    // directory entry refers to an unused inode
+	FSCK_BADDIR                    // malformed directory block
+	FSCK_DOTDOT                    // "." or ".." refers to the wrong directory
+	FSCK_DIRIDX                    // directory index disagrees with the entries
+	FSCK_NKINDS
+)
+
+var fsckkinds = [FSCK_NKINDS]string{
+	FSCK_SUPER:   "superblock",
+	FSCK_LOG:     "log",
+	FSCK_IMAP:    "inode map",
+	FSCK_ORPHAN:  "orphan map",
+	FSCK_BADBLK:  "bad block",
+	FSCK_DUPBLK:  "duplicate block",
+	FSCK_LEAKBLK: "leaked block",
+	FSCK_FREEBLK: "free block in use",
+	FSCK_LINKS:   "link count",
+	FSCK_LOST:    "lost inode",
+	FSCK_DANGLE:  "dangling entry",
+	FSCK_BADDIR:  "bad directory",
+	FSCK_DOTDOT:  "dot entry",
+	FSCK_DIRIDX:  "directory index",
+}
+
+// /       String returns a short name for the kind of inconsistency.
+func (k Fsckkind_t) String() string {
+	if k < 0 || k >= FSCK_NKINDS {
+		return fmt.Sprintf("kind %d", int(k))
+	}
+	return fsckkinds[k]
+}
+
+// /       Fsckerr_t describes one inconsistency and whether it was repaired.
+type Fsckerr_t struct {
+	Kind  Fsckkind_t
+	Msg   string
+	Fixed bool
+}
+
+// /       String formats the inconsistency for printing.
+func (e *Fsckerr_t) String() string {
+	s := e.Kind.String() + ": " + e.Msg
+	if e.Fixed {
+		s += " (fixed)"
+	}
+	return s
+}
+
+// /       Fsckreport_t summarizes a check of a file system image.
+type Fsckreport_t struct {
+	Errs     []Fsckerr_t
+	Ninodes  int // inodes in use, including orphans
+	Nblocks  int // data and indirect blocks in use
+	Norphans int // unlinked inodes that recovery will free
+}
+
+// /       Count returns the number of inconsistencies of kind k.
+func (r *Fsckreport_t) Count(k Fsckkind_t) int {
+	n := 0
+	for i := range r.Errs {
+		if r.Errs[i].Kind == k {
+			n++
+		}
+	}
+	return n
+}
+
+// /       Clean reports whether every inconsistency, if any, was repaired.
+func (r *Fsckreport_t) Clean() bool {
+	for i := range r.Errs {
+		if !r.Errs[i].Fixed {
+			return false
+		}
+	}
+	return true
+}
+
+type fsck_t struct {
+	bcache  *bcache_t
+	repair  bool
+	rep     *Fsckreport_t
+	sbstart int
+	sb      Superblock_t
+	// layout of the image
+	logstart int
+	loglen   int
+	omap     int
+	imap     int
+	maplen   int
+	bmap     int
+	bmaplen  int
+	istart   int
+	first    int
+	last     int
+	maxinode int
+	// per-inode state gathered by the directory walk
+	itype []int
+	refs  []int
+	isdir []bool
+	bused []bool
+	dirty bool
+}
+
+// /       Fsck checks the file system image on disk and, if repair is set,
+// /       repairs what it can: it installs the log, frees leaked blocks and
+// /       inodes, fixes the bitmaps and link counts, removes dangling
+// /       directory entries and hands lost inodes to orphan recovery. duplicate
+// /       and out-of-range block addresses are only reported.
+func Fsck(mem Blockmem_i, disk Disk_i, repair bool) *Fsckreport_t {
+	fk := &fsck_t{}
+	fk.bcache = mkBcache(mem, disk)
+	fk.repair = repair
+	fk.rep = &Fsckreport_t{}
+	if !fk.super() {
+		return fk.rep
+	}
+	fk.log()
+	fk.inodes()
+	fk.walk()
+	fk.account()
+	fk.blockmap()
+	if fk.dirty {
+		ider := MkRequest(nil, BDEV_FLUSH, true)
+		if disk.Start(ider) {
+			<-ider.AckCh
+		}
+	}
+	return fk.rep
+}
+
+// records an inconsistency; returns true if the caller should repair it.
+func (fk *fsck_t) err(k Fsckkind_t, fixable bool, f string, args ...interface{}) bool {
+	fix := fixable && fk.repair
+	e := Fsckerr_t{Kind: k, Msg: fmt.Sprintf(f, args...), Fixed: fix}
+	fk.rep.Errs = append(fk.rep.Errs, e)
+	if fix {
+		fk.dirty = true
+	}
+	return fix
+}
+
+func (fk *fsck_t) read(blkno int) *Bdev_block_t {
+	b, err := fk.bcache.Get_fill(blkno, "fsck", false)
+	if err != 0 {
+		panic(fmt.Sprintf("fsck: cannot read block %v: %v", blkno, err))
+	}
+	return b
+}
+
+func (fk *fsck_t) write(b *Bdev_block_t) {
+	if err := fk.bcache.Write(b); err != 0 {
+		panic(fmt.Sprintf("fsck: cannot write block %v: %v", b.Block, err))
+	}
+}
+
+func (fk *fsck_t) relse(b *Bdev_block_t) {
+	fk.bcache.Relse(b, "fsck")
+}
+
+func (fk *fsck_t) getbit(start, bit int) bool {
+	b := fk.read(start + blkno(bit))
+	v := b.Data[byteno(bit)]&(1<<uint(byteoffset(bit))) != 0
+	fk.relse(b)
+	return v
+}
+
+func (fk *fsck_t) setbit(start, bit int, v bool) {
+	b := fk.read(start + blkno(bit))
+	m := uint8(1 << uint(byteoffset(bit)))
+	if v {
+		b.Data[byteno(bit)] |= m
+	} else {
+		b.Data[byteno(bit)] &^= m
+	}
+	fk.write(b)
+	fk.relse(b)
+}
+
+// checks that the superblock describes the layout that ufs.MkDisk creates.
+func (fk *fsck_t) super() bool {
+	b := fk.read(0)
+	fk.sbstart = util.Readn(b.Data[:], 4, FSOFF)
+	fk.relse(b)
+	if fk.sbstart <= 0 {
+		fk.err(FSCK_SUPER, false, "bad superblock address %v", fk.sbstart)
+		return false
+	}
+	b = fk.read(fk.sbstart)
+	fk.sb = Superblock_t{b.Data}
+	sb := &fk.sb
+
+	fk.logstart = fk.sbstart + 1
+	fk.loglen = sb.Loglen()
+	fk.omap = sb.Iorphanblock()
+	fk.maplen = sb.Imaplen()
+	fk.imap = fk.omap + fk.maplen
+	fk.bmap = sb.Freeblock()
+	fk.bmaplen = sb.Freeblocklen()
+	fk.istart = fk.bmap + fk.bmaplen
+	fk.first = fk.istart + sb.Inodelen()
+	fk.last = sb.Lastblock()
+	fk.maxinode = sb.Inodelen() * (BSIZE / ISIZE)
+	switch {
+	case fk.loglen < 2:
+		fk.err(FSCK_SUPER, false, "log length %v", fk.loglen)
+	case fk.omap != fk.logstart+fk.loglen:
+		fk.err(FSCK_SUPER, false, "orphan map at %v, log ends at %v",
+			fk.omap, fk.logstart+fk.loglen)
+	case fk.maplen <= 0 || sb.Iorphanlen() != fk.maplen:
+		fk.err(FSCK_SUPER, false, "orphan map length %v, inode map length %v",
+			sb.Iorphanlen(), fk.maplen)
+	case fk.bmap != fk.imap+fk.maplen:
+		fk.err(FSCK_SUPER, false, "block map at %v, inode map ends at %v",
+			fk.bmap, fk.imap+fk.maplen)
+	case fk.bmaplen <= 0 || sb.Inodelen() <= 0:
+		fk.err(FSCK_SUPER, false, "block map length %v, inode length %v",
+			fk.bmaplen, sb.Inodelen())
+	case fk.maxinode > fk.maplen*bitsperblk:
+		fk.err(FSCK_SUPER, false, "%v inodes, inode map holds %v",
+			fk.maxinode, fk.maplen*bitsperblk)
+	case fk.last <= fk.first || fk.last-fk.first > fk.bmaplen*bitsperblk:
+		fk.err(FSCK_SUPER, false, "data blocks [%v, %v), block map holds %v",
+			fk.first, fk.last, fk.bmaplen*bitsperblk)
+	default:
+		return true
+	}
+	return false
+}
+
+// reports committed transactions that were not installed; installing them
+// is the only repair that happens before the rest of the image is checked.
+func (fk *fsck_t) log() {
+	b := fk.read(fk.logstart)
+	lh := logheader_t{b.Data}
+	tail, head := lh.r_tail(), lh.r_head()
+	fk.relse(b)
+	if tail == head {
+		return
+	}
+	if fk.err(FSCK_LOG, true, "%v blocks from %v to %v not installed",
+		head-tail, tail, head) {
+		l := &log_t{}
+		l.ml = mk_memlog(fk.logstart, fk.loglen, fk.bcache)
+		l.recover()
+	}
+}
+
+func (fk *fsck_t) inode(inum defs.Inum_t) (*Inode_t, *Bdev_block_t) {
+	b := fk.read(fk.istart + int(inum)/(BSIZE/ISIZE))
+	return &Inode_t{b, ioffset(inum)}, b
+}
+
+// reads the type of every inode without panicking on garbage.
+func (fk *fsck_t) inodes() {
+	fk.itype = make([]int, fk.maxinode)
+	fk.refs = make([]int, fk.maxinode)
+	fk.isdir = make([]bool, fk.maxinode)
+	fk.bused = make([]bool, fk.last-fk.first)
+	for i := range fk.itype {
+		ind, b := fk.inode(defs.Inum_t(i))
+		fk.itype[i] = fieldr(ind.Iblk.Data, ifield(ind.Ioff, 0))
+		fk.relse(b)
+	}
+	for bit := fk.maxinode; bit < fk.maplen*bitsperblk; bit++ {
+		if !fk.getbit(fk.imap, bit) {
+			fk.err(FSCK_IMAP, false, "nonexistent inode %v is free", bit)
+			break
+		}
+	}
+}
+
+func (fk *fsck_t) validtype(inum defs.Inum_t) bool {
+	it := fk.itype[inum]
+	return it > I_INVALID && it <= I_VALID
+}
+
+// returns the blocks of inode inum: its data blocks in file order followed by
+// its indirect blocks. addresses outside the data region are reported once
+// and skipped.
+func (fk *fsck_t) blocks(inum defs.Inum_t, report bool) ([]int, []int) {
+	var data, meta []int
+	if fk.itype[inum] == I_DEV {
+		return nil, nil
+	}
+	ok := func(blk int, what string) bool {
+		if blk == 0 {
+			return false
+		}
+		if blk < fk.first || blk >= fk.last {
+			if report {
+				fk.err(FSCK_BADBLK, false, "inode %v: %v block %v",
+					inum, what, blk)
+			}
+			return false
+		}
+		return true
+	}
+	// visits the block tree rooted at blk, which has the given depth of
+	// indirection
+	var tree func(blk, depth int)
+	tree = func(blk, depth int) {
+		if !ok(blk, "indirect") {
+			return
+		}
+		meta = append(meta, blk)
+		b := fk.read(blk)
+		var slots [INDADDR]int
+		for i := range slots {
+			slots[i] = util.Readn(b.Data[:], 8, i*8)
+		}
+		fk.relse(b)
+		for _, s := range slots {
+			if depth == 1 {
+				if ok(s, "data") {
+					data = append(data, s)
+				}
+			} else {
+				tree(s, depth-1)
+			}
+		}
+	}
+	ind, b := fk.inode(inum)
+	addrs := make([]int, NIADDRS)
+	for i := range addrs {
+		addrs[i] = ind.addr(i)
+	}
+	indirs := []int{ind.indirect(), ind.dindirect(), ind.tindirect()}
+	diridx := ind.diridx()
+	fk.relse(b)
+	for _, a := range addrs {
+		if ok(a, "data") {
+			data = append(data, a)
+		}
+	}
+	for i, a := range indirs {
+		tree(a, i+1)
+	}
+	if fk.itype[inum] == I_DIR && diridx > DIRIDX_EMPTY && ok(diridx, "index") {
+		meta = append(meta, diridx)
+		slots := fk.ndxroot(diridx)
+		seen := map[int]bool{}
+		for i, blk := range slots {
+			if i >= NDXHINT && i < NDXTABLE {
+				continue
+			}
+			// buckets appear in several slots; the guard also stops
+			// chains that loop
+			for blk != 0 && !seen[blk] && ok(blk, "index") {
+				seen[blk] = true
+				meta = append(meta, blk)
+				if i < NDXHINT {
+					break
+				}
+				blk, _ = fk.ndxchain(blk)
+			}
+		}
+	}
+	return data, meta
+}
+
+// returns the words of the root of a directory index.
+func (fk *fsck_t) ndxroot(root int) [NDXSLOTS]int {
+	var slots [NDXSLOTS]int
+	b := fk.read(root)
+	for i := range slots {
+		slots[i] = util.Readn(b.Data[:], 8, i*8)
+	}
+	fk.relse(b)
+	return slots
+}
+
+// returns the next block of a bucket's chain and the entries of block blk.
+func (fk *fsck_t) ndxchain(blk int) (int, [][2]int) {
+	b := fk.read(blk)
+	defer fk.relse(b)
+	next := util.Readn(b.Data[:], 8, 0)
+	n := util.Min(util.Readn(b.Data[:], 8, 8), NDXENTS)
+	ents := make([][2]int, n)
+	for i := range ents {
+		h, off := ndxent(b, i)
+		ents[i] = [2]int{h, off}
+	}
+	return next, ents
+}
+
+// checks that the index of directory dir has an entry for each of its names,
+// whose records are at the directory offsets in names, and that the free space
+// hints match maxfree, the hints computed from the directory blocks. returns
+// false if the index is inconsistent.
+func (fk *fsck_t) ndxcheck(dir defs.Inum_t, root int, names map[int]string, maxfree []int) bool {
+	if root == DIRIDX_EMPTY {
+		// only directories with more than one block are indexed
+		if len(maxfree) > 1 {
+			fk.err(FSCK_DIRIDX, true, "directory %v: %v blocks, no index",
+				dir, len(maxfree))
+			return false
+		}
+		return true
+	}
+	if root < fk.first || root >= fk.last {
+		// reported as a bad block
+		return false
+	}
+	slots := fk.ndxroot(root)
+	g := slots[NDXDEPTH]
+	if g < 0 || g > NDXMAXDEPTH {
+		fk.err(FSCK_DIRIDX, true, "directory %v: bucket table depth %v", dir, g)
+		return false
+	}
+	// the entries of each bucket, by the bucket's first block
+	type ent_t struct {
+		head, h, off int
+	}
+	ents := map[ent_t]bool{}
+	seen := map[int]bool{}
+	for i := NDXTABLE; i < NDXTABLE+1<<uint(g); i++ {
+		head := slots[i]
+		for blk := head; blk != 0 && !seen[blk]; {
+			if blk < fk.first || blk >= fk.last {
+				return false
+			}
+			seen[blk] = true
+			var be [][2]int
+			blk, be = fk.ndxchain(blk)
+			for _, e := range be {
+				ents[ent_t{head, e[0], e[1]}] = true
+			}
+		}
+	}
+	for off, fn := range names {
+		h := ndxhash(ustr.Ustr(fn))
+		head := slots[NDXTABLE+h&(1<<uint(g)-1)]
+		if !ents[ent_t{head, h, off}] {
+			fk.err(FSCK_DIRIDX, true, "directory %v: %q at offset %v not indexed",
+				dir, fn, off)
+			return false
+		}
+	}
+	for bi, m := range maxfree {
+		hblk := slots[bi/BSIZE]
+		if hblk < fk.first || hblk >= fk.last {
+			continue
+		}
+		b := fk.read(hblk)
+		hint := int(b.Data[bi%BSIZE])
+		fk.relse(b)
+		if hint != m {
+			fk.err(FSCK_DIRIDX, true, "directory %v: block %v has free space hint %v, not %v",
+				dir, bi, hint, m)
+			return false
+		}
+	}
+	return true
+}
+
+// walks the directory tree from the root, counting the entries that refer to
+// each inode and checking "." and "..".
+func (fk *fsck_t) walk() {
+	if fk.itype[iroot] != I_DIR {
+		fk.err(FSCK_SUPER, false, "root inode has type %v", fk.itype[iroot])
+		return
+	}
+	fk.isdir[iroot] = true
+	q := []defs.Inum_t{iroot}
+	parent := map[defs.Inum_t]defs.Inum_t{iroot: iroot}
+	for len(q) > 0 {
+		dir := q[0]
+		q = q[1:]
+		for _, child := range fk.dirents(dir, parent[dir]) {
+			if fk.isdir[child] {
+				continue
+			}
+			fk.isdir[child] = true
+			parent[child] = dir
+			q = append(q, child)
+		}
+	}
+}
+
+// checks the entries of directory dir and returns the subdirectories that it
+// refers to.
+func (fk *fsck_t) dirents(dir, par defs.Inum_t) []defs.Inum_t {
+	var subdirs []defs.Inum_t
+	ind, ib := fk.inode(dir)
+	size := ind.size()
+	diridx := ind.diridx()
+	fk.relse(ib)
+	data, _ := fk.blocks(dir, false)
+	nblk := util.Min(len(data), util.Roundup(size, BSIZE)/BSIZE)
+	var dot, dotdot bool
+	// the names and free space that the index must describe
+	names := map[int]string{}
+	maxfree := make([]int, nblk)
+	dirchanged := false
+	for bi, blk := range data[:nblk] {
+		b := fk.read(blk)
+		dd := &Dirdata_t{b.Data[:]}
+		changed := false
+		for off := 0; off < BSIZE; off += dd.Reclen(off) {
+			if !dd.Valid(off) {
+				if fk.err(FSCK_BADDIR, true, "directory %v: bad record at block %v offset %v",
+					dir, blk, off) {
+					// drop the rest of the block
+					dd.W_dirent(off, BSIZE-off, nil, 0)
+					changed = true
+				}
+				break
+			}
+			fn := dd.Filename(off)
+			if len(fn) == 0 {
+				m := util.Min(dd.Reclen(off)/DIRALIGN, NDXHINTMAX)
+				if m > maxfree[bi] {
+					maxfree[bi] = m
+				}
+				continue
+			}
+			child := dd.inodenext(off)
+			switch {
+			case fn.Isdot():
+				dot = true
+				if child != dir && fk.err(FSCK_DOTDOT, true,
+					"directory %v: \".\" refers to %v", dir, child) {
+					dd.W_inodenext(off, dir)
+					changed = true
+				}
+				continue
+			case fn.Isdotdot():
+				dotdot = true
+				if child != par && fk.err(FSCK_DOTDOT, true,
+					"directory %v: \"..\" refers to %v, not %v", dir, child, par) {
+					dd.W_inodenext(off, par)
+					changed = true
+				}
+				continue
+			}
+			dangling := int(child) >= fk.maxinode || child == iroot ||
+				!fk.validtype(child)
+			// a directory has exactly one name
+			twice := !dangling && fk.itype[child] == I_DIR &&
+				(fk.isdir[child] || fk.refs[child] > 0)
+			if dangling || twice {
+				what := "unused inode"
+				if twice {
+					what = "directory that already has a name"
+				}
+				if fk.err(FSCK_DANGLE, true, "directory %v: %q refers to %v %v",
+					dir, fn, what, child) {
+					dd.W_filename(off, nil)
+					dd.W_inodenext(off, 0)
+					changed = true
+				}
+				continue
+			}
+			fk.refs[child]++
+			names[bi*BSIZE+off] = string(fn)
+			if fk.itype[child] == I_DIR {
+				subdirs = append(subdirs, child)
+			}
+		}
+		if changed {
+			fk.write(b)
+			dirchanged = true
+		}
+		fk.relse(b)
+	}
+	if !dot || !dotdot {
+		fk.err(FSCK_DOTDOT, false, "directory %v: missing \".\" or \"..\"", dir)
+	}
+	// an index that cannot be trusted is dropped, which makes dir a linear
+	// directory; the block map repair then frees the index blocks.
+	if diridx != DIRIDX_NONE && (dirchanged || !fk.ndxcheck(dir, diridx, names, maxfree)) &&
+		fk.repair {
+		ind, ib := fk.inode(dir)
+		ind.W_diridx(DIRIDX_NONE)
+		fk.write(ib)
+		fk.relse(ib)
+	}
+	return subdirs
+}
+
+// reconciles the inodes with the inode and orphan maps and their link counts,
+// and marks the blocks of every inode in use.
+func (fk *fsck_t) account() {
+	for i := 0; i < fk.maxinode; i++ {
+		inum := defs.Inum_t(i)
+		alloc := fk.getbit(fk.imap, i)
+		orphan := fk.getbit(fk.omap, i)
+		inuse := false
+		ind, b := fk.inode(inum)
+		links := 0
+		if fk.validtype(inum) {
+			links = ind.linkcount()
+		}
+		nlinks := fk.refs[i]
+		if inum == iroot {
+			nlinks = 1
+		}
+		switch {
+		case nlinks > 0:
+			inuse = true
+			if !alloc && fk.err(FSCK_IMAP, true, "inode %v in use but free", i) {
+				fk.setbit(fk.imap, i, true)
+			}
+			if links != nlinks && fk.err(FSCK_LINKS, true,
+				"inode %v has %v links, %v entries", i, links, nlinks) {
+				ind.W_linkcount(nlinks)
+				fk.write(b)
+			}
+			if orphan && fk.err(FSCK_ORPHAN, true, "linked inode %v is an orphan", i) {
+				fk.setbit(fk.omap, i, false)
+			}
+		case alloc && fk.validtype(inum):
+			// recovery frees unlinked inodes in the orphan map at the
+			// next mount
+			inuse = true
+			if links > 0 {
+				if fk.err(FSCK_LOST, true, "inode %v has %v links, no entries",
+					i, links) {
+					ind.W_linkcount(0)
+					fk.write(b)
+					fk.setbit(fk.omap, i, true)
+				}
+			} else if !orphan {
+				if fk.err(FSCK_ORPHAN, true, "unlinked inode %v is not an orphan", i) {
+					fk.setbit(fk.omap, i, true)
+				}
+			} else {
+				fk.rep.Norphans++
+			}
+		case alloc:
+			if fk.err(FSCK_IMAP, true, "allocated inode %v has type %v",
+				i, fk.itype[i]) {
+				fk.setbit(fk.imap, i, false)
+				fk.setbit(fk.omap, i, false)
+			}
+		case orphan:
+			if fk.err(FSCK_ORPHAN, true, "free inode %v is an orphan", i) {
+				fk.setbit(fk.omap, i, false)
+			}
+		}
+		fk.relse(b)
+		if !inuse {
+			continue
+		}
+		fk.rep.Ninodes++
+		data, meta := fk.blocks(inum, true)
+		for _, blk := range append(data, meta...) {
+			bit := blk - fk.first
+			if fk.bused[bit] {
+				fk.err(FSCK_DUPBLK, false, "inode %v: block %v already in use",
+					i, blk)
+				continue
+			}
+			fk.bused[bit] = true
+			fk.rep.Nblocks++
+		}
+	}
+}
+
+// reconciles the block map with the blocks in use.
+func (fk *fsck_t) blockmap() {
+	for bit := 0; bit < fk.bmaplen*bitsperblk; bit++ {
+		set := fk.getbit(fk.bmap, bit)
+		blk := fk.first + bit
+		if bit >= len(fk.bused) {
+			// bits past the end of the disk are always allocated
+			if !set && fk.err(FSCK_FREEBLK, true, "nonexistent block %v is free", blk) {
+				fk.setbit(fk.bmap, bit, true)
+			}
+			continue
+		}
+		used := fk.bused[bit]
+		if set && !used && fk.err(FSCK_LEAKBLK, true, "block %v is unused", blk) {
+			fk.setbit(fk.bmap, bit, false)
+		} else if !set && used && fk.err(FSCK_FREEBLK, true, "block %v is in use", blk) {
+			fk.setbit(fk.bmap, bit, true)
+		}
+	}
+}
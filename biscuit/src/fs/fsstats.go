@@ -0,0 +1,115 @@
+package fs
+
+import "reflect"
+import "strconv"
+
+import "stats"
+
+// typed statistics of a file system. the fields of type stats.Counter_t count
+// events since the file system started or since its counters were last reset;
+// the other fields describe the file system at the time of the snapshot. most
+// counters are cheap enough to always count, since they count under a lock
+// that is taken anyway, but the hits of the caches happen without a lock and
+// are only counted if stats.Stats is set.
+
+// /       Cachestats_t describes the block or the inode cache.
+type Cachestats_t struct {
+	Nhit   stats.Counter_t /// lookups that found the object, if stats.Stats
+	Nmiss  stats.Counter_t /// lookups that had to add the object
+	Nevict stats.Counter_t /// objects evicted
+	Nobj   int             /// objects in the cache
+	Limit  int             /// the limit on the number of objects
+}
+
+// /       Logstats_t describes the log.
+type Logstats_t struct {
+	Nop           stats.Counter_t /// operations that began
+	Nlogwrite     stats.Counter_t /// blocks written through the log
+	Norderedwrite stats.Counter_t /// blocks written in place
+	Nabsorption   stats.Counter_t /// writes to a block already logged
+	Nforce        stats.Counter_t /// forces of the log to disk
+	Ncommit       stats.Counter_t /// transactions committed
+	Nblkcommitted stats.Counter_t /// blocks committed to the log
+	Napply        stats.Counter_t /// times the log was applied
+	Nblkapply     stats.Counter_t /// blocks applied to their home
+	Nrevokeblk    stats.Counter_t /// revoke blocks written
+	Ndiscard      stats.Counter_t /// freed blocks discarded
+	Logblks       int             /// blocks of the log
+}
+
+// /       Allocstats_t describes the block or the inode bitmap.
+type Allocstats_t struct {
+	Nalloc stats.Counter_t /// allocations
+	Nfree  stats.Counter_t /// frees
+	Total  int             /// blocks or inodes
+	Free   int             /// free blocks or inodes
+}
+
+// /       Fsstats_t is a snapshot of the statistics of a file system.
+type Fsstats_t struct {
+	Bcache Cachestats_t
+	Icache Cachestats_t
+	Log    Logstats_t
+	Blocks Allocstats_t
+	Inodes Allocstats_t
+}
+
+// /       Fs_stats returns a snapshot of the statistics of the file system.
+func (fs *Fs_t) Fs_stats() Fsstats_t {
+	st := Fsstats_t{}
+	st.Bcache = fs.bcache.cache.snapshot()
+	st.Icache = fs.icache.cache.snapshot()
+	st.Log = fs.fslog.snapshot()
+	st.Blocks = fs.balloc.alloc.snapshot()
+	st.Blocks.Total = fs.superb.Lastblock() - fs.balloc.first
+	st.Inodes = fs.ialloc.alloc.snapshot()
+	st.Inodes.Total = fs.ialloc.maxinode
+	return st
+}
+
+// /       Fs_resetstats resets the counters of the file system's statistics.
+func (fs *Fs_t) Fs_resetstats() {
+	fs.bcache.cache.resetstats()
+	fs.icache.cache.resetstats()
+	fs.fslog.resetstats()
+	fs.balloc.alloc.ResetStats()
+	fs.ialloc.alloc.ResetStats()
+}
+
+// /       Sub returns the statistics that changed from old to st: the counters
+// /       of st minus those of old, and the other fields of st.
+func (st Fsstats_t) Sub(old Fsstats_t) Fsstats_t {
+	subcounters(reflect.ValueOf(&st).Elem(), reflect.ValueOf(old))
+	return st
+}
+
+// subtracts the counters of old from those of st, which are structs of the
+// same type.
+func subcounters(st, old reflect.Value) {
+	for i := 0; i < st.NumField(); i++ {
+		f := st.Field(i)
+		switch v := f.Addr().Interface().(type) {
+		case *stats.Counter_t:
+			*v -= old.Field(i).Interface().(stats.Counter_t)
+		default:
+			if f.Kind() == reflect.Struct {
+				subcounters(f, old.Field(i))
+			}
+		}
+	}
+}
+
+// /       String returns the statistics as "Group.Name:\tvalue" lines, such as
+// /       "Bcache.Nhit:\t12", which is the format of procfs's fsstats file.
+func (st Fsstats_t) String() string {
+	s := ""
+	v := reflect.ValueOf(st)
+	for i := 0; i < v.NumField(); i++ {
+		g := v.Field(i)
+		for j := 0; j < g.NumField(); j++ {
+			s += v.Type().Field(i).Name + "." + g.Type().Field(j).Name +
+				":\t" + strconv.FormatInt(g.Field(j).Int(), 10) + "\n"
+		}
+	}
+	return s
+}
@@ -3,10 +3,12 @@ package fs
 import "fmt"
 import "sync"
 import "sort"
+import "time"
 import "unsafe"
 
 import "bounds"
 import "defs"
+import "fd"
 import "fdops"
 import "hashtable"
 import "limits"
@@ -40,7 +42,11 @@ type inode_stats_t struct {
 	Nmkdir      stats.Counter_t
 	Nclose      stats.Counter_t
 	Nsync       stats.Counter_t
+	Nfsync      stats.Counter_t
+	Nfallocate  stats.Counter_t
+	Npunch      stats.Counter_t
 	Nreopen     stats.Counter_t
+	Nreadahead  stats.Counter_t
 	CWrite      stats.Cycles_t
 	Cwrite      stats.Cycles_t
 	Ciwrite     stats.Cycles_t
@@ -68,22 +74,50 @@ const (
 	I_FILE    = 1
 	I_DIR     = 2
 	I_DEV     = 3
-	I_VALID   = I_DEV
+	I_SYMLINK = 4
+	I_VALID   = I_SYMLINK
 	// ready to be reclaimed
-	I_DEAD = 4
+	I_DEAD = 5
 	I_LAST = I_DEAD
 
 	// direct block addresses
 	NIADDRS = 9
+	// word index of the first timestamp, following the block addresses
+	ITIMEOFF = 7 + NIADDRS
+	// word index of the permission bits, followed by the owner and group
+	IPERMOFF = ITIMEOFF + 3
+	// word index of the triple-indirect block address
+	ITINDOFF = IPERMOFF + 3
+	// word index of a directory's index root (see diridx.go)
+	IDIRIDXOFF = ITINDOFF + 1
 	// number of words in an inode
-	NIWORDS = 7 + NIADDRS
+	NIWORDS = IDIRIDXOFF + 1
 	// number of address in indirect block
 	INDADDR = (BSIZE / 8)
-	ISIZE   = 128
+	ISIZE   = 256
+	// longest symbolic link target, which must fit in one block
+	SYMLINK_MAX = NAME_MAX
 )
 
+// permission bits
+const (
+	S_ISUID = 04000
+	S_ISGID = 02000
+	S_ISVTX = 01000
+	S_IPERM = 07777
+	// access requested from iaccess, in the layout of an rwx triple
+	A_READ  = 04
+	A_WRITE = 02
+	A_EXEC  = 01
+)
+
+// the inode size, not the number of used words, determines where an inode
+// starts so that fields can be added without changing the on-disk layout.
 func ifield(iidx int, fieldn int) int {
-	return iidx*NIWORDS + fieldn
+	if fieldn >= NIWORDS || NIWORDS*8 > ISIZE {
+		panic("bad inode field")
+	}
+	return iidx*(ISIZE/8) + fieldn
 }
 
 // iidx is the inode index; necessary since there are four inodes in one block
@@ -119,6 +153,14 @@ func (ind *Inode_t) dindirect() int {
 	return fieldr(ind.Iblk.Data, ifield(ind.Ioff, 6))
 }
 
+func (ind *Inode_t) tindirect() int {
+	return fieldr(ind.Iblk.Data, ifield(ind.Ioff, ITINDOFF))
+}
+
+func (ind *Inode_t) diridx() int {
+	return fieldr(ind.Iblk.Data, ifield(ind.Ioff, IDIRIDXOFF))
+}
+
 func (ind *Inode_t) addr(i int) int {
 	if i < 0 || i > NIADDRS {
 		panic("bad inode block index")
@@ -127,6 +169,31 @@ func (ind *Inode_t) addr(i int) int {
 	return fieldr(ind.Iblk.Data, ifield(ind.Ioff, addroff+i))
 }
 
+// timestamps are stored as nanoseconds since the Unix epoch.
+func (ind *Inode_t) atime() int {
+	return fieldr(ind.Iblk.Data, ifield(ind.Ioff, ITIMEOFF))
+}
+
+func (ind *Inode_t) mtime() int {
+	return fieldr(ind.Iblk.Data, ifield(ind.Ioff, ITIMEOFF+1))
+}
+
+func (ind *Inode_t) ctime() int {
+	return fieldr(ind.Iblk.Data, ifield(ind.Ioff, ITIMEOFF+2))
+}
+
+func (ind *Inode_t) mode() int {
+	return fieldr(ind.Iblk.Data, ifield(ind.Ioff, IPERMOFF))
+}
+
+func (ind *Inode_t) uid() int {
+	return fieldr(ind.Iblk.Data, ifield(ind.Ioff, IPERMOFF+1))
+}
+
+func (ind *Inode_t) gid() int {
+	return fieldr(ind.Iblk.Data, ifield(ind.Ioff, IPERMOFF+2))
+}
+
 // /       W_itype updates the inode's type field.
 func (ind *Inode_t) W_itype(n int) {
 	if n < I_FIRST || n > I_LAST {
@@ -163,6 +230,46 @@ func (ind *Inode_t) w_dindirect(blk int) {
 	fieldw(ind.Iblk.Data, ifield(ind.Ioff, 6), blk)
 }
 
+// blk is the block number and iidx in the index of the inode on block blk.
+func (ind *Inode_t) w_tindirect(blk int) {
+	fieldw(ind.Iblk.Data, ifield(ind.Ioff, ITINDOFF), blk)
+}
+
+// /       W_diridx records the directory index root, or DIRIDX_NONE.
+func (ind *Inode_t) W_diridx(blk int) {
+	fieldw(ind.Iblk.Data, ifield(ind.Ioff, IDIRIDXOFF), blk)
+}
+
+// /       W_atime records the last access time.
+func (ind *Inode_t) W_atime(ns int) {
+	fieldw(ind.Iblk.Data, ifield(ind.Ioff, ITIMEOFF), ns)
+}
+
+// /       W_mtime records the last modification time.
+func (ind *Inode_t) W_mtime(ns int) {
+	fieldw(ind.Iblk.Data, ifield(ind.Ioff, ITIMEOFF+1), ns)
+}
+
+// /       W_ctime records the last status change time.
+func (ind *Inode_t) W_ctime(ns int) {
+	fieldw(ind.Iblk.Data, ifield(ind.Ioff, ITIMEOFF+2), ns)
+}
+
+// /       W_mode records the permission bits.
+func (ind *Inode_t) W_mode(m int) {
+	fieldw(ind.Iblk.Data, ifield(ind.Ioff, IPERMOFF), m&S_IPERM)
+}
+
+// /       W_uid records the owner's user id.
+func (ind *Inode_t) W_uid(uid int) {
+	fieldw(ind.Iblk.Data, ifield(ind.Ioff, IPERMOFF+1), uid)
+}
+
+// /       W_gid records the owner's group id.
+func (ind *Inode_t) W_gid(gid int) {
+	fieldw(ind.Iblk.Data, ifield(ind.Ioff, IPERMOFF+2), gid)
+}
+
 // /       W_addr sets the i'th direct block address.
 func (ind *Inode_t) W_addr(i int, blk int) {
 	if i < 0 || i > NIADDRS {
@@ -191,7 +298,34 @@ type imemnode_t struct {
 	minor  int
 	indir  int
 	dindir int
+	tindir int
 	addrs  [NIADDRS]int
+	// root of a directory's on-disk index, or DIRIDX_NONE/DIRIDX_EMPTY
+	diridx int
+	// the last transactions that logged the inode and that changed its
+	// data, which fsync and fdatasync wait for.
+	ltrans int
+	dtrans int
+	// timestamps in nanoseconds. atime is only updated in memory by reads
+	// and reaches the disk with the next update of the inode.
+	atime int
+	mtime int
+	ctime int
+	// permission bits (S_IPERM) and owner
+	mode int
+	uid  int
+	gid  int
+	// the error of reading the inode from disk. an inode that could not be
+	// read is dead, and looking it up fails until it leaves the cache.
+	ioerr defs.Err_t
+	// sequential read detection: the file block after the last one read,
+	// the read-ahead window in blocks, which is zero while reads are not
+	// sequential, and the file block up to which blocks were read ahead
+	ra struct {
+		next int
+		win  int
+		end  int
+	}
 	// inode specific metadata blocks
 	dentc struct {
 		// true iff all non-empty directory entries are cached, thus
@@ -263,6 +397,12 @@ func (idm *imemnode_t) EvictDone() {
 	// nothing to do anymore: Evict() already deleted idm's directory cache
 }
 
+// /      Evictable reports whether the cache may evict the unused inode. An
+// /      unlinked inode is removed by its last Refdown instead.
+func (idm *imemnode_t) Evictable() bool {
+	return idm.links != 0
+}
+
 // /      Free releases all resources associated with the inode.
 func (idm *imemnode_t) Free() {
 	// no need to lock...
@@ -298,11 +438,23 @@ func (idm *imemnode_t) idm_init(inum defs.Inum_t) {
 	if fs_debug {
 		fmt.Printf("idm_init: read inode %v\n", inum)
 	}
-	blk := idm.idibread()
+	blk, err := idm.fs.fslog.Get_fill(idm.fs.ialloc.Iblock(inum), "idm_init", true)
 	idm.fs.istats.Nifill.Inc()
-	idm.fill(blk, inum)
+	if err == 0 {
+		idm.fill(blk, inum)
+	} else {
+		// a link keeps the inode evictable, so that a later lookup
+		// reads it again
+		idm.ioerr = err
+		idm.itype = I_DEAD
+		idm.links = 1
+	}
 	blk.Unlock()
 	idm.fs.fslog.Relse(blk, "idm_init")
+	// the inode may have been changed by any transaction that has not
+	// committed yet
+	idm.ltrans = idm.fs.fslog.Transid()
+	idm.dtrans = idm.ltrans
 }
 
 func (idm *imemnode_t) iunlock_refdown(s string) bool {
@@ -325,6 +477,7 @@ func (idm *imemnode_t) _iupdate(opid opid_t) defs.Err_t {
 		if idm.flushto(iblk, idm.inum) {
 			iblk.Unlock()
 			idm.fs.fslog.Write(opid, iblk)
+			idm.ltrans = idm.fs.fslog.Transid()
 		} else {
 			iblk.Unlock()
 		}
@@ -341,10 +494,284 @@ func (idm *imemnode_t) do_trunc(opid opid_t, truncto uint) defs.Err_t {
 	err := idm.itrunc(opid, truncto)
 	if err == 0 {
 		idm._iupdate(opid)
+		idm.dtrans = idm.fs.fslog.Transid()
 	}
 	return err
 }
 
+// waits until the inode's changes are on disk. with datasync, only changes to
+// the data and to what is needed to read it back count, like fdatasync(2).
+func (idm *imemnode_t) do_fsync(datasync bool) defs.Err_t {
+	idm.ilock("fsync")
+	id := idm.dtrans
+	if !datasync && idm.ltrans > id {
+		id = idm.ltrans
+	}
+	idm.iunlock("fsync")
+	idm.fs.istats.Nfsync.Inc()
+	return idm.fs.fslog.Force_trans(id)
+}
+
+// fallocate(2) on a regular file. without FALLOC_FL_PUNCH_HOLE, the blocks of
+// [off, off+len) are allocated (zeroed) and, unless FALLOC_FL_KEEP_SIZE is
+// given, the file grows to cover them. with it, the range is zeroed and the
+// blocks entirely inside it are freed, leaving a hole.
+func (idm *imemnode_t) do_fallocate(mode, off, len int) defs.Err_t {
+	if mode&^(defs.FALLOC_FL_KEEP_SIZE|defs.FALLOC_FL_PUNCH_HOLE) != 0 {
+		return -defs.EOPNOTSUPP
+	}
+	punch := mode&defs.FALLOC_FL_PUNCH_HOLE != 0
+	if punch && mode&defs.FALLOC_FL_KEEP_SIZE == 0 {
+		return -defs.EOPNOTSUPP
+	}
+	if off < 0 || len <= 0 {
+		return -defs.EINVAL
+	}
+	end := off + len
+	if end < off || end > maxfilesz {
+		if !punch {
+			return -defs.EFBIG
+		}
+		end = maxfilesz
+	}
+
+	idm.ilock("fallocate")
+	itype := idm.itype
+	idm.iunlock("fallocate")
+	if itype == I_DIR {
+		return -defs.EISDIR
+	} else if itype != I_FILE {
+		return -defs.ENODEV
+	}
+
+	idm.fs.istats.Nfallocate.Inc()
+	if punch {
+		return idm.ipunch(off, end)
+	}
+	return idm.iprealloc(off, end, mode&defs.FALLOC_FL_KEEP_SIZE == 0)
+}
+
+// allocates the missing blocks of [off, end), growing the file to end if
+// extend is set. like do_write, the work is split into operations of at most
+// MaxBlkPerOp - 3 new blocks, to account for indirect blocks.
+func (idm *imemnode_t) iprealloc(off, end int, extend bool) defs.Err_t {
+	fbn := off / BSIZE
+	lastfbn := (end - 1) / BSIZE
+	for fbn <= lastfbn {
+		gimme := bounds.Bounds(bounds.B_IMEMNODE_T_DO_FALLOCATE)
+		if !res.Resadd_noblock(gimme) {
+			return -defs.ENOHEAP
+		}
+
+		opid := idm.fs.fslog.Op_begin("fallocate")
+		idm.ilock("fallocate")
+		var err defs.Err_t
+		for n := 0; fbn <= lastfbn && n < MaxBlkPerOp-3; fbn++ {
+			// leave room for the indirect blocks; the allocator
+			// can't back out of a full disk.
+			if idm.fs.balloc.alloc.nfreebits < 4 {
+				err = -defs.ENOSPC
+				break
+			}
+			var isnew bool
+			_, isnew, err = idm.fbn2block(opid, fbn, true)
+			if err != 0 {
+				break
+			}
+			if isnew {
+				n++
+			}
+		}
+		if extend {
+			if e := min(fbn*BSIZE, end); e > idm.size {
+				idm.size = e
+				idm.mtime = now()
+				idm.ctime = idm.mtime
+			}
+		}
+		idm.dtrans = idm.fs.fslog.Transid()
+		idm._iupdate(opid)
+		idm.iunlock("fallocate")
+		idm.fs.fslog.Op_end(opid)
+		if err != 0 {
+			return err
+		}
+	}
+	return 0
+}
+
+// zeroes [off, end) of the file and frees the blocks that lie entirely inside
+// it. the partial blocks at either end are zeroed with ordered writes, like
+// any other write of file data. a freed block may still be in the log or have
+// an ordered write pending; the log already copes with both when the block is
+// allocated again, by dropping the stale write or adding a revoke record.
+func (idm *imemnode_t) ipunch(off, end int) defs.Err_t {
+	fbn := util.Roundup(off, BSIZE) / BSIZE
+	lastfbn := end / BSIZE
+
+	opid := idm.fs.fslog.Op_begin("punch")
+	idm.ilock("punch")
+	if fbn > lastfbn {
+		idm.izero(opid, off, end)
+	} else {
+		idm.izero(opid, off, fbn*BSIZE)
+		idm.izero(opid, lastfbn*BSIZE, end)
+	}
+	idm.mtime = now()
+	idm.ctime = idm.mtime
+	idm.dtrans = idm.fs.fslog.Transid()
+	idm._iupdate(opid)
+	idm.iunlock("punch")
+	idm.fs.fslog.Op_end(opid)
+
+	for fbn < lastfbn {
+		gimme := bounds.Bounds(bounds.B_IMEMNODE_T_DO_FALLOCATE)
+		if !res.Resadd_noblock(gimme) {
+			return -defs.ENOHEAP
+		}
+
+		opid := idm.fs.fslog.Op_begin("punch")
+		idm.ilock("punch")
+		// freeing one data block writes at most four more blocks: its
+		// bitmap block and, for each indirect block on the way to it,
+		// either that block or, if it became empty, its bitmap block.
+		distinct := map[int]bool{idm.fs.ialloc.Iblock(idm.inum): true}
+		for fbn < lastfbn && len(distinct)+4 <= MaxBlkPerOp {
+			fbn = idm.ipunch1(opid, fbn, lastfbn, distinct)
+		}
+		idm.dtrans = idm.fs.fslog.Transid()
+		idm._iupdate(opid)
+		idm.iunlock("punch")
+		idm.fs.fslog.Op_end(opid)
+	}
+	return 0
+}
+
+// zeroes the part of [off, end) that lies within the file and within a single
+// block, unless that block is a hole. caller holds lock on idm.
+func (idm *imemnode_t) izero(opid opid_t, off, end int) {
+	end = min(end, idm.size)
+	if off >= end {
+		return
+	}
+	b, err := idm.off2buf(opid, off, end-off, false, true, "izero")
+	if err != 0 || b == nil {
+		return
+	}
+	s := off % BSIZE
+	copy(b.Data[s:s+end-off], zeroblk[:])
+	b.Unlock()
+	idm.fs.fslog.Write_ordered(opid, b)
+	idm.fs.fslog.Relse(b, "izero")
+	idm.fs.istats.Npunch.Inc()
+}
+
+// returns the number of indirect blocks between the inode and file block fbn,
+// the first file block reached through the same inode slot, and the slot to
+// follow in each indirect block, outermost first.
+func fbnpath(fbn int) (int, int, [3]int) {
+	var slots [3]int
+	if fbn < NIADDRS {
+		slots[0] = fbn
+		return 0, 0, slots
+	}
+	base := NIADDRS
+	span := INDADDR
+	for lvl := 1; lvl <= 3; lvl++ {
+		if fbn < base+span {
+			rel := fbn - base
+			for i := lvl - 1; i >= 0; i-- {
+				slots[i] = rel % INDADDR
+				rel /= INDADDR
+			}
+			return lvl, base, slots
+		}
+		base += span
+		span *= INDADDR
+	}
+	panic("too big fbn")
+}
+
+// frees block blkno and records the bitmap block it changes in distinct.
+func (idm *imemnode_t) ibfree(opid opid_t, blkno int, distinct map[int]bool) {
+	idm.fs.balloc.Bfree(opid, blkno)
+	distinct[idm.fs.balloc.mapblock(blkno)] = true
+}
+
+// reports whether every slot of indirect block b is empty.
+func indempty(b *Bdev_block_t) bool {
+	for i := 0; i < INDADDR; i++ {
+		if util.Readn(b.Data[:], 8, i*8) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// frees file block fbn, if it exists, and returns the next file block to
+// punch; a missing indirect block skips all the file blocks under it. once the
+// punch moves past the last slot of an indirect block, or reaches end, the
+// indirect block is freed if it is empty. the blocks written are added to
+// distinct. caller holds lock on idm.
+func (idm *imemnode_t) ipunch1(opid opid_t, fbn, end int, distinct map[int]bool) int {
+	lvl, base, slots := fbnpath(fbn)
+	if lvl == 0 {
+		if blkno := idm.addrs[fbn]; blkno != 0 {
+			idm.ibfree(opid, blkno, distinct)
+			idm.addrs[fbn] = 0
+			idm.fs.istats.Npunch.Inc()
+		}
+		return fbn + 1
+	}
+
+	root := [...]*int{&idm.indir, &idm.dindir, &idm.tindir}[lvl-1]
+	var path [3]*Bdev_block_t
+	// span is the number of file blocks under blkno
+	span := 1
+	for i := 0; i < lvl; i++ {
+		span *= INDADDR
+	}
+	blkno := *root
+	n := 0
+	for ; n < lvl && blkno != 0; n++ {
+		path[n] = idm.mbread(blkno)
+		blkno = util.Readn(path[n].Data[:], 8, slots[n]*8)
+		span /= INDADDR
+	}
+	next := base + ((fbn-base)/span+1)*span
+	dirty := false
+	if blkno != 0 {
+		idm.ibfree(opid, blkno, distinct)
+		util.Writen(path[n-1].Data[:], 8, slots[n-1]*8, 0)
+		dirty = true
+		idm.fs.istats.Npunch.Inc()
+	}
+	for i := n - 1; i >= 0; i-- {
+		b := path[i]
+		span *= INDADDR
+		start := base + ((fbn-base)/span)*span
+		done := next >= start+span || next >= end
+		if !done || !indempty(b) {
+			if dirty {
+				idm.fs.fslog.Write(opid, b)
+				distinct[b.Block] = true
+			}
+			break
+		}
+		idm.ibfree(opid, b.Block, distinct)
+		if i == 0 {
+			*root = 0
+		} else {
+			util.Writen(path[i-1].Data[:], 8, slots[i-1]*8, 0)
+		}
+		dirty = true
+	}
+	for _, b := range path[:n] {
+		idm.fs.fslog.Relse(b, "ipunch1")
+	}
+	return next
+}
+
 func (idm *imemnode_t) do_read(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return idm.iread(dst, offset)
 }
@@ -387,6 +814,7 @@ func (idm *imemnode_t) do_write(src fdops.Userio_i, offset int, app bool) (int,
 		s1 := stats.Rdtsc()
 		wrote, err := idm.iwrite(opid, src, off, n)
 		idm.fs.istats.Ciwrite.Add(s1)
+		idm.dtrans = idm.fs.fslog.Transid()
 
 		s2 := stats.Rdtsc()
 		idm._iupdate(opid)
@@ -404,6 +832,10 @@ func (idm *imemnode_t) do_write(src fdops.Userio_i, offset int, app bool) (int,
 		}
 
 		i += wrote
+		if wrote < n {
+			// reached the largest file size
+			break
+		}
 	}
 	return i, 0
 }
@@ -415,9 +847,105 @@ func (idm *imemnode_t) do_stat(st *stat.Stat_t) defs.Err_t {
 	st.Wmode(idm.mkmode())
 	st.Wsize(uint(idm.size))
 	st.Wrdev(defs.Mkdev(idm.major, idm.minor))
+	st.Wuid(uint(idm.uid))
+	st.Wgid(uint(idm.gid))
+	st.Watime(uint(idm.atime/1e9), uint(idm.atime%1e9))
+	st.Wmtime(uint(idm.mtime/1e9), uint(idm.mtime%1e9))
+	st.Wctime(uint(idm.ctime/1e9), uint(idm.ctime%1e9))
 	return 0
 }
 
+// sets the access and modification times of idm; a negative time leaves the
+// corresponding timestamp unchanged.
+func (idm *imemnode_t) do_utimens(opid opid_t, atime, mtime int) defs.Err_t {
+	if atime >= 0 {
+		idm.atime = atime
+	}
+	if mtime >= 0 {
+		idm.mtime = mtime
+	}
+	idm.ctime = now()
+	return idm._iupdate(opid)
+}
+
+// checks whether cred may access idm as requested by want, a combination of
+// A_READ, A_WRITE and A_EXEC. the superuser may do anything except execute a
+// file without any execute bit. caller holds lock on idm.
+func (idm *imemnode_t) iaccess(cred *fd.Cred_t, want int) defs.Err_t {
+	if cred.Root() {
+		if want&A_EXEC != 0 && idm.itype != I_DIR && idm.mode&0111 == 0 {
+			return -defs.EACCES
+		}
+		return 0
+	}
+	var have int
+	switch {
+	case cred.Uid == idm.uid:
+		have = idm.mode >> 6
+	case cred.Gid == idm.gid:
+		have = idm.mode >> 3
+	default:
+		have = idm.mode
+	}
+	if have&want != want {
+		return -defs.EACCES
+	}
+	return 0
+}
+
+// in a sticky directory idm, only the owner of child, the owner of idm and the
+// superuser may remove or rename child. caller holds both locks.
+func (idm *imemnode_t) isticky(cred *fd.Cred_t, child *imemnode_t) defs.Err_t {
+	if idm.mode&S_ISVTX == 0 || cred.Root() {
+		return 0
+	}
+	if cred.Uid == idm.uid || cred.Uid == child.uid {
+		return 0
+	}
+	return -defs.EPERM
+}
+
+// only the owner and the superuser may change the mode. a non-superuser
+// cannot set the set-group-id bit on a file of another group.
+func (idm *imemnode_t) do_chmod(opid opid_t, mode int, cred *fd.Cred_t) defs.Err_t {
+	if !cred.Root() && cred.Uid != idm.uid {
+		return -defs.EPERM
+	}
+	if !cred.Root() && cred.Gid != idm.gid {
+		mode &^= S_ISGID
+	}
+	idm.mode = mode & S_IPERM
+	idm.ctime = now()
+	return idm._iupdate(opid)
+}
+
+// a negative uid or gid leaves it unchanged. only the superuser may change the
+// owner; the owner may change the group to its own group. a change clears the
+// set-user-id and set-group-id bits of non-directories.
+func (idm *imemnode_t) do_chown(opid opid_t, uid, gid int, cred *fd.Cred_t) defs.Err_t {
+	if uid < 0 {
+		uid = idm.uid
+	}
+	if gid < 0 {
+		gid = idm.gid
+	}
+	if !cred.Root() {
+		if cred.Uid != idm.uid || uid != idm.uid {
+			return -defs.EPERM
+		}
+		if gid != idm.gid && gid != cred.Gid {
+			return -defs.EPERM
+		}
+	}
+	idm.uid = uid
+	idm.gid = gid
+	if idm.itype != I_DIR {
+		idm.mode &^= S_ISUID | S_ISGID
+	}
+	idm.ctime = now()
+	return idm._iupdate(opid)
+}
+
 func (idm *imemnode_t) do_mmapi(off, len int, inc bool) ([]mem.Mmapinfo_t, defs.Err_t) {
 	if idm.itype != I_FILE && idm.itype != I_DIR {
 		panic("bad mmapinfo")
@@ -452,51 +980,77 @@ func (idm *imemnode_t) do_unlink(opid opid_t, name ustr.Ustr) defs.Err_t {
 	return err
 }
 
-// create new dir ent with given inode number
-func (idm *imemnode_t) do_insert(opid opid_t, fn ustr.Ustr, n defs.Inum_t) defs.Err_t {
-	err := idm.iinsert(opid, fn, n)
+// create new dir ent with given inode number and type
+func (idm *imemnode_t) do_insert(opid opid_t, fn ustr.Ustr, n defs.Inum_t, itype int) defs.Err_t {
+	err := idm.iinsert(opid, fn, n, itype)
 	if err == 0 {
 		idm._iupdate(opid)
 	}
 	return err
 }
 
-func (idm *imemnode_t) do_createnod(opid opid_t, fn ustr.Ustr, maj, min int) (*imemnode_t, defs.Err_t) {
+func (idm *imemnode_t) do_createnod(opid opid_t, fn ustr.Ustr, maj, min, mode int, cred *fd.Cred_t) (*imemnode_t, defs.Err_t) {
 	if idm.itype != I_DIR {
 		return nil, -defs.ENOTDIR
 	}
 
 	itype := I_DEV
-	child, err := idm.icreate(opid, fn, itype, maj, min)
+	child, err := idm.icreate(opid, fn, itype, maj, min, mode, cred)
 	idm._iupdate(opid)
 	return child, err
 }
 
-func (idm *imemnode_t) do_createfile(opid opid_t, fn ustr.Ustr) (*imemnode_t, defs.Err_t) {
+func (idm *imemnode_t) do_createfile(opid opid_t, fn ustr.Ustr, mode int, cred *fd.Cred_t) (*imemnode_t, defs.Err_t) {
 	if idm.itype != I_DIR {
 		return nil, -defs.ENOTDIR
 	}
 
 	itype := I_FILE
-	child, err := idm.icreate(opid, fn, itype, 0, 0)
+	child, err := idm.icreate(opid, fn, itype, 0, 0, mode, cred)
 	idm._iupdate(opid)
 	return child, err
 }
 
-func (idm *imemnode_t) do_createdir(opid opid_t, fn ustr.Ustr) (*imemnode_t, defs.Err_t) {
+func (idm *imemnode_t) do_createdir(opid opid_t, fn ustr.Ustr, mode int, cred *fd.Cred_t) (*imemnode_t, defs.Err_t) {
 	if idm.itype != I_DIR {
 		return nil, -defs.ENOTDIR
 	}
 
 	itype := I_DIR
-	child, err := idm.icreate(opid, fn, itype, 0, 0)
+	child, err := idm.icreate(opid, fn, itype, 0, 0, mode, cred)
+	idm._iupdate(opid)
+	return child, err
+}
+
+// creates a symbolic link named fn that refers to target.
+func (idm *imemnode_t) do_createsymlink(opid opid_t, fn, target ustr.Ustr, cred *fd.Cred_t) (*imemnode_t, defs.Err_t) {
+	if idm.itype != I_DIR {
+		return nil, -defs.ENOTDIR
+	}
+
+	child, err := idm.icreate(opid, fn, I_SYMLINK, 0, 0, 0777, cred)
 	idm._iupdate(opid)
+	if err == -defs.EEXIST {
+		return child, err
+	} else if err != 0 {
+		return nil, err
+	}
+	child.ilock("do_createsymlink")
+	if err = child.iwritelink(opid, target); err != 0 {
+		// the caller's reference frees the orphaned link
+		if _, nerr := idm.iunlink(opid, fn); nerr != 0 {
+			panic("must succeed")
+		}
+		child._linkdown(opid)
+	}
+	child.iunlock("do_createsymlink")
 	return child, err
 }
 
 // caller holds lock on idm
 func (idm *imemnode_t) _linkdown(opid opid_t) {
 	idm.links--
+	idm.ctime = now()
 	if idm.links <= 0 {
 		idm.fs.icache.markOrphan(opid, idm.inum)
 	}
@@ -505,16 +1059,28 @@ func (idm *imemnode_t) _linkdown(opid opid_t) {
 
 func (idm *imemnode_t) _linkup(opid opid_t) {
 	idm.links++
+	idm.ctime = now()
 	idm._iupdate(opid)
 }
 
 // metadata block interface; only one inode touches these blocks at a time,
 // thus no concurrency control
 func (ic *imemnode_t) mbread(blockn int) *Bdev_block_t {
-	mb := ic.fs.fslog.Get_fill(blockn, "mbread", false)
+	mb := ic.fs.fslog.Get_meta(blockn, "mbread", false)
 	return mb
 }
 
+// mbread for callers that can fail with the disk's error. the block is
+// released if the disk cannot read it.
+func (ic *imemnode_t) mbfill(blockn int) (*Bdev_block_t, defs.Err_t) {
+	mb, err := ic.fs.fslog.Get_fill(blockn, "mbfill", false)
+	if err != 0 {
+		ic.fs.fslog.Relse(mb, "mbfill")
+		return nil, err
+	}
+	return mb, 0
+}
+
 func (ic *imemnode_t) fill(blk *Bdev_block_t, inum defs.Inum_t) {
 	inode := Inode_t{blk, ioffset(inum)}
 	ic.itype = inode.itype()
@@ -529,9 +1095,17 @@ func (ic *imemnode_t) fill(blk *Bdev_block_t, inum defs.Inum_t) {
 	ic.minor = inode.minor()
 	ic.indir = inode.indirect()
 	ic.dindir = inode.dindirect()
+	ic.tindir = inode.tindirect()
+	ic.diridx = inode.diridx()
 	for i := 0; i < NIADDRS; i++ {
 		ic.addrs[i] = inode.addr(i)
 	}
+	ic.atime = inode.atime()
+	ic.mtime = inode.mtime()
+	ic.ctime = inode.ctime()
+	ic.mode = inode.mode()
+	ic.uid = inode.uid()
+	ic.gid = inode.gid()
 	if ic.itype == I_DIR {
 		ic.dentc.dents = hashtable.MkHash(100)
 	}
@@ -545,7 +1119,12 @@ func (ic *imemnode_t) flushto(blk *Bdev_block_t, inum defs.Inum_t) bool {
 	ret := false
 	if j.itype() != k.itype || j.linkcount() != k.links ||
 		j.size() != k.size || j.major() != k.major ||
-		j.minor() != k.minor || j.indirect() != k.indir {
+		j.minor() != k.minor || j.indirect() != k.indir ||
+		j.dindirect() != k.dindir || j.tindirect() != k.tindir ||
+		j.diridx() != k.diridx ||
+		j.atime() != k.atime || j.mtime() != k.mtime ||
+		j.ctime() != k.ctime || j.mode() != k.mode ||
+		j.uid() != k.uid || j.gid() != k.gid {
 		ret = true
 	}
 	for i, v := range ic.addrs {
@@ -560,9 +1139,17 @@ func (ic *imemnode_t) flushto(blk *Bdev_block_t, inum defs.Inum_t) bool {
 	inode.w_minor(ic.minor)
 	inode.w_indirect(ic.indir)
 	inode.w_dindirect(ic.dindir)
+	inode.w_tindirect(ic.tindir)
+	inode.W_diridx(ic.diridx)
 	for i := 0; i < NIADDRS; i++ {
 		inode.W_addr(i, ic.addrs[i])
 	}
+	inode.W_atime(ic.atime)
+	inode.W_mtime(ic.mtime)
+	inode.W_ctime(ic.ctime)
+	inode.W_mode(ic.mode)
+	inode.W_uid(ic.uid)
+	inode.W_gid(ic.gid)
 	return ret
 }
 
@@ -576,26 +1163,28 @@ func (idm *imemnode_t) ensureb(opid opid_t, blkno int, writing bool) (int, bool,
 }
 
 // ensure entry in indirect block exists
-func (idm *imemnode_t) ensureind(opid opid_t, blk *Bdev_block_t, slot int, writing bool) (int, defs.Err_t) {
+func (idm *imemnode_t) ensureind(opid opid_t, blk *Bdev_block_t, slot int, writing bool) (int, bool, defs.Err_t) {
 	off := slot * 8
 	s := blk.Data[:]
 	blkn := util.Readn(s, 8, off)
 	blkn, isnew, err := idm.ensureb(opid, blkn, writing)
 	if err != 0 {
-		return 0, err
+		return 0, false, err
 	}
 	if isnew {
 		util.Writen(s, 8, off, blkn)
 		idm.fs.fslog.Write(opid, blk)
 	}
-	return blkn, 0
+	return blkn, isnew, 0
 }
 
-// Assumes that every block until b exits
+// returns the block holding file block fbn and whether it was just allocated.
+// when not writing, a hole (a missing block or a missing indirect block on the
+// way to it) yields block number 0.
 // XXX change to wrap blockiter_t instead
 func (idm *imemnode_t) fbn2block(opid opid_t, fbn int, writing bool) (int, bool, defs.Err_t) {
 	if fbn < NIADDRS {
-		if idm.addrs[fbn] != 0 {
+		if idm.addrs[fbn] != 0 || !writing {
 			return idm.addrs[fbn], false, 0
 		}
 		blkn, err := idm.fs.balloc.Balloc(opid)
@@ -618,11 +1207,17 @@ func (idm *imemnode_t) fbn2block(opid opid_t, fbn int, writing bool) (int, bool,
 				// new indirect block will be written to log by iupdate()
 				idm.indir = indno
 			}
-			indblk := idm.mbread(indno)
-			blkn, err := idm.ensureind(opid, indblk, fbn, writing)
+			if indno == 0 {
+				return 0, false, 0
+			}
+			indblk, err := idm.mbfill(indno)
+			if err != 0 {
+				return 0, false, err
+			}
+			blkn, isnew, err := idm.ensureind(opid, indblk, fbn, writing)
 			idm.fs.fslog.Relse(indblk, "indblk")
-			return blkn, false, err
-		} else if fbn < INDADDR*INDADDR {
+			return blkn, isnew, err
+		} else if fbn < INDADDR+INDADDR*INDADDR {
 			fbn -= INDADDR
 			dindno := idm.dindir
 			dindno, isnew, err := idm.ensureb(opid, dindno, writing)
@@ -633,14 +1228,67 @@ func (idm *imemnode_t) fbn2block(opid opid_t, fbn int, writing bool) (int, bool,
 				// new dindirect block will be written to log by iupdate()
 				idm.dindir = dindno
 			}
-			dindblk := idm.mbread(dindno)
-			indno, err := idm.ensureind(opid, dindblk, fbn/INDADDR, writing)
+			if dindno == 0 {
+				return 0, false, 0
+			}
+			dindblk, err := idm.mbfill(dindno)
+			if err != 0 {
+				return 0, false, err
+			}
+			indno, _, err := idm.ensureind(opid, dindblk, fbn/INDADDR, writing)
 			idm.fs.fslog.Relse(dindblk, "dindblk")
+			if err != 0 || indno == 0 {
+				return 0, false, err
+			}
 
-			indblk := idm.mbread(indno)
-			blkn, err := idm.ensureind(opid, indblk, fbn%INDADDR, writing)
+			indblk, err := idm.mbfill(indno)
+			if err != 0 {
+				return 0, false, err
+			}
+			blkn, isnew, err := idm.ensureind(opid, indblk, fbn%INDADDR, writing)
 			idm.fs.fslog.Relse(indblk, "indblk2")
-			return blkn, false, err
+			return blkn, isnew, err
+		} else if fbn < INDADDR+INDADDR*INDADDR+INDADDR*INDADDR*INDADDR {
+			fbn -= INDADDR + INDADDR*INDADDR
+			tindno := idm.tindir
+			tindno, isnew, err := idm.ensureb(opid, tindno, writing)
+			if err != 0 {
+				return 0, false, err
+			}
+			if isnew {
+				// new tindirect block will be written to log by iupdate()
+				idm.tindir = tindno
+			}
+			if tindno == 0 {
+				return 0, false, 0
+			}
+			tindblk, err := idm.mbfill(tindno)
+			if err != 0 {
+				return 0, false, err
+			}
+			dindno, _, err := idm.ensureind(opid, tindblk, fbn/(INDADDR*INDADDR), writing)
+			idm.fs.fslog.Relse(tindblk, "tindblk")
+			if err != 0 || dindno == 0 {
+				return 0, false, err
+			}
+
+			dindblk, err := idm.mbfill(dindno)
+			if err != 0 {
+				return 0, false, err
+			}
+			indno, _, err := idm.ensureind(opid, dindblk, (fbn/INDADDR)%INDADDR, writing)
+			idm.fs.fslog.Relse(dindblk, "dindblk3")
+			if err != 0 || indno == 0 {
+				return 0, false, err
+			}
+
+			indblk, err := idm.mbfill(indno)
+			if err != 0 {
+				return 0, false, err
+			}
+			blkn, isnew, err := idm.ensureind(opid, indblk, fbn%INDADDR, writing)
+			idm.fs.fslog.Relse(indblk, "indblk3")
+			return blkn, isnew, err
 		} else {
 			panic("too big fbn")
 			return 0, false, 0
@@ -649,40 +1297,21 @@ func (idm *imemnode_t) fbn2block(opid opid_t, fbn int, writing bool) (int, bool,
 	}
 }
 
+// returns the block of whichblk, allocating it if writing. a write past the
+// end of the file, whose last block is lastblk, allocates only the block
+// written and leaves the blocks in between as holes, which read as zeros.
 func (idm *imemnode_t) bmapfill(opid opid_t, lastblk int, whichblk int, writing bool) (int, bool, defs.Err_t) {
-	blkn := 0
-	new := false
-	var err defs.Err_t
-
-	if whichblk >= lastblk { // a hole?
-		// allocate the missing blocks
-		if whichblk > lastblk && writing {
-			idm.fs.istats.Nfillhole.Inc()
-		} else if writing {
-			idm.fs.istats.Ngrow.Inc()
-		}
-		for b := lastblk; b <= whichblk; b++ {
-			gimme := bounds.Bounds(bounds.B_IMEMNODE_T_BMAPFILL)
-			if !res.Resadd_noblock(gimme) {
-				return 0, false, -defs.ENOHEAP
-			}
-			// XXX we could remember where the last slot was
-			blkn, new, err = idm.fbn2block(opid, b, writing)
-			if err != 0 {
-				return blkn, new, err
-			}
-		}
-	} else {
-		blkn, new, err = idm.fbn2block(opid, whichblk, writing)
-		if err != 0 {
-			return blkn, new, err
-		}
+	if whichblk > lastblk && writing {
+		idm.fs.istats.Nfillhole.Inc()
+	} else if whichblk == lastblk && writing {
+		idm.fs.istats.Ngrow.Inc()
 	}
-	return blkn, new, 0
+	return idm.fbn2block(opid, whichblk, writing)
 }
 
 // Takes as input the file offset and whether the operation is a write and
-// returns the block number of the block responsible for that offset.
+// returns the block number of the block responsible for that offset, or 0 if
+// the offset falls in a hole and the operation is not a write.
 func (idm *imemnode_t) offsetblk(opid opid_t, offset int, writing bool) (int, bool, defs.Err_t) {
 	if writing && opid == 0 && idm.fs.diskfs {
 		panic("offsetblk: writing but no opid\n")
@@ -693,13 +1322,14 @@ func (idm *imemnode_t) offsetblk(opid opid_t, offset int, writing bool) (int, bo
 	if err != 0 {
 		return blkn, new, err
 	}
-	if blkn <= 0 || blkn >= idm.fs.superb.Lastblock() {
+	if blkn < 0 || (blkn == 0 && writing) || blkn >= idm.fs.superb.Lastblock() {
 		panic("offsetblk: bad data blocks")
 	}
 	return blkn, new, 0
 }
 
-// Return locked buffer for offset
+// Return locked buffer for offset, or nil if the offset falls in a hole and
+// fillhole is false
 func (idm *imemnode_t) off2buf(opid opid_t, offset int, len int, fillhole bool, fill bool, s string) (*Bdev_block_t, defs.Err_t) {
 	if offset%mem.PGSIZE+len > mem.PGSIZE {
 		panic("off2buf")
@@ -708,15 +1338,28 @@ func (idm *imemnode_t) off2buf(opid opid_t, offset int, len int, fillhole bool,
 	if err != 0 {
 		return nil, err
 	}
+	if blkno == 0 {
+		return nil, 0
+	}
 	var b *Bdev_block_t
 	if fill && !new {
-		b = idm.fs.fslog.Get_fill(blkno, s, true)
+		b, err = idm.fs.fslog.Get_fill(blkno, s, true)
+		if err != 0 {
+			b.Unlock()
+			idm.fs.fslog.Relse(b, s)
+			return nil, err
+		}
 	} else {
 		b = idm.fs.fslog.Get_nofill(blkno, s, true)
 	}
 	return b, 0
 }
 
+// returns the current time in the unit of inode timestamps.
+func now() int {
+	return int(time.Now().UnixNano())
+}
+
 func min(a, b int) int {
 	if a < b {
 		return a
@@ -724,10 +1367,73 @@ func min(a, b int) int {
 	return b
 }
 
+// the contents of a hole
+var zeroblk [BSIZE]uint8
+
+// the smallest and the largest read-ahead windows in blocks
+const (
+	ramin = 4
+	ramax = 64
+)
+
+// notes a read of the bytes from off up to end and starts reading the blocks
+// of the read that are not cached with as few disk requests as possible. if
+// reads of idm are sequential, it also reads the blocks that follow ahead. the
+// window starts at ramin blocks and doubles each time the reader comes within
+// half a window of the end of the blocks read ahead, up to ramax blocks; a
+// read elsewhere resets it. caller holds lock on idm.
+func (idm *imemnode_t) readahead(off, end int) {
+	if end <= off {
+		return
+	}
+	ra := &idm.ra
+	first := off / BSIZE
+	last := (end - 1) / BSIZE
+	// a read that starts in the block where the last one ended is
+	// sequential too
+	if first != ra.next && first != ra.next-1 {
+		ra.win = 0
+		ra.end = 0
+	} else if ra.win == 0 {
+		ra.win = ramin
+	} else if ra.end-(last+1) < ra.win/2 {
+		ra.win = min(2*ra.win, ramax)
+	} else {
+		ra.next = last + 1
+		return
+	}
+	ra.next = last + 1
+	from := first
+	if ra.end > from {
+		from = ra.end
+	}
+	to := min(last+1+ra.win, (idm.size+BSIZE-1)/BSIZE)
+	// a read of a single block needs no help
+	if to-from <= 1 {
+		return
+	}
+	var blks []int
+	for fbn := from; fbn < to; fbn++ {
+		blkn, _, err := idm.offsetblk(opid_t(0), fbn*BSIZE, false)
+		if err != 0 {
+			break
+		}
+		// holes read as zeros
+		if blkn != 0 {
+			blks = append(blks, blkn)
+		}
+	}
+	ra.end = to
+	if idm.fs.fslog.Read_ahead(blks) > 0 {
+		idm.fs.istats.Nreadahead.Inc()
+	}
+}
+
 func (idm *imemnode_t) iread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 	idm.fs.istats.Niread.Inc()
 	isz := idm.size
 	c := 0
+	idm.readahead(offset, min(isz, offset+dst.Remain()))
 	gimme := bounds.Bounds(bounds.B_IMEMNODE_T_IREAD)
 	for offset < isz && dst.Remain() != 0 {
 		if !res.Resadd_noblock(gimme) {
@@ -739,6 +1445,16 @@ func (idm *imemnode_t) iread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 		if err != 0 {
 			return c, err
 		}
+		if b == nil {
+			// holes read as zeros
+			wrote, err := dst.Uiowrite(zeroblk[:m])
+			c += wrote
+			offset += wrote
+			if err != 0 {
+				return c, err
+			}
+			continue
+		}
 		s := offset % BSIZE
 		src := b.Data[s : s+m]
 
@@ -756,12 +1472,21 @@ func (idm *imemnode_t) iread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
 			return c, err
 		}
 	}
+	if c > 0 {
+		idm.atime = now()
+	}
 	return c, 0
 }
 
+// a write that starts at or past the largest file size fails with EFBIG and
+// one that crosses it is cut short, as in Linux.
 func (idm *imemnode_t) iwrite(opid opid_t, src fdops.Userio_i, offset int, n int) (int, defs.Err_t) {
 	idm.fs.istats.Niwrite.Inc()
 	sz := min(src.Totalsz(), n)
+	if sz > 0 && offset >= maxfilesz {
+		return 0, -defs.EFBIG
+	}
+	sz = min(sz, maxfilesz-offset)
 	newsz := offset + sz
 	c := 0
 	gimme := bounds.Bounds(bounds.B_IMEMNODE_T_IWRITE)
@@ -799,22 +1524,60 @@ func (idm *imemnode_t) iwrite(opid opid_t, src fdops.Userio_i, offset int, n int
 	if newsz > idm.size {
 		idm.size = newsz
 	}
+	if wrote > 0 {
+		idm.mtime = now()
+		idm.ctime = idm.mtime
+	}
 	return wrote, 0
 }
 
-func (idm *imemnode_t) itrunc(opid opid_t, newlen uint) defs.Err_t {
-	if newlen > uint(idm.size) {
-		// this will cause the hole to filled in with zero blocks which
-		// are logged to disk
-		_, _, err := idm.offsetblk(opid, int(newlen), true)
-		if err != 0 {
-			return err
-		}
+// the target of a symbolic link is stored in its first block. caller holds
+// lock on idm.
+func (idm *imemnode_t) iwritelink(opid opid_t, target ustr.Ustr) defs.Err_t {
+	if len(target) > SYMLINK_MAX {
+		panic("symlink target too long")
+	}
+	b, err := idm.off2buf(opid, 0, len(target), true, false, "iwritelink")
+	if err != 0 {
+		return err
+	}
+	copy(b.Data[:], target)
+	b.Unlock()
+	idm.fs.fslog.Write(opid, b)
+	idm.fs.fslog.Relse(b, "iwritelink")
+	idm.size = len(target)
+	return idm._iupdate(opid)
+}
+
+// returns the target of the symbolic link idm. caller holds lock on idm.
+func (idm *imemnode_t) ireadlink() (ustr.Ustr, defs.Err_t) {
+	if idm.itype != I_SYMLINK {
+		return nil, -defs.EINVAL
+	}
+	if idm.size <= 0 || idm.size > SYMLINK_MAX {
+		return nil, -defs.EIO
+	}
+	b, err := idm.off2buf(opid_t(0), 0, idm.size, false, true, "ireadlink")
+	if err != 0 {
+		return nil, err
+	}
+	target := make(ustr.Ustr, idm.size)
+	copy(target, b.Data[:idm.size])
+	b.Unlock()
+	idm.fs.fslog.Relse(b, "ireadlink")
+	return target, 0
+}
 
+func (idm *imemnode_t) itrunc(opid opid_t, newlen uint) defs.Err_t {
+	if newlen > maxfilesz {
+		return -defs.EFBIG
 	}
+	// growing the file leaves a hole, which reads as zeros
 	idm.fs.istats.Nitrunc.Inc()
 	// inode is flushed by do_itrunc
 	idm.size = int(newlen)
+	idm.mtime = now()
+	idm.ctime = idm.mtime
 	return 0
 }
 
@@ -828,7 +1591,7 @@ func (idm *imemnode_t) create_undo(opid opid_t, childi defs.Inum_t, childn ustr.
 	if ci != childi {
 		panic("inconsistent")
 	}
-	ib := idm.fs.fslog.Get_fill(idm.fs.ialloc.Iblock(childi), "create_undo", true)
+	ib := idm.fs.fslog.Get_meta(idm.fs.ialloc.Iblock(childi), "create_undo", true)
 	ni := &Inode_t{ib, ioffset(childi)}
 	ni.W_itype(I_DEAD)
 	ib.Unlock()
@@ -837,7 +1600,8 @@ func (idm *imemnode_t) create_undo(opid opid_t, childi defs.Inum_t, childn ustr.
 	return 0
 }
 
-func (idm *imemnode_t) icreate(opid opid_t, name ustr.Ustr, nitype, major, minor int) (*imemnode_t, defs.Err_t) {
+// the new inode gets the permission bits of mode and is owned by cred.
+func (idm *imemnode_t) icreate(opid opid_t, name ustr.Ustr, nitype, major, minor, mode int, cred *fd.Cred_t) (*imemnode_t, defs.Err_t) {
 	// XXX XXX fail if links == 0
 	if !idm._amlocked {
 		panic("lsjdf")
@@ -857,10 +1621,14 @@ func (idm *imemnode_t) icreate(opid opid_t, name ustr.Ustr, nitype, major, minor
 	if err == 0 {
 		return child, -defs.EEXIST
 	}
+	if err := idm.iaccess(cred, A_WRITE|A_EXEC); err != 0 {
+		return nil, err
+	}
 
 	idm.fs.istats.Nicreate.Inc()
 
 	// allocate new inode
+	t := now()
 	newinum, err := idm.fs.ialloc.Ialloc(opid)
 	var newidm *imemnode_t
 	var newinode *Inode_t
@@ -870,7 +1638,7 @@ func (idm *imemnode_t) icreate(opid opid_t, name ustr.Ustr, nitype, major, minor
 		if err != 0 {
 			return nil, err
 		}
-		newiblk := idm.fs.fslog.Get_fill(newbn, "icreate", true)
+		newiblk := idm.fs.fslog.Get_meta(newbn, "icreate", true)
 		if fs_debug {
 			fmt.Printf("ialloc: %v %v %v\n", newbn, newioff, newinum)
 		}
@@ -883,13 +1651,27 @@ func (idm *imemnode_t) icreate(opid opid_t, name ustr.Ustr, nitype, major, minor
 		newinode.w_minor(minor)
 		newinode.w_indirect(0)
 		newinode.w_dindirect(0)
+		newinode.w_tindirect(0)
+		// new directories are indexed
+		if nitype == I_DIR {
+			newinode.W_diridx(DIRIDX_EMPTY)
+		} else {
+			newinode.W_diridx(DIRIDX_NONE)
+		}
 		for i := 0; i < NIADDRS; i++ {
 			newinode.W_addr(i, 0)
 		}
+		newinode.W_atime(t)
+		newinode.W_mtime(t)
+		newinode.W_ctime(t)
+		newinode.W_mode(mode)
+		newinode.W_uid(cred.Uid)
+		newinode.W_gid(cred.Gid)
 		newiblk.Unlock()
 		idm.fs.fslog.Write(opid, newiblk)
 		idm.fs.fslog.Relse(newiblk, "icreate")
 		newidm = idm.fs.icache.Iref(newinum, "icreate")
+		newidm.ltrans = idm.fs.fslog.Transid()
 	} else {
 		// insert in icache
 		newidm = idm.fs.icache.Iref_locked_nofill(newinum, "icreate")
@@ -897,13 +1679,19 @@ func (idm *imemnode_t) icreate(opid opid_t, name ustr.Ustr, nitype, major, minor
 		newidm.links = 1
 		newidm.major = major
 		newidm.minor = minor
+		newidm.atime = t
+		newidm.mtime = t
+		newidm.ctime = t
+		newidm.mode = mode & S_IPERM
+		newidm.uid = cred.Uid
+		newidm.gid = cred.Gid
 		if newidm.itype == I_DIR {
 			newidm.dentc.dents = hashtable.MkHash(100)
 		}
 		newidm.iunlock("icreate")
 	}
 	// write new directory entry referencing newinode
-	err = idm._deinsert(opid, name, newinum)
+	err = idm._deinsert(opid, name, newinum, nitype)
 	if err != 0 {
 		fmt.Printf("deinsert failed\n")
 		if idm.fs.diskfs {
@@ -930,6 +1718,17 @@ func (idm *imemnode_t) immapinfo(offset, len int, mapshared bool) ([]mem.Mmapinf
 	idm.fs.istats.Nimmap.Inc()
 	o := util.Rounddown(offset, mem.PGSIZE)
 	len = util.Roundup(offset+len, mem.PGSIZE) - o
+	// the pages of a hole have nothing to map; the caller must fill it
+	// first. look before taking references on any of the pages.
+	for i := 0; i < len; i += mem.PGSIZE {
+		blkno, _, err := idm.offsetblk(opid_t(0), o+i, false)
+		if err != 0 {
+			return nil, err
+		}
+		if blkno == 0 {
+			return nil, -defs.EAGAIN
+		}
+	}
 	pgc := len / mem.PGSIZE
 	ret := make([]mem.Mmapinfo_t, pgc)
 	for i := 0; i < len; i += mem.PGSIZE {
@@ -963,20 +1762,41 @@ func (idm *imemnode_t) immapinfo(offset, len int, mapshared bool) ([]mem.Mmapinf
 }
 
 func (idm *imemnode_t) idibread() *Bdev_block_t {
-	return idm.fs.fslog.Get_fill(idm.fs.ialloc.Iblock(idm.inum), "idibread", true)
+	return idm.fs.fslog.Get_meta(idm.fs.ialloc.Iblock(idm.inum), "idibread", true)
 }
 
 // a type to iterate over the data and indirect blocks of an imemnode_t without
 // re-reading and re-locking indirect blocks. it may simultaneously hold
-// references to at most two blocks until blockiter_t.release() is called.
+// references to at most four blocks until blockiter_t.release() is called.
 type blockiter_t struct {
 	idm      *imemnode_t
 	which    int
 	tryevict bool
 	dub      *Bdev_block_t
+	trip     *Bdev_block_t
+	lastd    *Bdev_block_t
 	lasti    *Bdev_block_t
 }
 
+// the slots visited by blockiter_t, in order: the data blocks, the indirect
+// blocks referred to by the double-indirect block, the indirect and
+// double-indirect blocks under the triple-indirect block, and finally the
+// indirect, double-indirect and triple-indirect blocks themselves. each
+// indirect block is visited after the blocks it refers to.
+const (
+	BI_DBLOCKS = NIADDRS + INDADDR + INDADDR*INDADDR + INDADDR*INDADDR*INDADDR
+	BI_DINDS   = BI_DBLOCKS + INDADDR
+	BI_TINDS   = BI_DINDS + INDADDR*INDADDR
+	BI_TDINDS  = BI_TINDS + INDADDR
+	BI_IMD1    = BI_TDINDS
+	BI_IMD2    = BI_TDINDS + 1
+	BI_IMD3    = BI_TDINDS + 2
+	BI_ALL     = BI_TDINDS + 3
+)
+
+// the largest size of a file: its data blocks all fit in the block map
+const maxfilesz = BI_DBLOCKS * BSIZE
+
 func (bl *blockiter_t) bi_init(idm *imemnode_t, tryevict bool) {
 	var zbl blockiter_t
 	*bl = zbl
@@ -1015,6 +1835,55 @@ func (bl *blockiter_t) _isdubind(dubslot int, fetch bool) (*Bdev_block_t, int, b
 	return ret, blkno, ok
 }
 
+// if this imemnode_t has a triple-indirect block, _istrip loads it and caches
+// it and returns true.
+func (bl *blockiter_t) _istrip() (*Bdev_block_t, bool) {
+	if bl.trip != nil {
+		return bl.trip, true
+	}
+	blkno := bl.idm.tindir
+	if blkno == 0 {
+		return nil, false
+	}
+	bl.trip = bl.idm.mbread(blkno)
+	return bl.trip, true
+}
+
+// returns the double-indirect block or block number from the given slot in
+// the triple-indirect block
+func (bl *blockiter_t) _istripdub(tripslot int, fetch bool) (*Bdev_block_t, int, bool) {
+	trip, ok := bl._istrip()
+	if !ok {
+		return nil, 0, false
+	}
+
+	blkno := util.Readn(trip.Data[:], 8, tripslot*8)
+	var ret *Bdev_block_t
+	ok = blkno != 0
+	if fetch {
+		ret, ok = bl._isdind(blkno)
+	}
+	return ret, blkno, ok
+}
+
+// returns the block number in the given slot of the indirect block that the
+// triple-indirect block refers to via the double-indirect slot dslot.
+func (bl *blockiter_t) _istripind(dslot, islot int) int {
+	dub, _, ok := bl._istripdub(dslot/INDADDR, true)
+	if !ok {
+		return 0
+	}
+	blkno := util.Readn(dub.Data[:], 8, (dslot%INDADDR)*8)
+	if islot < 0 {
+		return blkno
+	}
+	single, ok := bl._isind(blkno)
+	if !ok {
+		return 0
+	}
+	return util.Readn(single.Data[:], 8, islot*8)
+}
+
 func (bl *blockiter_t) _isind(blkno int) (*Bdev_block_t, bool) {
 	if blkno == 0 {
 		return nil, false
@@ -1032,85 +1901,151 @@ func (bl *blockiter_t) _isind(blkno int) (*Bdev_block_t, bool) {
 	return bl.lasti, true
 }
 
-func (bl *blockiter_t) release() {
-	if bl.dub != nil {
-		bl.idm.fs.fslog.Relse(bl.dub, "release")
-		bl.dub = nil
+// like _isind, but for the double-indirect blocks under the triple-indirect
+// block.
+func (bl *blockiter_t) _isdind(blkno int) (*Bdev_block_t, bool) {
+	if blkno == 0 {
+		return nil, false
 	}
-	if bl.lasti != nil {
-		bl.idm.fs.fslog.Relse(bl.lasti, "release")
-		bl.lasti = nil
+	if bl.lastd != nil {
+		if bl.lastd.Block == blkno {
+			return bl.lastd, true
+		}
+		bl.idm.fs.fslog.Relse(bl.lastd, "release")
+	}
+	bl.lastd = bl.idm.mbread(blkno)
+	if bl.tryevict && bl.idm.fs.diskfs {
+		bl.lastd.Tryevict()
 	}
+	return bl.lastd, true
 }
 
-// returns block number and the next slot to check for the given slot.
-func (bl *blockiter_t) next1(which int) (int, int) {
-	const DBLOCKS = NIADDRS + INDADDR + INDADDR*INDADDR
-	const INDBLOCKS = DBLOCKS + INDADDR
-	const IMD1 = INDBLOCKS
-	const IMD2 = INDBLOCKS + 1
-	const ALL = INDBLOCKS + 2
+func (bl *blockiter_t) release() {
+	for _, b := range []**Bdev_block_t{&bl.dub, &bl.trip, &bl.lastd, &bl.lasti} {
+		if *b != nil {
+			bl.idm.fs.fslog.Relse(*b, "release")
+			*b = nil
+		}
+	}
+}
 
-	if which >= ALL {
+// returns block number and the next slot to check for the given slot. files
+// may have holes, so a missing block only says something about the slots
+// under it: a missing indirect block skips all of them.
+func (bl *blockiter_t) next1(which int) (int, int) {
+	if which >= BI_ALL {
 		panic("none left")
 	}
 
 	ret := -1
 	w := which
-	if w < DBLOCKS {
+	if w < BI_DBLOCKS {
 		if w < NIADDRS {
 			blkno := bl.idm.addrs[w]
 			if blkno == 0 {
-				return -1, DBLOCKS
+				return -1, which + 1
 			}
 			ret = blkno
 		} else if w < NIADDRS+INDADDR {
 			w -= NIADDRS
-			blkno := 0
 			single, ok := bl._isind(bl.idm.indir)
-			if ok {
-				blkno = util.Readn(single.Data[:], 8, w*8)
+			if !ok {
+				return -1, NIADDRS + INDADDR
 			}
-			if !ok || blkno == 0 {
-				return -1, DBLOCKS
+			blkno := util.Readn(single.Data[:], 8, w*8)
+			if blkno == 0 {
+				return -1, which + 1
 			}
 			ret = blkno
-		} else {
-			w -= NIADDRS + INDADDR
+		} else if w < NIADDRS+INDADDR+INDADDR*INDADDR {
+			base := NIADDRS + INDADDR
+			w -= base
 			dslot := w / INDADDR
 			islot := w % INDADDR
-			blkno := 0
+			if _, ok := bl._isdub(); !ok {
+				return -1, base + INDADDR*INDADDR
+			}
 			single, _, ok := bl._isdubind(dslot, true)
-			if ok {
-				blkno = util.Readn(single.Data[:], 8, islot*8)
+			if !ok {
+				return -1, base + (dslot+1)*INDADDR
+			}
+			blkno := util.Readn(single.Data[:], 8, islot*8)
+			if blkno == 0 {
+				return -1, which + 1
+			}
+			ret = blkno
+		} else {
+			base := NIADDRS + INDADDR + INDADDR*INDADDR
+			w -= base
+			tslot := w / (INDADDR * INDADDR)
+			if _, ok := bl._istrip(); !ok {
+				return -1, BI_DBLOCKS
+			}
+			if _, _, ok := bl._istripdub(tslot, true); !ok {
+				return -1, base + (tslot+1)*INDADDR*INDADDR
 			}
-			if !ok || blkno == 0 {
-				return -1, DBLOCKS
+			blkno := bl._istripind(w/INDADDR, w%INDADDR)
+			if blkno == 0 {
+				if bl._istripind(w/INDADDR, -1) == 0 {
+					return -1, base + (w/INDADDR+1)*INDADDR
+				}
+				return -1, which + 1
 			}
 			ret = blkno
 		}
-	} else if w < INDBLOCKS {
-		w -= DBLOCKS
+	} else if w < BI_DINDS {
+		w -= BI_DBLOCKS
 		dslot := w % INDADDR
+		if _, ok := bl._isdub(); !ok {
+			return -1, BI_DINDS
+		}
 		_, sblkno, ok := bl._isdubind(dslot, false)
 		if !ok || sblkno == 0 {
-			return -1, IMD1
+			return -1, which + 1
+		}
+		ret = sblkno
+	} else if w < BI_TINDS {
+		w -= BI_DINDS
+		if _, ok := bl._istrip(); !ok {
+			return -1, BI_TINDS
+		}
+		if _, _, ok := bl._istripdub(w/INDADDR, true); !ok {
+			return -1, BI_DINDS + (w/INDADDR+1)*INDADDR
+		}
+		sblkno := bl._istripind(w, -1)
+		if sblkno == 0 {
+			return -1, which + 1
 		}
 		ret = sblkno
-	} else if w < ALL {
+	} else if w < BI_TDINDS {
+		w -= BI_TINDS
+		if _, ok := bl._istrip(); !ok {
+			return -1, BI_IMD1
+		}
+		_, dblkno, ok := bl._istripdub(w, false)
+		if !ok || dblkno == 0 {
+			return -1, which + 1
+		}
+		ret = dblkno
+	} else if w < BI_ALL {
 		switch w {
 		default:
 			panic("huh?")
-		case IMD1:
+		case BI_IMD1:
 			if bl.idm.indir == 0 {
-				return -1, IMD2
+				return -1, BI_IMD2
 			}
 			ret = bl.idm.indir
-		case IMD2:
+		case BI_IMD2:
 			if bl.idm.dindir == 0 {
-				return -1, ALL
+				return -1, BI_IMD3
 			}
 			ret = bl.idm.dindir
+		case BI_IMD3:
+			if bl.idm.tindir == 0 {
+				return -1, BI_ALL
+			}
+			ret = bl.idm.tindir
 		}
 	} else {
 		panic("bad which")
@@ -1123,22 +2058,18 @@ func (bl *blockiter_t) next1(which int) (int, int) {
 // check, and whether any more blocks remain (so the caller can avoid acquiring
 // log admission spuriously).
 func (bl *blockiter_t) next(which int) (int, bool, int, bool) {
-	const DBLOCKS = NIADDRS + INDADDR + INDADDR*INDADDR
-	const INDBLOCKS = DBLOCKS + INDADDR
-	const ALL = INDBLOCKS + 2
-
 	ret := -1
-	for ret == -1 && which != ALL {
+	for ret == -1 && which != BI_ALL {
 		ret, which = bl.next1(which)
 	}
 	ok := ret != -1
 	remains := false
-	for ok && which != ALL {
+	for ok && which != BI_ALL {
 		d, next := bl.next1(which)
 		if d != -1 {
 			remains = true
 			break
-		} else if next == ALL {
+		} else if next == BI_ALL {
 			break
 		}
 		which = next
@@ -1158,12 +2089,14 @@ func (idm *imemnode_t) ifree() defs.Err_t {
 	// indirect) blocks of a file have been freed. specifically, blocks in
 	// the range [0, major) have been freed. major refers to a data block
 	// when:
-	// 	major < DBLOCKS
-	// where DBLOCKS is NIADDRS+INDADDR+INDADDR*INDADDR, the indirect
-	// blocks referred to by the double-indirect block when
-	// 	DBLOCKS <= major < DBLOCKS + INDADDR, and the
-	// indirect/double-indirect itself when:
-	//	DBLOCKS+INADDR <= major DBLOCKS+INADDR+2
+	// 	major < BI_DBLOCKS
+	// the indirect blocks referred to by the double-indirect block when
+	// 	BI_DBLOCKS <= major < BI_DINDS,
+	// the indirect and double-indirect blocks under the triple-indirect
+	// block when
+	// 	BI_DINDS <= major < BI_TDINDS, and the
+	// indirect/double-indirect/triple-indirect itself when:
+	//	BI_IMD1 <= major < BI_ALL
 
 	var ca res.Cacheallocs_t
 	gimme := bounds.Bounds(bounds.B_IMEMNODE_T_IFREE)
@@ -1173,28 +2106,31 @@ func (idm *imemnode_t) ifree() defs.Err_t {
 		tryevict = tryevict || ca.Shouldevict(gimme)
 		opid := idm.fs.fslog.Op_begin("ifree")
 
-		// set of blocks that will be written by this transaction;
-		// include an entry for the inode block (to update major) and a
-		// fake entry for the orphan block conservatively.
+		// set of blocks that will be written by this transaction, by
+		// block number; include an entry for the inode block (to update
+		// major) and a fake entry for the orphan block conservatively.
 		distinct := map[int]bool{idm.fs.ialloc.Iblock(idm.inum): true,
 			-1: true}
 
 		which := idm.major
 
-		bliter := &blockiter_t{}
-		bliter.bi_init(idm, tryevict)
-
-		for len(distinct) < MaxBlkPerOp && remains {
-			blkno := -1
-			var ok bool
-			blkno, ok, which, remains = bliter.next(which)
-			if ok {
-				idm.fs.balloc.Bfree(opid, blkno)
-				freeblk := idm.fs.balloc.alloc.bitmapblkno(blkno)
-				distinct[freeblk] = true
+		// a directory's index is freed before its blocks, since the
+		// index root records how far freeing the index has come.
+		if idm._ndxfree(opid, distinct, MaxBlkPerOp) {
+			bliter := &blockiter_t{}
+			bliter.bi_init(idm, tryevict)
+
+			for len(distinct) < MaxBlkPerOp && remains {
+				blkno := -1
+				var ok bool
+				blkno, ok, which, remains = bliter.next(which)
+				if ok {
+					idm.fs.balloc.Bfree(opid, blkno)
+					distinct[idm.fs.balloc.mapblock(blkno)] = true
+				}
 			}
+			bliter.release()
 		}
-		bliter.release()
 
 		idm.major = which
 		if !remains {
@@ -1226,11 +2162,11 @@ func (idm *imemnode_t) ifree() defs.Err_t {
 func (idm *imemnode_t) mkmode() uint {
 	itype := idm.itype
 	switch itype {
-	case I_DIR, I_FILE:
-		return uint(itype << 16)
+	case I_DIR, I_FILE, I_SYMLINK:
+		return uint(itype<<16 | idm.mode)
 	case I_DEV:
 		// this can happen by fs-internal stats
-		return defs.Mkdev(idm.major, idm.minor)
+		return defs.Mkdev(idm.major, idm.minor) | uint(idm.mode)
 	default:
 		panic("weird itype")
 	}
@@ -1268,7 +2204,7 @@ const maxinodepersys = 4
 
 func mkIcache(fs *Fs_t, start, len int) *icache_t {
 	icache := &icache_t{}
-	icache.cache = mkCache(limits.Syslimit.Vnodes)
+	icache.cache = mkCache(&limits.Syslimit.Vnodes)
 	icache.fs = fs
 	icache.orphanbitmap = mkAllocater(fs, start, len, fs.fslog)
 	return icache
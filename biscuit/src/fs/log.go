@@ -1,8 +1,10 @@
 package fs
 
 import "fmt"
+import "sort"
 import "sync"
 
+import "defs"
 import "mem"
 import "stats"
 import "util"
@@ -20,6 +22,16 @@ const log_debug = false
 // all its data structures, and use ordered writes only for file data.  The file
 // system must guarantee that it performs no more than maxblkspersys logged
 // writes in an operation, to ensure that its operation will fit in the log.
+//
+// If the disk fails a write, the log stops writing: it drops the transactions
+// that follow instead of committing them, and Force reports the error. The
+// on-disk log still holds the transactions committed before the failure, so
+// that recovery brings the file system back to a consistent state.
+//
+// The log tells the disk to discard the blocks that a transaction frees once
+// the transaction is durable, but not before: a crash before the commit must
+// find their contents intact. A block that is allocated again before its
+// transaction commits is not discarded.
 
 const LogOffset = 1 // log block 0 is used for head
 
@@ -105,12 +117,13 @@ func (log *log_t) Op_end(opid opid_t) {
 	log.stats.Opendcycles.Add(s)
 }
 
-// /      Force waits for outstanding logged operations to commit to disk.
+// /      Force waits for outstanding logged operations to commit to disk. It
+// /      returns -EIO once the disk has failed a write.
 // Ensure any fs ops in the journal preceding this sync call are flushed to disk
 // by waiting for log commit.
-func (log *log_t) Force(doapply bool) {
+func (log *log_t) Force(doapply bool) defs.Err_t {
 	if !log.logging {
-		return
+		return 0
 	}
 
 	log.Lock()
@@ -124,7 +137,7 @@ func (log *log_t) Force(doapply bool) {
 
 	if t.isempty() || t.forcedone {
 		log.stats.Nbatchforce++
-		return
+		return log.err
 	}
 
 	if t.force {
@@ -157,6 +170,60 @@ func (log *log_t) Force(doapply bool) {
 	if log_debug {
 		fmt.Printf("Force: done trans %d\n", t.start)
 	}
+	return log.err
+}
+
+// /      Transid returns the identifier of the transaction that the running
+// /      operation belongs to, for Force_trans. transactions are numbered in
+// /      commit order, starting at 1.
+func (log *log_t) Transid() int {
+	if !log.logging {
+		return 0
+	}
+	log.Lock()
+	defer log.Unlock()
+	return log.curtrans.id
+}
+
+// /      Force_trans waits until transaction id, and with it every earlier
+// /      transaction, has committed to disk, including its ordered writes.
+// /      unlike Force, it returns at once if that has happened already, and it
+// /      never waits for transactions after id. it returns -EIO if the disk
+// /      failed a write before id committed.
+func (log *log_t) Force_trans(id int) defs.Err_t {
+	if !log.logging {
+		return 0
+	}
+
+	log.Lock()
+	defer log.Unlock()
+
+	log.stats.Nforcetrans++
+	if id <= log.committed {
+		log.stats.Nforcetransdone++
+		return 0
+	}
+
+	s := stats.Rdtsc()
+
+	t := log.curtrans
+	if t.id == id && !t.force {
+		t.force = true
+		if t.iscommittable() {
+			t.committing = true
+			log.commitcond.Signal()
+		}
+	}
+	// otherwise id is being committed already
+	for id > log.committed && log.err == 0 {
+		log.commitdonecond.Wait()
+	}
+
+	log.stats.Forcecycles.Add(s)
+	if id > log.committed {
+		return log.err
+	}
+	return 0
 }
 
 // /      Write logs the provided block for the given operation.
@@ -172,6 +239,28 @@ func (log *log_t) Write_ordered(opid opid_t, b *Bdev_block_t) {
 	log.write(opid, b, true)
 }
 
+// /      Free records that the operation freed block blkno, which the log
+// /      discards once the operation's transaction is durable.
+func (log *log_t) Free(opid opid_t, blkno int) {
+	if !log.logging {
+		return
+	}
+	log.Lock()
+	log.curtrans.freed[blkno] = true
+	log.Unlock()
+}
+
+// /      Reuse records that the operation allocated block blkno, which must not
+// /      be discarded anymore if its transaction freed it earlier.
+func (log *log_t) Reuse(opid opid_t, blkno int) {
+	if !log.logging {
+		return
+	}
+	log.Lock()
+	delete(log.curtrans.freed, blkno)
+	log.Unlock()
+}
+
 // /      Loglen returns the length of the in-memory log in blocks.
 func (log *log_t) Loglen() int {
 	return log.ml.loglen
@@ -180,13 +269,40 @@ func (log *log_t) Loglen() int {
 // All layers above log read blocks through the log layer, which are mostly
 // wrappers for the the corresponding cache operations.
 // /      Get_fill retrieves a block from cache, populating it from disk if needed.
-func (log *log_t) Get_fill(blkn int, s string, lock bool) *Bdev_block_t {
+func (log *log_t) Get_fill(blkn int, s string, lock bool) (*Bdev_block_t, defs.Err_t) {
 	t := stats.Rdtsc()
-	r := log.ml.bcache.Get_fill(blkn, s, lock)
+	r, err := log.ml.bcache.Get_fill(blkn, s, lock)
 	log.stats.Readcycles.Add(t)
+	return r, err
+}
+
+// /      Get_meta is Get_fill for the blocks of the file system's own
+// /      structures, whose readers have no way to report an error. if the disk
+// /      cannot read the block, the log stops writing, so that nothing built on
+// /      the zeroed block that Get_meta returns reaches the disk.
+func (log *log_t) Get_meta(blkn int, s string, lock bool) *Bdev_block_t {
+	r, err := log.Get_fill(blkn, s, lock)
+	if err != 0 {
+		log.Lock()
+		log.fail(err)
+		log.Unlock()
+	}
 	return r
 }
 
+// /      Err returns the error that made the log stop writing or 0.
+func (log *log_t) Err() defs.Err_t {
+	log.Lock()
+	defer log.Unlock()
+	return log.err
+}
+
+// /      Read_ahead starts reading the uncached blocks blks into the cache
+// /      without waiting for them and returns how many it started reading.
+func (log *log_t) Read_ahead(blks []int) int {
+	return log.ml.bcache.Read_ahead(blks)
+}
+
 // /      Get_zero returns a zeroed block from the cache.
 func (log *log_t) Get_zero(blkn int, s string, lock bool) *Bdev_block_t {
 	return log.ml.bcache.Get_zero(blkn, s, lock)
@@ -211,11 +327,29 @@ func (log *log_t) Stats() string {
 	return s1 + s2
 }
 
+// returns the log's part of the file system's statistics.
+func (log *log_t) snapshot() Logstats_t {
+	return Logstats_t{Nop: log.stats.Nop, Nlogwrite: log.stats.Nlogwrite,
+		Norderedwrite: log.stats.Norderedwrite,
+		Nabsorption:   log.stats.Nabsorption, Nforce: log.stats.Nforce,
+		Ncommit: log.ml.stats.Ncommit, Nblkcommitted: log.ml.stats.Nblkcommitted,
+		Napply: log.ml.stats.Napply, Nblkapply: log.ml.stats.Nblkapply,
+		Nrevokeblk: log.ml.stats.Nrevokeblk, Ndiscard: log.ml.stats.Ndiscard,
+		Logblks: log.ml.loglen}
+}
+
+func (log *log_t) resetstats() {
+	log.stats = logstat_t{}
+	log.ml.stats = memlogstat_t{}
+}
+
 // /       StartLog initializes the on-disk log and starts the commit goroutine.
 func StartLog(logstart, loglen int, bcache *bcache_t, logging bool) *log_t {
 	log := &log_t{}
 	log.mk_log(logstart, loglen, bcache, logging)
-	log.recover()
+	if err := log.recover(); err != 0 {
+		log.fail(err)
+	}
 	log.curtrans = log.mk_trans(log.head, log.ml)
 	go log.committer()
 	return log
@@ -262,6 +396,7 @@ type memlogstat_t struct {
 	Maxblks_per_trans stats.Counter_t
 	Nwriteordered     stats.Counter_t
 	Nrevokeblk        stats.Counter_t
+	Ndiscard          stats.Counter_t
 
 	Napply       stats.Counter_t
 	Nblkapply    stats.Counter_t
@@ -313,9 +448,9 @@ func (ml *memlog_t) getmemlog(i index_t) *Bdev_block_t {
 	return ml.log[n]
 }
 
-func (ml *memlog_t) readhdr() (*logheader_t, *Bdev_block_t) {
-	headblk := ml.bcache.Get_fill(ml.logstart, "readhdr", true)
-	return &logheader_t{headblk.Data}, headblk
+func (ml *memlog_t) readhdr() (*logheader_t, *Bdev_block_t, defs.Err_t) {
+	headblk, err := ml.bcache.Get_fill(ml.logstart, "readhdr", true)
+	return &logheader_t{headblk.Data}, headblk, err
 }
 
 func (ml *memlog_t) mkdescriptor(blk *Bdev_block_t) *logdescriptor_t {
@@ -327,41 +462,55 @@ func (ml *memlog_t) getdescriptor(i index_t) *logdescriptor_t {
 	return ml.mkdescriptor(b)
 }
 
-func (ml *memlog_t) readdescriptor(i index_t) (*logdescriptor_t, *Bdev_block_t) {
-	dblk := ml.bcache.Get_fill(ml.diskindex(i), "readdescriptor", false)
-	return ml.mkdescriptor(dblk), dblk
+func (ml *memlog_t) readdescriptor(i index_t) (*logdescriptor_t, *Bdev_block_t, defs.Err_t) {
+	dblk, err := ml.bcache.Get_fill(ml.diskindex(i), "readdescriptor", false)
+	return ml.mkdescriptor(dblk), dblk, err
 }
 
-// Flush i
-func (ml *memlog_t) flush() {
+// Flush i. returns the error of the flush or of a write that the disk failed
+// since the last flush.
+func (ml *memlog_t) flush() defs.Err_t {
 	ider := MkRequest(nil, BDEV_FLUSH, true)
 	if ml.bcache.disk.Start(ider) {
 		<-ider.AckCh
 	}
+	return ider.Err
 }
 
-func (ml *memlog_t) commit_head(head index_t) {
+func (ml *memlog_t) commit_head(head index_t) defs.Err_t {
 	ml.stats.Ncommithead++
-	lh, headblk := ml.readhdr()
+	lh, headblk, err := ml.readhdr()
+	if err != 0 {
+		headblk.Unlock()
+		ml.bcache.Relse(headblk, "commit_done")
+		return err
+	}
 	lh.w_head(head)
 	headblk.Unlock()
 	ml.bcache.Write_async(headblk)
 	s := stats.Rdtsc()
-	ml.flush() // commit log header
+	err = ml.flush() // commit log header
 	ml.stats.Headcycles.Add(s)
 	ml.bcache.Relse(headblk, "commit_done")
+	return err
 }
 
-func (ml *memlog_t) commit_tail(tail index_t) {
+func (ml *memlog_t) commit_tail(tail index_t) defs.Err_t {
 	ml.stats.Ncommittail++
-	lh, headblk := ml.readhdr()
+	lh, headblk, err := ml.readhdr()
+	if err != 0 {
+		headblk.Unlock()
+		ml.bcache.Relse(headblk, "commit_tail")
+		return err
+	}
 	lh.w_tail(tail)
 	headblk.Unlock()
 	ml.bcache.Write_async(headblk)
 	s := stats.Rdtsc()
-	ml.flush() // commit log header
+	err = ml.flush() // commit log header
 	ml.stats.Tailcycles.Add(s)
 	ml.bcache.Relse(headblk, "commit_tail")
+	return err
 }
 
 func (ml *memlog_t) freespace(head, tail index_t) bool {
@@ -414,7 +563,7 @@ func (rl *revokelist_t) addRevokeRecord(blkno int, ml *memlog_t) {
 		db = ml.mkdescriptor(blk)
 		db.w_logdest(0, int(RevokeBlk))
 		rl.index = 1
-		ml.stats.Nrevokeblk.Inc()
+		ml.stats.Nrevokeblk++
 	} else {
 		db = ml.mkdescriptor(blk)
 	}
@@ -427,6 +576,7 @@ func (rl *revokelist_t) addRevokeRecord(blkno int, ml *memlog_t) {
 }
 
 type trans_t struct {
+	id             int
 	forcecond      *sync.Cond
 	ml             *memlog_t
 	start          index_t
@@ -438,6 +588,7 @@ type trans_t struct {
 	revokel        *revokelist_t
 	logpresent     map[int]bool // enable quick check to see if block is in log
 	orderedpresent map[int]bool // enable quick check so see if block is in ordered
+	freed          map[int]bool // blocks to discard once committed
 	force          bool
 	forceapply     bool
 	forcedone      bool
@@ -446,6 +597,8 @@ type trans_t struct {
 
 func (log *log_t) mk_trans(start index_t, ml *memlog_t) *trans_t {
 	t := &trans_t{start: start, head: start + NCommitBlk}
+	t.id = log.nexttrans
+	log.nexttrans++
 	t.ml = ml
 	t.forcecond = sync.NewCond(log)
 	t.logged = MkBlkList()      // bounded by MaxDescriptor
@@ -454,6 +607,7 @@ func (log *log_t) mk_trans(start index_t, ml *memlog_t) *trans_t {
 	t.logpresent = make(map[int]bool, ml.loglen)
 	t.orderedpresent = make(map[int]bool, MaxOrdered)
 	t.revokel = mkRevokeList()
+	t.freed = make(map[int]bool)
 	return t
 }
 
@@ -600,7 +754,7 @@ func (trans *trans_t) write_ordered(ml *memlog_t) {
 	trans.ordered.Delete()
 }
 
-func (trans *trans_t) commit(tail index_t, ml *memlog_t) {
+func (trans *trans_t) commit(tail index_t, ml *memlog_t) defs.Err_t {
 	if log_debug {
 		fmt.Printf("commit: start %d head %d\n", trans.start, trans.head)
 	}
@@ -652,12 +806,19 @@ func (trans *trans_t) commit(tail index_t, ml *memlog_t) {
 	trans.write_ordered(ml)
 
 	s := stats.Rdtsc()
-	ml.flush() // flush outstanding writes  (if you kill this line, then Atomic test fails)
+	err := ml.flush() // flush outstanding writes  (if you kill this line, then Atomic test fails)
 	ml.stats.Flushdatacycles.Add(s)
+	if err != 0 {
+		// the log head doesn't cover the blocks that made it to disk
+		return err
+	}
 
 	if trans.start != trans.head {
-		ml.commit_head(trans.head)
+		if err := ml.commit_head(trans.head); err != 0 {
+			return err
+		}
 	}
+	trans.trim(ml)
 
 	n := stats.Counter_t(blks1.Len() + blks2.Len())
 	ml.stats.Nblkcommitted += n
@@ -668,6 +829,48 @@ func (trans *trans_t) commit(tail index_t, ml *memlog_t) {
 	if log_debug {
 		fmt.Printf("commit: committed %d blks\n", n)
 	}
+	return 0
+}
+
+// tells the disk to discard the blocks that the committed transaction freed.
+// the transaction's ops are done, so nobody changes its freed set; a block
+// that a later transaction allocates meanwhile is written by the committer
+// after the discard finishes. a failed discard is harmless.
+func (trans *trans_t) trim(ml *memlog_t) {
+	if len(trans.freed) == 0 {
+		return
+	}
+	blknos := make([]int, 0, len(trans.freed))
+	for blkno := range trans.freed {
+		blknos = append(blknos, blkno)
+	}
+	sort.Ints(blknos)
+	l := MkBlkList()
+	for _, blkno := range blknos {
+		l.PushBack(MkBlock(blkno, "discard", ml.bcache.mem, ml.bcache.disk, &_nop_relse))
+	}
+	req := MkRequest(l, BDEV_DISCARD, true)
+	if ml.bcache.disk.Start(req) {
+		<-req.AckCh
+	}
+	ml.stats.Ndiscard += stats.Counter_t(len(blknos))
+}
+
+// releases the blocks of a transaction that is dropped instead of committed
+// since the disk failed.
+func (trans *trans_t) discard(ml *memlog_t) {
+	trans.revokel.revoked.Apply(func(b *Bdev_block_t) {
+		b.Free_page()
+	})
+	trans.revokel.revoked.Delete()
+	trans.logged.Apply(func(b *Bdev_block_t) {
+		ml.bcache.Relse(b, "discard")
+	})
+	trans.logged.Delete()
+	trans.ordered.Apply(func(b *Bdev_block_t) {
+		ml.bcache.Relse(b, "discard")
+	})
+	trans.ordered.Delete()
 }
 
 type logstat_t struct {
@@ -679,6 +882,9 @@ type logstat_t struct {
 	Nbatchforce stats.Counter_t
 	Forcecycles stats.Cycles_t
 
+	Nforcetrans     stats.Counter_t
+	Nforcetransdone stats.Counter_t
+
 	Nlogwrite       stats.Counter_t
 	Norderedwrite   stats.Counter_t
 	Nabsorption     stats.Counter_t
@@ -693,13 +899,21 @@ type log_t struct {
 	sync.Mutex
 	admissioncond *sync.Cond
 	commitcond    *sync.Cond
-	ml            *memlog_t
-	curtrans      *trans_t
-	tail          index_t
-	head          index_t
-	translog      *translog_t
-	stop          bool
-	stopc         chan (bool)
+	// signaled whenever a transaction has committed
+	commitdonecond *sync.Cond
+	ml             *memlog_t
+	curtrans       *trans_t
+	tail           index_t
+	head           index_t
+	translog       *translog_t
+	stop           bool
+	stopc          chan (bool)
+	// id of the next transaction and of the last committed one
+	nexttrans int
+	committed int
+	// the error of the failed disk write after which the log stopped
+	// writing, or 0
+	err defs.Err_t
 
 	logging bool
 	nextop  opid_t
@@ -759,12 +973,24 @@ func (log *log_t) mk_log(ls, ll int, bcache *bcache_t, logging bool) {
 	log.ml = mk_memlog(ls, ll, bcache)
 	log.admissioncond = sync.NewCond(log)
 	log.commitcond = sync.NewCond(log)
+	log.commitdonecond = sync.NewCond(log)
+	log.nexttrans = 1
 	log.stopc = make(chan bool)
 	log.translog = mkTransLog()
 	log.nextop = opid_t(1)
 	log.logging = logging
 }
 
+// stops writing to the disk after its failure err. caller holds the log lock.
+func (log *log_t) fail(err defs.Err_t) {
+	if log.err != 0 {
+		return
+	}
+	fmt.Printf("log: disk failed (%v), file system is read-only now\n", err)
+	log.err = err
+	log.commitdonecond.Broadcast()
+}
+
 func (log *log_t) write(opid opid_t, b *Bdev_block_t, ordered bool) {
 	if !log.logging {
 		return
@@ -859,7 +1085,15 @@ func (log *log_t) committer() {
 		log.ml.stats.Ncommitter.Inc()
 		s := stats.Rdtsc()
 		t := log.curtrans
-		if t.committing {
+		if t.committing && log.err != 0 {
+			// the disk failed; drop the transaction and let the next
+			// one take its place in the log
+			t.discard(log.ml)
+			t.forcedone = true
+			t.forcecond.Broadcast()
+			log.curtrans = log.mk_trans(t.start, log.ml)
+			log.admissioncond.Broadcast()
+		} else if t.committing {
 
 			t.head = t.head + index_t(t.logged.Len()+t.revokel.len())
 
@@ -897,19 +1131,29 @@ func (log *log_t) committer() {
 			}
 
 			log.Unlock()
-			t.commit(log.tail, log.ml)
+			err := t.commit(log.tail, log.ml)
 			log.Lock()
 
 			if log_debug {
 				fmt.Printf("committer: wakeup forcer for trans %d\n", t.start)
 			}
 
+			if err != 0 {
+				log.fail(err)
+			}
 			t.forcedone = true
 			t.forcecond.Broadcast()
+			if err == 0 {
+				log.committed = t.id
+			}
+			log.commitdonecond.Broadcast()
 
-			if t.forceapply || log.ml.almosthalffull(log.tail, t.head) {
+			if err == 0 && (t.forceapply || log.ml.almosthalffull(log.tail, t.head)) {
 				log.cancel(log.tail, t.head, t.revokel)
-				log.tail = log.apply(log.tail, t.head)
+				log.tail, err = log.apply(log.tail, t.head)
+				if err != 0 {
+					log.fail(err)
+				}
 				t.revokel.revoked.Delete()
 				log.translog.remove(log.tail)
 			}
@@ -938,7 +1182,8 @@ func (log *log_t) committer() {
 	log.stopc <- true
 }
 
-func (log *log_t) apply(tail, head index_t) index_t {
+// returns the new tail of the log, which stays tail if the disk fails.
+func (log *log_t) apply(tail, head index_t) (index_t, defs.Err_t) {
 	log.ml.stats.Napply++
 
 	done := make(map[int]bool, log.ml.loglen)
@@ -952,7 +1197,7 @@ func (log *log_t) apply(tail, head index_t) index_t {
 	}
 
 	if tail == head {
-		return head
+		return head, 0
 	}
 
 	// no need to iterate over tail itself since it is a CommitBlk, which
@@ -973,8 +1218,12 @@ func (log *log_t) apply(tail, head index_t) index_t {
 	}
 
 	s := stats.Rdtsc()
-	log.ml.flush() // flush apply
+	err := log.ml.flush() // flush apply
 	log.ml.stats.Flushapplydatacycles.Add(s)
+	if err != 0 {
+		// the log still holds the blocks for recovery to install
+		return tail, err
+	}
 
 	for _, t := range log.translog.trans {
 		if t.head > head {
@@ -986,13 +1235,15 @@ func (log *log_t) apply(tail, head index_t) index_t {
 		t.logged.Delete()
 	}
 
-	log.ml.commit_tail(head)
+	if err := log.ml.commit_tail(head); err != 0 {
+		return tail, err
+	}
 
 	if log_debug {
 		fmt.Printf("apply log: updated tail %d\n", head)
 	}
 
-	return head
+	return head, 0
 }
 
 func (log *log_t) revoke(im []int, tail, until index_t, r int) {
@@ -1005,11 +1256,15 @@ func (log *log_t) revoke(im []int, tail, until index_t, r int) {
 	}
 }
 
-func (log *log_t) installmap(tail, head index_t) []int {
+func (log *log_t) installmap(tail, head index_t) ([]int, defs.Err_t) {
 	im := make([]int, log.ml.loglen)
 	for i := tail; i != head; {
 		ti := i
-		db, dblk := log.ml.readdescriptor(i)
+		db, dblk, err := log.ml.readdescriptor(i)
+		if err != 0 {
+			log.ml.bcache.Relse(dblk, "installmap")
+			return nil, err
+		}
 		im[log.ml.logindex(i)] = Canceled
 		i += NCommitBlk
 		j := 1
@@ -1020,7 +1275,12 @@ func (log *log_t) installmap(tail, head index_t) []int {
 				if log_debug {
 					fmt.Printf("installmap: revoke descriptor block at i %d\n", i)
 				}
-				rb, rblk := log.ml.readdescriptor(i)
+				rb, rblk, err := log.ml.readdescriptor(i)
+				if err != 0 {
+					log.ml.bcache.Relse(rblk, "installmap")
+					log.ml.bcache.Relse(dblk, "installmap")
+					return nil, err
+				}
 				im[log.ml.logindex(index)] = Canceled
 				for k := 1; ; k++ {
 					r := rb.r_logdest(k)
@@ -1048,11 +1308,14 @@ func (log *log_t) installmap(tail, head index_t) []int {
 		}
 		log.ml.bcache.Relse(dblk, "installmap")
 	}
-	return im
+	return im, 0
 }
 
-func (log *log_t) install(tail, head index_t) {
-	im := log.installmap(tail, head)
+func (log *log_t) install(tail, head index_t) defs.Err_t {
+	im, err := log.installmap(tail, head)
+	if err != 0 {
+		return err
+	}
 	for i := tail; i != head; i++ {
 		li := log.ml.logindex(i)
 		dst := im[li]
@@ -1060,18 +1323,30 @@ func (log *log_t) install(tail, head index_t) {
 			if log_debug {
 				fmt.Printf("install: write log %d to %d\n", i, dst)
 			}
-			lb := log.ml.bcache.Get_fill(log.ml.diskindex(i), "i", false)
-			fb := log.ml.bcache.Get_fill(dst, "bdest", false)
-			copy(fb.Data[:], lb.Data[:])
-			log.ml.bcache.Write(fb)
+			lb, err := log.ml.bcache.Get_fill(log.ml.diskindex(i), "i", false)
+			if err != 0 {
+				log.ml.bcache.Relse(lb, "install lb")
+				return err
+			}
+			fb, err := log.ml.bcache.Get_fill(dst, "bdest", false)
+			if err == 0 {
+				copy(fb.Data[:], lb.Data[:])
+				err = log.ml.bcache.Write(fb)
+			}
 			log.ml.bcache.Relse(lb, "install lb")
 			log.ml.bcache.Relse(fb, "install fb")
+			if err != 0 {
+				return err
+			}
 		}
 	}
+	return 0
 }
 
-func (log *log_t) recover() {
-	lh, headblk := log.ml.readhdr()
+// if the disk fails, the log keeps the transactions that recovery did not
+// install.
+func (log *log_t) recover() defs.Err_t {
+	lh, headblk, err := log.ml.readhdr()
 	tail := lh.r_tail()
 	head := lh.r_head()
 	headblk.Unlock()
@@ -1080,14 +1355,22 @@ func (log *log_t) recover() {
 	log.head = head
 
 	log.ml.bcache.Relse(headblk, "recover")
+	if err != 0 {
+		return err
+	}
 	if tail == head {
 		fmt.Printf("no FS recovery needed: head %d\n", head)
-		return
+		return 0
 	}
 	fmt.Printf("starting FS recovery start %d end %d\n", tail, head)
-	log.install(tail, head)
-	log.ml.commit_tail(head)
+	if err := log.install(tail, head); err != 0 {
+		return err
+	}
+	if err := log.ml.commit_tail(head); err != 0 {
+		return err
+	}
 	log.tail = head
 
 	fmt.Printf("restored blocks from %d till %d\n", tail, head)
+	return 0
 }
@@ -0,0 +1,263 @@
+package fs
+
+import "defs"
+import "util"
+
+// decodes the on-disk log of an image without starting the log, to debug
+// journaling. the header block of the log records its tail and head, which
+// are indices that only grow; index i lives in log block i modulo the length
+// of the log. the committed transactions lie one after another from the tail
+// to the head. the first block of a transaction is its descriptor, which lists
+// the home block of each of the blocks that follow it, or RevokeBlk for a
+// block of revoke records, and ends with EndDescriptor. moving the head past a
+// transaction commits it, so its descriptor is its commit block as well. a
+// revoke record cancels the blocks that earlier transactions logged for the
+// revoked home block, which has since been written in place.
+
+// /       Logblk_t is a block that a transaction logs.
+type Logblk_t struct {
+	Blkno     int  /// where the block is in the image
+	Home      int  /// where recovery installs the block
+	Revoked   bool /// a later transaction revokes the block
+	Installed bool /// the home block holds the block's data already
+}
+
+// /       Logtrans_t is a committed transaction of the on-disk log.
+type Logtrans_t struct {
+	Start      int        /// log index of its descriptor
+	End        int        /// log index after its last block
+	Descriptor int        /// where its descriptor is in the image
+	Revokes    []int      /// the home blocks that it revokes
+	Blks       []Logblk_t /// the blocks that it logs, in log order
+}
+
+// /       Logdump_t describes the on-disk log of an image.
+type Logdump_t struct {
+	Logstart int /// the header block of the log
+	Loglen   int /// the number of log blocks after the header
+	Tail     int /// log index of the first committed transaction
+	Head     int /// log index after the last committed transaction
+	Trans    []Logtrans_t
+}
+
+// reads the log of an image through a private block cache, as fsck does
+type logreader_t struct {
+	bcache   *bcache_t
+	logstart int
+	loglen   int
+	maxtrans int
+	last     int
+}
+
+func mklogreader(mem Blockmem_i, disk Disk_i) (*logreader_t, defs.Err_t) {
+	lr := &logreader_t{bcache: mkBcache(mem, disk)}
+	b, err := lr.read(0)
+	if err != 0 {
+		return nil, err
+	}
+	sbstart := util.Readn(b.Data[:], 4, FSOFF)
+	lr.relse(b)
+	if sbstart <= 0 {
+		return nil, -defs.EINVAL
+	}
+	b, err = lr.read(sbstart)
+	if err != 0 {
+		return nil, err
+	}
+	sb := Superblock_t{b.Data}
+	ll := sb.Loglen()
+	lr.last = sb.Lastblock()
+	lr.relse(b)
+	if ll <= LogOffset {
+		return nil, -defs.EINVAL
+	}
+	lr.logstart = sbstart + 1
+	lr.loglen = ll - LogOffset
+	lr.maxtrans = util.Min(ll/2, MaxDescriptor)
+	return lr, 0
+}
+
+func (lr *logreader_t) read(blkno int) (*Bdev_block_t, defs.Err_t) {
+	b, err := lr.bcache.Get_fill(blkno, "logdump", false)
+	if err != 0 {
+		lr.relse(b)
+		return nil, err
+	}
+	return b, 0
+}
+
+func (lr *logreader_t) relse(b *Bdev_block_t) {
+	lr.bcache.Relse(b, "logdump")
+}
+
+// returns the block of the image that holds log index i.
+func (lr *logreader_t) blkno(i int) int {
+	return lr.logstart + LogOffset + i%lr.loglen
+}
+
+// /       Readlog decodes the on-disk log of the file system on disk, which must
+// /       not be booted. It fails with EINVAL if the log is garbled, in which
+// /       case the returned Logdump_t holds the transactions before the garbled
+// /       one.
+func Readlog(mem Blockmem_i, disk Disk_i) (*Logdump_t, defs.Err_t) {
+	lr, err := mklogreader(mem, disk)
+	if err != 0 {
+		return nil, err
+	}
+	return lr.dump()
+}
+
+func (lr *logreader_t) dump() (*Logdump_t, defs.Err_t) {
+	b, err := lr.read(lr.logstart)
+	if err != 0 {
+		return nil, err
+	}
+	lh := logheader_t{b.Data}
+	ld := &Logdump_t{Logstart: lr.logstart, Loglen: lr.loglen,
+		Tail: int(lh.r_tail()), Head: int(lh.r_head())}
+	lr.relse(b)
+	if ld.Head < ld.Tail || ld.Head-ld.Tail > lr.loglen {
+		return ld, -defs.EINVAL
+	}
+	for i := ld.Tail; i != ld.Head; {
+		t, err := lr.trans(i, ld.Head)
+		if err != 0 {
+			return ld, err
+		}
+		ld.Trans = append(ld.Trans, *t)
+		i = t.End
+	}
+	// a revoke record cancels the blocks of the transactions before its own
+	for k := range ld.Trans {
+		for _, r := range ld.Trans[k].Revokes {
+			for m := 0; m < k; m++ {
+				for n := range ld.Trans[m].Blks {
+					if ld.Trans[m].Blks[n].Home == r {
+						ld.Trans[m].Blks[n].Revoked = true
+					}
+				}
+			}
+		}
+	}
+	return ld, 0
+}
+
+// decodes the transaction whose descriptor is at log index start; the
+// transaction must end by log index head.
+func (lr *logreader_t) trans(start, head int) (*Logtrans_t, defs.Err_t) {
+	t := &Logtrans_t{Start: start, Descriptor: lr.blkno(start)}
+	db, err := lr.read(t.Descriptor)
+	if err != 0 {
+		return nil, err
+	}
+	defer lr.relse(db)
+	d := &logdescriptor_t{db.Data, lr.maxtrans}
+	if d.r_logdest(0) != int(CommitBlk) {
+		return nil, -defs.EINVAL
+	}
+	i := start + NCommitBlk
+	for j := 1; ; j++ {
+		if j >= lr.maxtrans {
+			// no end marker
+			return nil, -defs.EINVAL
+		}
+		dest := d.r_logdest(j)
+		if dest == EndDescriptor {
+			break
+		}
+		if i == head {
+			return nil, -defs.EINVAL
+		}
+		blkno := lr.blkno(i)
+		if dest == int(RevokeBlk) {
+			revokes, err := lr.revokes(blkno)
+			if err != 0 {
+				return nil, err
+			}
+			t.Revokes = append(t.Revokes, revokes...)
+		} else {
+			if dest <= 0 || dest >= lr.last {
+				return nil, -defs.EINVAL
+			}
+			inst, err := lr.installed(blkno, dest)
+			if err != 0 {
+				return nil, err
+			}
+			t.Blks = append(t.Blks, Logblk_t{Blkno: blkno, Home: dest,
+				Installed: inst})
+		}
+		i++
+	}
+	t.End = i
+	return t, 0
+}
+
+// returns the home blocks that the revoke block blkno lists.
+func (lr *logreader_t) revokes(blkno int) ([]int, defs.Err_t) {
+	b, err := lr.read(blkno)
+	if err != 0 {
+		return nil, err
+	}
+	defer lr.relse(b)
+	if fieldr(b.Data, 0) != int(RevokeBlk) {
+		return nil, -defs.EINVAL
+	}
+	var ret []int
+	for k := 1; k < MaxDescriptor; k++ {
+		r := fieldr(b.Data, k)
+		if r == EndDescriptor {
+			break
+		}
+		ret = append(ret, r)
+	}
+	return ret, 0
+}
+
+// reports whether the home block holds the data of the log block blkno.
+func (lr *logreader_t) installed(blkno, home int) (bool, defs.Err_t) {
+	lb, err := lr.read(blkno)
+	if err != 0 {
+		return false, err
+	}
+	defer lr.relse(lb)
+	hb, err := lr.read(home)
+	if err != 0 {
+		return false, err
+	}
+	defer lr.relse(hb)
+	return *lb.Data == *hb.Data, 0
+}
+
+// /       Replaylog installs the first n committed transactions of the on-disk
+// /       log of the file system on disk as recovery would and drops the
+// /       others, so that the image holds the file system as the commit of
+// /       transaction n left it. The file system must not be booted. Replaylog
+// /       fails with EINVAL if the log holds fewer than n transactions or is
+// /       garbled.
+func Replaylog(mem Blockmem_i, disk Disk_i, n int) defs.Err_t {
+	lr, err := mklogreader(mem, disk)
+	if err != 0 {
+		return err
+	}
+	ld, err := lr.dump()
+	if err != 0 {
+		return err
+	}
+	if n < 0 || n > len(ld.Trans) {
+		return -defs.EINVAL
+	}
+	end := index_t(ld.Tail)
+	if n > 0 {
+		end = index_t(ld.Trans[n-1].End)
+	}
+	l := &log_t{}
+	l.ml = mk_memlog(lr.logstart, lr.loglen+LogOffset, lr.bcache)
+	if err := l.install(index_t(ld.Tail), end); err != 0 {
+		return err
+	}
+	// moving the head back first keeps the log valid if this stops half way
+	if err := l.ml.commit_head(end); err != 0 {
+		return err
+	}
+	return l.ml.commit_tail(end)
+}
@@ -47,6 +47,29 @@ func (sb *Superblock_t) Lastblock() int {
 	return fieldr(sb.Data, 7)
 }
 
+// /       Crypt returns the cipher of the blocks after the superblock.
+func (sb *Superblock_t) Crypt() int {
+	return fieldr(sb.Data, 8)
+}
+
+// /       Cryptsalt returns the salt of the key of an encrypted file system. The
+// /       caller may write it.
+func (sb *Superblock_t) Cryptsalt() []uint8 {
+	return sb.Data[9*8 : 9*8+CRYPT_SALTLEN]
+}
+
+// /       Cryptcheck returns the check value of the key of an encrypted file
+// /       system. The caller may write it.
+func (sb *Superblock_t) Cryptcheck() []uint8 {
+	return sb.Data[11*8 : 11*8+CRYPT_SALTLEN]
+}
+
+// /       Cryptiters returns the number of iterations of the derivation of the
+// /       key of an encrypted file system from its passphrase.
+func (sb *Superblock_t) Cryptiters() int {
+	return fieldr(sb.Data, 13)
+}
+
 // writing
 
 // /       SetLoglen updates the log length field.
@@ -88,3 +111,13 @@ func (sb *Superblock_t) SetInodelen(n int) {
 func (sb *Superblock_t) SetLastblock(n int) {
 	fieldw(sb.Data, 7, n)
 }
+
+// /       SetCrypt records the cipher of the blocks after the superblock.
+func (sb *Superblock_t) SetCrypt(n int) {
+	fieldw(sb.Data, 8, n)
+}
+
+// /       SetCryptiters records the number of iterations of the key derivation.
+func (sb *Superblock_t) SetCryptiters(n int) {
+	fieldw(sb.Data, 13, n)
+}
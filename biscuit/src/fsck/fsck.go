@@ -0,0 +1,52 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"biscuit/biscuit/src/ufs"
+)
+
+// usage prints the command line syntax and exits.
+func usage() {
+	fmt.Printf("Usage: fsck [-y] [-k passfile] <image>\n")
+	fmt.Printf("  -y  repair the image instead of only reporting\n")
+	fmt.Printf("  -k  unlock an encrypted image with the passphrase in passfile\n")
+	os.Exit(2)
+}
+
+// main is the entry point for the fsck utility. It checks the consistency of
+// a disk image created by mkfs and exits with status 0 if the image is
+// consistent (or was fully repaired), 1 if inconsistencies remain, and 2 on
+// usage errors.
+func main() {
+	repair := flag.Bool("y", false, "repair the image")
+	passfile := flag.String("k", "", "file holding the passphrase of an encrypted image")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 {
+		usage()
+	}
+	if *passfile != "" {
+		if err := ufs.ReadPassphrase(*passfile); err != nil {
+			fmt.Printf("fsck: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	image := flag.Arg(0)
+	if _, err := os.Stat(image); err != nil {
+		fmt.Printf("fsck: %v\n", err)
+		os.Exit(2)
+	}
+
+	rep := ufs.Fsck(image, *repair)
+	for i := range rep.Errs {
+		fmt.Printf("%v\n", rep.Errs[i].String())
+	}
+	fmt.Printf("%v: %d inodes (%d orphans), %d blocks in use, %d problems\n",
+		image, rep.Ninodes, rep.Norphans, rep.Nblocks, len(rep.Errs))
+	if !rep.Clean() {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,3 @@
+module fsck
+
+go 1.24.0
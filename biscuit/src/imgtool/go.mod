@@ -0,0 +1,3 @@
+module imgtool
+
+go 1.24.0
@@ -0,0 +1,604 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"biscuit/biscuit/src/defs"
+	"biscuit/biscuit/src/fs"
+	"biscuit/biscuit/src/stat"
+	"biscuit/biscuit/src/ufs"
+	"biscuit/biscuit/src/ustr"
+)
+
+// out is where the commands print. The file system reports on booting and
+// shutting down on standard output, so main points os.Stdout at standard
+// error to keep those messages out of, say, the output of cat.
+var out = os.Stdout
+
+// status is the exit status; any failed operation sets it to 1.
+var status = 0
+
+// fail reports that the operation on `p` failed with `err` and makes the
+// utility exit with status 1. Biscuit's error numbers are Linux's, so the
+// host's error strings describe them.
+//
+// \param p    path in the image or on the host
+// \param err  the negated error number
+func fail(p string, err defs.Err_t) {
+	fmt.Fprintf(os.Stderr, "imgtool: %v: %v\n", p, syscall.Errno(-err))
+	status = 1
+}
+
+// failhost reports a failed operation on the host and makes the utility exit
+// with status 1.
+//
+// \param err  the host's error
+func failhost(err error) {
+	fmt.Fprintf(os.Stderr, "imgtool: %v\n", err)
+	status = 1
+}
+
+// itype returns the inode type encoded in the mode of a stat, or fs.I_DEV
+// for a device.
+//
+// \param st  stat of an inode
+// \return    the inode type
+func itype(st *stat.Stat_t) int {
+	m := st.Mode()
+	if m>>32 != 0 {
+		return fs.I_DEV
+	}
+	return int(m >> 16)
+}
+
+// modestr formats the type and permission bits of a stat as ls -l does.
+//
+// \param st  stat of an inode
+// \return    a string such as "drwxr-xr-x"
+func modestr(st *stat.Stat_t) string {
+	b := []byte("?rwxrwxrwx")
+	switch itype(st) {
+	case fs.I_FILE:
+		b[0] = '-'
+	case fs.I_DIR:
+		b[0] = 'd'
+	case fs.I_SYMLINK:
+		b[0] = 'l'
+	case fs.I_DEV:
+		b[0] = 'c'
+	}
+	perm := st.Mode() & 0777
+	for i := 0; i < 9; i++ {
+		if perm&(1<<uint(8-i)) == 0 {
+			b[i+1] = '-'
+		}
+	}
+	return string(b)
+}
+
+// isdir reports whether `p` is a directory in the image.
+//
+// \param f  file system of the image
+// \param p  path in the image
+// \return   true if p exists and is a directory
+func isdir(f *ufs.Ufs_t, p string) bool {
+	st, err := f.Stat(ustr.Ustr(p))
+	return err == 0 && itype(st) == fs.I_DIR
+}
+
+// children returns the names in directory `p` of the image, except "." and
+// "..", sorted.
+//
+// \param f  file system of the image
+// \param p  path of a directory in the image
+// \return   the names and an error, if any
+func children(f *ufs.Ufs_t, p string) ([]string, defs.Err_t) {
+	des, err := f.Readdir(ustr.Ustr(p), fs.BSIZE)
+	if err != 0 {
+		return nil, err
+	}
+	var names []string
+	for _, de := range des {
+		if de.Name.Isdot() || de.Name.Isdotdot() {
+			continue
+		}
+		names = append(names, string(de.Name))
+	}
+	sort.Strings(names)
+	return names, 0
+}
+
+// lsone prints one entry of an ls listing.
+//
+// \param f     file system of the image
+// \param p     path of the entry in the image
+// \param name  name to print
+// \param long  print the mode, owner, size and modification time too
+func lsone(f *ufs.Ufs_t, p, name string, long bool) {
+	if !long {
+		fmt.Fprintf(out, "%v\n", name)
+		return
+	}
+	st, err := f.Lstat(ustr.Ustr(p))
+	if err != 0 {
+		fail(p, err)
+		return
+	}
+	sec, _ := st.Mtime()
+	mtime := time.Unix(int64(sec), 0).Format("2006-01-02 15:04")
+	size := fmt.Sprintf("%d", st.Size())
+	if itype(st) == fs.I_DEV {
+		maj, min := defs.Unmkdev(st.Rdev())
+		size = fmt.Sprintf("%d, %d", maj, min)
+	}
+	fmt.Fprintf(out, "%v %5d %5d %10v %v %v", modestr(st), st.Uid(),
+		st.Gid(), size, mtime, name)
+	if itype(st) == fs.I_SYMLINK {
+		if target, err := f.Readlink(ustr.Ustr(p)); err == 0 {
+			fmt.Fprintf(out, " -> %v", target)
+		}
+	}
+	fmt.Fprintf(out, "\n")
+}
+
+// ls lists the directories in `args`, or the root if there are none, and
+// names the other files in args.
+//
+// \param f     file system of the image
+// \param args  command line arguments of ls
+func ls(f *ufs.Ufs_t, args []string) {
+	flags := flag.NewFlagSet("ls", flag.ExitOnError)
+	long := flags.Bool("l", false, "long listing")
+	flags.Parse(args)
+	paths := flags.Args()
+	if len(paths) == 0 {
+		paths = []string{"/"}
+	}
+	for i, p := range paths {
+		st, err := f.Lstat(ustr.Ustr(p))
+		if err != 0 {
+			fail(p, err)
+			continue
+		}
+		if itype(st) != fs.I_DIR {
+			lsone(f, p, p, *long)
+			continue
+		}
+		names, err := children(f, p)
+		if err != 0 {
+			fail(p, err)
+			continue
+		}
+		if len(paths) > 1 {
+			if i > 0 {
+				fmt.Fprintf(out, "\n")
+			}
+			fmt.Fprintf(out, "%v:\n", p)
+		}
+		for _, n := range names {
+			lsone(f, path.Join(p, n), n, *long)
+		}
+	}
+}
+
+// cat prints the files in `args`.
+//
+// \param f     file system of the image
+// \param args  paths of files in the image
+func cat(f *ufs.Ufs_t, args []string) {
+	for _, p := range args {
+		data, err := f.Read(ustr.Ustr(p))
+		if err != 0 {
+			fail(p, err)
+			continue
+		}
+		out.Write(data)
+	}
+}
+
+// statcmd prints the attributes of the files in `args`.
+//
+// \param f     file system of the image
+// \param args  paths in the image
+func statcmd(f *ufs.Ufs_t, args []string) {
+	for _, p := range args {
+		st, err := f.Lstat(ustr.Ustr(p))
+		if err != 0 {
+			fail(p, err)
+			continue
+		}
+		tm := func(sec, nsec uint) string {
+			t := time.Unix(int64(sec), int64(nsec))
+			return t.Format("2006-01-02 15:04:05.000000000")
+		}
+		fmt.Fprintf(out, "  File: %v\n", p)
+		fmt.Fprintf(out, "  Size: %-10d Inode: %-10d %v\n", st.Size(),
+			st.Rino(), modestr(st))
+		fmt.Fprintf(out, "  Mode: %04o      Uid: %-5d Gid: %d\n",
+			st.Mode()&07777, st.Uid(), st.Gid())
+		if itype(st) == fs.I_DEV {
+			maj, min := defs.Unmkdev(st.Rdev())
+			fmt.Fprintf(out, "Device: %d, %d\n", maj, min)
+		}
+		fmt.Fprintf(out, "Access: %v\n", tm(st.Atime()))
+		fmt.Fprintf(out, "Modify: %v\n", tm(st.Mtime()))
+		fmt.Fprintf(out, "Change: %v\n", tm(st.Ctime()))
+	}
+}
+
+// getone copies `src` in the image to `dst` on the host, recursively if src
+// is a directory. Devices are skipped.
+//
+// \param f    file system of the image
+// \param src  path in the image
+// \param dst  path on the host
+func getone(f *ufs.Ufs_t, src, dst string) {
+	st, err := f.Lstat(ustr.Ustr(src))
+	if err != 0 {
+		fail(src, err)
+		return
+	}
+	perm := os.FileMode(st.Mode() & 0777)
+	switch itype(st) {
+	case fs.I_DIR:
+		if err := os.Mkdir(dst, perm); err != nil && !os.IsExist(err) {
+			failhost(err)
+			return
+		}
+		names, err := children(f, src)
+		if err != 0 {
+			fail(src, err)
+			return
+		}
+		for _, n := range names {
+			getone(f, path.Join(src, n), filepath.Join(dst, n))
+		}
+	case fs.I_SYMLINK:
+		target, err := f.Readlink(ustr.Ustr(src))
+		if err != 0 {
+			fail(src, err)
+			return
+		}
+		if err := os.Symlink(string(target), dst); err != nil {
+			failhost(err)
+		}
+	case fs.I_FILE:
+		data, err := f.Read(ustr.Ustr(src))
+		if err != 0 {
+			fail(src, err)
+			return
+		}
+		if err := os.WriteFile(dst, data, perm); err != nil {
+			failhost(err)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "imgtool: %v: skipping device\n", src)
+	}
+}
+
+// get copies files out of the image like cp -R: the last argument is the
+// destination on the host, and the sources are copied into it if it is a
+// directory.
+//
+// \param f     file system of the image
+// \param args  paths in the image followed by a path on the host
+func get(f *ufs.Ufs_t, args []string) {
+	if len(args) < 2 {
+		usage()
+	}
+	srcs, dst := args[:len(args)-1], args[len(args)-1]
+	fi, err := os.Stat(dst)
+	into := err == nil && fi.IsDir()
+	if len(srcs) > 1 && !into {
+		fmt.Fprintf(os.Stderr, "imgtool: %v is not a directory\n", dst)
+		os.Exit(1)
+	}
+	for _, src := range srcs {
+		d := dst
+		if into {
+			d = filepath.Join(dst, path.Base(src))
+		}
+		getone(f, src, d)
+	}
+}
+
+// copydata appends the contents of the host file `src` to `dst` in the
+// image, one block at a time.
+//
+// \param f    file system of the image
+// \param src  path on the host
+// \param dst  path of a file in the image
+func copydata(f *ufs.Ufs_t, src, dst string) {
+	in, err := os.Open(src)
+	if err != nil {
+		failhost(err)
+		return
+	}
+	defer in.Close()
+
+	buf := make([]byte, fs.BSIZE)
+	for {
+		n, rerr := in.Read(buf)
+		if n > 0 {
+			if e := f.Append(ustr.Ustr(dst), ufs.MkBuf(buf[:n])); e != 0 {
+				fail(dst, e)
+				return
+			}
+		}
+		if rerr == io.EOF {
+			return
+		}
+		if rerr != nil {
+			failhost(rerr)
+			return
+		}
+	}
+}
+
+// putone copies `src` on the host to `dst` in the image, recursively if src
+// is a directory. A file or link at dst is replaced; a directory at dst is
+// merged with src.
+//
+// \param f    file system of the image
+// \param src  path on the host
+// \param dst  path in the image
+func putone(f *ufs.Ufs_t, src, dst string) {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		failhost(err)
+		return
+	}
+	d := ustr.Ustr(dst)
+	if fi.IsDir() {
+		if e := f.MkDir(d); e != 0 && !(e == -defs.EEXIST && isdir(f, dst)) {
+			fail(dst, e)
+			return
+		}
+		if e := f.Chmod(d, int(fi.Mode().Perm())); e != 0 {
+			fail(dst, e)
+		}
+		ents, err := os.ReadDir(src)
+		if err != nil {
+			failhost(err)
+			return
+		}
+		for _, ent := range ents {
+			putone(f, filepath.Join(src, ent.Name()), path.Join(dst, ent.Name()))
+		}
+		return
+	}
+
+	if st, e := f.Lstat(d); e == 0 {
+		if itype(st) == fs.I_DIR {
+			fail(dst, -defs.EISDIR)
+			return
+		}
+		if e := f.Unlink(d); e != 0 {
+			fail(dst, e)
+			return
+		}
+	}
+	switch {
+	case fi.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(src)
+		if err != nil {
+			failhost(err)
+			return
+		}
+		if e := f.Symlink(ustr.Ustr(target), d); e != 0 {
+			fail(dst, e)
+		}
+	case fi.Mode().IsRegular():
+		if e := f.MkFile(d, nil); e != 0 {
+			fail(dst, e)
+			return
+		}
+		copydata(f, src, dst)
+		if e := f.Chmod(d, int(fi.Mode().Perm())); e != 0 {
+			fail(dst, e)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "imgtool: %v: skipping special file\n", src)
+	}
+}
+
+// put copies files into the image like cp -R: the last argument is the
+// destination in the image, and the sources are copied into it if it is a
+// directory.
+//
+// \param f     file system of the image
+// \param args  paths on the host followed by a path in the image
+func put(f *ufs.Ufs_t, args []string) {
+	if len(args) < 2 {
+		usage()
+	}
+	srcs, dst := args[:len(args)-1], args[len(args)-1]
+	into := isdir(f, dst)
+	if len(srcs) > 1 && !into {
+		fail(dst, -defs.ENOTDIR)
+		return
+	}
+	for _, src := range srcs {
+		d := dst
+		if into {
+			d = path.Join(dst, filepath.Base(src))
+		}
+		putone(f, src, d)
+	}
+}
+
+// rmone removes `p` from the image, and everything below it if p is a
+// directory and `recurse` is set.
+//
+// \param f        file system of the image
+// \param p        path in the image
+// \param recurse  remove directories and their contents
+func rmone(f *ufs.Ufs_t, p string, recurse bool) {
+	st, err := f.Lstat(ustr.Ustr(p))
+	if err != 0 {
+		fail(p, err)
+		return
+	}
+	if itype(st) != fs.I_DIR {
+		if e := f.Unlink(ustr.Ustr(p)); e != 0 {
+			fail(p, e)
+		}
+		return
+	}
+	if !recurse {
+		fail(p, -defs.EISDIR)
+		return
+	}
+	names, err := children(f, p)
+	if err != 0 {
+		fail(p, err)
+		return
+	}
+	for _, n := range names {
+		rmone(f, path.Join(p, n), true)
+	}
+	if e := f.UnlinkDir(ustr.Ustr(p)); e != 0 {
+		fail(p, e)
+	}
+}
+
+// rm removes the files in `args` from the image.
+//
+// \param f     file system of the image
+// \param args  command line arguments of rm
+func rm(f *ufs.Ufs_t, args []string) {
+	flags := flag.NewFlagSet("rm", flag.ExitOnError)
+	recurse := flags.Bool("r", false, "remove directories and their contents")
+	flags.Parse(args)
+	for _, p := range flags.Args() {
+		rmone(f, p, *recurse)
+	}
+}
+
+// mkdir creates the directories in `args` in the image.
+//
+// \param f     file system of the image
+// \param args  command line arguments of mkdir
+func mkdir(f *ufs.Ufs_t, args []string) {
+	flags := flag.NewFlagSet("mkdir", flag.ExitOnError)
+	parents := flags.Bool("p", false, "create missing parents; existing directories are fine")
+	flags.Parse(args)
+	for _, p := range flags.Args() {
+		dirs := []string{p}
+		if *parents {
+			dirs = nil
+			for d := path.Clean("/" + p); d != "/"; d = path.Dir(d) {
+				dirs = append([]string{d}, dirs...)
+			}
+		}
+		for _, d := range dirs {
+			e := f.MkDir(ustr.Ustr(d))
+			if e == -defs.EEXIST && *parents && isdir(f, d) {
+				continue
+			}
+			if e != 0 {
+				fail(d, e)
+				break
+			}
+		}
+	}
+}
+
+// mv renames files in the image like mv: the last argument is the new name,
+// or the directory to move the other arguments into.
+//
+// \param f     file system of the image
+// \param args  paths in the image
+func mv(f *ufs.Ufs_t, args []string) {
+	if len(args) < 2 {
+		usage()
+	}
+	srcs, dst := args[:len(args)-1], args[len(args)-1]
+	into := isdir(f, dst)
+	if len(srcs) > 1 && !into {
+		fail(dst, -defs.ENOTDIR)
+		return
+	}
+	for _, src := range srcs {
+		d := dst
+		if into {
+			d = path.Join(dst, path.Base(src))
+		}
+		if e := f.Rename(ustr.Ustr(src), ustr.Ustr(d)); e != 0 {
+			fail(src, e)
+		}
+	}
+}
+
+// commands maps each command to its implementation.
+var commands = map[string]func(*ufs.Ufs_t, []string){
+	"ls":    ls,
+	"cat":   cat,
+	"stat":  statcmd,
+	"get":   get,
+	"put":   put,
+	"rm":    rm,
+	"mkdir": mkdir,
+	"mv":    mv,
+}
+
+// usage prints the command line syntax and exits.
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: imgtool [-k passfile] <image> <command> [args]\n")
+	fmt.Fprintf(os.Stderr, "  ls [-l] [path...]         list directories\n")
+	fmt.Fprintf(os.Stderr, "  cat path...               print files\n")
+	fmt.Fprintf(os.Stderr, "  stat path...              print file attributes\n")
+	fmt.Fprintf(os.Stderr, "  get path... hostpath      copy out of the image, recursively\n")
+	fmt.Fprintf(os.Stderr, "  put hostpath... path      copy into the image, recursively\n")
+	fmt.Fprintf(os.Stderr, "  rm [-r] path...           remove files\n")
+	fmt.Fprintf(os.Stderr, "  mkdir [-p] path...        create directories\n")
+	fmt.Fprintf(os.Stderr, "  mv path... path           rename files\n")
+	fmt.Fprintf(os.Stderr, "-k unlocks an encrypted image with the passphrase in passfile\n")
+	os.Exit(2)
+}
+
+// main is the entry point for the imgtool utility. It opens an existing disk
+// image, runs one command on its file system and shuts the file system down
+// so that changes are on disk. It exits with status 0 on success, 1 if an
+// operation failed and 2 on usage errors.
+func main() {
+	passfile := flag.String("k", "", "file holding the passphrase of an encrypted image")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 2 {
+		usage()
+	}
+	if *passfile != "" {
+		if err := ufs.ReadPassphrase(*passfile); err != nil {
+			fmt.Fprintf(os.Stderr, "imgtool: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	image := flag.Arg(0)
+	cmd, ok := commands[flag.Arg(1)]
+	if !ok {
+		usage()
+	}
+	if _, err := os.Stat(image); err != nil {
+		fmt.Fprintf(os.Stderr, "imgtool: %v\n", err)
+		os.Exit(2)
+	}
+
+	os.Stdout = os.Stderr
+	f := ufs.BootFS(image)
+	if _, err := f.Stat(ustr.MkUstrRoot()); err != 0 {
+		fmt.Fprintf(os.Stderr, "imgtool: %v: not a valid fs: no root inode\n", image)
+		os.Exit(1)
+	}
+	cmd(f, flag.Args()[2:])
+	ufs.ShutdownFS(f)
+	os.Exit(status)
+}
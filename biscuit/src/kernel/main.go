@@ -15,6 +15,7 @@ import "apic"
 import "bnet"
 import "caller"
 import "defs"
+import "devfs"
 import "inet"
 import "fd"
 import "fdops"
@@ -24,12 +25,15 @@ import "ixgbe"
 import "mem"
 import "pci"
 import "proc"
+import "procfs"
 import "res"
 import "stat"
 import "stats"
 import "tinfo"
+import "tmpfs"
 import "ustr"
 import "util"
+import "vfs"
 import "vm"
 
 const (
@@ -125,7 +129,7 @@ type dev_t struct {
 	minor int
 }
 
-var dummyfops = &fs.Devfops_t{Maj: defs.D_CONSOLE, Min: 0}
+var dummyfops = fs.Console()
 
 // special fds
 var fd_stdin = fd.Fd_t{Fops: dummyfops, Perms: fd.FD_READ}
@@ -637,6 +641,9 @@ type cons_t struct {
 	reqc    chan int
 	pollc   chan fdops.Pollmsg_t
 	pollret chan fdops.Ready_t
+	// while non-zero, typed keys are echoed as '*' and trigger no debug
+	// commands, so that a passphrase stays off the screen
+	masked int32
 }
 
 var cons = cons_t{}
@@ -775,12 +782,25 @@ func kbd_daemon(cons *cons_t, km map[int]byte) {
 	var lastpk time.Time
 	pkcount := 0
 	addprint := func(c byte) {
-		fmt.Printf("%c", c)
+		masked := atomic.LoadInt32(&cons.masked) != 0
+		switch {
+		case !masked:
+			fmt.Printf("%c", c)
+		case c == '\n':
+			fmt.Printf("\n")
+		case c == '\b':
+			fmt.Printf("\b \b")
+		default:
+			fmt.Printf("*")
+		}
 		if len(data) > 1024 {
 			fmt.Printf("key dropped!\n")
 			return
 		}
 		data = append(data, c)
+		if masked {
+			return
+		}
 		if c == '\\' {
 			if time.Since(lastpk) > time.Second {
 				pkcount = 0
@@ -943,6 +963,33 @@ func kbd_get(cnt int) ([]byte, defs.Err_t) {
 	return <-cons.reader, 0
 }
 
+// asks on the console for the passphrase of an encrypted disk. the console
+// echoes a '*' for each key typed instead of the key.
+func askpass() []uint8 {
+	atomic.StoreInt32(&cons.masked, 1)
+	defer atomic.StoreInt32(&cons.masked, 0)
+	fmt.Printf("disk passphrase: ")
+	var pass []uint8
+	for {
+		d, err := kbd_get(1)
+		if err != 0 {
+			panic("cannot read passphrase")
+		}
+		for _, c := range d {
+			switch c {
+			case '\n', '\r':
+				return pass
+			case '\b':
+				if len(pass) > 0 {
+					pass = pass[:len(pass)-1]
+				}
+			default:
+				pass = append(pass, c)
+			}
+		}
+	}
+}
+
 func attach_devs() int {
 	// must occur before devices attach (drivers may use Bsp_apic_id to
 	// route interrupts to the BSP)
@@ -1018,6 +1065,18 @@ func cpuidfamily() (uint, uint) {
 	return dispmodel, dispfamily
 }
 
+// returns the processor's vendor string, such as "GenuineIntel".
+func cpuvendor() string {
+	_, bx, cx, dx := cpuid(0, 0)
+	v := make([]uint8, 0, 12)
+	for _, r := range []uint32{bx, dx, cx} {
+		for i := uint(0); i < 4; i++ {
+			v = append(v, uint8(r>>(8*i)))
+		}
+	}
+	return string(v)
+}
+
 func cpuid(ax, cx uint32) (uint32, uint32, uint32, uint32) {
 	// Intel® Processor Identification and the CPUID Instruction: leafs
 	// greater than 0x80000000 are "extended", leafs less than 0x80000000
@@ -1659,7 +1718,7 @@ func _fakefail() bool {
 }
 
 func structchk() {
-	if unsafe.Sizeof(stat.Stat_t{}) != 9*8 {
+	if unsafe.Sizeof(stat.Stat_t{}) != 14*8 {
 		panic("bad stat_t size")
 	}
 }
@@ -1667,9 +1726,56 @@ func structchk() {
 var lhits int
 var physmem *mem.Physmem_t
 var thefs *fs.Fs_t
+var thevfs *vfs.Vfs_t
 
 const diskfs = false
 
+// mounts root at "/", makes the stat device show the statistics of every
+// mount, makes the raw disk devices use root and makes tmpfs, procfs and devfs
+// mountable. unless its size option says otherwise, a tmpfs may hold up to
+// half of the physical pages.
+func vfs_init(root *fs.Fs_t) {
+	thevfs = vfs.MkVfs(root, "biscuitfs", ustr.Ustr("ahci"))
+	fs.Devstats = func() string {
+		return root.Fs_statistics() + thevfs.Stats()
+	}
+	ahci.Rawfs = root
+	vfs.Register("tmpfs", func(src ustr.Ustr, flags int, data ustr.Ustr) (vfs.Fs_i, defs.Err_t) {
+		tfs, err := tmpfs.MkTmpfs(mem.Physmem, data, len(mem.Physmem.Pgs)/2)
+		if err != 0 {
+			return nil, err
+		}
+		return tfs, 0
+	})
+	model, family := cpuidfamily()
+	// the root file system is mounted right after the CPUs start, which is
+	// as good a boot time as any
+	si := &procfs.Sysinfo_t{Pages: physpages, Ncpu: runtime.GOMAXPROCS(0),
+		Vendor: cpuvendor(), Family: family, Model: model,
+		Boot: time.Now(), Fsstats: root.Fs_stats}
+	vfs.Register("proc", func(src ustr.Ustr, flags int, data ustr.Ustr) (vfs.Fs_i, defs.Err_t) {
+		if len(data) != 0 {
+			return nil, -defs.EINVAL
+		}
+		return procfs.MkProcfs(si), 0
+	})
+	vfs.Register("devfs", func(src ustr.Ustr, flags int, data ustr.Ustr) (vfs.Fs_i, defs.Err_t) {
+		if len(data) != 0 {
+			return nil, -defs.EINVAL
+		}
+		return devfs.MkDevfs(), 0
+	})
+}
+
+// returns the number of physical pages and how many of them are free.
+func physpages() (int, int) {
+	free, _, pcpg, _ := physmem.Pgcount()
+	for _, n := range pcpg {
+		free += n
+	}
+	return len(physmem.Pgs), free
+}
+
 // /       main initializes device drivers, CPUs, and the filesystem
 // /       before scheduling the initial process.
 // /       Major steps:
@@ -1733,8 +1839,13 @@ func main() {
 	tinfo.SetCurrent(&tinfo.Tnote_t{})
 	manymeg := &res.Res_t{Objs: runtime.Resobjs_t{1: 100 << 20}}
 	res.Resbegin(manymeg)
-	rf, fs := fs.StartFS(ahci.Blockmem, ahci.Ahci, console, diskfs)
+	disk, err := fs.Unlockdisk(ahci.Blockmem, ahci.Ahci, askpass)
+	if err != 0 {
+		panic(fmt.Sprintf("cannot unlock disk: %v", err))
+	}
+	rf, fs := fs.StartFS(ahci.Blockmem, disk, console, diskfs)
 	thefs = fs
+	vfs_init(thefs)
 
 	proc.Oom_init(thefs.Fs_evict)
 
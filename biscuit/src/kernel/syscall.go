@@ -13,9 +13,9 @@ import "unsafe"
 
 import "bnet"
 import "bounds"
-import "bpath"
 import "circbuf"
 import "defs"
+import "dev"
 import "fd"
 import "fdops"
 import "fs"
@@ -36,6 +36,7 @@ var _sysbounds = []*res.Res_t{
 	defs.SYS_CLOSE:      bounds.Bounds(bounds.B_SYSCALL_T_SYS_CLOSE),
 	defs.SYS_STAT:       bounds.Bounds(bounds.B_SYS_STAT),
 	defs.SYS_FSTAT:      bounds.Bounds(bounds.B_SYS_FSTAT),
+	defs.SYS_LSTAT:      bounds.Bounds(bounds.B_SYS_LSTAT),
 	defs.SYS_POLL:       bounds.Bounds(bounds.B_SYS_POLL),
 	defs.SYS_LSEEK:      bounds.Bounds(bounds.B_SYS_LSEEK),
 	defs.SYS_MMAP:       bounds.Bounds(bounds.B_SYS_MMAP),
@@ -75,14 +76,33 @@ var _sysbounds = []*res.Res_t{
 	defs.SYS_MKDIR:      bounds.Bounds(bounds.B_SYS_MKDIR),
 	defs.SYS_LINK:       bounds.Bounds(bounds.B_SYS_LINK),
 	defs.SYS_UNLINK:     bounds.Bounds(bounds.B_SYS_UNLINK),
+	defs.SYS_SYMLINK:    bounds.Bounds(bounds.B_SYS_SYMLINK),
+	defs.SYS_READLINK:   bounds.Bounds(bounds.B_SYS_READLINK),
+	defs.SYS_CHMOD:      bounds.Bounds(bounds.B_SYS_CHMOD),
+	defs.SYS_FCHMOD:     bounds.Bounds(bounds.B_SYS_FCHMOD),
+	defs.SYS_CHOWN:      bounds.Bounds(bounds.B_SYS_CHOWN),
+	defs.SYS_FCHOWN:     bounds.Bounds(bounds.B_SYS_FCHOWN),
 	defs.SYS_GETTOD:     bounds.Bounds(bounds.B_SYS_GETTIMEOFDAY),
 	defs.SYS_GETRLMT:    bounds.Bounds(bounds.B_SYS_GETRLIMIT),
 	defs.SYS_GETRUSG:    bounds.Bounds(bounds.B_SYS_GETRUSAGE),
+	defs.SYS_GETUID:     bounds.Bounds(bounds.B_SYS_GETUID),
+	defs.SYS_GETGID:     bounds.Bounds(bounds.B_SYS_GETGID),
+	defs.SYS_SETUID:     bounds.Bounds(bounds.B_SYS_SETUID),
+	defs.SYS_SETGID:     bounds.Bounds(bounds.B_SYS_SETGID),
 	defs.SYS_MKNOD:      bounds.Bounds(bounds.B_SYS_MKNOD),
+	defs.SYS_STATFS:     bounds.Bounds(bounds.B_SYS_STATFS),
+	defs.SYS_FSTATFS:    bounds.Bounds(bounds.B_SYS_FSTATFS),
 	defs.SYS_SETRLMT:    bounds.Bounds(bounds.B_SYS_SETRLIMIT),
 	defs.SYS_SYNC:       bounds.Bounds(bounds.B_SYS_SYNC),
+	defs.SYS_MOUNT:      bounds.Bounds(bounds.B_SYS_MOUNT),
+	defs.SYS_UMOUNT2:    bounds.Bounds(bounds.B_SYS_UMOUNT2),
+	defs.SYS_FSYNC:      bounds.Bounds(bounds.B_SYS_FSYNC),
+	defs.SYS_FDATASYNC:  bounds.Bounds(bounds.B_SYS_FSYNC),
 	defs.SYS_REBOOT:     bounds.Bounds(bounds.B_SYS_REBOOT),
+	defs.SYS_GETDENTS64: bounds.Bounds(bounds.B_SYS_GETDENTS64),
 	defs.SYS_NANOSLEEP:  bounds.Bounds(bounds.B_SYS_NANOSLEEP),
+	defs.SYS_UTIMENSAT:  bounds.Bounds(bounds.B_SYS_UTIMENSAT),
+	defs.SYS_FALLOCATE:  bounds.Bounds(bounds.B_SYS_FALLOCATE),
 	defs.SYS_PIPE2:      bounds.Bounds(bounds.B_SYS_PIPE2),
 	defs.SYS_PROF:       bounds.Bounds(bounds.B_SYS_PROF),
 	defs.SYS_THREXIT:    bounds.Bounds(bounds.B_SYS_THREXIT),
@@ -143,6 +163,8 @@ func (s *syscall_t) Syscall(p *proc.Proc_t, tid defs.Tid_t, tf *[defs.TFSIZE]uin
 		ret = sys_stat(p, a1, a2)
 	case defs.SYS_FSTAT:
 		ret = sys_fstat(p, a1, a2)
+	case defs.SYS_LSTAT:
+		ret = sys_lstat(p, a1, a2)
 	case defs.SYS_POLL:
 		ret = sys_poll(p, tid, a1, a2, a3)
 	case defs.SYS_LSEEK:
@@ -211,6 +233,10 @@ func (s *syscall_t) Syscall(p *proc.Proc_t, tid defs.Tid_t, tf *[defs.TFSIZE]uin
 		ret = sys_truncate(p, a1, uint(a2))
 	case defs.SYS_FTRUNC:
 		ret = sys_ftruncate(p, a1, uint(a2))
+	case defs.SYS_FSYNC:
+		ret = sys_fsync(p, a1, false)
+	case defs.SYS_FDATASYNC:
+		ret = sys_fsync(p, a1, true)
 	case defs.SYS_GETCWD:
 		ret = sys_getcwd(p, a1, a2)
 	case defs.SYS_CHDIR:
@@ -223,22 +249,56 @@ func (s *syscall_t) Syscall(p *proc.Proc_t, tid defs.Tid_t, tf *[defs.TFSIZE]uin
 		ret = sys_link(p, a1, a2)
 	case defs.SYS_UNLINK:
 		ret = sys_unlink(p, a1, a2)
+	case defs.SYS_SYMLINK:
+		ret = sys_symlink(p, a1, a2)
+	case defs.SYS_READLINK:
+		ret = sys_readlink(p, a1, a2, a3)
+	case defs.SYS_CHMOD:
+		ret = sys_chmod(p, a1, a2)
+	case defs.SYS_FCHMOD:
+		ret = sys_fchmod(p, a1, a2)
+	case defs.SYS_CHOWN:
+		ret = sys_chown(p, a1, a2, a3)
+	case defs.SYS_FCHOWN:
+		ret = sys_fchown(p, a1, a2, a3)
 	case defs.SYS_GETTOD:
 		ret = sys_gettimeofday(p, a1)
 	case defs.SYS_GETRLMT:
 		ret = sys_getrlimit(p, a1, a2)
 	case defs.SYS_GETRUSG:
 		ret = sys_getrusage(p, a1, a2)
+	case defs.SYS_GETUID:
+		ret = sys_getuid(p)
+	case defs.SYS_GETGID:
+		ret = sys_getgid(p)
+	case defs.SYS_SETUID:
+		ret = sys_setuid(p, a1)
+	case defs.SYS_SETGID:
+		ret = sys_setgid(p, a1)
 	case defs.SYS_MKNOD:
 		ret = sys_mknod(p, a1, a2, a3)
+	case defs.SYS_STATFS:
+		ret = sys_statfs(p, a1, a2)
+	case defs.SYS_FSTATFS:
+		ret = sys_fstatfs(p, a1, a2)
 	case defs.SYS_SETRLMT:
 		ret = sys_setrlimit(p, a1, a2)
 	case defs.SYS_SYNC:
 		ret = sys_sync(p)
+	case defs.SYS_MOUNT:
+		ret = sys_mount(p, a1, a2, a3, a4, a5)
+	case defs.SYS_UMOUNT2:
+		ret = sys_umount2(p, a1, a2)
 	case defs.SYS_REBOOT:
 		ret = sys_reboot(p)
+	case defs.SYS_GETDENTS64:
+		ret = sys_getdents64(p, a1, a2, a3)
 	case defs.SYS_NANOSLEEP:
 		ret = sys_nanosleep(p, a1, a2)
+	case defs.SYS_UTIMENSAT:
+		ret = sys_utimensat(p, a1, a2, a3, a4)
+	case defs.SYS_FALLOCATE:
+		ret = sys_fallocate(p, a1, a2, a3, a4)
 	case defs.SYS_PIPE2:
 		ret = sys_pipe2(p, a1, a2)
 	case defs.SYS_PROF:
@@ -342,6 +402,23 @@ func sys_read(p *proc.Proc_t, fdn int, bufp int, sz int) int {
 	return ret
 }
 
+func sys_getdents64(p *proc.Proc_t, fdn int, bufp int, sz int) int {
+	if sz < 0 {
+		return int(-defs.EINVAL)
+	}
+	fd, err := _fd_read(p, fdn)
+	if err != 0 {
+		return int(err)
+	}
+	userbuf := p.Vm.Mkuserbuf(bufp, sz)
+
+	ret, err := fd.Fops.Getdents(userbuf)
+	if err != 0 {
+		return int(err)
+	}
+	return ret
+}
+
 func sys_write(p *proc.Proc_t, fdn int, bufp int, sz int) int {
 	if sz == 0 {
 		return 0
@@ -388,7 +465,7 @@ func sys_open(p *proc.Proc_t, pathn int, _flags int, mode int) int {
 	if err != 0 {
 		return int(err)
 	}
-	file, err := thefs.Fs_open(path, flags, mode, p.Cwd, 0, 0)
+	file, err := thevfs.Fs_open(path, flags, mode, p.Cwd, 0, 0)
 	if err != 0 {
 		return int(err)
 	}
@@ -503,7 +580,7 @@ func sys_mmap(p *proc.Proc_t, addrn, lenn, protflags, fdn, offset int) int {
 		// vmadd_*file will increase the open count on the file
 		if shared {
 			p.Vm.Vmadd_sharefile(addr, lenn, perms, fops, offset,
-				thefs)
+				thevfs.Unpinner(f))
 		} else {
 			p.Vm.Vmadd_file(addr, lenn, perms, fops, offset)
 		}
@@ -630,21 +707,21 @@ func sys_access(p *proc.Proc_t, pathn, mode int) int {
 		return int(-defs.EINVAL)
 	}
 
-	fsf, err := thefs.Fs_open_inner(path, defs.O_RDONLY, 0, p.Cwd, 0, 0)
-	if err != 0 {
-		return int(err)
+	if mode&^(defs.R_OK|defs.W_OK|defs.X_OK) != 0 {
+		return int(-defs.EINVAL)
 	}
 
-	// XXX no permissions yet
-	//R_OK := 1 << 0
-	//W_OK := 1 << 1
-	//X_OK := 1 << 2
-	ret := 0
-
-	if thefs.Fs_close(fsf.Inum) != 0 {
-		panic("must succeed")
+	want := 0
+	if mode&defs.R_OK != 0 {
+		want |= fs.A_READ
 	}
-	return ret
+	if mode&defs.W_OK != 0 {
+		want |= fs.A_WRITE
+	}
+	if mode&defs.X_OK != 0 {
+		want |= fs.A_EXEC
+	}
+	return int(thevfs.Fs_access(path, p.Cwd, want))
 }
 
 func sys_dup2(p *proc.Proc_t, oldn, newn int) int {
@@ -666,8 +743,27 @@ func sys_stat(p *proc.Proc_t, pathn, statn int) int {
 	if err != 0 {
 		return int(err)
 	}
+	if err := badpath(path); err != 0 {
+		return int(err)
+	}
 	buf := &stat.Stat_t{}
-	err = thefs.Fs_stat(path, buf, p.Cwd)
+	err = thevfs.Fs_stat(path, buf, p.Cwd)
+	if err != 0 {
+		return int(err)
+	}
+	return int(p.Vm.K2user(buf.Bytes(), statn))
+}
+
+func sys_lstat(p *proc.Proc_t, pathn, statn int) int {
+	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	if err := badpath(path); err != 0 {
+		return int(err)
+	}
+	buf := &stat.Stat_t{}
+	err = thevfs.Fs_lstat(path, buf, p.Cwd)
 	if err != 0 {
 		return int(err)
 	}
@@ -688,6 +784,89 @@ func sys_fstat(p *proc.Proc_t, fdn int, statn int) int {
 	return int(p.Vm.K2user(buf.Bytes(), statn))
 }
 
+func sys_statfs(p *proc.Proc_t, pathn, statn int) int {
+	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	buf := &stat.Statfs_t{}
+	err = thevfs.Fs_statfs(path, buf, p.Cwd)
+	if err != 0 {
+		return int(err)
+	}
+	return int(p.Vm.K2user(buf.Bytes(), statn))
+}
+
+func sys_fstatfs(p *proc.Proc_t, fdn int, statn int) int {
+	f, ok := p.Fd_get(fdn)
+	if !ok {
+		return int(-defs.EBADF)
+	}
+	buf := &stat.Statfs_t{}
+	thevfs.Fs_fstatfs(f, buf)
+	return int(p.Vm.K2user(buf.Bytes(), statn))
+}
+
+// reads the user timespec at va and returns it in nanoseconds, or -1 for
+// UTIME_OMIT.
+func _utimespec(p *proc.Proc_t, va int) (int, defs.Err_t) {
+	secs, err := p.Vm.Userreadn(va, 8)
+	if err != 0 {
+		return 0, err
+	}
+	nsecs, err := p.Vm.Userreadn(va+8, 8)
+	if err != 0 {
+		return 0, err
+	}
+	switch nsecs {
+	case defs.UTIME_NOW:
+		return int(time.Now().UnixNano()), 0
+	case defs.UTIME_OMIT:
+		return -1, 0
+	}
+	if secs < 0 || nsecs < 0 || nsecs >= 1e9 {
+		return 0, -defs.EINVAL
+	}
+	return secs*1e9 + nsecs, 0
+}
+
+// only dirfd == AT_FDCWD is supported for relative paths. a null path sets the
+// times of the file open at dirfd, like futimens(3).
+func sys_utimensat(p *proc.Proc_t, dirfd, pathn, timesn, flags int) int {
+	if flags != 0 {
+		return int(-defs.EINVAL)
+	}
+	atime := int(time.Now().UnixNano())
+	mtime := atime
+	if timesn != 0 {
+		var err defs.Err_t
+		if atime, err = _utimespec(p, timesn); err != 0 {
+			return int(err)
+		}
+		if mtime, err = _utimespec(p, timesn+16); err != 0 {
+			return int(err)
+		}
+	}
+	if pathn == 0 {
+		f, ok := p.Fd_get(dirfd)
+		if !ok {
+			return int(-defs.EBADF)
+		}
+		return int(thevfs.Fs_futimens(f, atime, mtime))
+	}
+	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	if err := badpath(path); err != 0 {
+		return int(err)
+	}
+	if dirfd != defs.AT_FDCWD && !path.IsAbsolute() {
+		return int(-defs.EINVAL)
+	}
+	return int(thevfs.Fs_utimens(path, p.Cwd, atime, mtime))
+}
+
 // converts internal states to poll states
 // pokes poll status bits into user memory. since we only use one priority
 // internally, mask away any POLL bits the user didn't not request.
@@ -1156,6 +1335,18 @@ func (of *pipefops_t) Pwrite(fdops.Userio_i, int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
 
+func (of *pipefops_t) Getdents(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.ENOTDIR
+}
+
+func (of *pipefops_t) Fsync(bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (of *pipefops_t) Fallocate(int, int, int) defs.Err_t {
+	return -defs.ESPIPE
+}
+
 func (of *pipefops_t) Accept(fdops.Userio_i) (fdops.Fdops_i, int, defs.Err_t) {
 	return nil, 0, -defs.ENOTSOCK
 }
@@ -1232,7 +1423,7 @@ func sys_rename(p *proc.Proc_t, oldn int, newn int) int {
 	if err2 != 0 {
 		return int(err2)
 	}
-	err := thefs.Fs_rename(old, new, p.Cwd)
+	err := thevfs.Fs_rename(old, new, p.Cwd)
 	return int(err)
 }
 
@@ -1245,7 +1436,7 @@ func sys_mkdir(p *proc.Proc_t, pathn int, mode int) int {
 	if err != 0 {
 		return int(err)
 	}
-	err = thefs.Fs_mkdir(path, mode, p.Cwd)
+	err = thevfs.Fs_mkdir(path, mode, p.Cwd)
 	return int(err)
 }
 
@@ -1266,7 +1457,7 @@ func sys_link(p *proc.Proc_t, oldn int, newn int) int {
 	if err2 != 0 {
 		return int(err2)
 	}
-	err := thefs.Fs_link(old, new, p.Cwd)
+	err := thevfs.Fs_link(old, new, p.Cwd)
 	return int(err)
 }
 
@@ -1280,10 +1471,98 @@ func sys_unlink(p *proc.Proc_t, pathn, isdiri int) int {
 		return int(err)
 	}
 	wantdir := isdiri != 0
-	err = thefs.Fs_unlink(path, p.Cwd, wantdir)
+	err = thevfs.Fs_unlink(path, p.Cwd, wantdir)
+	return int(err)
+}
+
+func sys_symlink(p *proc.Proc_t, targetn, linkn int) int {
+	target, err1 := p.Vm.Userstr(targetn, fs.SYMLINK_MAX)
+	link, err2 := p.Vm.Userstr(linkn, fs.NAME_MAX)
+	if err1 != 0 {
+		return int(err1)
+	}
+	if err2 != 0 {
+		return int(err2)
+	}
+	err := badpath(link)
+	if err != 0 {
+		return int(err)
+	}
+	err = thevfs.Fs_symlink(target, link, p.Cwd)
 	return int(err)
 }
 
+// returns the number of bytes of the target copied to the user buffer, which
+// is not NUL terminated.
+func sys_readlink(p *proc.Proc_t, pathn, bufn, sz int) int {
+	if sz < 0 {
+		return int(-defs.EINVAL)
+	}
+	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	err = badpath(path)
+	if err != 0 {
+		return int(err)
+	}
+	target, err := thevfs.Fs_readlink(path, p.Cwd)
+	if err != 0 {
+		return int(err)
+	}
+	if len(target) > sz {
+		target = target[:sz]
+	}
+	dst := p.Vm.Mkuserbuf(bufn, len(target))
+	n, err := dst.Uiowrite([]uint8(target))
+	if err != 0 {
+		return int(err)
+	}
+	return n
+}
+
+func sys_chmod(p *proc.Proc_t, pathn, mode int) int {
+	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	err = badpath(path)
+	if err != 0 {
+		return int(err)
+	}
+	err = thevfs.Fs_chmod(path, p.Cwd, mode)
+	return int(err)
+}
+
+func sys_fchmod(p *proc.Proc_t, fdn, mode int) int {
+	f, ok := p.Fd_get(fdn)
+	if !ok {
+		return int(-defs.EBADF)
+	}
+	return int(thevfs.Fs_fchmod(f, &p.Cwd.Cred, mode))
+}
+
+func sys_chown(p *proc.Proc_t, pathn, uid, gid int) int {
+	path, err := p.Vm.Userstr(pathn, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	err = badpath(path)
+	if err != 0 {
+		return int(err)
+	}
+	err = thevfs.Fs_chown(path, p.Cwd, uid, gid)
+	return int(err)
+}
+
+func sys_fchown(p *proc.Proc_t, fdn, uid, gid int) int {
+	f, ok := p.Fd_get(fdn)
+	if !ok {
+		return int(-defs.EBADF)
+	}
+	return int(thevfs.Fs_fchown(f, &p.Cwd.Cred, uid, gid))
+}
+
 func sys_gettimeofday(p *proc.Proc_t, timevaln int) int {
 	tvalsz := 16
 	now := time.Now()
@@ -1381,18 +1660,55 @@ func sys_mknod(p *proc.Proc_t, pathn, moden, devn int) int {
 		return int(err)
 	}
 	maj, min := defs.Unmkdev(uint(devn))
-	fsf, err := thefs.Fs_open_inner(path, defs.O_CREAT, 0, p.Cwd, maj, min)
+	_, err = thevfs.Fs_mknod(path, defs.O_CREAT, p.Cwd, maj, min)
+	return int(err)
+}
+
+func sys_sync(p *proc.Proc_t) int {
+	return int(thevfs.Fs_sync())
+}
+
+// the source may be null for file systems that have none. the file system
+// specific data, if not null, is a string of options.
+func sys_mount(p *proc.Proc_t, srcn, targetn, fstypen, flags, datan int) int {
+	var src ustr.Ustr
+	if srcn != 0 {
+		var err defs.Err_t
+		src, err = p.Vm.Userstr(srcn, fs.NAME_MAX)
+		if err != 0 {
+			return int(err)
+		}
+	}
+	target, err := p.Vm.Userstr(targetn, fs.NAME_MAX)
 	if err != 0 {
 		return int(err)
 	}
-	if thefs.Fs_close(fsf.Inum) != 0 {
-		panic("must succeed")
+	if err := badpath(target); err != 0 {
+		return int(err)
 	}
-	return 0
+	fstype, err := p.Vm.Userstr(fstypen, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	var data ustr.Ustr
+	if datan != 0 {
+		data, err = p.Vm.Userstr(datan, fs.NAME_MAX)
+		if err != 0 {
+			return int(err)
+		}
+	}
+	return int(thevfs.Mount(src, target, fstype.String(), flags, data, p.Cwd))
 }
 
-func sys_sync(p *proc.Proc_t) int {
-	return int(thefs.Fs_sync())
+func sys_umount2(p *proc.Proc_t, targetn, flags int) int {
+	target, err := p.Vm.Userstr(targetn, fs.NAME_MAX)
+	if err != 0 {
+		return int(err)
+	}
+	if err := badpath(target); err != 0 {
+		return int(err)
+	}
+	return int(thevfs.Umount(target, flags, p.Cwd))
 }
 
 func sys_reboot(p *proc.Proc_t) int {
@@ -1436,6 +1752,43 @@ func sys_getppid(p *proc.Proc_t, tid defs.Tid_t) int {
 	return p.Pwait.Pid
 }
 
+// the credentials live in the cwd since they are used by path lookups; the
+// cwd lock serializes changes to them.
+func sys_getuid(p *proc.Proc_t) int {
+	return p.Cwd.Cred.Uid
+}
+
+func sys_getgid(p *proc.Proc_t) int {
+	return p.Cwd.Cred.Gid
+}
+
+// only the superuser may change its user id.
+func sys_setuid(p *proc.Proc_t, uid int) int {
+	if uid < 0 {
+		return int(-defs.EINVAL)
+	}
+	p.Cwd.Lock()
+	defer p.Cwd.Unlock()
+	if !p.Cwd.Cred.Root() && uid != p.Cwd.Cred.Uid {
+		return int(-defs.EPERM)
+	}
+	p.Cwd.Cred.Uid = uid
+	return 0
+}
+
+func sys_setgid(p *proc.Proc_t, gid int) int {
+	if gid < 0 {
+		return int(-defs.EINVAL)
+	}
+	p.Cwd.Lock()
+	defer p.Cwd.Unlock()
+	if !p.Cwd.Cred.Root() && gid != p.Cwd.Cred.Gid {
+		return int(-defs.EPERM)
+	}
+	p.Cwd.Cred.Gid = gid
+	return 0
+}
+
 func sys_socket(p *proc.Proc_t, domain, typ, proto int) int {
 	var opts defs.Fdopt_t
 	if typ&defs.SOCK_NONBLOCK != 0 {
@@ -1877,6 +2230,13 @@ func sys_bind(p *proc.Proc_t, fdn, sockaddrn, socklen int) int {
 	return int(r)
 }
 
+// the special files of UNIX domain datagram and stream sockets cannot be
+// opened
+func init() {
+	dev.RegisterAt("sud", dev.D_SUD, nil)
+	dev.RegisterAt("sus", dev.D_SUS, nil)
+}
+
 type sudfops_t struct {
 	// this lock protects open and bound; bud has its own lock
 	sync.Mutex
@@ -1906,7 +2266,8 @@ func (sf *sudfops_t) Close() defs.Err_t {
 }
 
 func (sf *sudfops_t) Fstat(s *stat.Stat_t) defs.Err_t {
-	panic("no imp")
+	s.Wmode(defs.Mkdev(dev.D_SUD, 0))
+	return 0
 }
 
 func (sf *sudfops_t) Mmapi(int, int, bool) ([]mem.Mmapinfo_t, defs.Err_t) {
@@ -1944,6 +2305,18 @@ func (sf *sudfops_t) Pwrite(src fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
 
+func (sf *sudfops_t) Getdents(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.ENOTDIR
+}
+
+func (sf *sudfops_t) Fsync(bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (sf *sudfops_t) Fallocate(int, int, int) defs.Err_t {
+	return -defs.ESPIPE
+}
+
 func (sf *sudfops_t) Lseek(int, int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
@@ -1976,15 +2349,11 @@ func (sf *sudfops_t) Bind(sa []uint8) defs.Err_t {
 	path := ustr.MkUstrSlice(sa[poff:])
 	// try to create the specified file as a special device
 	bid := allbuds.bud_id_new()
-	fsf, err := thefs.Fs_open_inner(path, defs.O_CREAT|defs.O_EXCL, 0, proc.CurrentProc().Cwd, defs.D_SUD, int(bid))
+	inum, err := thevfs.Fs_mknod(path, defs.O_CREAT|defs.O_EXCL, proc.CurrentProc().Cwd, dev.D_SUD, int(bid))
 	if err != 0 {
 		return err
 	}
-	inum := fsf.Inum
 	bud := allbuds.bud_new(bid, path, inum)
-	if thefs.Fs_close(fsf.Inum) != 0 {
-		panic("must succeed")
-	}
 	sf.bud = bud
 	sf.bound = true
 	return 0
@@ -2010,12 +2379,12 @@ func (sf *sudfops_t) Sendmsg(src fdops.Userio_i, sa []uint8,
 	st := &stat.Stat_t{}
 	path := ustr.MkUstrSlice(sa[poff:])
 
-	err := thefs.Fs_stat(path, st, proc.CurrentProc().Cwd)
+	err := thevfs.Fs_stat(path, st, proc.CurrentProc().Cwd)
 	if err != 0 {
 		return 0, err
 	}
 	maj, min := defs.Unmkdev(st.Rdev())
-	if maj != defs.D_SUD {
+	if maj != dev.D_SUD {
 		return 0, -defs.ECONNREFUSED
 	}
 	ino := st.Rino()
@@ -2397,8 +2766,9 @@ func (sus *susfops_t) Close() defs.Err_t {
 	return err2
 }
 
-func (sus *susfops_t) Fstat(*stat.Stat_t) defs.Err_t {
-	panic("no imp")
+func (sus *susfops_t) Fstat(st *stat.Stat_t) defs.Err_t {
+	st.Wmode(defs.Mkdev(dev.D_SUS, 0))
+	return 0
 }
 
 func (sus *susfops_t) Lseek(int, int) (int, defs.Err_t) {
@@ -2450,6 +2820,18 @@ func (sus *susfops_t) Pwrite(src fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
 
+func (sus *susfops_t) Getdents(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.ENOTDIR
+}
+
+func (sus *susfops_t) Fsync(bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (sus *susfops_t) Fallocate(int, int, int) defs.Err_t {
+	return -defs.ESPIPE
+}
+
 func (sus *susfops_t) Accept(fdops.Userio_i) (fdops.Fdops_i, int, defs.Err_t) {
 	return nil, 0, -defs.EINVAL
 }
@@ -2466,13 +2848,10 @@ func (sus *susfops_t) Bind(saddr []uint8) defs.Err_t {
 	sid := susid_new()
 
 	// create special file
-	fsf, err := thefs.Fs_open_inner(path, defs.O_CREAT|defs.O_EXCL, 0, proc.CurrentProc().Cwd, defs.D_SUS, sid)
+	_, err := thevfs.Fs_mknod(path, defs.O_CREAT|defs.O_EXCL, proc.CurrentProc().Cwd, dev.D_SUS, sid)
 	if err != 0 {
 		return err
 	}
-	if thefs.Fs_close(fsf.Inum) != 0 {
-		panic("must succeed")
-	}
 	sus.myaddr = path
 	sus.mysid = sid
 	sus.bound = true
@@ -2491,12 +2870,12 @@ func (sus *susfops_t) Connect(saddr []uint8) defs.Err_t {
 
 	// lookup sid
 	st := &stat.Stat_t{}
-	err := thefs.Fs_stat(path, st, proc.CurrentProc().Cwd)
+	err := thevfs.Fs_stat(path, st, proc.CurrentProc().Cwd)
 	if err != 0 {
 		return err
 	}
 	maj, min := defs.Unmkdev(st.Rdev())
-	if maj != defs.D_SUS {
+	if maj != dev.D_SUS {
 		return -defs.ECONNREFUSED
 	}
 	sid := min
@@ -2934,8 +3313,9 @@ func (sf *suslfops_t) Close() defs.Err_t {
 	return sf.susl.susl_reopen(-1)
 }
 
-func (sf *suslfops_t) Fstat(*stat.Stat_t) defs.Err_t {
-	panic("no imp")
+func (sf *suslfops_t) Fstat(st *stat.Stat_t) defs.Err_t {
+	st.Wmode(defs.Mkdev(dev.D_SUS, 0))
+	return 0
 }
 
 func (sf *suslfops_t) Lseek(int, int) (int, defs.Err_t) {
@@ -2974,6 +3354,18 @@ func (sf *suslfops_t) Pwrite(src fdops.Userio_i, offset int) (int, defs.Err_t) {
 	return 0, -defs.ESPIPE
 }
 
+func (sf *suslfops_t) Getdents(fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.ENOTDIR
+}
+
+func (sf *suslfops_t) Fsync(bool) defs.Err_t {
+	return -defs.EINVAL
+}
+
+func (sf *suslfops_t) Fallocate(int, int, int) defs.Err_t {
+	return -defs.ESPIPE
+}
+
 func (sf *suslfops_t) Accept(fromsa fdops.Userio_i) (fdops.Fdops_i, int, defs.Err_t) {
 	// the connector has already taken syslimit.Socks (1 sock reservation
 	// counts for a connected pair of UNIX stream sockets).
@@ -3156,6 +3548,7 @@ func sys_fork(parent *proc.Proc_t, ptf *[defs.TFSIZE]uintptr, tforkp int, flags
 			lhits++
 			return int(-defs.ENOMEM)
 		}
+		child.Args = parent.Args
 
 		child.Vm.Pmap, child.Vm.P_pmap, ok = physmem.Pmap_new()
 		if !ok {
@@ -3306,7 +3699,7 @@ func sys_execv1(p *proc.Proc_t, tf *[defs.TFSIZE]uintptr, paths ustr.Ustr,
 	}
 
 	// load binary image -- get first block of file
-	file, err := thefs.Fs_open(paths, defs.O_RDONLY, 0, p.Cwd, 0, 0)
+	file, err := thevfs.Fs_open(paths, defs.O_RDONLY, 0, p.Cwd, 0, 0)
 	if err != 0 {
 		restore()
 		return int(err)
@@ -3421,6 +3814,7 @@ func sys_execv1(p *proc.Proc_t, tf *[defs.TFSIZE]uintptr, paths ustr.Ustr,
 	tf[defs.TF_FSBASE] = uintptr(tls0addr)
 	p.Mmapi = mem.USERMIN
 	p.Name = paths
+	p.Args = args
 
 	return 0
 }
@@ -3961,7 +4355,7 @@ func sys_truncate(p *proc.Proc_t, pathn int, newlen uint) int {
 	if err := badpath(path); err != 0 {
 		return int(err)
 	}
-	f, err := thefs.Fs_open(path, defs.O_WRONLY, 0, p.Cwd, 0, 0)
+	f, err := thevfs.Fs_open(path, defs.O_WRONLY, 0, p.Cwd, 0, 0)
 	if err != 0 {
 		return int(err)
 	}
@@ -3978,6 +4372,23 @@ func sys_ftruncate(p *proc.Proc_t, fdn int, newlen uint) int {
 	return int(fd.Fops.Truncate(newlen))
 }
 
+// fsync(2) and, with datasync set, fdatasync(2)
+func sys_fsync(p *proc.Proc_t, fdn int, datasync bool) int {
+	fd, ok := p.Fd_get(fdn)
+	if !ok {
+		return int(-defs.EBADF)
+	}
+	return int(fd.Fops.Fsync(datasync))
+}
+
+func sys_fallocate(p *proc.Proc_t, fdn, mode, off, len int) int {
+	f, err := _fd_write(p, fdn)
+	if err != 0 {
+		return int(err)
+	}
+	return int(f.Fops.Fallocate(mode, off, len))
+}
+
 func sys_getcwd(p *proc.Proc_t, bufn, sz int) int {
 	dst := p.Vm.Mkuserbuf(bufn, sz)
 	_, err := dst.Uiowrite([]uint8(p.Cwd.Path))
@@ -4003,17 +4414,15 @@ func sys_chdir(p *proc.Proc_t, dirn int) int {
 	p.Cwd.Lock()
 	defer p.Cwd.Unlock()
 
-	newfd, err := thefs.Fs_open(path, defs.O_RDONLY|defs.O_DIRECTORY, 0, p.Cwd, 0, 0)
+	// the cwd's path holds no symbolic links, so that ".." in a relative
+	// path names the parent of the cwd
+	newfd, full, err := thevfs.Fs_opendir(path, p.Cwd)
 	if err != 0 {
 		return int(err)
 	}
 	fd.Close_panic(p.Cwd.Fd)
 	p.Cwd.Fd = newfd
-	if path.IsAbsolute() {
-		p.Cwd.Path = bpath.Canonicalize(path)
-	} else {
-		p.Cwd.Path = p.Cwd.Canonicalpath(path)
-	}
+	p.Cwd.Path = full
 	return 0
 }
 
@@ -0,0 +1,3 @@
+module logtool
+
+go 1.24.0
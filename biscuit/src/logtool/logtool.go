@@ -0,0 +1,149 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"syscall"
+
+	"biscuit/biscuit/src/defs"
+	"biscuit/biscuit/src/fs"
+	"biscuit/biscuit/src/ufs"
+)
+
+// out is where the log is printed. The file system reports on replaying on
+// standard output, so main points os.Stdout at standard error to keep those
+// messages out of the listing.
+var out = os.Stdout
+
+// usage prints the command line syntax and exits.
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: logtool [-k passfile] [-r n -o copy] <image>\n")
+	fmt.Fprintf(os.Stderr, "  -k  unlock an encrypted image with the passphrase in passfile\n")
+	fmt.Fprintf(os.Stderr, "  -r  install only the first n transactions of the log into copy\n")
+	fmt.Fprintf(os.Stderr, "  -o  the copy of the image to replay the log in\n")
+	os.Exit(2)
+}
+
+// errstr describes an error of the file system with the host's error strings,
+// since Biscuit's error numbers are Linux's.
+//
+// \param err  the negated error number
+// \return     the error string
+func errstr(err defs.Err_t) string {
+	return syscall.Errno(-err).Error()
+}
+
+// printlog prints the header of the log and each transaction in it with the
+// log blocks that it holds and the home blocks that recovery installs them
+// to. A block is marked revoked if a later transaction revokes it, so that
+// recovery skips it, and installed if its home holds its data already.
+//
+// \param ld  the decoded log
+func printlog(ld *fs.Logdump_t) {
+	fmt.Fprintf(out, "log: header at block %v, %v blocks, tail %v, head %v, %v transactions\n",
+		ld.Logstart, ld.Loglen, ld.Tail, ld.Head, len(ld.Trans))
+	for i, t := range ld.Trans {
+		fmt.Fprintf(out, "transaction %v: log [%v, %v), descriptor at block %v, %v blocks\n",
+			i+1, t.Start, t.End, t.Descriptor, len(t.Blks))
+		if len(t.Revokes) != 0 {
+			fmt.Fprintf(out, "\trevokes")
+			for _, r := range t.Revokes {
+				fmt.Fprintf(out, " %v", r)
+			}
+			fmt.Fprintf(out, "\n")
+		}
+		for _, b := range t.Blks {
+			s := ""
+			if b.Revoked {
+				s += " (revoked)"
+			}
+			if b.Installed {
+				s += " (installed)"
+			}
+			fmt.Fprintf(out, "\tblock %v -> %v%v\n", b.Blkno, b.Home, s)
+		}
+	}
+}
+
+// copyimage copies the image src to dst.
+//
+// \param src  the image
+// \param dst  the copy, which is created or truncated
+// \return     the host's error, if any
+func copyimage(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	o, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(o, in); err != nil {
+		o.Close()
+		return err
+	}
+	return o.Close()
+}
+
+// main is the entry point for the logtool utility. It decodes the on-disk log
+// of an image, which must not be booted, and prints the transactions that
+// recovery would install. With -r and -o it copies the image and installs
+// only the first n transactions in the copy, dropping the others, so that the
+// copy holds the file system as the commit of transaction n left it. It exits
+// with status 0 on success, 1 if the log is garbled or the replay failed and
+// 2 on usage errors.
+func main() {
+	passfile := flag.String("k", "", "file holding the passphrase of an encrypted image")
+	n := flag.Int("r", -1, "number of transactions to replay")
+	dst := flag.String("o", "", "copy of the image to replay in")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() != 1 || (*n >= 0) != (*dst != "") {
+		usage()
+	}
+	if *passfile != "" {
+		if err := ufs.ReadPassphrase(*passfile); err != nil {
+			fmt.Fprintf(os.Stderr, "logtool: %v\n", err)
+			os.Exit(2)
+		}
+	}
+	image := flag.Arg(0)
+	if _, err := os.Stat(image); err != nil {
+		fmt.Fprintf(os.Stderr, "logtool: %v\n", err)
+		os.Exit(2)
+	}
+
+	os.Stdout = os.Stderr
+	ld, err := ufs.Readlog(image)
+	if ld == nil {
+		fmt.Fprintf(os.Stderr, "logtool: %v: no log: %v\n", image, errstr(err))
+		os.Exit(1)
+	}
+	printlog(ld)
+	if err != 0 {
+		fmt.Fprintf(os.Stderr, "logtool: %v: cannot decode the log after %v transactions: %v\n",
+			image, len(ld.Trans), errstr(err))
+		os.Exit(1)
+	}
+	if *dst == "" {
+		return
+	}
+	if *n > len(ld.Trans) {
+		fmt.Fprintf(os.Stderr, "logtool: %v: the log holds only %v transactions\n",
+			image, len(ld.Trans))
+		os.Exit(1)
+	}
+	if err := copyimage(image, *dst); err != nil {
+		fmt.Fprintf(os.Stderr, "logtool: %v\n", err)
+		os.Exit(1)
+	}
+	if err := ufs.Replaylog(*dst, *n); err != 0 {
+		fmt.Fprintf(os.Stderr, "logtool: %v: %v\n", *dst, errstr(err))
+		os.Exit(1)
+	}
+	fmt.Fprintf(out, "%v: installed %v of %v transactions\n", *dst, *n, len(ld.Trans))
+}
@@ -1,10 +1,12 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"biscuit/biscuit/src/fs"
@@ -12,13 +14,86 @@ import (
 	"biscuit/biscuit/src/ustr"
 )
 
-// Constants describing the layout of the created filesystem.
+// Constants describing the default layout of the created filesystem.
 const (
 	nlogblks   = 1024 // number of log blocks
 	ninodeblks = 100 * 50
 	ndatablks  = 40000
+	minlogblks = 32 // smallest log the tests run with
+	bpi        = 16384
+	ipb        = fs.BSIZE / fs.ISIZE // inodes per block
 )
 
+// parsesize parses a byte count with an optional K, M or G suffix.
+//
+// \param s  size as given on the command line
+// \return   the size in bytes, or -1 if s is malformed
+func parsesize(s string) int {
+	mult := 1
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return -1
+	}
+	return n * mult
+}
+
+// fitsize computes the number of inode and data blocks that fill an image
+// of `size` bytes, allocating one inode per `ratio` bytes of data.
+//
+// \param size   total image size in bytes
+// \param start  block number of the superblock
+// \param nlog   number of log blocks
+// \param ratio  bytes of data per inode
+// \return       the number of inode and data blocks, or zero if the image
+//                is too small
+func fitsize(size, start, nlog, ratio int) (int, int) {
+	avail := size/fs.BSIZE - start - 1 - nlog
+	for ninode := avail * fs.BSIZE / (ratio + fs.ISIZE); ninode > 0; ninode-- {
+		niblks := (ninode + ipb - 1) / ipb
+		nmap := niblks*ipb/(fs.BSIZE*8) + 1
+		// the block map needs one bit per data block
+		ndata := avail - niblks - 2*nmap
+		ndata -= ndata/(fs.BSIZE*8) + 1
+		if ndata > 0 {
+			return niblks, ndata
+		}
+	}
+	return 0, 0
+}
+
+// printlayout prints the regions of the image described by `sb`.
+//
+// \param sb     superblock of the image
+// \param start  block number of the superblock
+func printlayout(sb *fs.Superblock_t, start int) {
+	region := func(name string, first, n int) {
+		fmt.Printf("%-12s %10d %10d\n", name, first, n)
+	}
+	fmt.Printf("%-12s %10s %10s\n", "region", "start", "blocks")
+	region("boot", 0, start)
+	region("superblock", start, 1)
+	region("log", start+1, sb.Loglen())
+	region("orphan map", sb.Iorphanblock(), sb.Iorphanlen())
+	region("inode map", sb.Iorphanblock()+sb.Iorphanlen(), sb.Imaplen())
+	region("block map", sb.Freeblock(), sb.Freeblocklen())
+	region("inodes", sb.Freeblock()+sb.Freeblocklen(), sb.Inodelen())
+	first := sb.Freeblock() + sb.Freeblocklen() + sb.Inodelen()
+	region("data", first, sb.Lastblock()-first)
+	fmt.Printf("%d inodes, %d bytes\n", sb.Inodelen()*ipb,
+		sb.Lastblock()*fs.BSIZE)
+}
+
 // copydata reads the file at `src` and appends its contents to `dst` in the
 // provided filesystem.
 //
@@ -49,6 +124,21 @@ func copydata(src string, f *ufs.Ufs_t, dst string) {
 	}
 }
 
+// copymode sets the permission bits of `dst` to those of the host entry `d`.
+//
+// \param d   host directory entry
+// \param f   filesystem handle obtained from ufs.BootFS
+// \param dst destination path within the image
+func copymode(d os.DirEntry, f *ufs.Ufs_t, dst string) {
+	info, err := d.Info()
+	if err != nil {
+		panic(err)
+	}
+	if e := f.Chmod(ustr.Ustr(dst), int(info.Mode().Perm())); e != 0 {
+		fmt.Printf("failed to chmod %v\n", dst)
+	}
+}
+
 // addfiles walks `skeldir` on the host and replicates its contents into the
 // filesystem `fs`.
 //
@@ -70,6 +160,20 @@ func addfiles(fs *ufs.Ufs_t, skeldir string) {
 			if e := fs.MkDir(ustr.Ustr(rel)); e != 0 {
 				fmt.Printf("failed to create dir %v\n", rel)
 			}
+			copymode(d, fs, rel)
+			return nil
+		}
+
+		// copy the link itself; WalkDir does not follow it
+		if d.Type()&os.ModeSymlink != 0 {
+			target, err := os.Readlink(path)
+			if err != nil {
+				fmt.Printf("failed to read link %v\n", path)
+				return nil
+			}
+			if e := fs.Symlink(ustr.Ustr(target), ustr.Ustr(rel)); e != 0 {
+				fmt.Printf("failed to create link %v\n", rel)
+			}
 			return nil
 		}
 
@@ -77,6 +181,7 @@ func addfiles(fs *ufs.Ufs_t, skeldir string) {
 			fmt.Printf("failed to create file %v\n", rel)
 		}
 		copydata(path, fs, rel)
+		copymode(d, fs, rel)
 		return nil
 	})
 
@@ -86,17 +191,73 @@ func addfiles(fs *ufs.Ufs_t, skeldir string) {
 	}
 }
 
+// usage prints the command line syntax and exits.
+func usage() {
+	fmt.Printf("Usage: mkfs [options] <bootimage> <kernel image> <output image> <skel dir>\n")
+	flag.PrintDefaults()
+	os.Exit(1)
+}
+
 // main is the entry point for the mkfs utility. It creates a bootable disk
-// image composed of the bootloader, kernel, and a skeletal filesystem.
+// image composed of the bootloader, kernel, and a skeletal filesystem. The
+// geometry is given either block by block or as a total image size, which is
+// split between inodes and data according to -bpi. With -k, the file system
+// is encrypted with a key derived from the passphrase with -iters iterations;
+// the boot loader and kernel stay plain.
 func main() {
-	if len(os.Args) < 5 {
-		fmt.Printf("Usage: mkfs <bootimage> <kernel image> <output image> <skel dir>\n")
+	nlog := flag.Int("log", nlogblks, "number of log blocks")
+	ninodes := flag.Int("inodes", ninodeblks*ipb, "number of inodes")
+	ndata := flag.Int("data", ndatablks, "number of data blocks")
+	size := flag.String("size", "", "total image size in bytes (K, M or G suffix); overrides -inodes and -data")
+	ratio := flag.Int("bpi", bpi, "bytes of data per inode when -size is given")
+	dryrun := flag.Bool("n", false, "print the layout without writing the image")
+	passfile := flag.String("k", "", "encrypt the image with the passphrase in this file")
+	iters := flag.Int("iters", fs.CRYPT_ITERS, "iterations of the key derivation with -k")
+	flag.Usage = usage
+	flag.Parse()
+	if flag.NArg() < 4 && !(*dryrun && flag.NArg() >= 2) {
+		usage()
+	}
+	if *passfile != "" {
+		if err := ufs.ReadPassphrase(*passfile); err != nil {
+			fmt.Printf("mkfs: %v\n", err)
+			os.Exit(1)
+		}
+		if *iters <= 0 {
+			fmt.Printf("mkfs: bad number of iterations %v\n", *iters)
+			os.Exit(1)
+		}
+		ufs.Cryptiters = *iters
+	}
+
+	inputs := []string{flag.Arg(0), flag.Arg(1)}
+	start := ufs.SuperStart(inputs)
+	niblks := (*ninodes + ipb - 1) / ipb
+	ndblks := *ndata
+	if *nlog < minlogblks {
+		fmt.Printf("log must have at least %d blocks\n", minlogblks)
+		os.Exit(1)
+	}
+	if *size != "" {
+		sz := parsesize(*size)
+		if sz < 0 || *ratio <= 0 {
+			fmt.Printf("bad size %v or bytes per inode %v\n", *size, *ratio)
+			os.Exit(1)
+		}
+		niblks, ndblks = fitsize(sz, start, *nlog, *ratio)
+	}
+	if niblks <= 0 || ndblks <= 0 {
+		fmt.Printf("image needs at least one inode and one data block\n")
 		os.Exit(1)
 	}
 
-	image := os.Args[3]
-	inputs := []string{os.Args[1], os.Args[2]}
-	ufs.MkDisk(image, inputs, nlogblks, ninodeblks, ndatablks)
+	if *dryrun {
+		printlayout(ufs.MkSuperBlock(start, *nlog, niblks, ndblks), start)
+		return
+	}
+
+	image := flag.Arg(2)
+	ufs.MkDisk(image, inputs, *nlog, niblks, ndblks)
 
 	fs := ufs.BootFS(image)
 	if _, err := fs.Stat(ustr.MkUstrRoot()); err != 0 {
@@ -104,7 +265,7 @@ func main() {
 		os.Exit(1)
 	}
 
-	addfiles(fs, os.Args[4])
+	addfiles(fs, flag.Arg(3))
 
 	ufs.ShutdownFS(fs)
 }
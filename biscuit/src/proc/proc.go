@@ -32,6 +32,8 @@ type Proc_t struct {
 	// first thread id
 	tid0 defs.Tid_t
 	Name ustr.Ustr
+	// the arguments that the running program was executed with
+	Args []ustr.Ustr
 
 	// waitinfo for my child processes
 	Mywait Wait_t
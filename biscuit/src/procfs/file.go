@@ -0,0 +1,284 @@
+package procfs
+
+import "sort"
+import "strconv"
+import "sync"
+
+import "defs"
+import "fdops"
+import "fs"
+import "mem"
+import "proc"
+import "stat"
+import "ustr"
+
+// returns the entries of directory pn, including "." and "..", as getdents64
+// records whose offsets are the index of the next record.
+func (pfs *Procfs_t) dirents(pn pnode_t) []fs.Dirent64_t {
+	root := pnode_t{kind: kroot}
+	ret := []fs.Dirent64_t{
+		{Inum: pn.inum(), Type: defs.DT_DIR, Name: ustr.MkUstrDot()},
+		{Inum: root.inum(), Type: defs.DT_DIR, Name: ustr.DotDot},
+	}
+	add := func(e pnode_t, name string) {
+		dt := defs.DT_REG
+		if e.isdir() {
+			dt = defs.DT_DIR
+		}
+		ret = append(ret, fs.Dirent64_t{Inum: e.inum(), Type: dt,
+			Name: ustr.Ustr(name)})
+	}
+	if pn.kind == kpid {
+		for _, e := range pidents {
+			add(pnode_t{kind: e.kind, pid: pn.pid}, e.name)
+		}
+	} else {
+		for _, e := range rootents {
+			add(pnode_t{kind: e.kind}, e.name)
+		}
+		var pids []int
+		proc.Ptable.Iter(func(pid int32, _ *proc.Proc_t) bool {
+			pids = append(pids, int(pid))
+			return false
+		})
+		sort.Ints(pids)
+		for _, pid := range pids {
+			add(pnode_t{kind: kpid, pid: pid}, strconv.Itoa(pid))
+		}
+	}
+	for i := range ret {
+		ret[i].Off = i + 1
+	}
+	return ret
+}
+
+// an open procfs file
+type pfops_t struct {
+	pfs *Procfs_t
+	pn  pnode_t
+	// the contents of a file and the entries of a directory as of when
+	// they were opened
+	data []uint8
+	ents []fs.Dirent64_t
+	// protects offset and count
+	sync.Mutex
+	offset int
+	count  int
+}
+
+func (pf *pfops_t) _read(dst fdops.Userio_i, toff int) (int, defs.Err_t) {
+	pf.Lock()
+	defer pf.Unlock()
+	if pf.count <= 0 {
+		return 0, -defs.EBADF
+	}
+	if pf.pn.isdir() {
+		return 0, -defs.EISDIR
+	}
+	useoffset := toff != -1
+	offset := pf.offset
+	if useoffset {
+		// XXXPANIC
+		if toff < 0 {
+			panic("neg offset")
+		}
+		offset = toff
+	}
+	pf.pfs.stats.Nread.Inc()
+	if offset >= len(pf.data) {
+		return 0, 0
+	}
+	did, err := dst.Uiowrite(pf.data[offset:])
+	if !useoffset && err == 0 {
+		pf.offset += did
+	}
+	return did, err
+}
+
+func (pf *pfops_t) Read(dst fdops.Userio_i) (int, defs.Err_t) {
+	return pf._read(dst, -1)
+}
+
+func (pf *pfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
+	return pf._read(dst, offset)
+}
+
+func (pf *pfops_t) Write(src fdops.Userio_i) (int, defs.Err_t) {
+	return 0, -defs.EROFS
+}
+
+func (pf *pfops_t) Pwrite(src fdops.Userio_i, offset int) (int, defs.Err_t) {
+	return 0, -defs.EROFS
+}
+
+func (pf *pfops_t) Truncate(newlen uint) defs.Err_t {
+	return -defs.EROFS
+}
+
+func (pf *pfops_t) Fallocate(mode, off, len int) defs.Err_t {
+	return -defs.EROFS
+}
+
+func (pf *pfops_t) Getdents(dst fdops.Userio_i) (int, defs.Err_t) {
+	pf.Lock()
+	defer pf.Unlock()
+	if pf.count <= 0 {
+		return 0, -defs.EBADF
+	}
+	if !pf.pn.isdir() {
+		return 0, -defs.ENOTDIR
+	}
+	if pf.offset >= len(pf.ents) {
+		return 0, 0
+	}
+	des := pf.ents[pf.offset:]
+	space := dst.Remain()
+	used := 0
+	fit := 0
+	for ; fit < len(des); fit++ {
+		l := fs.Dirent64len(len(des[fit].Name))
+		if used+l > space {
+			break
+		}
+		used += l
+	}
+	if fit == 0 {
+		// the next entry does not fit
+		return 0, -defs.EINVAL
+	}
+	buf := make([]uint8, used)
+	p := 0
+	for _, d := range des[:fit] {
+		p += d.Put(buf[p:])
+	}
+	did, err := dst.Uiowrite(buf)
+	if err != 0 {
+		return 0, err
+	}
+	pf.offset = des[fit-1].Off
+	return did, 0
+}
+
+// there is nothing to write back
+func (pf *pfops_t) Fsync(datasync bool) defs.Err_t {
+	pf.Lock()
+	defer pf.Unlock()
+	if pf.count <= 0 {
+		return -defs.EBADF
+	}
+	return 0
+}
+
+func (pf *pfops_t) Fstat(st *stat.Stat_t) defs.Err_t {
+	pf.Lock()
+	defer pf.Unlock()
+	if pf.count <= 0 {
+		return -defs.EBADF
+	}
+	pf.pfs.stat(pf.pn, st)
+	return 0
+}
+
+func (pf *pfops_t) Close() defs.Err_t {
+	pf.Lock()
+	defer pf.Unlock()
+	if pf.count <= 0 {
+		return -defs.EBADF
+	}
+	pf.count--
+	return 0
+}
+
+func (pf *pfops_t) Pathi() defs.Inum_t {
+	return pf.pn.inum()
+}
+
+func (pf *pfops_t) Reopen() defs.Err_t {
+	pf.Lock()
+	defer pf.Unlock()
+	if pf.count <= 0 {
+		return -defs.EBADF
+	}
+	pf.count++
+	return 0
+}
+
+// the end of a file is the end of its contents, even though its size is zero.
+// the offset of a directory is the index of its next entry.
+func (pf *pfops_t) Lseek(off, whence int) (int, defs.Err_t) {
+	pf.Lock()
+	defer pf.Unlock()
+	if pf.count <= 0 {
+		return 0, -defs.EBADF
+	}
+
+	switch whence {
+	case defs.SEEK_SET:
+		pf.offset = off
+	case defs.SEEK_CUR:
+		pf.offset += off
+	case defs.SEEK_END:
+		end := len(pf.data)
+		if pf.pn.isdir() {
+			end = len(pf.ents)
+		}
+		pf.offset = end + off
+	default:
+		return 0, -defs.EINVAL
+	}
+	if pf.offset < 0 {
+		pf.offset = 0
+	}
+	return pf.offset, 0
+}
+
+func (pf *pfops_t) Mmapi(offset, len int, inc bool) ([]mem.Mmapinfo_t, defs.Err_t) {
+	return nil, -defs.ENODEV
+}
+
+func (pf *pfops_t) Accept(fdops.Userio_i) (fdops.Fdops_i, int, defs.Err_t) {
+	return nil, 0, -defs.ENOTSOCK
+}
+
+func (pf *pfops_t) Bind([]uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (pf *pfops_t) Connect(sabuf []uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (pf *pfops_t) Listen(int) (fdops.Fdops_i, defs.Err_t) {
+	return nil, -defs.ENOTSOCK
+}
+
+func (pf *pfops_t) Sendmsg(fdops.Userio_i, []uint8, []uint8,
+	int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (pf *pfops_t) Recvmsg(fdops.Userio_i,
+	fdops.Userio_i, fdops.Userio_i, int) (int, int, int, defs.Msgfl_t, defs.Err_t) {
+	return 0, 0, 0, 0, -defs.ENOTSOCK
+}
+
+func (pf *pfops_t) Pollone(pm fdops.Pollmsg_t) (fdops.Ready_t, defs.Err_t) {
+	return pm.Events & fdops.R_READ, 0
+}
+
+func (pf *pfops_t) Fcntl(cmd, opt int) int {
+	return int(-defs.ENOSYS)
+}
+
+func (pf *pfops_t) Getsockopt(opt int, bufarg fdops.Userio_i,
+	intarg int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (pf *pfops_t) Setsockopt(int, int, fdops.Userio_i, int) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (pf *pfops_t) Shutdown(read, write bool) defs.Err_t {
+	return -defs.ENOTSOCK
+}
@@ -0,0 +1,268 @@
+package procfs
+
+import "fmt"
+import "runtime"
+import "sync/atomic"
+import "time"
+
+import "bounds"
+import "defs"
+import "fd"
+import "mem"
+import "proc"
+import "res"
+import "stat"
+import "vm"
+
+// generates the contents of file pn. fails with ENOENT if pn's process has
+// exited.
+func (pfs *Procfs_t) gen(pn pnode_t) ([]uint8, defs.Err_t) {
+	pfs.stats.Ngen.Inc()
+	switch pn.kind {
+	case kcpuinfo:
+		return []uint8(pfs.cpuinfo()), 0
+	case kmeminfo:
+		return []uint8(pfs.meminfo()), 0
+	case kuptime:
+		return []uint8(pfs.uptime()), 0
+	case kfsstats:
+		return []uint8(pfs.fsstats()), 0
+	}
+	p, ok := proc.Proc_check(pn.pid)
+	if !ok {
+		return nil, -defs.ENOENT
+	}
+	var s string
+	var err defs.Err_t
+	switch pn.kind {
+	case kcmdline:
+		s = cmdline(p)
+	case kfd:
+		s, err = fds(p)
+	case klimits:
+		s = limits(p)
+	case kmaps:
+		s, err = maps(p)
+	case kstatus:
+		s = status(p)
+	default:
+		panic("bad procfs file")
+	}
+	if err != 0 {
+		return nil, err
+	}
+	return []uint8(s), 0
+}
+
+// one paragraph per CPU, like Linux's
+func (pfs *Procfs_t) cpuinfo() string {
+	si := pfs.si
+	s := ""
+	for i := 0; i < si.Ncpu; i++ {
+		if i != 0 {
+			s += "\n"
+		}
+		s += fmt.Sprintf("processor\t: %v\n", i)
+		s += fmt.Sprintf("vendor_id\t: %v\n", si.Vendor)
+		s += fmt.Sprintf("cpu family\t: %v\n", si.Family)
+		s += fmt.Sprintf("model\t\t: %v\n", si.Model)
+	}
+	return s
+}
+
+// physical memory and the kernel's heap in kB
+func (pfs *Procfs_t) meminfo() string {
+	total, free := pfs.si.Pages()
+	ms := &runtime.MemStats{}
+	runtime.ReadMemStats(ms)
+	pgkb := mem.PGSIZE >> 10
+	s := fmt.Sprintf("MemTotal:\t%v kB\n", total*pgkb)
+	s += fmt.Sprintf("MemFree:\t%v kB\n", free*pgkb)
+	s += fmt.Sprintf("KernelHeap:\t%v kB\n", ms.Alloc>>10)
+	return s
+}
+
+// seconds since boot
+func (pfs *Procfs_t) uptime() string {
+	up := time.Since(pfs.si.Boot)
+	return fmt.Sprintf("%d.%02d\n", up/time.Second,
+		(up%time.Second)/(10*time.Millisecond))
+}
+
+// the statistics of the root file system as "Group.Name:\tvalue" lines. the
+// counters count since they were last reset, so subtract two readings to see
+// what happened in between.
+func (pfs *Procfs_t) fsstats() string {
+	if pfs.si.Fsstats == nil {
+		return ""
+	}
+	return pfs.si.Fsstats().String()
+}
+
+// the arguments of the program, each terminated by a NUL as on Linux. a
+// process that has not executed a program reports its name.
+func cmdline(p *proc.Proc_t) string {
+	args := p.Args
+	if args == nil {
+		return p.Name.String() + "\x00"
+	}
+	s := ""
+	for _, a := range args {
+		s += a.String() + "\x00"
+	}
+	return s
+}
+
+// "Name:\tvalue" lines. times are in nanoseconds; the C times include all of
+// the process's reaped children.
+func status(p *proc.Proc_t) string {
+	ppid := 0
+	if pw := p.Pwait; pw != nil {
+		ppid = pw.Pid
+	}
+	state := "running"
+	if p.Doomed() {
+		state = "doomed"
+	}
+	p.Fdl.Lock()
+	nfds := 0
+	for _, f := range p.Fds {
+		if f != nil {
+			nfds++
+		}
+	}
+	p.Fdl.Unlock()
+	p.Vm.Lock_pmap()
+	pglen := p.Vm.Vmregion.Pglen()
+	novma := p.Vm.Vmregion.Novma
+	p.Vm.Unlock_pmap()
+
+	s := fmt.Sprintf("Name:\t%v\n", p.Name)
+	s += fmt.Sprintf("Pid:\t%v\n", p.Pid)
+	s += fmt.Sprintf("PPid:\t%v\n", ppid)
+	s += fmt.Sprintf("State:\t%v\n", state)
+	s += fmt.Sprintf("Threads:\t%v\n", p.Thread_count())
+	s += fmt.Sprintf("Fds:\t%v\n", nfds)
+	s += fmt.Sprintf("VmPages:\t%v\n", pglen)
+	s += fmt.Sprintf("VmAreas:\t%v\n", novma)
+	s += fmt.Sprintf("Utime:\t%v\n", atomic.LoadInt64(&p.Atime.Userns))
+	s += fmt.Sprintf("Stime:\t%v\n", atomic.LoadInt64(&p.Atime.Sysns))
+	s += fmt.Sprintf("CUtime:\t%v\n", atomic.LoadInt64(&p.Catime.Userns))
+	s += fmt.Sprintf("CStime:\t%v\n", atomic.LoadInt64(&p.Catime.Sysns))
+	return s
+}
+
+// "start-end perms offset type" for each mapping in ascending order. perms
+// are r, w and s for shared or p for private; type is anon, file or shanon
+// (shared anonymous).
+func maps(p *proc.Proc_t) (string, defs.Err_t) {
+	s := ""
+	ok := true
+	p.Vm.Lock_pmap()
+	p.Vm.Vmregion.Iter(func(vmi *vm.Vminfo_t) {
+		if !ok {
+			return
+		}
+		if !res.Resadd_noblock(bounds.Bounds(bounds.B_PROCFS_T_GEN)) {
+			ok = false
+			return
+		}
+		perms := []uint8("---p")
+		if vmi.Perms&uint(vm.PTE_U) != 0 {
+			perms[0] = 'r'
+		}
+		if vmi.Perms&uint(vm.PTE_W) != 0 {
+			perms[1] = 'w'
+		}
+		if vmi.Shared() {
+			perms[3] = 's'
+		}
+		var mt string
+		switch vmi.Mtype {
+		case vm.VANON:
+			mt = "anon"
+		case vm.VFILE:
+			mt = "file"
+		case vm.VSANON:
+			mt = "shanon"
+		}
+		start := vmi.Pgn << vm.PGSHIFT
+		end := start + uintptr(vmi.Pglen)<<vm.PGSHIFT
+		s += fmt.Sprintf("%012x-%012x %s %08x %s\n", start, end, perms,
+			vmi.Fileoff(), mt)
+	})
+	p.Vm.Unlock_pmap()
+	if !ok {
+		return "", -defs.ENOHEAP
+	}
+	return s, 0
+}
+
+// "fd perms mode inode size" for each open fd, with the mode as fstat(2)
+// reports it in hex. perms are r, w and c for close-on-exec.
+func fds(p *proc.Proc_t) (string, defs.Err_t) {
+	// take references so that the fds can be examined without the fd
+	// table lock while another thread closes them
+	var fdns []int
+	var files []*fd.Fd_t
+	p.Fdl.Lock()
+	for i, f := range p.Fds {
+		if f == nil {
+			continue
+		}
+		if nf, err := fd.Copyfd(f); err == 0 {
+			fdns = append(fdns, i)
+			files = append(files, nf)
+		}
+	}
+	p.Fdl.Unlock()
+	defer func() {
+		for _, f := range files {
+			fd.Close_panic(f)
+		}
+	}()
+
+	s := ""
+	st := &stat.Stat_t{}
+	for i, f := range files {
+		if !res.Resadd_noblock(bounds.Bounds(bounds.B_PROCFS_T_GEN)) {
+			return "", -defs.ENOHEAP
+		}
+		perms := []uint8("---")
+		if f.Perms&fd.FD_READ != 0 {
+			perms[0] = 'r'
+		}
+		if f.Perms&fd.FD_WRITE != 0 {
+			perms[1] = 'w'
+		}
+		if f.Perms&fd.FD_CLOEXEC != 0 {
+			perms[2] = 'c'
+		}
+		*st = stat.Stat_t{}
+		if f.Fops.Fstat(st) != 0 {
+			continue
+		}
+		s += fmt.Sprintf("%v %s %#x %v %v\n", fdns[i], perms, st.Mode(),
+			st.Rino(), st.Size())
+	}
+	return s, 0
+}
+
+// "name value" for each limit
+func limits(p *proc.Proc_t) string {
+	lim := func(v uint) string {
+		if v == defs.RLIM_INFINITY {
+			return "unlimited"
+		}
+		return fmt.Sprintf("%v", v)
+	}
+	pages := uint(p.Ulim.Pages)
+	if p.Ulim.Pages == int(^uint(0)>>1) {
+		pages = defs.RLIM_INFINITY
+	}
+	s := fmt.Sprintf("pages\t%v\n", lim(pages))
+	s += fmt.Sprintf("nofile\t%v\n", lim(p.Ulim.Nofile))
+	s += fmt.Sprintf("novma\t%v\n", lim(p.Ulim.Novma))
+	s += fmt.Sprintf("noproc\t%v\n", lim(p.Ulim.Noproc))
+	return s
+}
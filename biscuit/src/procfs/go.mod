@@ -0,0 +1,3 @@
+module procfs
+
+go 1.24.0
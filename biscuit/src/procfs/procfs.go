@@ -0,0 +1,401 @@
+package procfs
+
+import "strconv"
+import "time"
+
+import "bpath"
+import "defs"
+import "fd"
+import "fs"
+import "mem"
+import "proc"
+import "stat"
+import "stats"
+import "ustr"
+
+/// Procfs_t is a read-only file system that describes the running system.
+/// Its root holds the files cpuinfo, meminfo, uptime and fsstats and a
+/// directory for every process, named by pid, with the files cmdline, fd,
+/// limits, maps and status. The contents of a file are generated when it is
+/// opened, so an open file is a snapshot; reopen the file to see new values.
+/// Every file has a size of zero, as on Linux, so read until the end of the
+/// file.
+type Procfs_t struct {
+	si    *Sysinfo_t
+	stats procstats_t
+}
+
+type procstats_t struct {
+	Nopen  stats.Counter_t
+	Nnamei stats.Counter_t
+	Nread  stats.Counter_t
+	Ngen   stats.Counter_t
+}
+
+/// Sysinfo_t describes the machine to procfs.
+type Sysinfo_t struct {
+	// returns the number of physical pages and how many of them are free
+	Pages func() (int, int)
+	Ncpu  int
+	// the processor's vendor, family and model as reported by CPUID
+	Vendor string
+	Family uint
+	Model  uint
+	// when the kernel booted
+	Boot time.Time
+	// returns the statistics of the root file system, if there is one
+	Fsstats func() fs.Fsstats_t
+}
+
+/// MkProcfs returns a procfs that describes the machine with si.
+func MkProcfs(si *Sysinfo_t) *Procfs_t {
+	return &Procfs_t{si: si}
+}
+
+/// MkRootCwd returns a cwd for the root of the file system.
+func (pfs *Procfs_t) MkRootCwd() *fd.Cwd_t {
+	f := &fd.Fd_t{Fops: &pfops_t{pfs: pfs, pn: pnode_t{kind: kroot}}}
+	return fd.MkRootCwd(f)
+}
+
+// the kinds of procfs files
+const (
+	kroot = 1 + iota
+	kcpuinfo
+	kmeminfo
+	kuptime
+	kfsstats
+	// the directory of a process and the files in it
+	kpid
+	kcmdline
+	kfd
+	klimits
+	kmaps
+	kstatus
+)
+
+// a procfs file. the files of a process name it by pid; other files have pid
+// zero.
+type pnode_t struct {
+	kind int
+	pid  int
+}
+
+// a directory entry
+type pent_t struct {
+	name string
+	kind int
+}
+
+// the entries of the root, besides the process directories, and of a process
+// directory
+var rootents = []pent_t{{"cpuinfo", kcpuinfo}, {"meminfo", kmeminfo},
+	{"uptime", kuptime}, {"fsstats", kfsstats}}
+var pidents = []pent_t{{"cmdline", kcmdline}, {"fd", kfd},
+	{"limits", klimits}, {"maps", kmaps}, {"status", kstatus}}
+
+// the inode number of a file packs its pid and kind
+func (pn pnode_t) inum() defs.Inum_t {
+	return defs.Inum_t(pn.pid<<8 | pn.kind)
+}
+
+func inode(inum defs.Inum_t) pnode_t {
+	return pnode_t{kind: int(inum & 0xff), pid: int(inum >> 8)}
+}
+
+func (pn pnode_t) isdir() bool {
+	return pn.kind == kroot || pn.kind == kpid
+}
+
+// reports whether the process that pn belongs to, if any, still exists.
+func (pn pnode_t) exists() bool {
+	if pn.pid == 0 {
+		return true
+	}
+	_, ok := proc.Proc_check(pn.pid)
+	return ok
+}
+
+// returns the pid that name spells or false if it spells none.
+func parsepid(name ustr.Ustr) (int, bool) {
+	s := name.String()
+	pid, err := strconv.Atoi(s)
+	if err != nil || pid <= 0 || pid > 1<<31-1 || strconv.Itoa(pid) != s {
+		return 0, false
+	}
+	return pid, true
+}
+
+// returns the entry name of directory pn.
+func (pn pnode_t) lookup(name ustr.Ustr) (pnode_t, defs.Err_t) {
+	if !pn.isdir() {
+		return pnode_t{}, -defs.ENOTDIR
+	}
+	if name.Isdot() {
+		return pn, 0
+	} else if name.Isdotdot() {
+		return pnode_t{kind: kroot}, 0
+	}
+	ents := rootents
+	if pn.kind == kpid {
+		ents = pidents
+	}
+	for _, e := range ents {
+		if name.Eq(ustr.Ustr(e.name)) {
+			return pnode_t{kind: e.kind, pid: pn.pid}, 0
+		}
+	}
+	if pn.kind == kroot {
+		if pid, ok := parsepid(name); ok {
+			ret := pnode_t{kind: kpid, pid: pid}
+			if ret.exists() {
+				return ret, 0
+			}
+		}
+	}
+	return pnode_t{}, -defs.ENOENT
+}
+
+// returns the file at paths. there are no symbolic links and every directory
+// may be searched by anyone. if the path leaves the file system, fails with
+// ECROSS and cwd.Mnt records where the path continues.
+func (pfs *Procfs_t) namei(paths ustr.Ustr, cwd *fd.Cwd_t) (pnode_t, defs.Err_t) {
+	pfs.stats.Nnamei.Inc()
+	pn := pnode_t{kind: kroot}
+	if len(paths) == 0 || paths[0] != '/' {
+		pn = inode(cwd.Fd.Fops.Pathi())
+		if !pn.exists() {
+			return pnode_t{}, -defs.ENOENT
+		}
+	}
+	var pp bpath.Pathparts_t
+	pp.Pp_init(paths)
+	for cp, ok := pp.Next(); ok; cp, ok = pp.Next() {
+		if cp.Isdotdot() && pn.kind == kroot && cwd.Mnt.Up(paths, cp) {
+			return pnode_t{}, -defs.ECROSS
+		}
+		next, err := pn.lookup(cp)
+		if err != 0 {
+			return pnode_t{}, err
+		}
+		pn = next
+		if cwd.Mnt.Down(pn.inum(), paths, cp) {
+			return pnode_t{}, -defs.ECROSS
+		}
+	}
+	cwd.Mnt.Resolved(paths)
+	return pn, 0
+}
+
+// fills st with the attributes of pn. everything belongs to root and is
+// readable by anyone.
+func (pfs *Procfs_t) stat(pn pnode_t, st *stat.Stat_t) {
+	mode := uint(fs.I_FILE<<16 | 0444)
+	if pn.isdir() {
+		mode = uint(fs.I_DIR<<16 | 0555)
+	}
+	boot := uint(pfs.si.Boot.UnixNano())
+	st.Wdev(0)
+	st.Wino(uint(pn.inum()))
+	st.Wmode(mode)
+	st.Wsize(0)
+	st.Wrdev(0)
+	st.Wuid(0)
+	st.Wgid(0)
+	st.Watime(boot/1e9, boot%1e9)
+	st.Wmtime(boot/1e9, boot%1e9)
+	st.Wctime(boot/1e9, boot%1e9)
+}
+
+/// Fs_open opens a path for reading and returns a new file descriptor.
+func (pfs *Procfs_t) Fs_open(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, major, minor int) (*fd.Fd_t, defs.Err_t) {
+	pfs.stats.Nopen.Inc()
+	pn, err := pfs.namei(paths, cwd)
+	if err != 0 {
+		if err == -defs.ENOENT && flags&defs.O_CREAT != 0 {
+			return nil, -defs.EROFS
+		}
+		return nil, err
+	}
+	if flags&defs.O_CREAT != 0 && flags&defs.O_EXCL != 0 {
+		return nil, -defs.EEXIST
+	}
+	if flags&(defs.O_WRONLY|defs.O_RDWR|defs.O_TRUNC) != 0 {
+		if pn.isdir() {
+			return nil, -defs.EISDIR
+		}
+		return nil, -defs.EROFS
+	}
+	if flags&defs.O_DIRECTORY != 0 && !pn.isdir() {
+		return nil, -defs.ENOTDIR
+	}
+	pf := &pfops_t{pfs: pfs, pn: pn, count: 1}
+	if pn.isdir() {
+		pf.ents = pfs.dirents(pn)
+	} else {
+		pf.data, err = pfs.gen(pn)
+		if err != 0 {
+			return nil, err
+		}
+	}
+	return &fd.Fd_t{Fops: pf}, 0
+}
+
+// fails with the error of resolving paths or, if it exists, with EROFS.
+func (pfs *Procfs_t) readonly(paths ustr.Ustr, cwd *fd.Cwd_t) defs.Err_t {
+	if _, err := pfs.namei(paths, cwd); err != 0 {
+		return err
+	}
+	return -defs.EROFS
+}
+
+// fails with EROFS to create paths, unless paths leads out of the file system.
+func (pfs *Procfs_t) create(paths ustr.Ustr, cwd *fd.Cwd_t) defs.Err_t {
+	if _, err := pfs.namei(paths, cwd); err == -defs.ECROSS {
+		return err
+	}
+	return -defs.EROFS
+}
+
+/// Fs_mknod fails since nothing can be created in a procfs.
+func (pfs *Procfs_t) Fs_mknod(paths ustr.Ustr, flags defs.Fdopt_t, cwd *fd.Cwd_t, major, minor int) (defs.Inum_t, defs.Err_t) {
+	return 0, pfs.create(paths, cwd)
+}
+
+/// Fs_access checks whether the credentials of cwd grant the access want to
+/// the file at path. Only reading files and searching directories is
+/// allowed.
+func (pfs *Procfs_t) Fs_access(paths ustr.Ustr, cwd *fd.Cwd_t, want int) defs.Err_t {
+	pn, err := pfs.namei(paths, cwd)
+	if err != 0 {
+		return err
+	}
+	if want&fs.A_WRITE != 0 {
+		return -defs.EROFS
+	}
+	if want&fs.A_EXEC != 0 && !pn.isdir() {
+		return -defs.EACCES
+	}
+	return 0
+}
+
+/// Fs_stat retrieves file information for the provided path.
+func (pfs *Procfs_t) Fs_stat(paths ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t) defs.Err_t {
+	pn, err := pfs.namei(paths, cwd)
+	if err != 0 {
+		return err
+	}
+	pfs.stat(pn, st)
+	return 0
+}
+
+/// Fs_lstat is Fs_stat; a procfs has no symbolic links.
+func (pfs *Procfs_t) Fs_lstat(paths ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t) defs.Err_t {
+	return pfs.Fs_stat(paths, st, cwd)
+}
+
+/// Fs_statfs fills st with the statistics of the file system if path exists.
+func (pfs *Procfs_t) Fs_statfs(paths ustr.Ustr, st *stat.Statfs_t, cwd *fd.Cwd_t) defs.Err_t {
+	if _, err := pfs.namei(paths, cwd); err != 0 {
+		return err
+	}
+	pfs.Statfs(st)
+	return 0
+}
+
+/// Statfs fills st with the file system's statistics. A procfs has neither
+/// blocks nor a log.
+func (pfs *Procfs_t) Statfs(st *stat.Statfs_t) {
+	st.Wbsize(uint(mem.PGSIZE))
+	st.Wblocks(0)
+	st.Wbfree(0)
+	st.Wbavail(0)
+	st.Wfiles(0)
+	st.Wffree(0)
+	st.Wnamelen(uint(fs.NAME_MAX))
+	st.Wloglen(0)
+}
+
+/// Fs_utimens fails since a procfs is read-only.
+func (pfs *Procfs_t) Fs_utimens(paths ustr.Ustr, cwd *fd.Cwd_t, atime, mtime int) defs.Err_t {
+	return pfs.readonly(paths, cwd)
+}
+
+/// Fs_futimens fails since a procfs is read-only.
+func (pfs *Procfs_t) Fs_futimens(f *fd.Fd_t, atime, mtime int) defs.Err_t {
+	return -defs.EROFS
+}
+
+/// Fs_chmod fails since a procfs is read-only.
+func (pfs *Procfs_t) Fs_chmod(paths ustr.Ustr, cwd *fd.Cwd_t, mode int) defs.Err_t {
+	return pfs.readonly(paths, cwd)
+}
+
+/// Fs_fchmod fails since a procfs is read-only.
+func (pfs *Procfs_t) Fs_fchmod(f *fd.Fd_t, cred *fd.Cred_t, mode int) defs.Err_t {
+	return -defs.EROFS
+}
+
+/// Fs_chown fails since a procfs is read-only.
+func (pfs *Procfs_t) Fs_chown(paths ustr.Ustr, cwd *fd.Cwd_t, uid, gid int) defs.Err_t {
+	return pfs.readonly(paths, cwd)
+}
+
+/// Fs_fchown fails since a procfs is read-only.
+func (pfs *Procfs_t) Fs_fchown(f *fd.Fd_t, cred *fd.Cred_t, uid, gid int) defs.Err_t {
+	return -defs.EROFS
+}
+
+/// Fs_mkdir fails since a procfs is read-only.
+func (pfs *Procfs_t) Fs_mkdir(paths ustr.Ustr, mode int, cwd *fd.Cwd_t) defs.Err_t {
+	return pfs.create(paths, cwd)
+}
+
+/// Fs_unlink fails since a procfs is read-only.
+func (pfs *Procfs_t) Fs_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, wantdir bool) defs.Err_t {
+	return pfs.readonly(paths, cwd)
+}
+
+/// Fs_link fails since a procfs is read-only.
+func (pfs *Procfs_t) Fs_link(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) defs.Err_t {
+	return pfs.readonly(oldp, cwd)
+}
+
+/// Fs_rename fails since a procfs is read-only.
+func (pfs *Procfs_t) Fs_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) defs.Err_t {
+	return pfs.readonly(oldp, cwd)
+}
+
+/// Fs_symlink fails since a procfs is read-only.
+func (pfs *Procfs_t) Fs_symlink(target, linkp ustr.Ustr, cwd *fd.Cwd_t) defs.Err_t {
+	return pfs.create(linkp, cwd)
+}
+
+/// Fs_readlink fails with EINVAL for any existing path since a procfs has no
+/// symbolic links.
+func (pfs *Procfs_t) Fs_readlink(paths ustr.Ustr, cwd *fd.Cwd_t) (ustr.Ustr, defs.Err_t) {
+	if _, err := pfs.namei(paths, cwd); err != 0 {
+		return nil, err
+	}
+	return nil, -defs.EINVAL
+}
+
+/// Fs_sync does nothing since a procfs has no backing store.
+func (pfs *Procfs_t) Fs_sync() defs.Err_t {
+	return 0
+}
+
+/// Unpin does nothing; procfs files cannot be mapped.
+func (pfs *Procfs_t) Unpin(pa mem.Pa_t) {
+}
+
+/// Fs_statistics returns the file system's statistics and resets them.
+func (pfs *Procfs_t) Fs_statistics() string {
+	s := "procfs" + stats.Stats2String(pfs.stats)
+	pfs.stats = procstats_t{}
+	return s
+}
+
+/// StopFS does nothing; a procfs holds no resources.
+func (pfs *Procfs_t) StopFS() {
+}
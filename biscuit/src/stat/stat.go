@@ -13,6 +13,11 @@ type Stat_t struct {
 	_blocks uint
 	_m_sec  uint
 	_m_nsec uint
+	_a_sec  uint
+	_a_nsec uint
+	_c_sec  uint
+	_c_nsec uint
+	_gid    uint
 }
 
 /// Wdev stores the device ID.
@@ -40,6 +45,34 @@ func (st *Stat_t) Wrdev(v uint) {
 	st._rdev = v
 }
 
+/// Wuid stores the owner's user id.
+func (st *Stat_t) Wuid(v uint) {
+	st._uid = v
+}
+
+/// Wgid stores the owner's group id.
+func (st *Stat_t) Wgid(v uint) {
+	st._gid = v
+}
+
+/// Wmtime stores the modification time.
+func (st *Stat_t) Wmtime(sec, nsec uint) {
+	st._m_sec = sec
+	st._m_nsec = nsec
+}
+
+/// Watime stores the access time.
+func (st *Stat_t) Watime(sec, nsec uint) {
+	st._a_sec = sec
+	st._a_nsec = nsec
+}
+
+/// Wctime stores the status change time.
+func (st *Stat_t) Wctime(sec, nsec uint) {
+	st._c_sec = sec
+	st._c_nsec = nsec
+}
+
 /// Mode returns the stored mode value.
 func (st *Stat_t) Mode() uint {
 	return st._mode
@@ -60,9 +93,133 @@ func (st *Stat_t) Rino() uint {
 	return st._ino
 }
 
+/// Uid returns the stored user id.
+func (st *Stat_t) Uid() uint {
+	return st._uid
+}
+
+/// Gid returns the stored group id.
+func (st *Stat_t) Gid() uint {
+	return st._gid
+}
+
+/// Mtime returns the stored modification time in seconds and nanoseconds.
+func (st *Stat_t) Mtime() (uint, uint) {
+	return st._m_sec, st._m_nsec
+}
+
+/// Atime returns the stored access time in seconds and nanoseconds.
+func (st *Stat_t) Atime() (uint, uint) {
+	return st._a_sec, st._a_nsec
+}
+
+/// Ctime returns the stored status change time in seconds and nanoseconds.
+func (st *Stat_t) Ctime() (uint, uint) {
+	return st._c_sec, st._c_nsec
+}
+
 /// Bytes exposes the raw bytes of the structure.
 func (st *Stat_t) Bytes() []uint8 {
 	const sz = unsafe.Sizeof(*st)
 	sl := (*[sz]uint8)(unsafe.Pointer(&st._dev))
 	return sl[:]
 }
+
+/// Statfs_t mirrors a file system's statfs information.
+type Statfs_t struct {
+	_bsize   uint
+	_blocks  uint
+	_bfree   uint
+	_bavail  uint
+	_files   uint
+	_ffree   uint
+	_namelen uint
+	_loglen  uint
+}
+
+/// Wbsize stores the block size in bytes.
+func (st *Statfs_t) Wbsize(v uint) {
+	st._bsize = v
+}
+
+/// Wblocks stores the number of data blocks.
+func (st *Statfs_t) Wblocks(v uint) {
+	st._blocks = v
+}
+
+/// Wbfree stores the number of free data blocks.
+func (st *Statfs_t) Wbfree(v uint) {
+	st._bfree = v
+}
+
+/// Wbavail stores the number of data blocks available to users.
+func (st *Statfs_t) Wbavail(v uint) {
+	st._bavail = v
+}
+
+/// Wfiles stores the number of inodes.
+func (st *Statfs_t) Wfiles(v uint) {
+	st._files = v
+}
+
+/// Wffree stores the number of free inodes.
+func (st *Statfs_t) Wffree(v uint) {
+	st._ffree = v
+}
+
+/// Wnamelen stores the maximum file name length.
+func (st *Statfs_t) Wnamelen(v uint) {
+	st._namelen = v
+}
+
+/// Wloglen stores the number of log blocks.
+func (st *Statfs_t) Wloglen(v uint) {
+	st._loglen = v
+}
+
+/// Bsize returns the stored block size.
+func (st *Statfs_t) Bsize() uint {
+	return st._bsize
+}
+
+/// Blocks returns the stored number of data blocks.
+func (st *Statfs_t) Blocks() uint {
+	return st._blocks
+}
+
+/// Bfree returns the stored number of free data blocks.
+func (st *Statfs_t) Bfree() uint {
+	return st._bfree
+}
+
+/// Bavail returns the stored number of available data blocks.
+func (st *Statfs_t) Bavail() uint {
+	return st._bavail
+}
+
+/// Files returns the stored number of inodes.
+func (st *Statfs_t) Files() uint {
+	return st._files
+}
+
+/// Ffree returns the stored number of free inodes.
+func (st *Statfs_t) Ffree() uint {
+	return st._ffree
+}
+
+/// Namelen returns the stored maximum file name length.
+func (st *Statfs_t) Namelen() uint {
+	return st._namelen
+}
+
+/// Loglen returns the stored number of log blocks.
+func (st *Statfs_t) Loglen() uint {
+	return st._loglen
+}
+
+/// Bytes exposes the raw bytes of the structure.
+func (st *Statfs_t) Bytes() []uint8 {
+	const sz = unsafe.Sizeof(*st)
+	sl := (*[sz]uint8)(unsafe.Pointer(&st._bsize))
+	return sl[:]
+}
@@ -0,0 +1,894 @@
+package tmpfs
+
+import "sort"
+import "sync"
+
+import "bounds"
+import "defs"
+import "fd"
+import "fdops"
+import "fs"
+import "mem"
+import "res"
+import "stat"
+import "ustr"
+import "util"
+
+// a tmpfs inode
+type tnode_t struct {
+	tfs   *Tmpfs_t
+	inum  defs.Inum_t
+	itype int
+	major int
+	minor int
+	// the fields up to the lock are protected by the fs lock
+	nlink int
+	// the number of open files that refer to the inode
+	nopen int
+	// the entries of a directory by name and in cookie order
+	ents       map[string]*dent_t
+	order      []*dent_t
+	nextcookie int
+	// the directory that holds a directory; the root is its own parent
+	parent *tnode_t
+	// the target of a symbolic link, which never changes
+	target ustr.Ustr
+	// protects the remaining fields. mode, uid and gid are written with
+	// both the fs lock and this lock held, so either suffices to read them.
+	sync.Mutex
+	mode  int
+	uid   int
+	gid   int
+	size  int
+	atime int
+	mtime int
+	ctime int
+	// the physical pages of a file by page number; missing pages are holes
+	pages map[int]mem.Pa_t
+}
+
+// a directory entry. its cookie is the getdents offset of the entry, which
+// never changes, so that getdents returns the entries that exist for a whole
+// iteration exactly once.
+type dent_t struct {
+	name   ustr.Ustr
+	n      *tnode_t
+	cookie int
+}
+
+// the cookies of "." and "..", which every directory reports first
+const (
+	dotcookie    = 0
+	dotdotcookie = 1
+	firstcookie  = 2
+)
+
+// returns the entry name of directory n. caller holds the fs lock.
+func (n *tnode_t) lookup(name ustr.Ustr) (*tnode_t, defs.Err_t) {
+	if n.itype != fs.I_DIR {
+		return nil, -defs.ENOTDIR
+	}
+	if name.Isdot() {
+		return n, 0
+	} else if name.Isdotdot() {
+		return n.parent, 0
+	}
+	de, ok := n.ents[string(name)]
+	if !ok {
+		return nil, -defs.ENOENT
+	}
+	return de.n, 0
+}
+
+// adds the entry name for child to directory n. caller holds the fs lock.
+func (n *tnode_t) insert(name ustr.Ustr, child *tnode_t) defs.Err_t {
+	if n.itype != fs.I_DIR {
+		return -defs.ENOTDIR
+	}
+	if n.nlink == 0 {
+		return -defs.ENOENT
+	}
+	if _, ok := n.ents[string(name)]; ok {
+		return -defs.EEXIST
+	}
+	de := &dent_t{name: append(ustr.Ustr{}, name...), n: child,
+		cookie: n.nextcookie}
+	n.nextcookie++
+	n.ents[string(name)] = de
+	n.order = append(n.order, de)
+	n.touch()
+	return 0
+}
+
+// removes the existing entry name from directory n. caller holds the fs lock.
+func (n *tnode_t) remove(name ustr.Ustr) {
+	de := n.ents[string(name)]
+	delete(n.ents, string(name))
+	i := sort.Search(len(n.order), func(i int) bool {
+		return n.order[i].cookie >= de.cookie
+	})
+	copy(n.order[i:], n.order[i+1:])
+	n.order[len(n.order)-1] = nil
+	n.order = n.order[:len(n.order)-1]
+	n.touch()
+}
+
+// updates the modification and status change times.
+func (n *tnode_t) touch() {
+	n.Lock()
+	n.mtime = now()
+	n.ctime = n.mtime
+	n.Unlock()
+}
+
+// creates a new inode named name in directory n, which the credentials must
+// allow to modify. caller holds the fs lock.
+func (n *tnode_t) create(name ustr.Ustr, itype, major, minor, mode int, cred *fd.Cred_t) (*tnode_t, defs.Err_t) {
+	if n.itype != fs.I_DIR {
+		return nil, -defs.ENOTDIR
+	}
+	if n.nlink == 0 {
+		return nil, -defs.ENOENT
+	}
+	if err := n.access(cred, fs.A_WRITE|fs.A_EXEC); err != 0 {
+		return nil, err
+	}
+	tfs := n.tfs
+	if len(tfs.inodes) >= tfs.maxinodes {
+		tfs.stats.Nnospc.Inc()
+		return nil, -defs.ENOSPC
+	}
+	tfs.stats.Ncreate.Inc()
+	child := tfs.ialloc(itype, major, minor, mode, cred)
+	if itype == fs.I_DIR {
+		child.parent = n
+	}
+	if err := n.insert(name, child); err != 0 {
+		delete(tfs.inodes, child.inum)
+		return nil, err
+	}
+	return child, 0
+}
+
+// caller holds the fs lock
+func (n *tnode_t) linkup() {
+	n.nlink++
+	n.Lock()
+	n.ctime = now()
+	n.Unlock()
+}
+
+// drops a link to n, which is freed once it has neither links nor open files.
+// a directory has one link. caller holds the fs lock.
+func (n *tnode_t) linkdown() {
+	n.nlink--
+	n.Lock()
+	n.ctime = now()
+	n.Unlock()
+	n.tfs.iput(n)
+}
+
+// checks whether cred may access n as requested by want, a combination of
+// fs.A_READ, fs.A_WRITE and fs.A_EXEC. the superuser may do anything except
+// execute a file without any execute bit. caller holds the fs lock or n's.
+func (n *tnode_t) access(cred *fd.Cred_t, want int) defs.Err_t {
+	if cred.Root() {
+		if want&fs.A_EXEC != 0 && n.itype != fs.I_DIR && n.mode&0111 == 0 {
+			return -defs.EACCES
+		}
+		return 0
+	}
+	var have int
+	switch {
+	case cred.Uid == n.uid:
+		have = n.mode >> 6
+	case cred.Gid == n.gid:
+		have = n.mode >> 3
+	default:
+		have = n.mode
+	}
+	if have&want != want {
+		return -defs.EACCES
+	}
+	return 0
+}
+
+// in a sticky directory n, only the owner of child, the owner of n and the
+// superuser may remove or rename child. caller holds the fs lock.
+func (n *tnode_t) sticky(cred *fd.Cred_t, child *tnode_t) defs.Err_t {
+	if n.mode&fs.S_ISVTX == 0 || cred.Root() {
+		return 0
+	}
+	if cred.Uid == n.uid || cred.Uid == child.uid {
+		return 0
+	}
+	return -defs.EPERM
+}
+
+// checks that n is a directory exactly when wantdir is set and that a
+// directory is empty. caller holds the fs lock.
+func (n *tnode_t) dirchk(wantdir bool) defs.Err_t {
+	amdir := n.itype == fs.I_DIR
+	if wantdir && !amdir {
+		return -defs.ENOTDIR
+	} else if !wantdir && amdir {
+		return -defs.EISDIR
+	} else if amdir && len(n.ents) != 0 {
+		return -defs.ENOTEMPTY
+	}
+	return 0
+}
+
+// returns the getdents64 type of an inode type
+func dtype(itype int) int {
+	switch itype {
+	case fs.I_DIR:
+		return defs.DT_DIR
+	case fs.I_FILE:
+		return defs.DT_REG
+	case fs.I_SYMLINK:
+		return defs.DT_LNK
+	case fs.I_DEV:
+		return defs.DT_CHR
+	}
+	return defs.DT_UNKNOWN
+}
+
+// copies the entries of directory n, starting with the one at cookie off, to
+// dst as getdents64 records. returns the number of bytes copied and the cookie
+// of the next entry. caller holds the fs lock.
+func (n *tnode_t) getdents(dst fdops.Userio_i, off int) (int, int, defs.Err_t) {
+	if n.itype != fs.I_DIR {
+		return 0, off, -defs.ENOTDIR
+	}
+	var des []fs.Dirent64_t
+	if off <= dotcookie {
+		des = append(des, fs.Dirent64_t{Inum: n.inum, Off: dotdotcookie,
+			Type: defs.DT_DIR, Name: ustr.MkUstrDot()})
+	}
+	if off <= dotdotcookie {
+		des = append(des, fs.Dirent64_t{Inum: n.parent.inum,
+			Off: firstcookie, Type: defs.DT_DIR, Name: ustr.DotDot})
+	}
+	i := sort.Search(len(n.order), func(i int) bool {
+		return n.order[i].cookie >= off
+	})
+	for _, de := range n.order[i:] {
+		des = append(des, fs.Dirent64_t{Inum: de.n.inum, Off: de.cookie + 1,
+			Type: dtype(de.n.itype), Name: de.name})
+	}
+	space := dst.Remain()
+	used := 0
+	fit := 0
+	for ; fit < len(des); fit++ {
+		l := fs.Dirent64len(len(des[fit].Name))
+		if used+l > space {
+			break
+		}
+		used += l
+	}
+	if fit == 0 {
+		if len(des) != 0 {
+			// the next entry does not fit
+			return 0, off, -defs.EINVAL
+		}
+		return 0, off, 0
+	}
+	buf := make([]uint8, used)
+	p := 0
+	for _, d := range des[:fit] {
+		p += d.Put(buf[p:])
+	}
+	did, err := dst.Uiowrite(buf)
+	if err != 0 {
+		return 0, off, err
+	}
+	return did, des[fit-1].Off, 0
+}
+
+// used for {,f}stat
+func (n *tnode_t) mkmode() uint {
+	switch n.itype {
+	case fs.I_DEV:
+		return defs.Mkdev(n.major, n.minor) | uint(n.mode)
+	default:
+		return uint(n.itype<<16 | n.mode)
+	}
+}
+
+// caller holds n's lock
+func (n *tnode_t) stat(st *stat.Stat_t) {
+	st.Wdev(0)
+	st.Wino(uint(n.inum))
+	st.Wmode(n.mkmode())
+	st.Wsize(uint(n.size))
+	st.Wrdev(defs.Mkdev(n.major, n.minor))
+	st.Wuid(uint(n.uid))
+	st.Wgid(uint(n.gid))
+	st.Watime(uint(n.atime/1e9), uint(n.atime%1e9))
+	st.Wmtime(uint(n.mtime/1e9), uint(n.mtime%1e9))
+	st.Wctime(uint(n.ctime/1e9), uint(n.ctime%1e9))
+}
+
+// sets the access and modification times of n; a negative time leaves the
+// corresponding timestamp unchanged. caller holds n's lock.
+func (n *tnode_t) utimens(atime, mtime int) defs.Err_t {
+	if atime >= 0 {
+		n.atime = atime
+	}
+	if mtime >= 0 {
+		n.mtime = mtime
+	}
+	n.ctime = now()
+	return 0
+}
+
+// only the owner and the superuser may change the mode. a non-superuser
+// cannot set the set-group-id bit on a file of another group. caller holds
+// both locks.
+func (n *tnode_t) chmod(mode int, cred *fd.Cred_t) defs.Err_t {
+	if !cred.Root() && cred.Uid != n.uid {
+		return -defs.EPERM
+	}
+	if !cred.Root() && cred.Gid != n.gid {
+		mode &^= fs.S_ISGID
+	}
+	n.mode = mode & fs.S_IPERM
+	n.ctime = now()
+	return 0
+}
+
+// a negative uid or gid leaves it unchanged. only the superuser may change the
+// owner; the owner may change the group to its own group. a change clears the
+// set-user-id and set-group-id bits of non-directories. caller holds both
+// locks.
+func (n *tnode_t) chown(uid, gid int, cred *fd.Cred_t) defs.Err_t {
+	if uid < 0 {
+		uid = n.uid
+	}
+	if gid < 0 {
+		gid = n.gid
+	}
+	if !cred.Root() {
+		if cred.Uid != n.uid || uid != n.uid {
+			return -defs.EPERM
+		}
+		if gid != n.gid && gid != cred.Gid {
+			return -defs.EPERM
+		}
+	}
+	n.uid = uid
+	n.gid = gid
+	if n.itype != fs.I_DIR {
+		n.mode &^= fs.S_ISUID | fs.S_ISGID
+	}
+	n.ctime = now()
+	return 0
+}
+
+// returns the page that holds byte off of the file, allocating it if fill is
+// set. the page is zero if the offset is in a hole and fill is not set.
+// caller holds n's lock.
+func (n *tnode_t) page(off int, fill bool) (*mem.Bytepg_t, defs.Err_t) {
+	pgn := off / mem.PGSIZE
+	if pa, ok := n.pages[pgn]; ok {
+		return n.tfs.pgbytes(pa), 0
+	}
+	if !fill {
+		return zeropg, 0
+	}
+	pa, err := n.tfs.pgalloc()
+	if err != 0 {
+		return nil, err
+	}
+	if n.pages == nil {
+		n.pages = make(map[int]mem.Pa_t)
+	}
+	n.pages[pgn] = pa
+	return n.tfs.pgbytes(pa), 0
+}
+
+var zeropg = &mem.Bytepg_t{}
+
+// reads from offset into dst. caller holds n's lock.
+func (n *tnode_t) read(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
+	if n.itype == fs.I_DIR {
+		return 0, -defs.EISDIR
+	}
+	did := 0
+	for off := offset; off < n.size && dst.Remain() != 0; {
+		if !res.Resadd_noblock(bounds.Bounds(bounds.B_TNODE_T_TREAD)) {
+			return did, -defs.ENOHEAP
+		}
+		pg, _ := n.page(off, false)
+		pgoff := off % mem.PGSIZE
+		l := util.Min(mem.PGSIZE-pgoff, n.size-off)
+		c, err := dst.Uiowrite(pg[pgoff : pgoff+l])
+		did += c
+		off += c
+		if err != 0 {
+			return did, err
+		}
+	}
+	return did, 0
+}
+
+// zeroes the rest of the page that holds byte off, which a shared mapping
+// may have written beyond the end of the file. called before the file grows
+// from size off. caller holds n's lock.
+func (n *tnode_t) zerotail(off int) {
+	if off%mem.PGSIZE == 0 {
+		return
+	}
+	if pa, ok := n.pages[off/mem.PGSIZE]; ok {
+		pg := n.tfs.pgbytes(pa)
+		for i := off % mem.PGSIZE; i < mem.PGSIZE; i++ {
+			pg[i] = 0
+		}
+	}
+}
+
+// grows the file to newsz. caller holds n's lock.
+func (n *tnode_t) grow(newsz int) {
+	if newsz > n.size {
+		n.zerotail(n.size)
+		n.size = newsz
+	}
+}
+
+// writes src at offset, or at the end of the file if app is set, allocating
+// pages for holes. the write stops at the largest file size and fails with
+// EFBIG if it starts there. caller holds n's lock.
+func (n *tnode_t) write(src fdops.Userio_i, offset int, app bool) (int, defs.Err_t) {
+	if n.itype != fs.I_FILE {
+		panic("write to non-file")
+	}
+	if app {
+		offset = n.size
+	}
+	if offset >= maxsize && src.Remain() != 0 {
+		return 0, -defs.EFBIG
+	}
+	if offset > n.size {
+		n.zerotail(n.size)
+	}
+	did := 0
+	var err defs.Err_t
+	// maxsize is a multiple of the page size, so no page straddles it
+	for src.Remain() != 0 && offset+did < maxsize {
+		if !res.Resadd_noblock(bounds.Bounds(bounds.B_TNODE_T_TWRITE)) {
+			err = -defs.ENOHEAP
+			break
+		}
+		off := offset + did
+		var pg *mem.Bytepg_t
+		pg, err = n.page(off, true)
+		if err != 0 {
+			break
+		}
+		pgoff := off % mem.PGSIZE
+		l := util.Min(mem.PGSIZE-pgoff, src.Remain())
+		var c int
+		c, err = src.Uioread(pg[pgoff : pgoff+l])
+		did += c
+		if off+c > n.size {
+			n.size = off + c
+		}
+		if err != 0 {
+			break
+		}
+	}
+	if did != 0 {
+		n.mtime = now()
+		n.ctime = n.mtime
+	}
+	return did, err
+}
+
+// frees the pages that lie entirely at or beyond offset off. caller holds n's
+// lock.
+func (n *tnode_t) freepages(off int) {
+	first := util.Roundup(off, mem.PGSIZE) / mem.PGSIZE
+	for pgn, pa := range n.pages {
+		if pgn >= first {
+			n.tfs.pgfree(pa)
+			delete(n.pages, pgn)
+		}
+	}
+}
+
+// sets the file's size to newlen, freeing the pages beyond it. caller holds
+// n's lock.
+func (n *tnode_t) truncate(newlen int) {
+	if newlen < n.size {
+		n.freepages(newlen)
+		n.zerotail(newlen)
+		n.size = newlen
+	} else {
+		n.grow(newlen)
+	}
+	n.mtime = now()
+	n.ctime = n.mtime
+}
+
+// the largest file size
+const maxsize = 1 << 40
+
+// fallocate(2) on a regular file. without FALLOC_FL_PUNCH_HOLE, the pages of
+// [off, off+len) are allocated (zeroed) and, unless FALLOC_FL_KEEP_SIZE is
+// given, the file grows to cover them. with it, the range is zeroed and the
+// pages entirely inside it are freed, leaving a hole. caller holds n's lock.
+func (n *tnode_t) fallocate(mode, off, len int) defs.Err_t {
+	if mode&^(defs.FALLOC_FL_KEEP_SIZE|defs.FALLOC_FL_PUNCH_HOLE) != 0 {
+		return -defs.EOPNOTSUPP
+	}
+	punch := mode&defs.FALLOC_FL_PUNCH_HOLE != 0
+	if punch && mode&defs.FALLOC_FL_KEEP_SIZE == 0 {
+		return -defs.EOPNOTSUPP
+	}
+	if off < 0 || len <= 0 {
+		return -defs.EINVAL
+	}
+	end := off + len
+	if end < off || end > maxsize {
+		if !punch {
+			return -defs.EFBIG
+		}
+		end = maxsize
+	}
+	if n.itype == fs.I_DIR {
+		return -defs.EISDIR
+	} else if n.itype != fs.I_FILE {
+		return -defs.ENODEV
+	}
+
+	if punch {
+		n.punch(off, end)
+		return 0
+	}
+	for o := util.Rounddown(off, mem.PGSIZE); o < end; o += mem.PGSIZE {
+		if !res.Resadd_noblock(bounds.Bounds(bounds.B_TNODE_T_TWRITE)) {
+			return -defs.ENOHEAP
+		}
+		if _, err := n.page(o, true); err != 0 {
+			return err
+		}
+	}
+	if mode&defs.FALLOC_FL_KEEP_SIZE == 0 {
+		n.grow(end)
+	}
+	n.ctime = now()
+	return 0
+}
+
+// zeroes [off, end) and frees the pages entirely inside it. caller holds n's
+// lock.
+func (n *tnode_t) punch(off, end int) {
+	for pgn, pa := range n.pages {
+		pgoff := pgn * mem.PGSIZE
+		if pgoff+mem.PGSIZE <= off || pgoff >= end {
+			continue
+		}
+		if pgoff >= off && pgoff+mem.PGSIZE <= end {
+			n.tfs.pgfree(pa)
+			delete(n.pages, pgn)
+			continue
+		}
+		pg := n.tfs.pgbytes(pa)
+		s, e := 0, mem.PGSIZE
+		if off > pgoff {
+			s = off - pgoff
+		}
+		if end < pgoff+mem.PGSIZE {
+			e = end - pgoff
+		}
+		for i := s; i < e; i++ {
+			pg[i] = 0
+		}
+	}
+	n.mtime = now()
+	n.ctime = n.mtime
+}
+
+// returns the pages that back [offset, offset+len) of the file, or the rest
+// of the file if len is -1, for the VM system to map. holes are filled first.
+// caller holds n's lock.
+func (n *tnode_t) mmapi(offset, len int) ([]mem.Mmapinfo_t, defs.Err_t) {
+	if n.itype != fs.I_FILE {
+		return nil, -defs.ENODEV
+	}
+	if (len != -1 && len < 0) || offset < 0 {
+		panic("bad off/len")
+	}
+	if offset >= n.size {
+		return nil, -defs.EINVAL
+	}
+	if len == -1 || offset+len > n.size {
+		len = n.size - offset
+	}
+	o := util.Rounddown(offset, mem.PGSIZE)
+	len = util.Roundup(offset+len, mem.PGSIZE) - o
+	// back the holes before taking references on any of the pages
+	for i := 0; i < len; i += mem.PGSIZE {
+		if _, err := n.page(o+i, true); err != 0 {
+			return nil, err
+		}
+	}
+	pages := n.tfs.pages
+	ret := make([]mem.Mmapinfo_t, len/mem.PGSIZE)
+	for i := range ret {
+		pa := n.pages[o/mem.PGSIZE+i]
+		// the VM system is going to use the page
+		pages.Refup(pa)
+		ret[i].Pg = pages.Dmap(pa)
+		ret[i].Phys = pa
+	}
+	return ret, 0
+}
+
+// an open tmpfs file
+type tfops_t struct {
+	n   *tnode_t
+	tfs *Tmpfs_t
+	// protects offset
+	sync.Mutex
+	offset int
+	append bool
+	count  int
+}
+
+func (tf *tfops_t) _read(dst fdops.Userio_i, toff int) (int, defs.Err_t) {
+	tf.Lock()
+	defer tf.Unlock()
+	if tf.count <= 0 {
+		return 0, -defs.EBADF
+	}
+	useoffset := toff != -1
+	offset := tf.offset
+	if useoffset {
+		// XXXPANIC
+		if toff < 0 {
+			panic("neg offset")
+		}
+		offset = toff
+	}
+	tf.tfs.stats.Nread.Inc()
+	tf.n.Lock()
+	did, err := tf.n.read(dst, offset)
+	tf.n.Unlock()
+	if !useoffset && err == 0 {
+		tf.offset += did
+	}
+	return did, err
+}
+
+func (tf *tfops_t) Read(dst fdops.Userio_i) (int, defs.Err_t) {
+	return tf._read(dst, -1)
+}
+
+func (tf *tfops_t) Pread(dst fdops.Userio_i, offset int) (int, defs.Err_t) {
+	return tf._read(dst, offset)
+}
+
+func (tf *tfops_t) _write(src fdops.Userio_i, toff int) (int, defs.Err_t) {
+	tf.Lock()
+	defer tf.Unlock()
+	if tf.count <= 0 {
+		return 0, -defs.EBADF
+	}
+	useoffset := toff != -1
+	offset := tf.offset
+	append := tf.append
+	if useoffset {
+		// XXXPANIC
+		if toff < 0 {
+			panic("neg offset")
+		}
+		offset = toff
+		append = false
+	}
+	tf.tfs.stats.Nwrite.Inc()
+	tf.n.Lock()
+	did, err := tf.n.write(src, offset, append)
+	tf.n.Unlock()
+	if !useoffset && err == 0 {
+		tf.offset += did
+	}
+	return did, err
+}
+
+func (tf *tfops_t) Write(src fdops.Userio_i) (int, defs.Err_t) {
+	return tf._write(src, -1)
+}
+
+func (tf *tfops_t) Pwrite(src fdops.Userio_i, offset int) (int, defs.Err_t) {
+	return tf._write(src, offset)
+}
+
+func (tf *tfops_t) Truncate(newlen uint) defs.Err_t {
+	tf.Lock()
+	defer tf.Unlock()
+	if tf.count <= 0 {
+		return -defs.EBADF
+	}
+	if tf.n.itype != fs.I_FILE {
+		return -defs.EINVAL
+	}
+	if newlen > maxsize {
+		return -defs.EFBIG
+	}
+	tf.n.Lock()
+	tf.n.truncate(int(newlen))
+	tf.n.Unlock()
+	return 0
+}
+
+func (tf *tfops_t) Getdents(dst fdops.Userio_i) (int, defs.Err_t) {
+	tf.Lock()
+	defer tf.Unlock()
+	if tf.count <= 0 {
+		return 0, -defs.EBADF
+	}
+	tf.tfs.Lock()
+	did, off, err := tf.n.getdents(dst, tf.offset)
+	tf.tfs.Unlock()
+	if err == 0 {
+		tf.offset = off
+	}
+	return did, err
+}
+
+// there is nothing to write back
+func (tf *tfops_t) Fsync(datasync bool) defs.Err_t {
+	tf.Lock()
+	defer tf.Unlock()
+	if tf.count <= 0 {
+		return -defs.EBADF
+	}
+	return 0
+}
+
+func (tf *tfops_t) Fallocate(mode, off, len int) defs.Err_t {
+	tf.Lock()
+	defer tf.Unlock()
+	if tf.count <= 0 {
+		return -defs.EBADF
+	}
+	tf.n.Lock()
+	err := tf.n.fallocate(mode, off, len)
+	tf.n.Unlock()
+	return err
+}
+
+// caller holds tf's lock
+func (tf *tfops_t) fstat(st *stat.Stat_t) {
+	tf.n.Lock()
+	tf.n.stat(st)
+	tf.n.Unlock()
+}
+
+func (tf *tfops_t) Fstat(st *stat.Stat_t) defs.Err_t {
+	tf.Lock()
+	defer tf.Unlock()
+	if tf.count <= 0 {
+		return -defs.EBADF
+	}
+	tf.fstat(st)
+	return 0
+}
+
+func (tf *tfops_t) Close() defs.Err_t {
+	tf.Lock()
+	if tf.count <= 0 {
+		tf.Unlock()
+		return -defs.EBADF
+	}
+	tf.count--
+	tf.Unlock()
+	tf.tfs.close(tf.n)
+	return 0
+}
+
+func (tf *tfops_t) Pathi() defs.Inum_t {
+	return tf.n.inum
+}
+
+func (tf *tfops_t) Reopen() defs.Err_t {
+	tf.Lock()
+	defer tf.Unlock()
+	if tf.count <= 0 {
+		return -defs.EBADF
+	}
+	tf.tfs.Lock()
+	tf.n.nopen++
+	tf.tfs.Unlock()
+	tf.count++
+	return 0
+}
+
+func (tf *tfops_t) Lseek(off, whence int) (int, defs.Err_t) {
+	tf.Lock()
+	defer tf.Unlock()
+	if tf.count <= 0 {
+		return 0, -defs.EBADF
+	}
+
+	switch whence {
+	case defs.SEEK_SET:
+		tf.offset = off
+	case defs.SEEK_CUR:
+		tf.offset += off
+	case defs.SEEK_END:
+		st := &stat.Stat_t{}
+		tf.fstat(st)
+		tf.offset = int(st.Size()) + off
+	default:
+		return 0, -defs.EINVAL
+	}
+	if tf.offset < 0 {
+		tf.offset = 0
+	}
+	return tf.offset, 0
+}
+
+// returns the mmapinfo for the pages of the file. the pages stay the file's,
+// so shared mappings need no pinning.
+func (tf *tfops_t) Mmapi(offset, len int, inc bool) ([]mem.Mmapinfo_t, defs.Err_t) {
+	tf.Lock()
+	defer tf.Unlock()
+	if tf.count <= 0 {
+		return nil, -defs.EBADF
+	}
+	tf.tfs.stats.Nmmapi.Inc()
+	tf.n.Lock()
+	mmi, err := tf.n.mmapi(offset, len)
+	tf.n.Unlock()
+	return mmi, err
+}
+
+func (tf *tfops_t) Accept(fdops.Userio_i) (fdops.Fdops_i, int, defs.Err_t) {
+	return nil, 0, -defs.ENOTSOCK
+}
+
+func (tf *tfops_t) Bind([]uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (tf *tfops_t) Connect(sabuf []uint8) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (tf *tfops_t) Listen(int) (fdops.Fdops_i, defs.Err_t) {
+	return nil, -defs.ENOTSOCK
+}
+
+func (tf *tfops_t) Sendmsg(fdops.Userio_i, []uint8, []uint8,
+	int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (tf *tfops_t) Recvmsg(fdops.Userio_i,
+	fdops.Userio_i, fdops.Userio_i, int) (int, int, int, defs.Msgfl_t, defs.Err_t) {
+	return 0, 0, 0, 0, -defs.ENOTSOCK
+}
+
+func (tf *tfops_t) Pollone(pm fdops.Pollmsg_t) (fdops.Ready_t, defs.Err_t) {
+	return pm.Events & (fdops.R_READ | fdops.R_WRITE), 0
+}
+
+func (tf *tfops_t) Fcntl(cmd, opt int) int {
+	return int(-defs.ENOSYS)
+}
+
+func (tf *tfops_t) Getsockopt(opt int, bufarg fdops.Userio_i,
+	intarg int) (int, defs.Err_t) {
+	return 0, -defs.ENOTSOCK
+}
+
+func (tf *tfops_t) Setsockopt(int, int, fdops.Userio_i, int) defs.Err_t {
+	return -defs.ENOTSOCK
+}
+
+func (tf *tfops_t) Shutdown(read, write bool) defs.Err_t {
+	return -defs.ENOTSOCK
+}
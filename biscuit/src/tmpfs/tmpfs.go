@@ -0,0 +1,892 @@
+package tmpfs
+
+import "strconv"
+import "sync"
+import "sync/atomic"
+import "time"
+
+import "bounds"
+import "bpath"
+import "defs"
+import "dev"
+import "fd"
+import "fs"
+import "mem"
+import "res"
+import "stat"
+import "stats"
+import "ustr"
+
+/// Tmpfs_t is a file system that lives entirely in memory. Inodes and
+/// directories are ordinary kernel objects and the data of each file is a set
+/// of physical pages, so there is no buffer cache and no log; nothing
+/// survives an unmount. The pages of a file are handed to the VM system as
+/// they are, which makes shared mappings coherent with read(2) and write(2)
+/// without pinning anything.
+type Tmpfs_t struct {
+	// protects the name space: directory entries, link and open counts,
+	// the inode table, and the owner and mode of every inode
+	sync.Mutex
+	pages mem.Page_i
+	// the most file pages and inodes that the file system may hold
+	maxpgs    int64
+	maxinodes int
+	// number of file pages held; atomic
+	npgs     int64
+	inodes   map[defs.Inum_t]*tnode_t
+	nextinum defs.Inum_t
+	root     *tnode_t
+	stats    tmpstats_t
+}
+
+type tmpstats_t struct {
+	Nopen    stats.Counter_t
+	Nnamei   stats.Counter_t
+	Ncreate  stats.Counter_t
+	Nunlink  stats.Counter_t
+	Nrename  stats.Counter_t
+	Nread    stats.Counter_t
+	Nwrite   stats.Counter_t
+	Nmmapi   stats.Counter_t
+	Npgalloc stats.Counter_t
+	Nnospc   stats.Counter_t
+}
+
+// the inode number of the root
+const troot = defs.Inum_t(1)
+
+/// MkTmpfs creates an empty tmpfs whose file pages come from pages. opts is a
+/// comma-separated list of mount options:
+///
+///   size=N[k|m|g]  - the most bytes of file data, rounded up to pages;
+///                    defpgs pages by default.
+///   nr_inodes=N    - the most inodes; by default as many as pages.
+///   mode=OCTAL     - the permission bits of the root; 01777 by default.
+func MkTmpfs(pages mem.Page_i, opts ustr.Ustr, defpgs int) (*Tmpfs_t, defs.Err_t) {
+	tfs := &Tmpfs_t{pages: pages, maxpgs: int64(defpgs), maxinodes: -1}
+	mode := 01777
+	if err := tfs.parseopts(opts, &mode); err != 0 {
+		return nil, err
+	}
+	if tfs.maxinodes < 0 {
+		tfs.maxinodes = int(tfs.maxpgs)
+	}
+	tfs.inodes = make(map[defs.Inum_t]*tnode_t)
+	tfs.nextinum = troot
+	tfs.root = tfs.ialloc(fs.I_DIR, 0, 0, mode, &fd.Cred_t{})
+	tfs.root.parent = tfs.root
+	return tfs, 0
+}
+
+// parses the mount options in opts into tfs and mode.
+func (tfs *Tmpfs_t) parseopts(opts ustr.Ustr, mode *int) defs.Err_t {
+	var o ustr.Ustr
+	for rest := opts; len(rest) != 0; rest = rest[len(o):] {
+		if rest[0] == ',' {
+			rest = rest[1:]
+		}
+		o = rest
+		if i := rest.IndexByte(','); i != -1 {
+			o = rest[:i]
+		}
+		if len(o) == 0 {
+			continue
+		}
+		k, v := o, ustr.MkUstr()
+		if i := o.IndexByte('='); i != -1 {
+			k, v = o[:i], o[i+1:]
+		}
+		switch k.String() {
+		case "size":
+			sz, ok := parsesize(v.String())
+			if !ok {
+				return -defs.EINVAL
+			}
+			tfs.maxpgs = int64((sz + mem.PGSIZE - 1) / mem.PGSIZE)
+		case "nr_inodes":
+			n, err := strconv.Atoi(v.String())
+			if err != nil || n <= 0 {
+				return -defs.EINVAL
+			}
+			tfs.maxinodes = n
+		case "mode":
+			m, err := strconv.ParseInt(v.String(), 8, 32)
+			if err != nil || m&^fs.S_IPERM != 0 {
+				return -defs.EINVAL
+			}
+			*mode = int(m)
+		default:
+			return -defs.EINVAL
+		}
+	}
+	return 0
+}
+
+// parses a size in bytes with an optional k, m or g suffix.
+func parsesize(s string) (int, bool) {
+	mult := 1
+	if l := len(s); l > 0 {
+		switch s[l-1] {
+		case 'k', 'K':
+			mult = 1 << 10
+		case 'm', 'M':
+			mult = 1 << 20
+		case 'g', 'G':
+			mult = 1 << 30
+		}
+		if mult != 1 {
+			s = s[:l-1]
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 || n > (1<<50)/mult {
+		return 0, false
+	}
+	return n * mult, true
+}
+
+/// MkRootCwd returns a cwd for the root of the file system.
+func (tfs *Tmpfs_t) MkRootCwd() *fd.Cwd_t {
+	f := &fd.Fd_t{Fops: &tfops_t{n: tfs.root, tfs: tfs, count: 0}}
+	return fd.MkRootCwd(f)
+}
+
+func now() int {
+	return int(time.Now().UnixNano())
+}
+
+// allocates a zeroed page for file data. it fails with ENOSPC once the file
+// system holds as many pages as its size allows.
+func (tfs *Tmpfs_t) pgalloc() (mem.Pa_t, defs.Err_t) {
+	for {
+		n := atomic.LoadInt64(&tfs.npgs)
+		if n >= tfs.maxpgs {
+			tfs.stats.Nnospc.Inc()
+			return 0, -defs.ENOSPC
+		}
+		if atomic.CompareAndSwapInt64(&tfs.npgs, n, n+1) {
+			break
+		}
+	}
+	_, pa, ok := tfs.pages.Refpg_new()
+	if !ok {
+		atomic.AddInt64(&tfs.npgs, -1)
+		return 0, -defs.ENOMEM
+	}
+	tfs.pages.Refup(pa)
+	tfs.stats.Npgalloc.Inc()
+	return pa, 0
+}
+
+// drops the file system's reference to a file page; a page that the VM
+// system still maps is freed once it is unmapped.
+func (tfs *Tmpfs_t) pgfree(pa mem.Pa_t) {
+	tfs.pages.Refdown(pa)
+	atomic.AddInt64(&tfs.npgs, -1)
+}
+
+func (tfs *Tmpfs_t) pgbytes(pa mem.Pa_t) *mem.Bytepg_t {
+	return mem.Pg2bytes(tfs.pages.Dmap(pa))
+}
+
+// creates an unnamed inode with one link. caller holds the fs lock.
+func (tfs *Tmpfs_t) ialloc(itype, major, minor, mode int, cred *fd.Cred_t) *tnode_t {
+	t := now()
+	n := &tnode_t{tfs: tfs, inum: tfs.nextinum, itype: itype, major: major,
+		minor: minor, nlink: 1, mode: mode & fs.S_IPERM, uid: cred.Uid,
+		gid: cred.Gid, atime: t, mtime: t, ctime: t}
+	tfs.nextinum++
+	if itype == fs.I_DIR {
+		n.ents = make(map[string]*dent_t)
+		n.nextcookie = firstcookie
+	}
+	tfs.inodes[n.inum] = n
+	return n
+}
+
+// frees n once it has neither links nor open files. caller holds the fs lock.
+func (tfs *Tmpfs_t) iput(n *tnode_t) {
+	if n.nlink > 0 || n.nopen > 0 || n == tfs.root {
+		return
+	}
+	delete(tfs.inodes, n.inum)
+	n.Lock()
+	n.freepages(0)
+	n.Unlock()
+}
+
+// returns the inode at paths. every directory that is searched must grant
+// search permission to the credentials of cwd. symbolic links are followed,
+// except for the last component if follow is false. if the path leaves the
+// file system, fails with ECROSS and cwd.Mnt records where the path
+// continues. caller holds the fs lock.
+func (tfs *Tmpfs_t) namei(paths ustr.Ustr, cwd *fd.Cwd_t, follow bool) (*tnode_t, defs.Err_t) {
+	for nlinks := 0; ; nlinks++ {
+		n, npaths, err := tfs.nameiwalk(paths, cwd, follow)
+		if err != 0 || npaths == nil {
+			if err == 0 {
+				cwd.Mnt.Resolved(paths)
+			}
+			return n, err
+		}
+		if nlinks == fs.MAXSYMLINKS {
+			return nil, -defs.ELOOP
+		}
+		paths = npaths
+	}
+}
+
+// walks paths until it resolves or reaches a symbolic link that must be
+// followed, in which case the second return value is the path with the link
+// replaced by its target.
+func (tfs *Tmpfs_t) nameiwalk(paths ustr.Ustr, cwd *fd.Cwd_t, follow bool) (*tnode_t, ustr.Ustr, defs.Err_t) {
+	tfs.stats.Nnamei.Inc()
+	mw := cwd.Mnt
+	var n *tnode_t
+	if len(paths) == 0 || paths[0] != '/' {
+		var ok bool
+		n, ok = tfs.inodes[cwd.Fd.Fops.Pathi()]
+		if !ok {
+			return nil, nil, -defs.ENOENT
+		}
+	} else {
+		n = tfs.root
+	}
+	var pp bpath.Pathparts_t
+	pp.Pp_init(paths)
+	// the component through which n was reached
+	var prev ustr.Ustr
+	for cp, ok := pp.Next(); ok; cp, ok = pp.Next() {
+		if n.itype == fs.I_SYMLINK {
+			return tfs.follow(paths, prev, n, mw)
+		}
+		if n.nlink == 0 {
+			return nil, nil, -defs.ENOENT
+		}
+		if err := n.access(&cwd.Cred, fs.A_EXEC); err != 0 {
+			return nil, nil, err
+		}
+		if cp.Isdotdot() && n == tfs.root && mw.Up(paths, cp) {
+			return nil, nil, -defs.ECROSS
+		}
+		next, err := n.lookup(cp)
+		if err != 0 {
+			return nil, nil, err
+		}
+		n = next
+		prev = cp
+		if mw.Down(n.inum, paths, cp) {
+			return nil, nil, -defs.ECROSS
+		}
+		if !res.Resadd_noblock(bounds.Bounds(bounds.B_TMPFS_T_NAMEI)) {
+			return nil, nil, -defs.ENOHEAP
+		}
+	}
+	if follow && n.itype == fs.I_SYMLINK {
+		return tfs.follow(paths, prev, n, mw)
+	}
+	return n, nil, 0
+}
+
+// returns the path that continues a lookup of paths through the symbolic link
+// n, which was reached via component comp, or ECROSS if the link leads out of
+// the file system.
+func (tfs *Tmpfs_t) follow(paths, comp ustr.Ustr, n *tnode_t, mw *fd.Mntwalk_t) (*tnode_t, ustr.Ustr, defs.Err_t) {
+	if mw.Follow(paths, comp, n.target) {
+		return nil, nil, -defs.ECROSS
+	}
+	return nil, bpath.Splice(paths, comp, n.target), 0
+}
+
+// the parent directory of the new name paths and the name's last component,
+// which must be a valid name.
+func (tfs *Tmpfs_t) namepar(paths ustr.Ustr, cwd *fd.Cwd_t, nilpatherr defs.Err_t) (*tnode_t, ustr.Ustr, defs.Err_t) {
+	dirs, fn := bpath.Sdirname(paths)
+	if len(fn) == 0 {
+		return nil, nil, nilpatherr
+	} else if fn.Isdot() || fn.Isdotdot() {
+		return nil, nil, -defs.EINVAL
+	}
+	if len(fn) > fs.NAME_MAX {
+		return nil, nil, -defs.ENAMETOOLONG
+	}
+	par, err := tfs.namei(dirs, cwd, true)
+	if err != 0 {
+		return nil, nil, cwd.Mnt.Dirs(err, fn)
+	}
+	return par, fn, 0
+}
+
+/// Fs_open opens a path and returns a new file descriptor. Device files are
+/// opened by their drivers.
+func (tfs *Tmpfs_t) Fs_open(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, major, minor int) (*fd.Fd_t, defs.Err_t) {
+	tfs.stats.Nopen.Inc()
+	n, err := tfs.open(paths, flags, mode, cwd, major, minor)
+	if err != 0 {
+		return nil, err
+	}
+	if n.itype != fs.I_DEV {
+		apnd := flags&defs.O_APPEND != 0
+		tf := &tfops_t{n: n, tfs: tfs, append: apnd, count: 1}
+		return &fd.Fd_t{Fops: tf}, 0
+	}
+	// don't need underlying file open
+	tfs.close(n)
+	// socket files cannot be open(2)'ed (must use connect(2)/sendto(2) etc.)
+	fops, err := dev.Open(n.major, n.minor)
+	if err != 0 {
+		return nil, err
+	}
+	return &fd.Fd_t{Fops: fops}, 0
+}
+
+/// Fs_mknod creates the special file paths for the device major and minor and
+/// returns its inode number.
+func (tfs *Tmpfs_t) Fs_mknod(paths ustr.Ustr, flags defs.Fdopt_t, cwd *fd.Cwd_t, major, minor int) (defs.Inum_t, defs.Err_t) {
+	n, err := tfs.open(paths, flags|defs.O_CREAT, 0, cwd, major, minor)
+	if err != 0 {
+		return 0, err
+	}
+	tfs.close(n)
+	return n.inum, 0
+}
+
+// returns the access to a file that open flags require
+func openaccess(flags defs.Fdopt_t) int {
+	var want int
+	switch flags & (defs.O_WRONLY | defs.O_RDWR) {
+	case defs.O_WRONLY:
+		want = fs.A_WRITE
+	case defs.O_RDWR:
+		want = fs.A_READ | fs.A_WRITE
+	default:
+		want = fs.A_READ
+	}
+	if flags&defs.O_TRUNC != 0 {
+		want |= fs.A_WRITE
+	}
+	return want
+}
+
+// looks up or creates the file at paths and counts it as open.
+func (tfs *Tmpfs_t) open(paths ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, major, minor int) (*tnode_t, defs.Err_t) {
+	tfs.Lock()
+	defer tfs.Unlock()
+
+	trunc := flags&defs.O_TRUNC != 0
+	nodir := false
+	created := false
+	var n *tnode_t
+	if flags&defs.O_CREAT != 0 {
+		nodir = true
+		isdev := major != 0 || minor != 0
+		par, fn, err := tfs.namepar(paths, cwd, -defs.EEXIST)
+		if err != 0 {
+			return nil, err
+		}
+		n, err = par.lookup(fn)
+		if err == 0 {
+			if flags&defs.O_EXCL != 0 || isdev {
+				return nil, -defs.EEXIST
+			}
+			// open the link's target below, which must exist
+			if n.itype == fs.I_SYMLINK {
+				n = nil
+			}
+		} else if err == -defs.ENOENT {
+			itype := fs.I_FILE
+			if isdev {
+				itype = fs.I_DEV
+			}
+			n, err = par.create(fn, itype, major, minor, mode, &cwd.Cred)
+			if err != 0 {
+				return nil, err
+			}
+			created = true
+		} else {
+			return nil, err
+		}
+	}
+	if n == nil {
+		var err defs.Err_t
+		n, err = tfs.namei(paths, cwd, true)
+		if err != 0 {
+			return nil, err
+		}
+	}
+
+	o_dir := flags&defs.O_DIRECTORY != 0
+	if flags&(defs.O_WRONLY|defs.O_RDWR) != 0 {
+		nodir = true
+	}
+	if o_dir && n.itype != fs.I_DIR {
+		return nil, -defs.ENOTDIR
+	}
+	if nodir && n.itype == fs.I_DIR {
+		return nil, -defs.EISDIR
+	}
+	// a newly created file is opened regardless of its mode
+	if !created {
+		if err := n.access(&cwd.Cred, openaccess(flags)); err != 0 {
+			return nil, err
+		}
+	}
+	if nodir && trunc && n.itype == fs.I_FILE {
+		n.Lock()
+		n.truncate(0)
+		n.Unlock()
+	}
+	n.nopen++
+	return n, 0
+}
+
+// drops an open reference to n.
+func (tfs *Tmpfs_t) close(n *tnode_t) {
+	tfs.Lock()
+	n.nopen--
+	if n.nopen < 0 {
+		panic("bad nopen")
+	}
+	tfs.iput(n)
+	tfs.Unlock()
+}
+
+// returns the locked inode at paths.
+func (tfs *Tmpfs_t) nameilock(paths ustr.Ustr, cwd *fd.Cwd_t, follow bool) (*tnode_t, defs.Err_t) {
+	tfs.Lock()
+	defer tfs.Unlock()
+	n, err := tfs.namei(paths, cwd, follow)
+	if err != 0 {
+		return nil, err
+	}
+	n.Lock()
+	return n, 0
+}
+
+/// Fs_stat retrieves file information for the provided path.
+func (tfs *Tmpfs_t) Fs_stat(paths ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t) defs.Err_t {
+	n, err := tfs.nameilock(paths, cwd, true)
+	if err != 0 {
+		return err
+	}
+	n.stat(st)
+	n.Unlock()
+	return 0
+}
+
+/// Fs_lstat is Fs_stat, but a symbolic link in the last component is not
+/// followed.
+func (tfs *Tmpfs_t) Fs_lstat(paths ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t) defs.Err_t {
+	n, err := tfs.nameilock(paths, cwd, false)
+	if err != 0 {
+		return err
+	}
+	n.stat(st)
+	n.Unlock()
+	return 0
+}
+
+/// Fs_statfs fills st with the statistics of the file system if path exists.
+func (tfs *Tmpfs_t) Fs_statfs(paths ustr.Ustr, st *stat.Statfs_t, cwd *fd.Cwd_t) defs.Err_t {
+	tfs.Lock()
+	_, err := tfs.namei(paths, cwd, true)
+	tfs.Unlock()
+	if err != 0 {
+		return err
+	}
+	tfs.Statfs(st)
+	return 0
+}
+
+/// Statfs fills st with the file system's size in pages and inodes and how
+/// many of them are free. A tmpfs has no log.
+func (tfs *Tmpfs_t) Statfs(st *stat.Statfs_t) {
+	tfs.Lock()
+	ninodes := len(tfs.inodes)
+	tfs.Unlock()
+	bfree := tfs.maxpgs - atomic.LoadInt64(&tfs.npgs)
+	if bfree < 0 {
+		bfree = 0
+	}
+	ifree := tfs.maxinodes - ninodes
+	if ifree < 0 {
+		ifree = 0
+	}
+	st.Wbsize(uint(mem.PGSIZE))
+	st.Wblocks(uint(tfs.maxpgs))
+	st.Wbfree(uint(bfree))
+	st.Wbavail(uint(bfree))
+	st.Wfiles(uint(tfs.maxinodes))
+	st.Wffree(uint(ifree))
+	st.Wnamelen(uint(fs.NAME_MAX))
+	st.Wloglen(0)
+}
+
+/// Fs_access checks whether the credentials of cwd grant the access want, a
+/// combination of fs.A_READ, fs.A_WRITE and fs.A_EXEC, to the file at path.
+func (tfs *Tmpfs_t) Fs_access(paths ustr.Ustr, cwd *fd.Cwd_t, want int) defs.Err_t {
+	tfs.Lock()
+	defer tfs.Unlock()
+	n, err := tfs.namei(paths, cwd, true)
+	if err != 0 {
+		return err
+	}
+	return n.access(&cwd.Cred, want)
+}
+
+// applies set to the locked inode at path.
+func (tfs *Tmpfs_t) setattr(paths ustr.Ustr, cwd *fd.Cwd_t, set func(*tnode_t) defs.Err_t) defs.Err_t {
+	tfs.Lock()
+	defer tfs.Unlock()
+	n, err := tfs.namei(paths, cwd, true)
+	if err != 0 {
+		return err
+	}
+	n.Lock()
+	err = set(n)
+	n.Unlock()
+	return err
+}
+
+// applies set to the locked inode of the open file f.
+func (tfs *Tmpfs_t) fsetattr(f *fd.Fd_t, set func(*tnode_t) defs.Err_t) defs.Err_t {
+	tf, ok := f.Fops.(*tfops_t)
+	if !ok || tf.tfs != tfs {
+		return -defs.EINVAL
+	}
+	tf.Lock()
+	defer tf.Unlock()
+	if tf.count <= 0 {
+		return -defs.EBADF
+	}
+	tfs.Lock()
+	defer tfs.Unlock()
+	tf.n.Lock()
+	err := set(tf.n)
+	tf.n.Unlock()
+	return err
+}
+
+/// Fs_utimens sets the access and modification times, in nanoseconds since
+/// the epoch, of the file at path. A negative time leaves that timestamp
+/// unchanged.
+func (tfs *Tmpfs_t) Fs_utimens(paths ustr.Ustr, cwd *fd.Cwd_t, atime, mtime int) defs.Err_t {
+	return tfs.setattr(paths, cwd, func(n *tnode_t) defs.Err_t {
+		return n.utimens(atime, mtime)
+	})
+}
+
+/// Fs_futimens is Fs_utimens for an open file descriptor.
+func (tfs *Tmpfs_t) Fs_futimens(f *fd.Fd_t, atime, mtime int) defs.Err_t {
+	return tfs.fsetattr(f, func(n *tnode_t) defs.Err_t {
+		return n.utimens(atime, mtime)
+	})
+}
+
+/// Fs_chmod sets the permission bits of the file at path.
+func (tfs *Tmpfs_t) Fs_chmod(paths ustr.Ustr, cwd *fd.Cwd_t, mode int) defs.Err_t {
+	return tfs.setattr(paths, cwd, func(n *tnode_t) defs.Err_t {
+		return n.chmod(mode, &cwd.Cred)
+	})
+}
+
+/// Fs_fchmod is Fs_chmod for an open file descriptor.
+func (tfs *Tmpfs_t) Fs_fchmod(f *fd.Fd_t, cred *fd.Cred_t, mode int) defs.Err_t {
+	return tfs.fsetattr(f, func(n *tnode_t) defs.Err_t {
+		return n.chmod(mode, cred)
+	})
+}
+
+/// Fs_chown sets the owner and group of the file at path. A negative id
+/// leaves it unchanged.
+func (tfs *Tmpfs_t) Fs_chown(paths ustr.Ustr, cwd *fd.Cwd_t, uid, gid int) defs.Err_t {
+	return tfs.setattr(paths, cwd, func(n *tnode_t) defs.Err_t {
+		return n.chown(uid, gid, &cwd.Cred)
+	})
+}
+
+/// Fs_fchown is Fs_chown for an open file descriptor.
+func (tfs *Tmpfs_t) Fs_fchown(f *fd.Fd_t, cred *fd.Cred_t, uid, gid int) defs.Err_t {
+	return tfs.fsetattr(f, func(n *tnode_t) defs.Err_t {
+		return n.chown(uid, gid, cred)
+	})
+}
+
+/// Fs_mkdir creates the directory path.
+func (tfs *Tmpfs_t) Fs_mkdir(paths ustr.Ustr, mode int, cwd *fd.Cwd_t) defs.Err_t {
+	tfs.Lock()
+	defer tfs.Unlock()
+	par, fn, err := tfs.namepar(paths, cwd, -defs.EINVAL)
+	if err != 0 {
+		return err
+	}
+	if _, err := par.lookup(fn); err == 0 {
+		return -defs.EEXIST
+	} else if err != -defs.ENOENT {
+		return err
+	}
+	_, err = par.create(fn, fs.I_DIR, 0, 0, mode, &cwd.Cred)
+	return err
+}
+
+/// Fs_unlink removes path, which must be a directory if wantdir is set and
+/// must not be one otherwise.
+func (tfs *Tmpfs_t) Fs_unlink(paths ustr.Ustr, cwd *fd.Cwd_t, wantdir bool) defs.Err_t {
+	dirs, fn := bpath.Sdirname(paths)
+	if fn.Isdot() || fn.Isdotdot() {
+		return -defs.EPERM
+	}
+	tfs.Lock()
+	defer tfs.Unlock()
+	tfs.stats.Nunlink.Inc()
+	par, err := tfs.namei(dirs, cwd, true)
+	if err != 0 {
+		return cwd.Mnt.Dirs(err, fn)
+	}
+	child, err := par.lookup(fn)
+	if err != 0 {
+		return err
+	}
+	cred := &cwd.Cred
+	if err := par.access(cred, fs.A_WRITE|fs.A_EXEC); err != 0 {
+		return err
+	}
+	if err := par.sticky(cred, child); err != 0 {
+		return err
+	}
+	if cwd.Mnt.Mntpt(child.inum) {
+		return -defs.EBUSY
+	}
+	if err := child.dirchk(wantdir); err != 0 {
+		return err
+	}
+	par.remove(fn)
+	child.linkdown()
+	return 0
+}
+
+/// Fs_link creates the hard link newp to the regular file oldp.
+func (tfs *Tmpfs_t) Fs_link(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) defs.Err_t {
+	tfs.Lock()
+	defer tfs.Unlock()
+	orig, err := tfs.namei(oldp, cwd, true)
+	if err != 0 {
+		return err
+	}
+	if orig.itype != fs.I_FILE {
+		return -defs.EINVAL
+	}
+	npar, fn, err := tfs.namepar(newp, cwd, -defs.EEXIST)
+	if err != 0 {
+		return err
+	}
+	if err := npar.access(&cwd.Cred, fs.A_WRITE|fs.A_EXEC); err != 0 {
+		return err
+	}
+	if err := npar.insert(fn, orig); err != 0 {
+		return err
+	}
+	orig.linkup()
+	return 0
+}
+
+// returns an error if directory anc is start or one of its ancestors.
+func (tfs *Tmpfs_t) isancestor(anc, start *tnode_t) defs.Err_t {
+	for here := start; ; here = here.parent {
+		if here == anc {
+			return -defs.EINVAL
+		}
+		if here == tfs.root {
+			return 0
+		}
+	}
+}
+
+// returns EBUSY if ochild is a mount point or a directory that holds one,
+// since the mount table names mounts by the path of their mount point.
+func (tfs *Tmpfs_t) mntbusy(ochild *tnode_t, mw *fd.Mntwalk_t) defs.Err_t {
+	if mw.Mntpt(ochild.inum) {
+		return -defs.EBUSY
+	}
+	if mw == nil || ochild.itype != fs.I_DIR {
+		return 0
+	}
+	for inum := range mw.Mntpts {
+		if tfs.isancestor(ochild, tfs.inodes[inum]) != 0 {
+			return -defs.EBUSY
+		}
+	}
+	return 0
+}
+
+/// Fs_rename moves oldp to newp, replacing newp if it exists and is of the
+/// same kind as oldp.
+func (tfs *Tmpfs_t) Fs_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) defs.Err_t {
+	tfs.Lock()
+	defer tfs.Unlock()
+	tfs.stats.Nrename.Inc()
+	opar, ofn, err := tfs.namepar(oldp, cwd, -defs.EINVAL)
+	if err != 0 {
+		return err
+	}
+	ochild, err := opar.lookup(ofn)
+	if err != 0 {
+		return err
+	}
+	if err := tfs.mntbusy(ochild, cwd.Mnt); err != 0 {
+		return err
+	}
+	npar, nfn, err := tfs.namepar(newp, cwd, -defs.EINVAL)
+	if err != 0 {
+		return err
+	}
+	if npar.itype != fs.I_DIR {
+		return -defs.ENOTDIR
+	}
+	// moving a directory into its own subtree would disconnect it from the
+	// root
+	if ochild.itype == fs.I_DIR {
+		if err := tfs.isancestor(ochild, npar); err != 0 {
+			return err
+		}
+	}
+	nchild, err := npar.lookup(nfn)
+	if err != 0 && err != -defs.ENOENT {
+		return err
+	}
+	// a mount point cannot be replaced
+	if nchild != nil && cwd.Mnt.Mntpt(nchild.inum) {
+		return -defs.EBUSY
+	}
+
+	// both parents are modified. moving a directory to a new parent also
+	// modifies the directory's "..".
+	cred := &cwd.Cred
+	for _, par := range []*tnode_t{opar, npar} {
+		if err := par.access(cred, fs.A_WRITE|fs.A_EXEC); err != 0 {
+			return err
+		}
+	}
+	if err := opar.sticky(cred, ochild); err != 0 {
+		return err
+	}
+	if nchild != nil {
+		if err := npar.sticky(cred, nchild); err != 0 {
+			return err
+		}
+	}
+	odir := ochild.itype == fs.I_DIR
+	if odir && opar != npar {
+		if err := ochild.access(cred, fs.A_WRITE); err != 0 {
+			return err
+		}
+	}
+
+	// if src and dst are the same file, we are done
+	if nchild == ochild {
+		return 0
+	}
+	if npar.nlink == 0 {
+		return -defs.ENOENT
+	}
+	if nchild != nil {
+		// make sure old and new are either both files or both
+		// directories
+		if err := nchild.dirchk(odir); err != 0 {
+			return err
+		}
+		npar.remove(nfn)
+		nchild.linkdown()
+	}
+	opar.remove(ofn)
+	if err := npar.insert(nfn, ochild); err != 0 {
+		panic("must succeed")
+	}
+	if odir {
+		ochild.parent = npar
+	}
+	// the rename changes ochild's status, even if only its name moved
+	ochild.Lock()
+	ochild.ctime = now()
+	ochild.Unlock()
+	return 0
+}
+
+/// Fs_symlink creates a symbolic link at linkp that refers to target.
+func (tfs *Tmpfs_t) Fs_symlink(target, linkp ustr.Ustr, cwd *fd.Cwd_t) defs.Err_t {
+	if len(target) == 0 {
+		return -defs.ENOENT
+	}
+	if len(target) > fs.SYMLINK_MAX {
+		return -defs.ENAMETOOLONG
+	}
+	tfs.Lock()
+	defer tfs.Unlock()
+	par, fn, err := tfs.namepar(linkp, cwd, -defs.EEXIST)
+	if err != 0 {
+		return err
+	}
+	if _, err := par.lookup(fn); err == 0 {
+		return -defs.EEXIST
+	} else if err != -defs.ENOENT {
+		return err
+	}
+	n, err := par.create(fn, fs.I_SYMLINK, 0, 0, 0777, &cwd.Cred)
+	if err != 0 {
+		return err
+	}
+	n.target = append(ustr.Ustr{}, target...)
+	n.Lock()
+	n.size = len(target)
+	n.Unlock()
+	return 0
+}
+
+/// Fs_readlink returns the target of the symbolic link at path.
+func (tfs *Tmpfs_t) Fs_readlink(paths ustr.Ustr, cwd *fd.Cwd_t) (ustr.Ustr, defs.Err_t) {
+	tfs.Lock()
+	defer tfs.Unlock()
+	n, err := tfs.namei(paths, cwd, false)
+	if err != 0 {
+		return nil, err
+	}
+	if n.itype != fs.I_SYMLINK {
+		return nil, -defs.EINVAL
+	}
+	return append(ustr.Ustr{}, n.target...), 0
+}
+
+/// Fs_sync does nothing since a tmpfs has no backing store.
+func (tfs *Tmpfs_t) Fs_sync() defs.Err_t {
+	return 0
+}
+
+/// Unpin does nothing; the pages of a tmpfs are never evicted, so shared
+/// mappings pin nothing.
+func (tfs *Tmpfs_t) Unpin(pa mem.Pa_t) {
+}
+
+/// Fs_statistics returns the file system's statistics and resets them.
+func (tfs *Tmpfs_t) Fs_statistics() string {
+	s := "tmpfs" + stats.Stats2String(tfs.stats)
+	tfs.stats = tmpstats_t{}
+	return s
+}
+
+/// StopFS frees every page of the file system, which must not be used
+/// afterwards.
+func (tfs *Tmpfs_t) StopFS() {
+	tfs.Lock()
+	defer tfs.Unlock()
+	for _, n := range tfs.inodes {
+		n.Lock()
+		n.freepages(0)
+		n.Unlock()
+	}
+	tfs.inodes = make(map[defs.Inum_t]*tnode_t)
+}
+
+/// Pages returns the number of pages that hold file data.
+func (tfs *Tmpfs_t) Pages() int {
+	return int(atomic.LoadInt64(&tfs.npgs))
+}
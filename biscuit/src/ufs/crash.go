@@ -0,0 +1,694 @@
+package ufs
+
+import "bufio"
+import "fmt"
+import "io"
+import "math/rand"
+import "os"
+import "path/filepath"
+import "strconv"
+import "strings"
+
+import "biscuit/biscuit/src/defs"
+import "biscuit/biscuit/src/fs"
+import "biscuit/biscuit/src/mem"
+import "biscuit/biscuit/src/ustr"
+import "biscuit/biscuit/src/util"
+
+//
+// Crash-consistency explorer
+//
+// A crash script describes a workload and the invariants that must hold after
+// a crash at any point during it, one command per line. # starts a comment.
+//
+//   setup <op>                       run op before tracing starts
+//   <op>                             run op while tracing the disk writes
+//   check <clause> [| <clause>]...   at least one of the clauses must hold
+//                                    after a crash, once every flush issued
+//                                    before the check has completed
+//
+// ops:
+//   mkdir <path>                     rmdir <path>
+//   create <path> [<n> <byte>]       unlink <path>
+//   write <path> <off> <n> <byte>    rename <old> <new>
+//   append <path> <n> <byte>         link <old> <new>
+//   truncate <path> <n>              symlink <target> <path>
+//   fsync <path>                     fdatasync <path>
+//   sync
+//
+// clauses:
+//   exists <path>                    absent <path>
+//   dir <path>                       size <path> <n>
+//   data <path> <off> <n> <byte>     file <path> <byte>
+//   fsck
+//
+// The explorer splits the trace of the workload into epochs at the disk
+// flushes. A crash during an epoch leaves all earlier epochs on disk and,
+// since the disk may reorder the writes between two flushes, any subset of
+// the epoch's writes; a block written several times in the epoch may hold
+// any of its versions.
+//
+
+// argument kinds of the ops and clauses: p is a path, n a number and b a byte.
+// create takes one of two argument lists.
+var crashops = map[string][]string{
+	"mkdir":     {"p"},
+	"create":    {"p", "pnb"},
+	"write":     {"pnnb"},
+	"append":    {"pnb"},
+	"truncate":  {"pn"},
+	"rename":    {"pp"},
+	"link":      {"pp"},
+	"unlink":    {"p"},
+	"rmdir":     {"p"},
+	"symlink":   {"pp"},
+	"fsync":     {"p"},
+	"fdatasync": {"p"},
+	"sync":      {""},
+}
+
+var crashclauses = map[string][]string{
+	"exists": {"p"},
+	"absent": {"p"},
+	"dir":    {"p"},
+	"size":   {"pn"},
+	"data":   {"pnnb"},
+	"file":   {"pb"},
+	"fsck":   {""},
+}
+
+type crashop_t struct {
+	line int
+	args []string
+}
+
+type crashcheck_t struct {
+	line    int
+	text    string
+	clauses [][]string
+	// number of traced ops that precede the check
+	after int
+	fsck  bool
+}
+
+/// Crashscript_t is a parsed crash script.
+type Crashscript_t struct {
+	setup  []crashop_t
+	ops    []crashop_t
+	checks []*crashcheck_t
+}
+
+// checks that args match one of the argument lists in specs.
+func crashargs(args []string, specs []string) bool {
+	for _, spec := range specs {
+		if len(spec) != len(args)-1 {
+			continue
+		}
+		ok := true
+		for i, k := range spec {
+			a := args[i+1]
+			switch k {
+			case 'n':
+				n, err := strconv.Atoi(a)
+				ok = ok && err == nil && n >= 0
+			case 'b':
+				n, err := strconv.Atoi(a)
+				ok = ok && err == nil && n >= 0 && n < 256
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+// converts an argument that crashargs checked already.
+func crashnum(s string) int {
+	n, _ := strconv.Atoi(s)
+	return n
+}
+
+/// ParseCrashScript reads a crash script from r.
+func ParseCrashScript(r io.Reader) (*Crashscript_t, error) {
+	cs := &Crashscript_t{}
+	sc := bufio.NewScanner(r)
+	for line := 1; sc.Scan(); line++ {
+		l := sc.Text()
+		if i := strings.IndexByte(l, '#'); i >= 0 {
+			l = l[:i]
+		}
+		args := strings.Fields(l)
+		if len(args) == 0 {
+			continue
+		}
+		switch args[0] {
+		case "check":
+			c := &crashcheck_t{line: line, after: len(cs.ops)}
+			c.text = strings.Join(args[1:], " ")
+			for _, s := range strings.Split(c.text, "|") {
+				cl := strings.Fields(s)
+				if len(cl) == 0 || !crashargs(cl, crashclauses[cl[0]]) {
+					return nil, fmt.Errorf("line %d: bad clause %q", line, s)
+				}
+				c.fsck = c.fsck || cl[0] == "fsck"
+				c.clauses = append(c.clauses, cl)
+			}
+			cs.checks = append(cs.checks, c)
+		case "setup":
+			op := crashop_t{line, args[1:]}
+			if len(op.args) == 0 || !crashargs(op.args, crashops[op.args[0]]) {
+				return nil, fmt.Errorf("line %d: bad op %q", line, l)
+			}
+			if len(cs.ops) != 0 {
+				return nil, fmt.Errorf("line %d: setup after traced ops", line)
+			}
+			cs.setup = append(cs.setup, op)
+		default:
+			if !crashargs(args, crashops[args[0]]) {
+				return nil, fmt.Errorf("line %d: bad op %q", line, l)
+			}
+			cs.ops = append(cs.ops, crashop_t{line, args})
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return cs, nil
+}
+
+func (ufs *Ufs_t) crashop(op crashop_t) defs.Err_t {
+	a := op.args
+	var p ustr.Ustr
+	if len(a) > 1 {
+		p = ustr.Ustr(a[1])
+	}
+	switch a[0] {
+	case "mkdir":
+		return ufs.MkDir(p)
+	case "create":
+		if len(a) == 2 {
+			return ufs.MkFile(p, nil)
+		}
+		return ufs.MkFile(p, mkData(uint8(crashnum(a[3])), crashnum(a[2])))
+	case "write", "truncate":
+		fd, err := ufs.fs.Fs_open(p, defs.O_RDWR, 0, ufs.cwd, 0, 0)
+		if err != 0 {
+			return err
+		}
+		if a[0] == "write" {
+			ub := mkData(uint8(crashnum(a[4])), crashnum(a[3]))
+			_, err = fd.Fops.Pwrite(ub, crashnum(a[2]))
+		} else {
+			err = fd.Fops.Truncate(uint(crashnum(a[2])))
+		}
+		fd.Fops.Close()
+		return err
+	case "append":
+		return ufs.Append(p, mkData(uint8(crashnum(a[3])), crashnum(a[2])))
+	case "rename":
+		return ufs.Rename(p, ustr.Ustr(a[2]))
+	case "link":
+		return ufs.fs.Fs_link(p, ustr.Ustr(a[2]), ufs.cwd)
+	case "unlink":
+		return ufs.Unlink(p)
+	case "rmdir":
+		return ufs.UnlinkDir(p)
+	case "symlink":
+		return ufs.Symlink(p, ustr.Ustr(a[2]))
+	case "fsync":
+		return ufs.Fsync(p, false)
+	case "fdatasync":
+		return ufs.Fsync(p, true)
+	case "sync":
+		return ufs.Sync()
+	}
+	panic("bad op")
+}
+
+// evaluates a clause other than fsck, returning why it does not hold.
+func (ufs *Ufs_t) crashclause(cl []string) (bool, string) {
+	p := ustr.Ustr(cl[1])
+	switch cl[0] {
+	case "exists":
+		if _, err := ufs.Lstat(p); err != 0 {
+			return false, fmt.Sprintf("%v does not exist (%v)", p, err)
+		}
+	case "absent":
+		if _, err := ufs.Lstat(p); err == 0 {
+			return false, fmt.Sprintf("%v exists", p)
+		}
+	case "dir", "size":
+		st, err := ufs.Stat(p)
+		if err != 0 {
+			return false, fmt.Sprintf("%v does not exist (%v)", p, err)
+		}
+		if cl[0] == "dir" && st.Mode()>>16 != fs.I_DIR {
+			return false, fmt.Sprintf("%v is not a directory", p)
+		}
+		if cl[0] == "size" && st.Size() != uint(crashnum(cl[2])) {
+			return false, fmt.Sprintf("%v has size %v", p, st.Size())
+		}
+	case "data", "file":
+		d, err := ufs.Read(p)
+		if err != 0 {
+			return false, fmt.Sprintf("%v cannot be read (%v)", p, err)
+		}
+		off, n, v := 0, len(d), crashnum(cl[2])
+		if cl[0] == "data" {
+			off, n, v = crashnum(cl[2]), crashnum(cl[3]), crashnum(cl[4])
+			if off+n > len(d) {
+				return false, fmt.Sprintf("%v has only %v bytes", p, len(d))
+			}
+		}
+		for i := off; i < off+n; i++ {
+			if int(d[i]) != v {
+				return false, fmt.Sprintf("%v has %v at offset %v", p, d[i], i)
+			}
+		}
+	}
+	return true, ""
+}
+
+/// Crashopts_t configures ExploreCrashes.
+type Crashopts_t struct {
+	// scratch directory for the disk images and the trace
+	Dir string
+	// geometry of the image that the script runs on
+	Nlog   int
+	Ninode int
+	Ndata  int
+	// most crash states booted per epoch; epochs with more are sampled
+	Max  int
+	Seed int64
+	// if not empty, the image of the minimized counterexample is written here
+	Out string
+	// if not nil, progress is reported here
+	Log io.Writer
+}
+
+/// Crashwrite_t is a block write in the trace of a crash script.
+type Crashwrite_t struct {
+	Rec    int
+	Blkno  int
+	Region string
+}
+
+/// Crashfail_t describes a crash state in which a check does not hold.
+type Crashfail_t struct {
+	Epoch   int
+	Start   int
+	End     int
+	Nwrites int
+	// the writes of the epoch that reached the disk
+	Landed []Crashwrite_t
+	// line and text of the check; line 0 means that booting failed
+	Line  int
+	Check string
+	Why   string
+}
+
+/// String formats the counterexample for printing.
+func (f *Crashfail_t) String() string {
+	s := fmt.Sprintf("crash in epoch %d (trace records %d-%d): %d of %d "+
+		"block writes reached the disk\n", f.Epoch, f.Start, f.End-1,
+		len(f.Landed), f.Nwrites)
+	for _, w := range f.Landed {
+		s += fmt.Sprintf("  record %d: block %d (%s)\n", w.Rec, w.Blkno,
+			w.Region)
+	}
+	if f.Line == 0 {
+		return s + fmt.Sprintf("boot failed: %s\n", f.Why)
+	}
+	return s + fmt.Sprintf("line %d: check %s\n  %s\n", f.Line, f.Check, f.Why)
+}
+
+/// Crashreport_t summarizes the crash states that ExploreCrashes booted.
+type Crashreport_t struct {
+	Nrecords int
+	Nepochs  int
+	Nstates  int
+	// epochs with more than Max crash states
+	Nsampled int
+	Fail     *Crashfail_t
+}
+
+// an epoch of the trace and its writes grouped by block
+type crashepoch_t struct {
+	n     int
+	start int
+	end   int
+	nw    int
+	blks  []int
+	// versions of each block as trace records, with duplicates removed
+	vers [][]int
+}
+
+type crashx_t struct {
+	cs    *Crashscript_t
+	opts  *Crashopts_t
+	trace trace_t
+	// trace length after each traced op
+	marks []int
+	img   string
+	super *fs.Superblock_t
+	sbs   int
+}
+
+func (ahci *ahci_disk_t) tracelen() int {
+	ahci.Lock()
+	defer ahci.Unlock()
+	return ahci.t.n
+}
+
+/// ExploreCrashes runs the script on a new image, boots the crash states that
+/// its trace allows and checks the script's invariants in each of them. It
+/// stops at the first state that fails a check and minimizes it. An error is
+/// returned if an op of the script fails.
+func ExploreCrashes(cs *Crashscript_t, opts *Crashopts_t) (*Crashreport_t, error) {
+	x := &crashx_t{cs: cs, opts: opts}
+	disk := filepath.Join(opts.Dir, "disk.img")
+	x.img = filepath.Join(opts.Dir, "crash.img")
+	tpath := filepath.Join(opts.Dir, "trace.json")
+	MkDisk(disk, nil, opts.Nlog, opts.Ninode, opts.Ndata)
+	defer os.Remove(disk)
+	defer os.Remove(tpath)
+
+	tfs := BootFS(disk)
+	for _, op := range cs.setup {
+		if err := tfs.crashop(op); err != 0 {
+			ShutdownFS(tfs)
+			return nil, fmt.Errorf("line %d: %v failed: %v", op.line,
+				op.args[0], err)
+		}
+	}
+	ShutdownFS(tfs)
+
+	tfs = BootFS(disk)
+	// the image as the traced run finds it, recovery included
+	base, uerr := os.ReadFile(disk)
+	if uerr != nil {
+		ShutdownFS(tfs)
+		return nil, uerr
+	}
+	tfs.ahci.t = mkTrace(tpath)
+	x.marks = append(x.marks, tfs.ahci.tracelen())
+	for _, op := range cs.ops {
+		if err := tfs.crashop(op); err != 0 {
+			ShutdownFS(tfs)
+			return nil, fmt.Errorf("line %d: %v failed: %v", op.line,
+				op.args[0], err)
+		}
+		x.marks = append(x.marks, tfs.ahci.tracelen())
+	}
+	ShutdownFS(tfs)
+	x.trace = readTrace(tpath)
+
+	x.sbs = util.Readn(base[:fs.BSIZE], 4, fs.FSOFF)
+	d := &mem.Bytepg_t{}
+	copy(d[:], base[x.sbs*fs.BSIZE:])
+	x.super = &fs.Superblock_t{Data: d}
+
+	rep := &Crashreport_t{Nrecords: len(x.trace)}
+	defer os.Remove(x.img)
+	cur := base
+	for start := 0; start < len(x.trace); {
+		end := x.trace.findSync(start)
+		if end < 0 {
+			end = len(x.trace)
+		}
+		e := x.mkepoch(rep.Nepochs, start, end)
+		if e.nw > 0 {
+			rep.Nepochs++
+			if err := x.explore(e, cur, rep); err != nil {
+				return nil, err
+			}
+			if rep.Fail != nil {
+				return rep, nil
+			}
+			cur = x.apply(e, cur, x.lastvers(e))
+		}
+		start = end + 1
+	}
+	return rep, nil
+}
+
+func (x *crashx_t) mkepoch(n, start, end int) *crashepoch_t {
+	e := &crashepoch_t{n: n, start: start, end: end}
+	idx := make(map[int]int)
+	for i := start; i < end; i++ {
+		r := &x.trace[i]
+		if r.Cmd != "write" {
+			continue
+		}
+		e.nw++
+		b, ok := idx[r.BlkNo]
+		if !ok {
+			b = len(e.blks)
+			idx[r.BlkNo] = b
+			e.blks = append(e.blks, r.BlkNo)
+			e.vers = append(e.vers, nil)
+		}
+		dup := false
+		for _, v := range e.vers[b] {
+			dup = dup || string(x.trace[v].BlkData) == string(r.BlkData)
+		}
+		if !dup {
+			e.vers[b] = append(e.vers[b], i)
+		}
+	}
+	return e
+}
+
+// a crash state of an epoch picks for each block either 0, for none of its
+// versions, or the version that the disk wrote last plus one.
+func (x *crashx_t) lastvers(e *crashepoch_t) []int {
+	c := make([]int, len(e.blks))
+	for i := range c {
+		c[i] = len(e.vers[i])
+	}
+	return c
+}
+
+func (x *crashx_t) apply(e *crashepoch_t, img []byte, choice []int) []byte {
+	res := make([]byte, len(img))
+	copy(res, img)
+	for i, c := range choice {
+		if c == 0 {
+			continue
+		}
+		r := &x.trace[e.vers[i][c-1]]
+		copy(res[r.BlkNo*fs.BSIZE:(r.BlkNo+1)*fs.BSIZE], r.BlkData)
+	}
+	return res
+}
+
+func (x *crashx_t) explore(e *crashepoch_t, cur []byte, rep *Crashreport_t) error {
+	total := 1
+	for _, v := range e.vers {
+		if total <= x.opts.Max {
+			total *= len(v) + 1
+		}
+	}
+	sampled := total > x.opts.Max
+	if sampled {
+		rep.Nsampled++
+		total = x.opts.Max
+	}
+	if x.opts.Log != nil {
+		fmt.Fprintf(x.opts.Log, "epoch %d: records %d-%d, %d writes to %d "+
+			"blocks, %d states", e.n, e.start, e.end-1, e.nw, len(e.blks), total)
+		if sampled {
+			fmt.Fprintf(x.opts.Log, " (sampled)")
+		}
+		fmt.Fprintf(x.opts.Log, "\n")
+	}
+
+	rnd := rand.New(rand.NewSource(x.opts.Seed + int64(e.n)))
+	choice := make([]int, len(e.blks))
+	for n := 0; n < total; n++ {
+		switch {
+		case n == 0:
+			// nothing of the epoch on disk
+		case sampled && n == 1:
+			copy(choice, x.lastvers(e))
+		case sampled:
+			for i := range choice {
+				choice[i] = rnd.Intn(len(e.vers[i]) + 1)
+			}
+		default:
+			// next choice in mixed radix
+			for i := range choice {
+				choice[i]++
+				if choice[i] <= len(e.vers[i]) {
+					break
+				}
+				choice[i] = 0
+			}
+		}
+		f, err := x.state(e, cur, choice)
+		if err != nil {
+			return err
+		}
+		rep.Nstates++
+		if f != nil {
+			f, err = x.minimize(e, cur, choice, f)
+			if err != nil {
+				return err
+			}
+			rep.Fail = f
+			return nil
+		}
+	}
+	return nil
+}
+
+// greedily drops the writes that the failure does not need.
+func (x *crashx_t) minimize(e *crashepoch_t, cur []byte, choice []int, f *Crashfail_t) (*Crashfail_t, error) {
+	for i := range choice {
+		if choice[i] == 0 {
+			continue
+		}
+		c := choice[i]
+		choice[i] = 0
+		f1, err := x.state(e, cur, choice)
+		if err != nil {
+			return nil, err
+		}
+		if f1 != nil {
+			f = f1
+		} else {
+			choice[i] = c
+		}
+	}
+	if x.opts.Out != "" {
+		uerr := os.WriteFile(x.opts.Out, x.apply(e, cur, choice), 0644)
+		if uerr != nil {
+			return nil, uerr
+		}
+	}
+	for i, c := range choice {
+		if c != 0 {
+			w := Crashwrite_t{Rec: e.vers[i][c-1], Blkno: e.blks[i]}
+			w.Region = x.region(w.Blkno)
+			f.Landed = append(f.Landed, w)
+		}
+	}
+	return f, nil
+}
+
+func (x *crashx_t) region(blkno int) string {
+	sb := x.super
+	switch {
+	case blkno < x.sbs:
+		return "boot"
+	case blkno == x.sbs:
+		return "superblock"
+	case blkno <= x.sbs+sb.Loglen():
+		return "log"
+	case blkno < sb.Iorphanblock()+sb.Iorphanlen():
+		return "orphan map"
+	case blkno < sb.Freeblock():
+		return "inode map"
+	case blkno < sb.Freeblock()+sb.Freeblocklen():
+		return "block map"
+	case blkno < sb.Freeblock()+sb.Freeblocklen()+sb.Inodelen():
+		return "inodes"
+	}
+	return "data"
+}
+
+// boots a crash state and returns the first check that does not hold in it,
+// if any.
+func (x *crashx_t) state(e *crashepoch_t, cur []byte, choice []int) (*Crashfail_t, error) {
+	full := true
+	for i, c := range choice {
+		full = full && c == len(e.vers[i])
+	}
+	var checks []*crashcheck_t
+	needfsck := false
+	for _, c := range x.cs.checks {
+		// the check applies once the flushes before it have completed
+		p := x.marks[c.after]
+		if p <= e.start || (full && p <= e.end) {
+			checks = append(checks, c)
+			needfsck = needfsck || c.fsck
+		}
+	}
+	if len(checks) == 0 {
+		return nil, nil
+	}
+	uerr := os.WriteFile(x.img, x.apply(e, cur, choice), 0644)
+	if uerr != nil {
+		return nil, uerr
+	}
+	f := &Crashfail_t{Epoch: e.n, Start: e.start, End: e.end, Nwrites: e.nw}
+
+	res, why := x.boot(checks)
+	if res == nil {
+		f.Why = why
+		return f, nil
+	}
+	clean := true
+	if needfsck {
+		rep := Fsck(x.img, false)
+		clean = rep.Clean()
+		if !clean {
+			why = fmt.Sprintf("fsck: %d problems", len(rep.Errs))
+			if len(rep.Errs) > 0 {
+				why += ", first " + rep.Errs[0].String()
+			}
+		}
+	}
+	for i, c := range checks {
+		ok := false
+		var whys []string
+		for j, cl := range c.clauses {
+			if cl[0] == "fsck" {
+				ok = ok || clean
+				if !clean {
+					whys = append(whys, why)
+				}
+			} else {
+				ok = ok || res[i][j] == ""
+				if res[i][j] != "" {
+					whys = append(whys, res[i][j])
+				}
+			}
+		}
+		if !ok {
+			f.Line = c.line
+			f.Check = c.text
+			f.Why = strings.Join(whys, "; ")
+			return f, nil
+		}
+	}
+	return nil, nil
+}
+
+// boots the crash image and evaluates the clauses of the checks, which hold
+// if their result is empty. it returns nil and the reason if booting panics.
+func (x *crashx_t) boot(checks []*crashcheck_t) (res [][]string, why string) {
+	var tfs *Ufs_t
+	defer func() {
+		if r := recover(); r != nil {
+			res = nil
+			why = fmt.Sprint(r)
+			if tfs != nil {
+				tfs.ahci.close()
+			}
+		}
+	}()
+	tfs = BootFS(x.img)
+	res = make([][]string, len(checks))
+	for i, c := range checks {
+		res[i] = make([]string, len(c.clauses))
+		for j, cl := range c.clauses {
+			if cl[0] != "fsck" {
+				_, res[i][j] = tfs.crashclause(cl)
+			}
+		}
+	}
+	ShutdownFS(tfs)
+	return res, ""
+}
@@ -2,6 +2,7 @@ package ufs
 
 import "os"
 import "sync"
+import "syscall"
 
 import "defs"
 import "fdops"
@@ -17,11 +18,16 @@ type ahci_disk_t struct {
 	sync.Mutex
 	f *os.File
 	t *tracef_t
+	// the number of read requests and of blocks read
+	nreads   int
+	nreadblk int
+	// the number of blocks discarded
+	ndiscard int
 }
 
 /// StartTrace enables tracing of write operations.
 func (ahci *ahci_disk_t) StartTrace() {
-	ahci.t = mkTrace()
+	ahci.t = mkTrace("trace.json")
 }
 
 /// Seek moves the underlying file offset to o.
@@ -39,19 +45,26 @@ func (ahci *ahci_disk_t) Start(req *fs.Bdev_req_t) bool {
 
 	switch req.Cmd {
 	case fs.BDEV_READ:
-		if req.Blks.Len() != 1 {
+		if req.Blks.Len() != 1 && req.Sync {
 			panic("read: too many blocks")
 		}
-		blk := req.Blks.FrontBlock()
-		ahci.Seek(blk.Block * fs.BSIZE)
-		b := make([]byte, fs.BSIZE)
-		n, err := ahci.f.Read(b)
-		if n != fs.BSIZE || err != nil {
-			panic(err)
-		}
-		blk.Data = &mem.Bytepg_t{}
-		for i, _ := range b {
-			blk.Data[i] = uint8(b[i])
+		ahci.nreads++
+		ahci.nreadblk += req.Blks.Len()
+		for blk := req.Blks.FrontBlock(); blk != nil; blk = req.Blks.NextBlock() {
+			ahci.Seek(blk.Block * fs.BSIZE)
+			b := make([]byte, fs.BSIZE)
+			n, err := ahci.f.Read(b)
+			if n != fs.BSIZE || err != nil {
+				panic(err)
+			}
+			blk.Data = &mem.Bytepg_t{}
+			for i, _ := range b {
+				blk.Data[i] = uint8(b[i])
+			}
+			// read-ahead
+			if !req.Sync {
+				blk.Done("Start")
+			}
 		}
 	case fs.BDEV_WRITE:
 		for b := req.Blks.FrontBlock(); b != nil; b = req.Blks.NextBlock() {
@@ -74,10 +87,35 @@ func (ahci *ahci_disk_t) Start(req *fs.Bdev_req_t) bool {
 		if ahci.t != nil {
 			ahci.t.sync()
 		}
+	case fs.BDEV_DISCARD:
+		ahci.ndiscard += req.Blks.Len()
+		first, n := 0, 0
+		for b := req.Blks.FrontBlock(); b != nil; b = req.Blks.NextBlock() {
+			if n > 0 && b.Block == first+n {
+				n++
+				continue
+			}
+			ahci.punch(first, n)
+			first, n = b.Block, 1
+		}
+		ahci.punch(first, n)
 	}
 	return false
 }
 
+// punches a hole for the n blocks starting at block first into the image so
+// that the host can reclaim their space. the image keeps its size. a host
+// file system without holes leaves the image as it is, which is fine since the
+// blocks are free.
+func (ahci *ahci_disk_t) punch(first, n int) {
+	if n == 0 {
+		return
+	}
+	mode := uint32(defs.FALLOC_FL_PUNCH_HOLE | defs.FALLOC_FL_KEEP_SIZE)
+	syscall.Fallocate(int(ahci.f.Fd()), mode, int64(first*fs.BSIZE),
+		int64(n*fs.BSIZE))
+}
+
 /// Stats returns statistics for the disk.
 func (ahci *ahci_disk_t) Stats() string {
 	return ""
@@ -118,6 +156,86 @@ func (bm *blockmem_t) Free(pa mem.Pa_t) {
 func (bm *blockmem_t) Refup(pa mem.Pa_t) {
 }
 
+/// pagemem_t is a page allocator for tests that counts references like
+/// mem.Physmem does.
+type pagemem_t struct {
+	sync.Mutex
+	pgs  map[mem.Pa_t]*mem.Pg_t
+	refs map[mem.Pa_t]int
+	next mem.Pa_t
+}
+
+func mkPagemem() *pagemem_t {
+	return &pagemem_t{pgs: make(map[mem.Pa_t]*mem.Pg_t),
+		refs: make(map[mem.Pa_t]int), next: mem.Pa_t(mem.PGSIZE)}
+}
+
+/// Refpg_new returns a zeroed page without a reference.
+func (pm *pagemem_t) Refpg_new() (*mem.Pg_t, mem.Pa_t, bool) {
+	pm.Lock()
+	defer pm.Unlock()
+	pa := pm.next
+	pm.next += mem.Pa_t(mem.PGSIZE)
+	pg := &mem.Pg_t{}
+	pm.pgs[pa] = pg
+	pm.refs[pa] = 0
+	return pg, pa, true
+}
+
+/// Refpg_new_nozero is Refpg_new.
+func (pm *pagemem_t) Refpg_new_nozero() (*mem.Pg_t, mem.Pa_t, bool) {
+	return pm.Refpg_new()
+}
+
+/// Refcnt returns the reference count of a page.
+func (pm *pagemem_t) Refcnt(pa mem.Pa_t) int {
+	pm.Lock()
+	defer pm.Unlock()
+	return pm.refs[pa]
+}
+
+/// Dmap returns the page at pa.
+func (pm *pagemem_t) Dmap(pa mem.Pa_t) *mem.Pg_t {
+	pm.Lock()
+	defer pm.Unlock()
+	pg, ok := pm.pgs[pa]
+	if !ok {
+		panic("no such page")
+	}
+	return pg
+}
+
+/// Refup increments the reference count of a page.
+func (pm *pagemem_t) Refup(pa mem.Pa_t) {
+	pm.Lock()
+	defer pm.Unlock()
+	pm.refs[pa]++
+}
+
+/// Refdown decrements the reference count of a page and frees it when it
+/// drops to zero, which it reports.
+func (pm *pagemem_t) Refdown(pa mem.Pa_t) bool {
+	pm.Lock()
+	defer pm.Unlock()
+	pm.refs[pa]--
+	if pm.refs[pa] < 0 {
+		panic("negative ref count")
+	}
+	if pm.refs[pa] != 0 {
+		return false
+	}
+	delete(pm.refs, pa)
+	delete(pm.pgs, pa)
+	return true
+}
+
+/// Inuse returns the number of allocated pages.
+func (pm *pagemem_t) Inuse() int {
+	pm.Lock()
+	defer pm.Unlock()
+	return len(pm.pgs)
+}
+
 /// console_t is a stub console driver used in tests.
 type console_t struct {
 }
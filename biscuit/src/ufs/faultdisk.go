@@ -0,0 +1,195 @@
+package ufs
+
+import "fmt"
+import "sync"
+import "time"
+
+import "defs"
+import "fs"
+
+//
+// A disk that fails
+//
+
+/// Fault_t describes what a Faultdisk_t does to the requests for a block.
+type Fault_t struct {
+	Rfail bool          /// fail reads
+	Wfail bool          /// fail writes
+	Torn  int           /// if positive, fail writes after storing this many bytes
+	Delay time.Duration /// delay requests
+}
+
+/// Faultdisk_t passes requests on to the disk it wraps, except that it injects
+/// faults into the requests for chosen blocks, to test how the file system
+/// copes with a failing disk. The faults may change while the file system
+/// runs. Like a real disk, it reports a failed asynchronous write with the
+/// next flush.
+type Faultdisk_t struct {
+	sync.Mutex
+	disk   fs.Disk_i
+	faults map[int]Fault_t
+	// the fault of the blocks without one of their own
+	all Fault_t
+	// whether an asynchronous write failed since the last flush
+	pending bool
+	// the number of block reads and writes that failed
+	nrfail int
+	nwfail int
+}
+
+/// MkFaultdisk returns a Faultdisk_t that wraps disk and has no faults yet.
+func MkFaultdisk(disk fs.Disk_i) *Faultdisk_t {
+	return &Faultdisk_t{disk: disk, faults: make(map[int]Fault_t)}
+}
+
+/// Set makes the requests for block blkno suffer f.
+func (fd *Faultdisk_t) Set(blkno int, f Fault_t) {
+	fd.Lock()
+	defer fd.Unlock()
+	fd.faults[blkno] = f
+}
+
+/// Setall makes the requests for the blocks without a fault of their own
+/// suffer f.
+func (fd *Faultdisk_t) Setall(f Fault_t) {
+	fd.Lock()
+	defer fd.Unlock()
+	fd.all = f
+}
+
+/// Clear removes all faults. A write that failed before still fails the next
+/// flush.
+func (fd *Faultdisk_t) Clear() {
+	fd.Lock()
+	defer fd.Unlock()
+	fd.faults = make(map[int]Fault_t)
+	fd.all = Fault_t{}
+}
+
+/// Nfail returns the number of block reads and writes that failed.
+func (fd *Faultdisk_t) Nfail() (int, int) {
+	fd.Lock()
+	defer fd.Unlock()
+	return fd.nrfail, fd.nwfail
+}
+
+// returns the fault of block blkno after waiting for its delay.
+func (fd *Faultdisk_t) fault(blkno int) Fault_t {
+	fd.Lock()
+	f, ok := fd.faults[blkno]
+	if !ok {
+		f = fd.all
+	}
+	fd.Unlock()
+	if f.Delay > 0 {
+		time.Sleep(f.Delay)
+	}
+	return f
+}
+
+// passes a request for block b, or a flush if b is nil, on to the wrapped disk
+// and waits for it if it is synchronous.
+func (fd *Faultdisk_t) pass(b *fs.Bdev_block_t, cmd fs.Bdevcmd_t, sync bool) defs.Err_t {
+	var l *fs.BlkList_t
+	if b != nil {
+		l = fs.MkBlkList()
+		l.PushBack(b)
+	}
+	req := fs.MkRequest(l, cmd, sync)
+	if fd.disk.Start(req) {
+		<-req.AckCh
+	}
+	return req.Err
+}
+
+// the release callback of the copies of torn blocks
+type tornrelse_t struct {
+}
+
+func (tr *tornrelse_t) Relse(b *fs.Bdev_block_t, s string) {
+	b.Free_page()
+}
+
+// writes only the first n bytes of block b, as a disk that loses power during
+// the write would.
+func (fd *Faultdisk_t) tear(b *fs.Bdev_block_t, n int) {
+	if n > fs.BSIZE {
+		n = fs.BSIZE
+	}
+	t := fs.MkBlock_newpage(b.Block, "torn", b.Mem, fd.disk, &tornrelse_t{})
+	if fd.pass(t, fs.BDEV_READ, true) != 0 {
+		t.Free_page()
+		return
+	}
+	copy(t.Data[:n], b.Data[:n])
+	fd.pass(t, fs.BDEV_WRITE, true)
+}
+
+/// Start services a block device request one block at a time. It finishes
+/// the request before it returns, except for discards, which it passes on.
+func (fd *Faultdisk_t) Start(req *fs.Bdev_req_t) bool {
+	switch req.Cmd {
+	case fs.BDEV_READ:
+		for b := req.Blks.FrontBlock(); b != nil; b = req.Blks.NextBlock() {
+			if !fd.fault(b.Block).Rfail {
+				fd.pass(b, fs.BDEV_READ, req.Sync)
+				continue
+			}
+			fd.Lock()
+			fd.nrfail++
+			fd.Unlock()
+			b.Err = -defs.EIO
+			if !req.Sync {
+				b.Done("faultdisk")
+			}
+		}
+	case fs.BDEV_WRITE:
+		failed := false
+		for b := req.Blks.FrontBlock(); b != nil; b = req.Blks.NextBlock() {
+			f := fd.fault(b.Block)
+			if f.Torn <= 0 && !f.Wfail {
+				if fd.pass(b, fs.BDEV_WRITE, req.Sync) != 0 {
+					failed = true
+				}
+				continue
+			}
+			if f.Torn > 0 {
+				fd.tear(b, f.Torn)
+			}
+			fd.Lock()
+			fd.nwfail++
+			fd.Unlock()
+			failed = true
+			// the disk is done with the block, as it would be after
+			// writing it
+			b.Done("faultdisk")
+		}
+		if failed {
+			if req.Sync {
+				req.Err = -defs.EIO
+			} else {
+				fd.Lock()
+				fd.pending = true
+				fd.Unlock()
+			}
+		}
+	case fs.BDEV_FLUSH:
+		err := fd.pass(nil, fs.BDEV_FLUSH, true)
+		fd.Lock()
+		if err != 0 || fd.pending {
+			req.Err = -defs.EIO
+		}
+		fd.pending = false
+		fd.Unlock()
+	case fs.BDEV_DISCARD:
+		return fd.disk.Start(req)
+	}
+	return false
+}
+
+/// Stats returns the number of failed reads and writes and the statistics of
+/// the wrapped disk.
+func (fd *Faultdisk_t) Stats() string {
+	nr, nw := fd.Nfail()
+	return fmt.Sprintf("faultdisk: nrfail %v nwfail %v\n", nr, nw) + fd.disk.Stats()
+}
@@ -1,7 +1,9 @@
 package ufs
 
+import "crypto/rand"
 import "os"
 import "fmt"
+import "time"
 
 import "fs"
 import "mem"
@@ -53,10 +55,9 @@ func writeBootBlock(f *os.File, superb int) {
 	f.Write(bytepg2byte(d))
 }
 
-func writeSuperBlock(f *os.File, start int, nlogblks, ninodeblks, ndatablks int) *fs.Superblock_t {
-	if Tell(f) != start {
-		panic("superblock in wrong location")
-	}
+/// MkSuperBlock returns the superblock of an image whose superblock is at
+/// block start and which has the given number of log, inode and data blocks.
+func MkSuperBlock(start int, nlogblks, ninodeblks, ndatablks int) *fs.Superblock_t {
 	d := &mem.Bytepg_t{}
 	sb := fs.Superblock_t{d}
 	sb.SetLoglen(nlogblks)
@@ -70,10 +71,18 @@ func writeSuperBlock(f *os.File, start int, nlogblks, ninodeblks, ndatablks int)
 	sb.SetFreeblocklen(bblock)
 	sb.SetInodelen(ninodeblks)
 	sb.SetLastblock(start + 1 + nlogblks + 2*ni + bblock + ninodeblks + ndatablks)
-	f.Write(bytepg2byte(sb.Data))
 	return &sb
 }
 
+func writeSuperBlock(f *os.File, start int, nlogblks, ninodeblks, ndatablks int) *fs.Superblock_t {
+	if Tell(f) != start {
+		panic("superblock in wrong location")
+	}
+	sb := MkSuperBlock(start, nlogblks, ninodeblks, ndatablks)
+	f.Write(bytepg2byte(sb.Data))
+	return sb
+}
+
 func markAllocated(d []byte, startbit int) {
 	for i := (startbit / 8) + 1; i < fs.BSIZE; i++ {
 		d[i] = byte(0xff)
@@ -107,8 +116,7 @@ func writeInodeMap(f *os.File, sb *fs.Superblock_t, ninodeblks int) {
 		for i := 1; i < sb.Imaplen()-1; i++ {
 			f.Write(block)
 		}
-		start := nbitsperblock - ninode%nbitsperblock
-		markAllocated(block, start)
+		markAllocated(block, ninode%nbitsperblock)
 		f.Write(block)
 	}
 }
@@ -164,6 +172,14 @@ func writeInodes(f *os.File, sb *fs.Superblock_t) {
 	root.W_linkcount(1)
 	root.W_size(fs.BSIZE)
 	root.W_addr(0, firstdata)
+	root.W_diridx(fs.DIRIDX_EMPTY)
+	t := int(time.Now().UnixNano())
+	root.W_atime(t)
+	root.W_mtime(t)
+	root.W_ctime(t)
+	root.W_mode(0755)
+	root.W_uid(0)
+	root.W_gid(0)
 	block := bytepg2byte(b.Data)
 
 	if Tell(f) != sb.Freeblock()+sb.Freeblocklen() {
@@ -182,14 +198,14 @@ func writeDataBlocks(f *os.File, sb *fs.Superblock_t, ndatablks int) {
 	// Root directory data
 	data := &mem.Bytepg_t{}
 	ddata := fs.Dirdata_t{data[:]}
-	ddata.W_filename(0, ustr.Ustr("."))
-	ddata.W_inodenext(0, 0)
-	ddata.W_filename(1, ustr.Ustr(".."))
-	ddata.W_inodenext(1, 0)
-	for i := 2; i < fs.NDIRENTS; i++ {
-		ddata.W_filename(i, ustr.MkUstr())
-		ddata.W_inodenext(i, 0)
-	}
+	dot := ustr.Ustr(".")
+	dotdot := ustr.Ustr("..")
+	off := 0
+	ddata.W_dirent(off, fs.Direclen(len(dot)), dot, 0)
+	off += fs.Direclen(len(dot))
+	ddata.W_dirent(off, fs.Direclen(len(dotdot)), dotdot, 0)
+	off += fs.Direclen(len(dotdot))
+	ddata.W_dirent(off, fs.BSIZE-off, ustr.MkUstr(), 0)
 	d := bytepg2byte(data)
 
 	if Tell(f) != sb.Freeblock()+sb.Freeblocklen()+sb.Inodelen() {
@@ -281,6 +297,24 @@ func pokeboot(f *os.File, start int) {
 	}
 }
 
+/// SuperStart returns the block at which MkDisk places the superblock when
+/// the image starts with the given boot and kernel images.
+func SuperStart(images []string) int {
+	if len(images) == 0 {
+		return 1
+	}
+	n := 0
+	for _, i := range images {
+		st, err := os.Stat(i)
+		if err != nil {
+			panic(err)
+		}
+		n += int(st.Size())
+	}
+	// pad always appends a full block
+	return (n + fs.BSIZE) / fs.BSIZE
+}
+
 /// MkDisk creates a disk image with a UFS filesystem.
 func MkDisk(disk string, images []string, nlogblks, ninodeblks, ndatablks int) {
 	fmt.Printf("Make FS disk %s\n", disk)
@@ -313,4 +347,55 @@ func MkDisk(disk string, images []string, nlogblks, ninodeblks, ndatablks int) {
 
 	f.Sync()
 	f.Close()
+
+	if Passphrase != nil {
+		encryptImage(disk, start)
+	}
+}
+
+// a release callback that does nothing, for blocks that their maker keeps
+type keeprelse_t struct {
+}
+
+func (kr *keeprelse_t) Relse(b *fs.Bdev_block_t, s string) {
+}
+
+// encrypts the file system in image disk, whose superblock is at block start,
+// in place with a key derived from Passphrase, a new salt and Cryptiters.
+func encryptImage(disk string, start int) {
+	fmt.Printf("Encrypt FS disk %s\n", disk)
+	a := openDisk(disk)
+	defer a.close()
+
+	b := fs.MkBlock_newpage(start, "super", blockmem, a, &keeprelse_t{})
+	if b.Read() != 0 {
+		panic("cannot read superblock")
+	}
+	sb := fs.Superblock_t{Data: b.Data}
+	if _, err := rand.Read(sb.Cryptsalt()); err != nil {
+		panic(err)
+	}
+	key, check := fs.Cryptkey(Passphrase, sb.Cryptsalt(), Cryptiters)
+	copy(sb.Cryptcheck(), check)
+	sb.SetCryptiters(Cryptiters)
+	sb.SetCrypt(fs.CRYPT_AESXTS)
+	if b.Write() != 0 {
+		panic("cannot write superblock")
+	}
+
+	cd, err := fs.MkCryptdisk(a, key, start+1)
+	if err != 0 {
+		panic("bad key")
+	}
+	for n := start + 1; n < sb.Lastblock(); n++ {
+		b := fs.MkBlock_newpage(n, "encrypt", blockmem, a, &keeprelse_t{})
+		if b.Read() != 0 {
+			panic("cannot read block")
+		}
+		b.Disk = cd
+		if b.Write() != 0 {
+			panic("cannot write block")
+		}
+	}
+	a.f.Sync()
 }
@@ -0,0 +1,125 @@
+package ufs
+
+import "container/list"
+import "fmt"
+import "sync"
+import "time"
+
+import "fs"
+
+//
+// A disk that queues requests
+//
+
+/// Queuedisk_t passes requests on to the disk it wraps from a queue, one at a
+/// time, as the AHCI driver does while all its command slots are busy. Like
+/// the driver, it combines a request with a queued one with fs.Coalesce, and
+/// it acknowledges a synchronous request once the wrapped disk has finished
+/// it. While it is stopped, requests wait in the queue.
+type Queuedisk_t struct {
+	sync.Mutex
+	cond  *sync.Cond
+	disk  fs.Disk_i
+	delay time.Duration
+	// requests that wait for the disk
+	queued  *list.List
+	stopped bool
+	closed  bool
+	// the number of requests combined with a queued one
+	ncoalesce int
+}
+
+/// MkQueuedisk returns a Queuedisk_t that wraps disk and delays each request
+/// by delay before it passes it on, so that requests pile up.
+func MkQueuedisk(disk fs.Disk_i, delay time.Duration) *Queuedisk_t {
+	qd := &Queuedisk_t{disk: disk, delay: delay, queued: list.New()}
+	qd.cond = sync.NewCond(qd)
+	go qd.run()
+	return qd
+}
+
+// passes the queued requests on to the wrapped disk until qd is closed.
+func (qd *Queuedisk_t) run() {
+	qd.Lock()
+	defer qd.Unlock()
+	for {
+		for !qd.closed && (qd.stopped || qd.queued.Len() == 0) {
+			qd.cond.Wait()
+		}
+		if qd.closed {
+			return
+		}
+		req := qd.queued.Remove(qd.queued.Front()).(*fs.Bdev_req_t)
+		qd.Unlock()
+		if qd.delay > 0 {
+			time.Sleep(qd.delay)
+		}
+		if qd.disk.Start(req) {
+			<-req.AckCh
+		}
+		if req.Sync {
+			req.AckCh <- true
+		}
+		qd.Lock()
+	}
+}
+
+/// Start queues a request, except for a discard, which it passes on.
+func (qd *Queuedisk_t) Start(req *fs.Bdev_req_t) bool {
+	if req.Cmd == fs.BDEV_DISCARD {
+		return qd.disk.Start(req)
+	}
+	qd.Lock()
+	defer qd.Unlock()
+	if fs.Coalesce(qd.queued, req) {
+		qd.ncoalesce++
+	} else {
+		qd.queued.PushBack(req)
+		qd.cond.Signal()
+	}
+	return true
+}
+
+/// Stop keeps the requests that are started from now on in the queue.
+func (qd *Queuedisk_t) Stop() {
+	qd.Lock()
+	defer qd.Unlock()
+	qd.stopped = true
+}
+
+/// Resume passes the queued requests on again.
+func (qd *Queuedisk_t) Resume() {
+	qd.Lock()
+	defer qd.Unlock()
+	qd.stopped = false
+	qd.cond.Signal()
+}
+
+/// Len returns the number of queued requests.
+func (qd *Queuedisk_t) Len() int {
+	qd.Lock()
+	defer qd.Unlock()
+	return qd.queued.Len()
+}
+
+/// Ncoalesce returns the number of requests that were combined with a
+/// queued one.
+func (qd *Queuedisk_t) Ncoalesce() int {
+	qd.Lock()
+	defer qd.Unlock()
+	return qd.ncoalesce
+}
+
+/// Close stops passing requests on; the requests still queued are dropped.
+func (qd *Queuedisk_t) Close() {
+	qd.Lock()
+	defer qd.Unlock()
+	qd.closed = true
+	qd.cond.Signal()
+}
+
+/// Stats returns the number of combined requests and the statistics of the
+/// wrapped disk.
+func (qd *Queuedisk_t) Stats() string {
+	return fmt.Sprintf("queuedisk: ncoalesce %v\n", qd.Ncoalesce()) + qd.disk.Stats()
+}
@@ -14,6 +14,8 @@ import "mem"
 type tracef_t struct {
 	file *os.File
 	enc  *json.Encoder
+	// number of records written so far
+	n int
 }
 
 type record_t struct {
@@ -26,9 +28,9 @@ type trace_t []record_t
 type order_t []int
 type orders_t []order_t
 
-func mkTrace() *tracef_t {
+func mkTrace(p string) *tracef_t {
 	t := &tracef_t{}
-	f, uerr := os.Create("trace.json")
+	f, uerr := os.Create(p)
 	if uerr != nil {
 		panic(uerr)
 	}
@@ -39,7 +41,7 @@ func mkTrace() *tracef_t {
 
 func readTrace(p string) trace_t {
 	res := make([]record_t, 0)
-	f, uerr := os.Open("trace.json")
+	f, uerr := os.Open(p)
 	if uerr != nil {
 		panic(uerr)
 	}
@@ -115,6 +117,7 @@ func (t *tracef_t) write(n int, v *mem.Bytepg_t) {
 	if err := t.enc.Encode(&r); err != nil {
 		panic(err)
 	}
+	t.n++
 }
 
 func (t *tracef_t) sync() {
@@ -124,6 +127,7 @@ func (t *tracef_t) sync() {
 	if err := t.enc.Encode(&r); err != nil {
 		panic(err)
 	}
+	t.n++
 }
 
 func (t *tracef_t) close() {
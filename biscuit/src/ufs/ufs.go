@@ -1,6 +1,8 @@
 package ufs
 
 import "os"
+import "strings"
+import "time"
 
 import "log"
 
@@ -63,7 +65,7 @@ func (ufs *Ufs_t) SyncApply() defs.Err_t {
 
 /// MkFile creates a new file at p and writes ub into it if provided.
 func (ufs *Ufs_t) MkFile(p ustr.Ustr, ub *vm.Fakeubuf_t) defs.Err_t {
-	fd, err := ufs.fs.Fs_open(p, defs.O_CREAT, 0, ufs.cwd, 0, 0)
+	fd, err := ufs.fs.Fs_open(p, defs.O_CREAT, 0644, ufs.cwd, 0, 0)
 	if err != 0 {
 		return err
 	}
@@ -139,6 +141,29 @@ func (ufs *Ufs_t) Append(p ustr.Ustr, ub *vm.Fakeubuf_t) defs.Err_t {
 	return err
 }
 
+/// Fsync opens p and waits until its changes are on disk, only its data
+/// changes if datasync is set.
+func (ufs *Ufs_t) Fsync(p ustr.Ustr, datasync bool) defs.Err_t {
+	fd, err := ufs.fs.Fs_open(p, defs.O_RDONLY, 0, ufs.cwd, 0, 0)
+	if err != 0 {
+		return err
+	}
+	err = fd.Fops.Fsync(datasync)
+	fd.Fops.Close()
+	return err
+}
+
+/// Fallocate opens p and applies fallocate(2) with mode to len bytes at off.
+func (ufs *Ufs_t) Fallocate(p ustr.Ustr, mode, off, len int) defs.Err_t {
+	fd, err := ufs.fs.Fs_open(p, defs.O_RDWR, 0, ufs.cwd, 0, 0)
+	if err != 0 {
+		return err
+	}
+	err = fd.Fops.Fallocate(mode, off, len)
+	fd.Fops.Close()
+	return err
+}
+
 /// Unlink removes the file at p.
 func (ufs *Ufs_t) Unlink(p ustr.Ustr) defs.Err_t {
 	err := ufs.fs.Fs_unlink(p, ufs.cwd, false)
@@ -167,6 +192,64 @@ func (ufs *Ufs_t) Stat(p ustr.Ustr) (*stat.Stat_t, defs.Err_t) {
 	return s, err
 }
 
+/// Statfs retrieves the statistics of the file system that contains p.
+func (ufs *Ufs_t) Statfs(p ustr.Ustr) (*stat.Statfs_t, defs.Err_t) {
+	s := &stat.Statfs_t{}
+	err := ufs.fs.Fs_statfs(p, s, ufs.cwd)
+	if err != 0 {
+		return nil, err
+	}
+	return s, err
+}
+
+/// Lstat is Stat, but returns the stat information of a symbolic link at p
+/// rather than of its target.
+func (ufs *Ufs_t) Lstat(p ustr.Ustr) (*stat.Stat_t, defs.Err_t) {
+	s := &stat.Stat_t{}
+	err := ufs.fs.Fs_lstat(p, s, ufs.cwd)
+	if err != 0 {
+		return nil, err
+	}
+	return s, err
+}
+
+/// Symlink creates a symbolic link at p that refers to target.
+func (ufs *Ufs_t) Symlink(target, p ustr.Ustr) defs.Err_t {
+	return ufs.fs.Fs_symlink(target, p, ufs.cwd)
+}
+
+/// Readlink returns the target of the symbolic link at p.
+func (ufs *Ufs_t) Readlink(p ustr.Ustr) (ustr.Ustr, defs.Err_t) {
+	return ufs.fs.Fs_readlink(p, ufs.cwd)
+}
+
+/// Utimens sets the access and modification times of p in nanoseconds; a
+/// negative time leaves that timestamp unchanged.
+func (ufs *Ufs_t) Utimens(p ustr.Ustr, atime, mtime int) defs.Err_t {
+	return ufs.fs.Fs_utimens(p, ufs.cwd, atime, mtime)
+}
+
+/// Chmod sets the permission bits of p.
+func (ufs *Ufs_t) Chmod(p ustr.Ustr, mode int) defs.Err_t {
+	return ufs.fs.Fs_chmod(p, ufs.cwd, mode)
+}
+
+/// Chown sets the owner and group of p; a negative id leaves it unchanged.
+func (ufs *Ufs_t) Chown(p ustr.Ustr, uid, gid int) defs.Err_t {
+	return ufs.fs.Fs_chown(p, ufs.cwd, uid, gid)
+}
+
+/// Access checks whether the current credentials grant want, a combination of
+/// fs.A_READ, fs.A_WRITE and fs.A_EXEC, on p.
+func (ufs *Ufs_t) Access(p ustr.Ustr, want int) defs.Err_t {
+	return ufs.fs.Fs_access(p, ufs.cwd, want)
+}
+
+/// SetCred sets the user and group ids used for subsequent operations.
+func (ufs *Ufs_t) SetCred(uid, gid int) {
+	ufs.cwd.Cred = fd.Cred_t{Uid: uid, Gid: gid}
+}
+
 /// Read reads the entire file at p into memory.
 func (ufs *Ufs_t) Read(p ustr.Ustr) ([]byte, defs.Err_t) {
 	st, err := ufs.Stat(p)
@@ -194,26 +277,51 @@ func (ufs *Ufs_t) Read(p ustr.Ustr) ([]byte, defs.Err_t) {
 	return v, err
 }
 
+/// Readdir returns the entries of directory p in directory order, read with
+/// the getdents iterator in chunks of bufsz bytes.
+func (ufs *Ufs_t) Readdir(p ustr.Ustr, bufsz int) ([]fs.Dirent64_t, defs.Err_t) {
+	fd, err := ufs.fs.Fs_open(p, defs.O_RDONLY|defs.O_DIRECTORY, 0, ufs.cwd, 0, 0)
+	if err != 0 {
+		return nil, err
+	}
+	defer fd.Fops.Close()
+	var res []fs.Dirent64_t
+	buf := make([]uint8, bufsz)
+	for {
+		ub := &vm.Fakeubuf_t{}
+		ub.Fake_init(buf)
+		n, err := fd.Fops.Getdents(ub)
+		if err != 0 {
+			return nil, err
+		}
+		if n == 0 {
+			return res, 0
+		}
+		for off := 0; off < n; {
+			de, l, ok := fs.Dirent64(buf[off:n])
+			if !ok {
+				return nil, -defs.EIO
+			}
+			res = append(res, de)
+			off += l
+		}
+	}
+}
+
 /// Ls returns a map of file names to stats for directory p.
 func (ufs *Ufs_t) Ls(p ustr.Ustr) (map[string]*stat.Stat_t, defs.Err_t) {
 	res := make(map[string]*stat.Stat_t, 100)
-	d, e := ufs.Read(p)
+	des, e := ufs.Readdir(p, fs.BSIZE)
 	if e != 0 {
 		return nil, e
 	}
-	for i := 0; i < len(d)/fs.BSIZE; i++ {
-		dd := fs.Dirdata_t{d[i*fs.BSIZE:]}
-		for j := 0; j < fs.NDIRENTS; j++ {
-			tfn := dd.Filename(j)
-			if len(tfn) > 0 {
-				f := p.Extend(tfn)
-				st, e := ufs.Stat(f)
-				if e != 0 {
-					return nil, e
-				}
-				res[string(tfn)] = st
-			}
+	for _, de := range des {
+		f := p.Extend(de.Name)
+		st, e := ufs.Lstat(f)
+		if e != 0 {
+			return nil, e
 		}
+		res[string(de.Name)] = st
 	}
 	return res, 0
 }
@@ -223,6 +331,17 @@ func (ufs *Ufs_t) Statistics() string {
 	return ufs.fs.Fs_statistics()
 }
 
+/// Stats returns a snapshot of the file system's statistics. Subtract an
+/// earlier snapshot from it to see what happened in between.
+func (ufs *Ufs_t) Stats() fs.Fsstats_t {
+	return ufs.fs.Fs_stats()
+}
+
+/// ResetStats resets the counters of the file system's statistics.
+func (ufs *Ufs_t) ResetStats() {
+	ufs.fs.Fs_resetstats()
+}
+
 /// Evict evicts cached inodes and blocks.
 func (ufs *Ufs_t) Evict() {
 	ufs.fs.Fs_evict()
@@ -233,6 +352,24 @@ func (ufs *Ufs_t) Sizes() (int, int) {
 	return ufs.fs.Sizes()
 }
 
+/// Passphrase, if set, makes MkDisk encrypt the images it makes and unlocks
+/// encrypted images when they are booted or checked.
+var Passphrase []byte
+
+/// Cryptiters is the number of iterations of the key derivation of the images
+/// that MkDisk encrypts.
+var Cryptiters = fs.CRYPT_ITERS
+
+/// ReadPassphrase sets Passphrase to the first line of the file path.
+func ReadPassphrase(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	Passphrase = []byte(strings.SplitN(string(b), "\n", 2)[0])
+	return nil
+}
+
 func openDisk(d string) *ahci_disk_t {
 	a := &ahci_disk_t{}
 	f, uerr := os.OpenFile(d, os.O_RDWR, 0755)
@@ -243,13 +380,31 @@ func openDisk(d string) *ahci_disk_t {
 	return a
 }
 
+// returns the disk through which the file system in image a is read, which
+// decrypts an encrypted image with Passphrase.
+func unlock(a *ahci_disk_t) fs.Disk_i {
+	disk, err := fs.Unlockdisk(blockmem, a, func() []uint8 {
+		if Passphrase == nil {
+			panic("image is encrypted; a passphrase is needed")
+		}
+		return Passphrase
+	})
+	if err == -defs.EACCES {
+		panic("wrong passphrase")
+	}
+	if err != 0 {
+		panic(err)
+	}
+	return disk
+}
+
 /// BootFS boots the filesystem from an on-disk image.
 func BootFS(dst string) *Ufs_t {
 	//log.Printf("reboot %v ...\n", dst)
 	ufs := &Ufs_t{}
 	ufs.ahci = openDisk(dst)
 	ufs.cwd = ufs.fs.MkRootCwd()
-	_, ufs.fs = fs.StartFS(blockmem, ufs.ahci, c, true)
+	_, ufs.fs = fs.StartFS(blockmem, unlock(ufs.ahci), c, true)
 	return ufs
 }
 
@@ -259,10 +414,56 @@ func BootMemFS(dst string) *Ufs_t {
 	ufs := &Ufs_t{}
 	ufs.ahci = openDisk(dst)
 	ufs.cwd = ufs.fs.MkRootCwd()
-	_, ufs.fs = fs.StartFS(blockmem, ufs.ahci, c, false)
+	_, ufs.fs = fs.StartFS(blockmem, unlock(ufs.ahci), c, false)
 	return ufs
 }
 
+/// BootFaultFS boots the filesystem from an on-disk image through a
+/// Faultdisk_t, which it returns for the caller to inject faults with.
+func BootFaultFS(dst string) (*Ufs_t, *Faultdisk_t) {
+	ufs := &Ufs_t{}
+	ufs.ahci = openDisk(dst)
+	ufs.cwd = ufs.fs.MkRootCwd()
+	disk := MkFaultdisk(unlock(ufs.ahci))
+	_, ufs.fs = fs.StartFS(blockmem, disk, c, true)
+	return ufs, disk
+}
+
+/// BootQueueFS boots the filesystem from an on-disk image through a
+/// Queuedisk_t that delays each request by delay, which it returns for the
+/// caller to stop and resume. ShutdownFS does not close the Queuedisk_t.
+func BootQueueFS(dst string, delay time.Duration) (*Ufs_t, *Queuedisk_t) {
+	ufs := &Ufs_t{}
+	ufs.ahci = openDisk(dst)
+	ufs.cwd = ufs.fs.MkRootCwd()
+	disk := MkQueuedisk(unlock(ufs.ahci), delay)
+	_, ufs.fs = fs.StartFS(blockmem, disk, c, true)
+	return ufs, disk
+}
+
+/// Fsck checks the file system in the image dst, which must not be booted, and
+/// repairs it if repair is set.
+func Fsck(dst string, repair bool) *fs.Fsckreport_t {
+	ahci := openDisk(dst)
+	defer ahci.close()
+	return fs.Fsck(blockmem, unlock(ahci), repair)
+}
+
+/// Readlog decodes the on-disk log of the image dst, which must not be booted.
+func Readlog(dst string) (*fs.Logdump_t, defs.Err_t) {
+	ahci := openDisk(dst)
+	defer ahci.close()
+	return fs.Readlog(blockmem, unlock(ahci))
+}
+
+/// Replaylog installs the first n transactions of the on-disk log of the
+/// image dst, which must not be booted, and drops the others.
+func Replaylog(dst string, n int) defs.Err_t {
+	ahci := openDisk(dst)
+	defer ahci.close()
+	return fs.Replaylog(blockmem, unlock(ahci), n)
+}
+
 /// ShutdownFS shuts down the filesystem and closes the disk image.
 func ShutdownFS(ufs *Ufs_t) {
 	ufs.fs.StopFS()
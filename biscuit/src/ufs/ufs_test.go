@@ -1,19 +1,38 @@
 package ufs
 
 import "testing"
+import "bytes"
+import "crypto/hmac"
+import "crypto/sha256"
+import "encoding/hex"
 import "fmt"
 import "io"
 import "os"
 import "strconv"
+import "strings"
 import "sync"
+import "sync/atomic"
+import "syscall"
 import "time"
 
 import "bpath"
 import "defs"
+import "dev"
+import "devfs"
 import "fd"
+import "fdops"
 import "fs"
+import "limits"
 import "mem"
+import "proc"
+import "procfs"
+import "stat"
+import "stats"
+import "tmpfs"
 import "ustr"
+import "util"
+import "vfs"
+import "vm"
 
 /// SMALL and LARGE define file sizes used in tests.
 const (
@@ -23,10 +42,21 @@ const (
 
 const (
 	nlogblks   = 32
-	ninodeblks = 1
+	ninodeblks = 2
 	ndatablks  = 20
 )
 
+/// TestMain runs the tests on images encrypted with the passphrase in
+/// UFS_PASSPHRASE, if it is set, and on plain images otherwise.
+func TestMain(m *testing.M) {
+	if p := os.Getenv("UFS_PASSPHRASE"); p != "" {
+		Passphrase = []byte(p)
+	}
+	// the tests boot many images; a cheap key derivation keeps them fast
+	Cryptiters = 1000
+	os.Exit(m.Run())
+}
+
 /// TestCanonicalize verifies path canonicalization.
 func TestCanonicalize(t *testing.T) {
 	if !ustr.Ustr("/").Eq(bpath.Canonicalize(ustr.Ustr("//"))) {
@@ -264,240 +294,3028 @@ func doTestSimple(tfs *Ufs_t, d ustr.Ustr) string {
 	if e != 0 {
 		return fmt.Sprintf("Mkdir %v failed", "d1")
 	}
-
-	e = tfs.Rename(d.ExtendStr("d0/d1"), d.ExtendStr("e0"))
-	if e != 0 {
-		return fmt.Sprintf("Rename failed")
+
+	e = tfs.Rename(d.ExtendStr("d0/d1"), d.ExtendStr("e0"))
+	if e != 0 {
+		return fmt.Sprintf("Rename failed")
+	}
+
+	ub = mkData(3, SMALL)
+	e = tfs.Append(d.ExtendStr("f1"), ub)
+	if e != 0 {
+		return fmt.Sprintf("Append failed")
+	}
+
+	e = tfs.Unlink(d.ExtendStr("f2"))
+	if e != 0 {
+		return fmt.Sprintf("Unlink failed")
+	}
+	return ""
+}
+
+func doCheckSimple(tfs *Ufs_t, d ustr.Ustr, t *testing.T) {
+	res, e := tfs.Ls(d)
+	if e != 0 {
+		t.Fatalf("doLs failed")
+	}
+	st, ok := res["f1"]
+	if !ok {
+		t.Fatalf("%s/f1 not present", d)
+	}
+	if st.Size() != 1024 {
+		t.Fatalf("f1 wrong size")
+	}
+
+	st, ok = res["f2"]
+	if ok {
+		t.Fatalf("f2 present")
+	}
+	st, ok = res["d0"]
+	if !ok {
+		t.Fatalf("d0 not present")
+	}
+	st, ok = res["e0"]
+	if !ok {
+		t.Fatalf("e0 not present")
+	}
+	res, e = tfs.Ls(d.ExtendStr("d0"))
+	if e != 0 {
+		t.Fatalf("doLs d0 failed")
+	}
+	st, ok = res["e0"]
+	if ok {
+		t.Fatalf("e0 present in d0")
+	}
+}
+
+//
+// Util
+//
+
+func uniqdir(id int) string {
+	return "d" + strconv.Itoa(id)
+}
+
+func uniqfile(id int) string {
+	return "f" + strconv.Itoa(id)
+}
+
+//
+// Simple test
+//
+
+/// TestFSSimple exercises simple filesystem operations.
+func TestFSSimple(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test FSSimple %v ...\n", dst)
+	d := ustr.Ustr("d/")
+	tfs := BootFS(dst)
+	s := doTestSimple(tfs, d)
+	if s != "" {
+		t.Fatalf("doTestSimple failed %s\n", s)
+	}
+	doCheckSimple(tfs, d, t)
+	ShutdownFS(tfs)
+
+	tfs = BootFS(dst)
+	doCheckSimple(tfs, d, t)
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+//
+// Test variable-length directory entries
+//
+
+func longname(id int, n int) string {
+	s := uniqfile(id)
+	for len(s) < n {
+		s += "x"
+	}
+	return s
+}
+
+func doCheckLongNames(tfs *Ufs_t, d ustr.Ustr, names []string, t *testing.T) {
+	ents, e := tfs.Ls(d)
+	if e != 0 {
+		t.Fatalf("Ls %v failed %v", d, e)
+	}
+	// "." and ".."
+	if len(ents) != len(names)+2 {
+		t.Fatalf("Ls %v: %d entries, expected %d", d, len(ents), len(names)+2)
+	}
+	for _, n := range names {
+		if _, ok := ents[n]; !ok {
+			t.Fatalf("Ls %v: missing %v", d, n)
+		}
+		if _, e := tfs.Stat(d.ExtendStr(n)); e != 0 {
+			t.Fatalf("Stat %v failed %v", n, e)
+		}
+	}
+}
+
+/// TestFSLongNames checks names longer than the old 14-byte dirent limit.
+func TestFSLongNames(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test FSLongNames %v ...\n", dst)
+	d := ustr.Ustr("d")
+	tfs := BootFS(dst)
+	if e := tfs.MkDir(d); e != 0 {
+		t.Fatalf("mkDir %v failed", d)
+	}
+	names := []string{}
+	for i, n := range []int{1, 14, 15, 100, 255, 300, fs.NAME_MAX} {
+		names = append(names, longname(i, n))
+	}
+	for _, n := range names {
+		if e := tfs.MkFile(d.ExtendStr(n), nil); e != 0 {
+			t.Fatalf("mkFile %v failed %v", len(n), e)
+		}
+	}
+	if e := tfs.MkFile(d.ExtendStr(longname(100, fs.NAME_MAX+1)), nil); e != -defs.ENAMETOOLONG {
+		t.Fatalf("mkFile of too long name returned %v", e)
+	}
+	doCheckLongNames(tfs, d, names, t)
+
+	// free some records and refill the space with names of other lengths
+	for _, i := range []int{1, 2, 3} {
+		if e := tfs.Unlink(d.ExtendStr(names[i])); e != 0 {
+			t.Fatalf("Unlink %v failed %v", names[i], e)
+		}
+	}
+	names = append(names[:1], names[4:]...)
+	o := d.ExtendStr(names[len(names)-1])
+	nn := longname(7, 200)
+	if e := tfs.Rename(o, d.ExtendStr(nn)); e != 0 {
+		t.Fatalf("Rename failed %v", e)
+	}
+	names[len(names)-1] = nn
+	for i := 0; i < 20; i++ {
+		n := longname(10+i, 20+i*10)
+		if e := tfs.MkFile(d.ExtendStr(n), nil); e != 0 {
+			t.Fatalf("mkFile %v failed %v", len(n), e)
+		}
+		names = append(names, n)
+	}
+	doCheckLongNames(tfs, d, names, t)
+	ShutdownFS(tfs)
+
+	tfs = BootFS(dst)
+	doCheckLongNames(tfs, d, names, t)
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+//
+// Test inode timestamps
+//
+
+func stime(sec, nsec uint) int {
+	return int(sec)*1e9 + int(nsec)
+}
+
+/// TestFSTimes checks that timestamps are updated and survive a reboot.
+func TestFSTimes(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test FSTimes %v ...\n", dst)
+	f := ustr.Ustr("f")
+	tfs := BootFS(dst)
+	before := int(time.Now().UnixNano())
+	if e := tfs.MkFile(f, nil); e != 0 {
+		t.Fatalf("mkFile %v failed", f)
+	}
+	st, e := tfs.Stat(f)
+	if e != 0 {
+		t.Fatalf("Stat failed")
+	}
+	created := stime(st.Mtime())
+	if created < before || stime(st.Ctime()) != created {
+		t.Fatalf("bad creation times %v %v", created, before)
+	}
+	root, _ := tfs.Stat(ustr.MkUstrRoot())
+	if stime(root.Mtime()) < created {
+		t.Fatalf("parent mtime not updated")
+	}
+
+	time.Sleep(time.Millisecond)
+	if e := tfs.Append(f, mkData(1, SMALL)); e != 0 {
+		t.Fatalf("Append failed")
+	}
+	st, _ = tfs.Stat(f)
+	if stime(st.Mtime()) <= created {
+		t.Fatalf("mtime not updated by write")
+	}
+
+	mtime := 1234000005678
+	atime := 4321000000000
+	if e := tfs.Utimens(f, atime, mtime); e != 0 {
+		t.Fatalf("Utimens failed %v", e)
+	}
+	if e := tfs.Utimens(ustr.Ustr("nonexistent"), atime, mtime); e != -defs.ENOENT {
+		t.Fatalf("Utimens of missing file returned %v", e)
+	}
+	ShutdownFS(tfs)
+
+	tfs = BootFS(dst)
+	st, e = tfs.Stat(f)
+	if e != 0 {
+		t.Fatalf("Stat failed")
+	}
+	if stime(st.Mtime()) != mtime || stime(st.Atime()) != atime {
+		t.Fatalf("times not persisted %v %v", stime(st.Mtime()), stime(st.Atime()))
+	}
+	if stime(st.Ctime()) <= created {
+		t.Fatalf("ctime not updated by Utimens")
+	}
+	// a negative time leaves the timestamp alone
+	if e := tfs.Utimens(f, -1, 0); e != 0 {
+		t.Fatalf("Utimens failed %v", e)
+	}
+	st, _ = tfs.Stat(f)
+	if stime(st.Mtime()) != 0 || stime(st.Atime()) != atime {
+		t.Fatalf("Utimens changed an omitted time")
+	}
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+//
+// Test ownership and permission checks
+//
+
+func chkperm(t *testing.T, tfs *Ufs_t, p string, mode, uid, gid uint) {
+	st, e := tfs.Stat(ustr.Ustr(p))
+	if e != 0 {
+		t.Fatalf("Stat %v failed %v", p, e)
+	}
+	if st.Mode()&fs.S_IPERM != mode || st.Uid() != uid || st.Gid() != gid {
+		t.Fatalf("%v: mode %o uid %v gid %v", p, st.Mode()&fs.S_IPERM,
+			st.Uid(), st.Gid())
+	}
+}
+
+/// TestFSPerms verifies owner, group and mode bits and their enforcement.
+func TestFSPerms(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test FSPerms %v ...\n", dst)
+	tfs := BootFS(dst)
+	d := ustr.Ustr("d")
+	f := ustr.Ustr("d/f")
+	if e := tfs.MkDir(d); e != 0 {
+		t.Fatalf("MkDir %v failed", d)
+	}
+	if e := tfs.MkFile(f, nil); e != 0 {
+		t.Fatalf("MkFile %v failed", f)
+	}
+	chkperm(t, tfs, "/", 0755, 0, 0)
+	chkperm(t, tfs, "d/f", 0644, 0, 0)
+	for _, p := range []ustr.Ustr{d, f} {
+		if e := tfs.Chown(p, 100, 100); e != 0 {
+			t.Fatalf("Chown %v failed %v", p, e)
+		}
+	}
+	if e := tfs.Chmod(d, 0700); e != 0 {
+		t.Fatalf("Chmod failed %v", e)
+	}
+
+	// others can neither search d nor create files in the root
+	tfs.SetCred(200, 200)
+	if _, e := tfs.Stat(f); e != -defs.EACCES {
+		t.Fatalf("Stat without search permission returned %v", e)
+	}
+	if e := tfs.Access(d, fs.A_READ); e != -defs.EACCES {
+		t.Fatalf("Access returned %v", e)
+	}
+	if e := tfs.MkFile(ustr.Ustr("g"), nil); e != -defs.EACCES {
+		t.Fatalf("MkFile in unwritable dir returned %v", e)
+	}
+	if e := tfs.Rename(f, ustr.Ustr("f")); e != -defs.EACCES {
+		t.Fatalf("Rename returned %v", e)
+	}
+
+	// the owner can
+	tfs.SetCred(100, 100)
+	if e := tfs.MkFile(ustr.Ustr("d/g"), nil); e != 0 {
+		t.Fatalf("MkFile by owner failed %v", e)
+	}
+	chkperm(t, tfs, "d/g", 0644, 100, 100)
+	if e := tfs.Chmod(f, 0400); e != 0 {
+		t.Fatalf("Chmod by owner failed %v", e)
+	}
+	if e := tfs.Update(f, mkData(1, SMALL)); e != -defs.EACCES {
+		t.Fatalf("Update of read-only file returned %v", e)
+	}
+	if e := tfs.Access(f, fs.A_READ); e != 0 {
+		t.Fatalf("Access failed %v", e)
+	}
+	if e := tfs.Chown(f, 200, -1); e != -defs.EPERM {
+		t.Fatalf("Chown to another user returned %v", e)
+	}
+	if e := tfs.Unlink(f); e != 0 {
+		t.Fatalf("Unlink failed %v", e)
+	}
+
+	// only the owner of a file may remove it from a sticky directory
+	tfs.SetCred(0, 0)
+	s := ustr.Ustr("s")
+	if e := tfs.MkDir(s); e != 0 {
+		t.Fatalf("MkDir %v failed", s)
+	}
+	if e := tfs.Chmod(s, 01777); e != 0 {
+		t.Fatalf("Chmod failed %v", e)
+	}
+	tfs.SetCred(100, 100)
+	if e := tfs.MkFile(ustr.Ustr("s/x"), nil); e != 0 {
+		t.Fatalf("MkFile in sticky dir failed %v", e)
+	}
+	tfs.SetCred(200, 200)
+	if e := tfs.Unlink(ustr.Ustr("s/x")); e != -defs.EPERM {
+		t.Fatalf("Unlink in sticky dir returned %v", e)
+	}
+	if e := tfs.Chmod(ustr.Ustr("s/x"), 0777); e != -defs.EPERM {
+		t.Fatalf("Chmod by non-owner returned %v", e)
+	}
+	ShutdownFS(tfs)
+
+	tfs = BootFS(dst)
+	chkperm(t, tfs, "d", 0700, 100, 100)
+	chkperm(t, tfs, "d/g", 0644, 100, 100)
+	chkperm(t, tfs, "s", 01777, 0, 0)
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+func chklink(t *testing.T, tfs *Ufs_t, p, target string) {
+	st, e := tfs.Lstat(ustr.Ustr(p))
+	if e != 0 {
+		t.Fatalf("Lstat %v failed %v", p, e)
+	}
+	if st.Mode()>>16 != fs.I_SYMLINK || st.Size() != uint(len(target)) {
+		t.Fatalf("Lstat %v mode %#o size %v", p, st.Mode(), st.Size())
+	}
+	l, e := tfs.Readlink(ustr.Ustr(p))
+	if e != 0 || string(l) != target {
+		t.Fatalf("Readlink %v returned %q %v", p, l, e)
+	}
+}
+
+func TestFSSymlinks(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test FSSymlinks %v ...\n", dst)
+	tfs := BootFS(dst)
+	for _, p := range []string{"d", "d/v1"} {
+		if e := tfs.MkDir(ustr.Ustr(p)); e != 0 {
+			t.Fatalf("MkDir %v failed", p)
+		}
+	}
+	if e := tfs.MkFile(ustr.Ustr("d/v1/f"), mkData(1, SMALL)); e != 0 {
+		t.Fatalf("MkFile failed %v", e)
+	}
+	links := [][2]string{
+		{"v1", "d/cur"},
+		{"/d/v1", "abs"},
+		{"../d/cur/", "d/up"},
+		{"d/cur", "chain"},
+		{"nope", "dangle"},
+		{"loop2", "loop1"},
+		{"loop1", "loop2"},
+	}
+	for _, l := range links {
+		if e := tfs.Symlink(ustr.Ustr(l[0]), ustr.Ustr(l[1])); e != 0 {
+			t.Fatalf("Symlink %v failed %v", l[1], e)
+		}
+	}
+	if e := tfs.Symlink(ustr.Ustr("v1"), ustr.Ustr("d/cur")); e != -defs.EEXIST {
+		t.Fatalf("Symlink over existing link returned %v", e)
+	}
+
+	// lookups through links reach d/v1/f
+	for _, p := range []string{"d/cur/f", "abs/f", "d/up/f", "chain/f"} {
+		d, e := tfs.Read(ustr.Ustr(p))
+		if e != 0 || len(d) != SMALL || d[0] != 1 {
+			t.Fatalf("Read %v failed %v", p, e)
+		}
+	}
+	st, e := tfs.Stat(ustr.Ustr("chain"))
+	if e != 0 || st.Mode()>>16 != fs.I_DIR {
+		t.Fatalf("Stat chain returned %v", e)
+	}
+	if _, e := tfs.Stat(ustr.Ustr("dangle")); e != -defs.ENOENT {
+		t.Fatalf("Stat of dangling link returned %v", e)
+	}
+	if _, e := tfs.Stat(ustr.Ustr("loop1/f")); e != -defs.ELOOP {
+		t.Fatalf("Stat of link loop returned %v", e)
+	}
+	if _, e := tfs.Readlink(ustr.Ustr("d/v1")); e != -defs.EINVAL {
+		t.Fatalf("Readlink of dir returned %v", e)
+	}
+	for _, l := range links {
+		chklink(t, tfs, l[1], l[0])
+	}
+
+	// O_CREAT through a dangling link creates its target, relative to the
+	// link's directory
+	if e := tfs.Symlink(ustr.Ustr("new"), ustr.Ustr("d/dl")); e != 0 {
+		t.Fatalf("Symlink failed %v", e)
+	}
+	for _, p := range [][3]string{{"dangle", "nope", "nope"}, {"d/dl", "new", "d/new"}} {
+		if e := tfs.MkFile(ustr.Ustr(p[0]), mkData(2, SMALL)); e != 0 {
+			t.Fatalf("MkFile through %v failed %v", p[0], e)
+		}
+		d, e := tfs.Read(ustr.Ustr(p[2]))
+		if e != 0 || len(d) != SMALL || d[0] != 2 {
+			t.Fatalf("Read %v failed %v", p[2], e)
+		}
+		chklink(t, tfs, p[0], p[1])
+	}
+	if e := tfs.MkFile(ustr.Ustr("loop1"), nil); e != -defs.ELOOP {
+		t.Fatalf("MkFile through link loop returned %v", e)
+	}
+
+	// removing a link leaves its target alone
+	if e := tfs.Unlink(ustr.Ustr("abs")); e != 0 {
+		t.Fatalf("Unlink failed %v", e)
+	}
+	if _, e := tfs.Stat(ustr.Ustr("d/v1/f")); e != 0 {
+		t.Fatalf("Stat after Unlink failed %v", e)
+	}
+	ShutdownFS(tfs)
+
+	tfs = BootFS(dst)
+	chklink(t, tfs, "d/cur", "v1")
+	if _, e := tfs.Lstat(ustr.Ustr("abs")); e != -defs.ENOENT {
+		t.Fatalf("Lstat of removed link returned %v", e)
+	}
+	if _, e := tfs.Stat(ustr.Ustr("chain/f")); e != 0 {
+		t.Fatalf("Stat through link after reboot failed %v", e)
+	}
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+func longfile(id int) string {
+	return "a-file-with-a-rather-long-name-" + strconv.Itoa(id)
+}
+
+// reads the next chunk of entries of fd with a buffer of sz bytes.
+func getdents(t *testing.T, f *fd.Fd_t, sz int) ([]fs.Dirent64_t, defs.Err_t) {
+	buf := make([]uint8, sz)
+	ub := &vm.Fakeubuf_t{}
+	ub.Fake_init(buf)
+	n, e := f.Fops.Getdents(ub)
+	if e != 0 {
+		return nil, e
+	}
+	var des []fs.Dirent64_t
+	for off := 0; off < n; {
+		de, l, ok := fs.Dirent64(buf[off:n])
+		if !ok {
+			t.Fatalf("bad record at %v", off)
+		}
+		des = append(des, de)
+		off += l
+	}
+	return des, 0
+}
+
+/// TestFSGetdents checks the entries and types returned by the directory
+/// iterator, and that its cookies survive inserts and removals made between
+/// calls.
+func TestFSGetdents(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, 16, ndatablks)
+
+	fmt.Printf("Test FSGetdents %v ...\n", dst)
+	tfs := BootFS(dst)
+	nfile := 150
+	for i := 0; i < nfile; i++ {
+		if e := tfs.MkFile(ustr.Ustr(longfile(i)), nil); e != 0 {
+			t.Fatalf("MkFile %v failed %v", i, e)
+		}
+	}
+	if e := tfs.MkDir(ustr.Ustr("d")); e != 0 {
+		t.Fatalf("MkDir failed %v", e)
+	}
+	if e := tfs.Symlink(ustr.Ustr("d"), ustr.Ustr("l")); e != 0 {
+		t.Fatalf("Symlink failed %v", e)
+	}
+	st, _ := tfs.Stat(ustr.Ustr("/"))
+	if int(st.Size()) < 2*fs.BSIZE {
+		t.Fatalf("directory fits in one block")
+	}
+
+	// a small buffer forces many calls
+	des, e := tfs.Readdir(ustr.MkUstrRoot(), 64)
+	if e != 0 || len(des) != nfile+4 {
+		t.Fatalf("Readdir returned %v entries, err %v", len(des), e)
+	}
+	types := map[string]int{".": defs.DT_DIR, "..": defs.DT_DIR,
+		"d": defs.DT_DIR, "l": defs.DT_LNK}
+	for _, de := range des {
+		want, ok := types[string(de.Name)]
+		if !ok {
+			want = defs.DT_REG
+		}
+		if de.Type != want {
+			t.Fatalf("%v has type %v", de.Name, de.Type)
+		}
+		st, e := tfs.Lstat(ustr.Ustr("/").Extend(de.Name))
+		if e != 0 || st.Rino() != uint(de.Inum) {
+			t.Fatalf("%v has inode %v, err %v", de.Name, de.Inum, e)
+		}
+	}
+
+	f, e := tfs.fs.Fs_open(ustr.Ustr("/"), defs.O_RDONLY, 0, tfs.fs.MkRootCwd(), 0, 0)
+	if e != 0 {
+		t.Fatalf("Fs_open failed %v", e)
+	}
+	if _, e := getdents(t, f, 8); e != -defs.EINVAL {
+		t.Fatalf("tiny buffer returned %v", e)
+	}
+	seen := make(map[string]int)
+	first, e := getdents(t, f, fs.BSIZE/2)
+	if e != 0 || len(first) == 0 {
+		t.Fatalf("getdents failed %v", e)
+	}
+	for _, de := range first {
+		seen[string(de.Name)]++
+	}
+
+	// remove every other file, returned or not, and add new ones
+	removed := make(map[string]bool)
+	for i := 0; i < nfile; i += 2 {
+		fn := longfile(i)
+		if e := tfs.Unlink(ustr.Ustr(fn)); e != 0 {
+			t.Fatalf("Unlink %v failed %v", fn, e)
+		}
+		removed[fn] = true
+	}
+	for i := nfile; i < nfile+20; i++ {
+		if e := tfs.MkFile(ustr.Ustr(longfile(i)), nil); e != 0 {
+			t.Fatalf("MkFile %v failed %v", i, e)
+		}
+	}
+	for {
+		des, e := getdents(t, f, fs.BSIZE/2)
+		if e != 0 {
+			t.Fatalf("getdents failed %v", e)
+		}
+		if len(des) == 0 {
+			break
+		}
+		for _, de := range des {
+			seen[string(de.Name)]++
+		}
+	}
+	f.Fops.Close()
+	for i := 0; i < nfile; i++ {
+		fn := longfile(i)
+		if seen[fn] > 1 {
+			t.Fatalf("%v returned %v times", fn, seen[fn])
+		}
+		if seen[fn] == 0 && !removed[fn] {
+			t.Fatalf("%v skipped", fn)
+		}
+	}
+	ShutdownFS(tfs)
+
+	// the entries record the types, so reading them loads no inodes
+	tfs = BootFS(dst)
+	ni, _ := tfs.Sizes()
+	des, e = tfs.Readdir(ustr.MkUstrRoot(), fs.BSIZE)
+	if e != 0 {
+		t.Fatalf("Readdir failed %v", e)
+	}
+	for _, de := range des {
+		if want, ok := types[string(de.Name)]; ok && de.Type != want {
+			t.Fatalf("%v has type %v after reboot", de.Name, de.Type)
+		} else if !ok && de.Type != defs.DT_REG {
+			t.Fatalf("%v has type %v after reboot", de.Name, de.Type)
+		}
+	}
+	if ni1, _ := tfs.Sizes(); ni1 != ni {
+		t.Fatalf("Readdir loaded %v inodes", ni1-ni)
+	}
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+// checks that exactly the files of d with ids in [0, n) for which present
+// returns true exist.
+func chkDirIndex(t *testing.T, tfs *Ufs_t, d string, n int, present func(int) bool) {
+	for i := 0; i < n; i++ {
+		_, e := tfs.Stat(ustr.Ustr(d + "/" + longfile(i)))
+		if present(i) && e != 0 {
+			t.Fatalf("Stat %v failed %v", i, e)
+		}
+		if !present(i) && e != -defs.ENOENT {
+			t.Fatalf("Stat of removed %v returned %v", i, e)
+		}
+	}
+}
+
+/// TestFSDirIndex checks that a large directory can be looked up, grown and
+/// shrunk through its on-disk index after the dcache has been evicted, and
+/// that the index is freed with the directory.
+func TestFSDirIndex(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, 48, ndatablks)
+
+	fmt.Printf("Test FSDirIndex %v ...\n", dst)
+	tfs := BootFS(dst)
+	d := "d"
+	if e := tfs.MkDir(ustr.Ustr(d)); e != 0 {
+		t.Fatalf("MkDir failed %v", e)
+	}
+	nfile := 600
+	for i := 0; i < nfile; i++ {
+		if e := tfs.MkFile(ustr.Ustr(d+"/"+longfile(i)), nil); e != 0 {
+			t.Fatalf("MkFile %v failed %v", i, e)
+		}
+	}
+	tfs.Evict()
+	chkDirIndex(t, tfs, d, nfile, func(int) bool { return true })
+	if _, e := tfs.Stat(ustr.Ustr(d + "/..")); e != 0 {
+		t.Fatalf("Stat .. failed %v", e)
+	}
+
+	for i := 0; i < nfile; i += 2 {
+		if e := tfs.Unlink(ustr.Ustr(d + "/" + longfile(i))); e != 0 {
+			t.Fatalf("Unlink %v failed %v", i, e)
+		}
+	}
+	st, e := tfs.Stat(ustr.Ustr(d))
+	if e != 0 {
+		t.Fatalf("Stat failed %v", e)
+	}
+	size := st.Size()
+	tfs.Evict()
+	odd := func(i int) bool { return i%2 == 1 }
+	chkDirIndex(t, tfs, d, nfile, odd)
+
+	// the freed records are found again without the dcache
+	for i := 0; i < nfile; i += 4 {
+		o := ustr.Ustr(d + "/" + longfile(i+1))
+		n := ustr.Ustr(d + "/" + longfile(i))
+		if e := tfs.Rename(o, n); e != 0 {
+			t.Fatalf("Rename %v failed %v", i, e)
+		}
+	}
+	renamed := func(i int) bool { return i%4 == 0 || i%4 == 3 }
+	chkDirIndex(t, tfs, d, nfile, renamed)
+	tfs.Evict()
+	for i := 0; i < nfile; i++ {
+		if renamed(i) {
+			continue
+		}
+		if e := tfs.MkFile(ustr.Ustr(d+"/"+longfile(i)), nil); e != 0 {
+			t.Fatalf("MkFile %v failed %v", i, e)
+		}
+	}
+	if st, e = tfs.Stat(ustr.Ustr(d)); e != 0 || st.Size() != size {
+		t.Fatalf("directory grew from %v to %v", size, st.Size())
+	}
+	ShutdownFS(tfs)
+
+	rep := Fsck(dst, false)
+	if len(rep.Errs) != 0 {
+		t.Fatalf("image has errors: %v", rep.Errs[0].String())
+	}
+
+	tfs = BootFS(dst)
+	chkDirIndex(t, tfs, d, nfile, func(int) bool { return true })
+	for i := 0; i < nfile; i++ {
+		if e := tfs.Unlink(ustr.Ustr(d + "/" + longfile(i))); e != 0 {
+			t.Fatalf("Unlink %v failed %v", i, e)
+		}
+	}
+	if e := tfs.UnlinkDir(ustr.Ustr(d)); e != 0 {
+		t.Fatalf("UnlinkDir failed %v", e)
+	}
+	ShutdownFS(tfs)
+
+	// a leaked index block would show up as a leaked block
+	rep = Fsck(dst, false)
+	if len(rep.Errs) != 0 || rep.Ninodes != 1 {
+		t.Fatalf("image has errors: %v", rep.Errs)
+	}
+	os.Remove(dst)
+}
+
+//
+// Test fsync
+//
+
+/// TestFSFsync checks that fsync and fdatasync make a file's data and metadata
+/// durable and fail on a closed file.
+func TestFSFsync(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+	defer os.Remove(dst)
+
+	fmt.Printf("Test FSFsync %v ...\n", dst)
+	tfs := BootFS(dst)
+	d := ustr.Ustr("d")
+	if e := tfs.MkDir(d); e != 0 {
+		t.Fatalf("MkDir failed %v", e)
+	}
+	fn := d.ExtendStr("f")
+	if e := tfs.MkFile(fn, mkData(1, 3*fs.BSIZE)); e != 0 {
+		t.Fatalf("MkFile failed %v", e)
+	}
+	if e := tfs.Fsync(fn, false); e != 0 {
+		t.Fatalf("Fsync failed %v", e)
+	}
+	if e := tfs.Fsync(d, false); e != 0 {
+		t.Fatalf("Fsync dir failed %v", e)
+	}
+	if e := tfs.Append(fn, mkData(2, fs.BSIZE)); e != 0 {
+		t.Fatalf("Append failed %v", e)
+	}
+	if e := tfs.Fsync(fn, true); e != 0 {
+		t.Fatalf("Fdatasync failed %v", e)
+	}
+	// nothing changed since the last fsync
+	if e := tfs.Fsync(fn, true); e != 0 {
+		t.Fatalf("Fdatasync failed %v", e)
+	}
+
+	fd, e := tfs.fs.Fs_open(fn, defs.O_RDONLY, 0, tfs.cwd, 0, 0)
+	if e != 0 {
+		t.Fatalf("open failed %v", e)
+	}
+	fd.Fops.Close()
+	if e := fd.Fops.Fsync(false); e != -defs.EBADF {
+		t.Fatalf("Fsync on closed file returned %v", e)
+	}
+	ShutdownFS(tfs)
+
+	tfs = BootFS(dst)
+	data, e := tfs.Read(fn)
+	if e != 0 || len(data) != 4*fs.BSIZE {
+		t.Fatalf("Read failed %v %v", e, len(data))
+	}
+	for i, v := range data {
+		if (i < 3*fs.BSIZE && v != 1) || (i >= 3*fs.BSIZE && v != 2) {
+			t.Fatalf("bad data at %v: %v", i, v)
+		}
+	}
+	ShutdownFS(tfs)
+}
+
+//
+// Test statfs
+//
+
+/// TestFSStatfs checks the sizes and free counts reported by statfs.
+func TestFSStatfs(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+	defer os.Remove(dst)
+
+	fmt.Printf("Test FSStatfs %v ...\n", dst)
+	tfs := BootFS(dst)
+	st, e := tfs.Statfs(ustr.Ustr("/"))
+	if e != 0 {
+		t.Fatalf("Statfs failed %v", e)
+	}
+	ninode := uint(ninodeblks * (fs.BSIZE / fs.ISIZE))
+	if st.Bsize() != fs.BSIZE || st.Blocks() != ndatablks ||
+		st.Files() != ninode || st.Loglen() != nlogblks ||
+		st.Namelen() != uint(fs.NAME_MAX) {
+		t.Fatalf("bad sizes %v", st)
+	}
+	// the root inode and its directory block
+	if st.Bfree() != ndatablks-1 || st.Bavail() != st.Bfree() ||
+		st.Ffree() != ninode-1 {
+		t.Fatalf("bad free counts %v", st)
+	}
+
+	fn := ustr.Ustr("f")
+	if e := tfs.MkFile(fn, mkData(1, 2*fs.BSIZE)); e != 0 {
+		t.Fatalf("MkFile failed %v", e)
+	}
+	st1, e := tfs.Statfs(fn)
+	if e != 0 {
+		t.Fatalf("Statfs failed %v", e)
+	}
+	if st1.Bfree() != st.Bfree()-2 || st1.Ffree() != st.Ffree()-1 {
+		t.Fatalf("bad free counts after create %v", st1)
+	}
+	if _, e := tfs.Statfs(ustr.Ustr("nonexistent")); e != -defs.ENOENT {
+		t.Fatalf("Statfs of missing file returned %v", e)
+	}
+	ShutdownFS(tfs)
+}
+
+/// TestFSStats checks that the statistics count allocations, frees, commits
+/// and cache misses, and that they can be subtracted and reset.
+func TestFSStats(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+	defer os.Remove(dst)
+
+	fmt.Printf("Test FSStats %v ...\n", dst)
+	ninode := ninodeblks * (fs.BSIZE / fs.ISIZE)
+	nblks := 4
+	tfs := BootFS(dst)
+	s0 := tfs.Stats()
+	if s0.Blocks.Total != ndatablks || s0.Blocks.Free != ndatablks-1 ||
+		s0.Inodes.Total != ninode || s0.Inodes.Free != ninode-1 ||
+		s0.Log.Logblks <= 0 || s0.Bcache.Limit <= 0 || s0.Icache.Nobj < 1 {
+		t.Fatalf("bad stats %+v", s0)
+	}
+
+	f := ustr.Ustr("f")
+	if e := tfs.MkFile(f, mkData(1, nblks*fs.BSIZE)); e != 0 {
+		t.Fatalf("MkFile failed %v", e)
+	}
+	if e := tfs.Sync(); e != 0 {
+		t.Fatalf("Sync failed %v", e)
+	}
+	s1 := tfs.Stats()
+	d := s1.Sub(s0)
+	if d.Blocks.Nalloc != stats.Counter_t(nblks) || d.Inodes.Nalloc != 1 ||
+		d.Blocks.Nfree != 0 || d.Log.Nop < 1 || d.Log.Ncommit < 1 ||
+		d.Log.Nlogwrite < 1 || d.Log.Nlogwrite+d.Log.Norderedwrite < stats.Counter_t(nblks) {
+		t.Fatalf("bad delta after create %+v", d)
+	}
+	// the gauges are not subtracted
+	if d.Blocks.Free != s0.Blocks.Free-nblks || d.Inodes.Free != s0.Inodes.Free-1 ||
+		d.Blocks.Total != ndatablks {
+		t.Fatalf("bad free counts after create %+v", d)
+	}
+
+	if e := tfs.Unlink(f); e != 0 {
+		t.Fatalf("Unlink failed %v", e)
+	}
+	if e := tfs.Sync(); e != 0 {
+		t.Fatalf("Sync failed %v", e)
+	}
+	d = tfs.Stats().Sub(s1)
+	if d.Blocks.Nfree != stats.Counter_t(nblks) || d.Inodes.Nfree != 1 ||
+		d.Log.Ndiscard < stats.Counter_t(nblks) || d.Blocks.Free != s0.Blocks.Free {
+		t.Fatalf("bad delta after unlink %+v", d)
+	}
+	str := tfs.Stats().String()
+	if !strings.Contains(str, "\nLog.Ncommit:\t") ||
+		!strings.Contains(str, fmt.Sprintf("\nBlocks.Free:\t%v\n", s0.Blocks.Free)) {
+		t.Fatalf("bad string %q", str)
+	}
+
+	tfs.ResetStats()
+	s := tfs.Stats()
+	if s.Log.Ncommit != 0 || s.Log.Nop != 0 || s.Blocks.Nalloc != 0 ||
+		s.Inodes.Nfree != 0 || s.Bcache.Nmiss != 0 || s.Blocks.Free != s0.Blocks.Free {
+		t.Fatalf("bad stats after reset %+v", s)
+	}
+
+	g := ustr.Ustr("g")
+	if e := tfs.MkFile(g, mkData(2, nblks*fs.BSIZE)); e != 0 {
+		t.Fatalf("MkFile failed %v", e)
+	}
+	ShutdownFS(tfs)
+
+	// nothing is cached after a reboot, so reading g misses in both caches
+	tfs = BootFS(dst)
+	s = tfs.Stats()
+	if _, e := tfs.Read(g); e != 0 {
+		t.Fatalf("Read failed %v", e)
+	}
+	d = tfs.Stats().Sub(s)
+	if d.Bcache.Nmiss < stats.Counter_t(nblks) || d.Icache.Nmiss < 1 {
+		t.Fatalf("bad delta after read %+v", d)
+	}
+	ShutdownFS(tfs)
+}
+
+//
+// Test fallocate
+//
+
+// checks that f is sz bytes long and that the bytes in [0, n) are v and the
+// rest are zero.
+func checkPunched(tfs *Ufs_t, f ustr.Ustr, sz, n int, v uint8) string {
+	d, e := tfs.Read(f)
+	if e != 0 || len(d) != sz {
+		return fmt.Sprintf("Read failed %v %v", e, len(d))
+	}
+	for i, b := range d {
+		if (i < n && b != v) || (i >= n && b != 0) {
+			return fmt.Sprintf("bad data at %v: %v", i, b)
+		}
+	}
+	return ""
+}
+
+/// TestFSFallocate checks preallocation, FALLOC_FL_KEEP_SIZE, and hole
+/// punching, including the freeing of indirect blocks that punching empties.
+func TestFSFallocate(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, ManyLogBlks, ninodeblks, ManyDataBlks)
+	defer os.Remove(dst)
+
+	fmt.Printf("Test FSFallocate %v ...\n", dst)
+	tfs := BootFS(dst)
+	_, nb := tfs.fs.Fs_size()
+	f := ustr.Ustr("f")
+	if e := tfs.MkFile(f, mkData(1, 2*fs.BSIZE)); e != 0 {
+		t.Fatalf("MkFile failed %v", e)
+	}
+	_, nb0 := tfs.fs.Fs_size()
+
+	// reach into the double-indirect blocks: besides the data blocks,
+	// this allocates the indirect block, the double-indirect block, and
+	// one indirect block under it.
+	nblks := fs.NIADDRS + fs.INDADDR + 10
+	keep := defs.FALLOC_FL_KEEP_SIZE
+	if e := tfs.Fallocate(f, keep, 0, nblks*fs.BSIZE); e != 0 {
+		t.Fatalf("Fallocate failed %v", e)
+	}
+	_, nb1 := tfs.fs.Fs_size()
+	if nb0-nb1 != uint(nblks-2+3) {
+		t.Fatalf("preallocated %v blocks", nb0-nb1)
+	}
+	if s := checkPunched(tfs, f, 2*fs.BSIZE, 2*fs.BSIZE, 1); s != "" {
+		t.Fatalf("after keep size: %s", s)
+	}
+
+	sz := 3*fs.BSIZE + 5
+	if e := tfs.Fallocate(f, 0, fs.BSIZE, sz-fs.BSIZE); e != 0 {
+		t.Fatalf("Fallocate failed %v", e)
+	}
+	if _, nb2 := tfs.fs.Fs_size(); nb2 != nb1 {
+		t.Fatalf("blocks allocated twice: %v %v", nb1, nb2)
+	}
+	if s := checkPunched(tfs, f, sz, 2*fs.BSIZE, 1); s != "" {
+		t.Fatalf("after preallocation: %s", s)
+	}
+
+	punch := defs.FALLOC_FL_KEEP_SIZE | defs.FALLOC_FL_PUNCH_HOLE
+	if e := tfs.Fallocate(f, punch, fs.BSIZE/2, nblks*fs.BSIZE); e != 0 {
+		t.Fatalf("punch failed %v", e)
+	}
+	// only the first block is left
+	if _, nb3 := tfs.fs.Fs_size(); nb3 != nb0+1 {
+		t.Fatalf("punch freed %v blocks", nb3-nb1)
+	}
+	if s := checkPunched(tfs, f, sz, fs.BSIZE/2, 1); s != "" {
+		t.Fatalf("after punch: %s", s)
+	}
+
+	// writes fill holes again
+	fd, e := tfs.fs.Fs_open(f, defs.O_RDWR, 0, tfs.cwd, 0, 0)
+	if e != 0 {
+		t.Fatalf("open failed %v", e)
+	}
+	if _, e := fd.Fops.Pwrite(mkData(2, fs.BSIZE), 2*fs.BSIZE); e != 0 {
+		t.Fatalf("Pwrite failed %v", e)
+	}
+	fd.Fops.Close()
+
+	if e := tfs.Fallocate(f, defs.FALLOC_FL_PUNCH_HOLE, 0, fs.BSIZE); e != -defs.EOPNOTSUPP {
+		t.Fatalf("punch without keep size returned %v", e)
+	}
+	if e := tfs.Fallocate(f, 0, 0, 0); e != -defs.EINVAL {
+		t.Fatalf("empty fallocate returned %v", e)
+	}
+	if e := tfs.MkDir(ustr.Ustr("d")); e != 0 {
+		t.Fatalf("MkDir failed %v", e)
+	}
+	fd, e = tfs.fs.Fs_open(ustr.Ustr("d"), defs.O_RDONLY, 0, tfs.cwd, 0, 0)
+	if e != 0 {
+		t.Fatalf("open failed %v", e)
+	}
+	if e := fd.Fops.Fallocate(0, 0, fs.BSIZE); e != -defs.EISDIR {
+		t.Fatalf("Fallocate of a directory returned %v", e)
+	}
+	fd.Fops.Close()
+	ShutdownFS(tfs)
+
+	rep := Fsck(dst, false)
+	if len(rep.Errs) != 0 {
+		t.Fatalf("image has errors: %v", rep.Errs[0].String())
+	}
+
+	tfs = BootFS(dst)
+	d, e := tfs.Read(f)
+	if e != 0 || len(d) != sz {
+		t.Fatalf("Read failed %v %v", e, len(d))
+	}
+	for i, b := range d {
+		v := uint8(0)
+		if i < fs.BSIZE/2 {
+			v = 1
+		} else if i >= 2*fs.BSIZE && i < 3*fs.BSIZE {
+			v = 2
+		}
+		if b != v {
+			t.Fatalf("bad data at %v: %v", i, b)
+		}
+	}
+	// freeing a file with holes frees all of its blocks
+	if e := tfs.Unlink(f); e != 0 {
+		t.Fatalf("Unlink failed %v", e)
+	}
+	if e := tfs.UnlinkDir(ustr.Ustr("d")); e != 0 {
+		t.Fatalf("UnlinkDir failed %v", e)
+	}
+	ShutdownFS(tfs)
+
+	tfs = BootFS(dst)
+	if _, nb4 := tfs.fs.Fs_size(); nb4 != nb {
+		t.Fatalf("blocks not freed: before %v after %v", nb, nb4)
+	}
+	ShutdownFS(tfs)
+}
+
+//
+// Test mounting a second file system
+//
+
+/// TestVFSMount mounts a second file system and checks that paths, including
+/// ones with "..", cross the mount point and that the mount point is protected.
+func TestVFSMount(t *testing.T) {
+	dst, dst2 := "tmp.img", "tmp2.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+	defer os.Remove(dst)
+	MkDisk(dst2, nil, nlogblks, ninodeblks, 2*ndatablks)
+	defer os.Remove(dst2)
+
+	fmt.Printf("Test VFSMount %v %v ...\n", dst, dst2)
+	tfs := BootFS(dst)
+	tfs2 := BootFS(dst2)
+	vfs.Register("ufstest", func(src ustr.Ustr, flags int, data ustr.Ustr) (vfs.Fs_i, defs.Err_t) {
+		if !src.Eq(ustr.Ustr(dst2)) {
+			return nil, -defs.ENOENT
+		}
+		return tfs2.fs, 0
+	})
+	v := vfs.MkVfs(tfs.fs, "biscuitfs", ustr.Ustr(dst))
+	root := tfs.cwd
+	mnt := ustr.Ustr("/mnt")
+
+	if e := tfs.MkDir(ustr.Ustr("mnt")); e != 0 {
+		t.Fatalf("MkDir failed %v", e)
+	}
+	if e := tfs.MkFile(ustr.Ustr("a"), mkData(1, SMALL)); e != 0 {
+		t.Fatalf("MkFile failed %v", e)
+	}
+	user := &fd.Cwd_t{Fd: root.Fd, Path: root.Path, Cred: fd.Cred_t{Uid: 1, Gid: 1}}
+	if e := v.Mount(ustr.Ustr(dst2), mnt, "ufstest", 0, nil, user); e != -defs.EPERM {
+		t.Fatalf("Mount by user returned %v", e)
+	}
+	if e := v.Mount(ustr.Ustr(dst2), mnt, "nofs", 0, nil, root); e != -defs.ENODEV {
+		t.Fatalf("Mount of unknown type returned %v", e)
+	}
+	if e := v.Mount(ustr.Ustr(dst2), ustr.Ustr("/a"), "ufstest", 0, nil, root); e != -defs.ENOTDIR {
+		t.Fatalf("Mount on file returned %v", e)
+	}
+	if e := v.Mount(ustr.Ustr(dst2), ustr.Ustr("/b"), "ufstest", 0, nil, root); e != -defs.ENOENT {
+		t.Fatalf("Mount on missing dir returned %v", e)
+	}
+	if e := v.Mount(ustr.Ustr(dst2), mnt, "ufstest", 0, nil, root); e != 0 {
+		t.Fatalf("Mount failed %v", e)
+	}
+	if e := v.Mount(ustr.Ustr(dst2), ustr.Ustr("/mnt/"), "ufstest", 0, nil, root); e != -defs.EBUSY {
+		t.Fatalf("second Mount returned %v", e)
+	}
+
+	// the mount point is the root of the mounted file system
+	st := &stat.Stat_t{}
+	if e := v.Fs_stat(mnt, st, root); e != 0 {
+		t.Fatalf("stat %v failed %v", mnt, e)
+	}
+	st2, e := tfs2.Stat(ustr.Ustr("/"))
+	if e != 0 || st.Rino() != st2.Rino() || st.Mode() != st2.Mode() {
+		t.Fatalf("mount point is not the root %v %v", st, st2)
+	}
+	sfs := &stat.Statfs_t{}
+	if e := v.Fs_statfs(ustr.Ustr("/mnt/."), sfs, root); e != 0 || sfs.Blocks() != 2*ndatablks {
+		t.Fatalf("statfs of mount %v %v", e, sfs.Blocks())
+	}
+
+	if e := v.Fs_mkdir(ustr.Ustr("/mnt/d"), 0755, root); e != 0 {
+		t.Fatalf("mkdir failed %v", e)
+	}
+	f, e := v.Fs_open(ustr.Ustr("/mnt/d/f"), defs.O_CREAT|defs.O_RDWR, 0644, root, 0, 0)
+	if e != 0 {
+		t.Fatalf("open failed %v", e)
+	}
+	if _, e := tfs2.Stat(ustr.Ustr("/d/f")); e != 0 {
+		t.Fatalf("file not in mounted fs %v", e)
+	}
+	if _, e := tfs.Stat(ustr.Ustr("/mnt/d")); e != -defs.ENOENT {
+		t.Fatalf("file in covered dir %v", e)
+	}
+	v.Fs_fstatfs(f, sfs)
+	if sfs.Blocks() != 2*ndatablks {
+		t.Fatalf("fstatfs of mounted file %v", sfs.Blocks())
+	}
+
+	// relative paths from a cwd in the mount and ".." back out of it
+	dfd, e := v.Fs_open(ustr.Ustr("/mnt/d"), defs.O_RDONLY|defs.O_DIRECTORY, 0, root, 0, 0)
+	if e != 0 {
+		t.Fatalf("open dir failed %v", e)
+	}
+	cwd := &fd.Cwd_t{Fd: dfd, Path: ustr.Ustr("/mnt/d")}
+	if e := v.Fs_stat(ustr.Ustr("f"), st, cwd); e != 0 {
+		t.Fatalf("relative stat failed %v", e)
+	}
+	if e := v.Fs_stat(ustr.Ustr("../../a"), st, cwd); e != 0 || st.Size() != SMALL {
+		t.Fatalf("stat across mount failed %v", e)
+	}
+	if e := v.Fs_stat(ustr.Ustr("/mnt/d/../../mnt/d/f"), st, root); e != 0 {
+		t.Fatalf("stat back into mount failed %v", e)
+	}
+	if e := v.Fs_stat(ustr.Ustr("../f"), st, cwd); e != -defs.ENOENT {
+		t.Fatalf("stat of missing file returned %v", e)
+	}
+
+	// symbolic links are resolved through the mount table
+	if e := v.Fs_symlink(ustr.Ustr("/mnt/d"), ustr.Ustr("/lnk"), root); e != 0 {
+		t.Fatalf("symlink failed %v", e)
+	}
+	if e := v.Fs_symlink(ustr.Ustr("mnt/d/f"), ustr.Ustr("/rlnk"), root); e != 0 {
+		t.Fatalf("symlink failed %v", e)
+	}
+	if e := v.Fs_stat(ustr.Ustr("/lnk/f"), st, root); e != 0 {
+		t.Fatalf("stat through link into mount failed %v", e)
+	}
+	if e := v.Fs_stat(ustr.Ustr("rlnk"), st, root); e != 0 {
+		t.Fatalf("stat through relative link into mount failed %v", e)
+	}
+	if e := v.Fs_lstat(ustr.Ustr("/lnk"), st, root); e != 0 || st.Mode()>>16 != fs.I_SYMLINK {
+		t.Fatalf("lstat of link %v %v", e, st.Mode())
+	}
+	// ".." after a link names the parent of its target
+	if e := v.Fs_stat(ustr.Ustr("/lnk/../d/f"), st, root); e != 0 {
+		t.Fatalf("stat of .. after link failed %v", e)
+	}
+	for p, want := range map[string]string{"lnk/": "/mnt/d",
+		"/mnt/d/..": "/mnt", "/lnk/../..": "/"} {
+		df, rp, e := v.Fs_opendir(ustr.Ustr(p), root)
+		if e != 0 || rp.String() != want {
+			t.Fatalf("Fs_opendir %v returned %v %v", p, rp, e)
+		}
+		fd.Close_panic(df)
+	}
+	// a link to an absolute path leaves the mount for the root
+	if e := v.Fs_symlink(ustr.Ustr("/a"), ustr.Ustr("/mnt/up"), root); e != 0 {
+		t.Fatalf("symlink failed %v", e)
+	}
+	if e := v.Fs_stat(ustr.Ustr("../up"), st, cwd); e != 0 || st.Size() != SMALL {
+		t.Fatalf("stat through link out of mount %v %v", e, st.Size())
+	}
+	if e := v.Fs_symlink(ustr.Ustr("/mnt/new"), ustr.Ustr("/dangle"), root); e != 0 {
+		t.Fatalf("symlink failed %v", e)
+	}
+	nf, e := v.Fs_open(ustr.Ustr("/dangle"), defs.O_CREAT|defs.O_RDWR, 0644, root, 0, 0)
+	if e != 0 {
+		t.Fatalf("create through link failed %v", e)
+	}
+	fd.Close_panic(nf)
+	if _, e := tfs2.Stat(ustr.Ustr("/new")); e != 0 {
+		t.Fatalf("link target not created in mount %v", e)
+	}
+	if _, e := v.Fs_open(ustr.Ustr("/dangle"), defs.O_CREAT|defs.O_EXCL|defs.O_RDWR, 0644, root, 0, 0); e != -defs.EEXIST {
+		t.Fatalf("exclusive create through link returned %v", e)
+	}
+	if e := v.Fs_symlink(ustr.Ustr("/loop"), ustr.Ustr("/loop"), root); e != 0 {
+		t.Fatalf("symlink failed %v", e)
+	}
+	if e := v.Fs_stat(ustr.Ustr("/loop"), st, root); e != -defs.ELOOP {
+		t.Fatalf("stat of link loop returned %v", e)
+	}
+	for _, l := range []string{"/lnk", "/rlnk", "/dangle", "/loop", "/mnt/new", "/mnt/up"} {
+		if e := v.Fs_unlink(ustr.Ustr(l), root, false); e != 0 {
+			t.Fatalf("unlink %v failed %v", l, e)
+		}
+	}
+
+	if e := v.Fs_rename(ustr.Ustr("f"), ustr.Ustr("/b"), cwd); e != -defs.EXDEV {
+		t.Fatalf("rename across mounts returned %v", e)
+	}
+	if e := v.Fs_link(ustr.Ustr("/a"), ustr.Ustr("g"), cwd); e != -defs.EXDEV {
+		t.Fatalf("link across mounts returned %v", e)
+	}
+	if e := v.Fs_rename(ustr.Ustr("f"), ustr.Ustr("../g"), cwd); e != 0 {
+		t.Fatalf("rename in mount failed %v", e)
+	}
+	if e := v.Fs_unlink(mnt, root, true); e != -defs.EBUSY {
+		t.Fatalf("rmdir of mount point returned %v", e)
+	}
+	if e := v.Fs_rename(mnt, ustr.Ustr("/m"), root); e != -defs.EBUSY {
+		t.Fatalf("rename of mount point returned %v", e)
+	}
+	if !strings.Contains(v.Stats(), "mount /mnt ufstest open 2") {
+		t.Fatalf("bad stats %v", v.Stats())
+	}
+
+	if e := v.Umount(ustr.Ustr("/"), 0, root); e != -defs.EINVAL {
+		t.Fatalf("umount of root returned %v", e)
+	}
+	if e := v.Umount(ustr.Ustr("/mnt/d"), 0, root); e != -defs.EINVAL {
+		t.Fatalf("umount of non-mount returned %v", e)
+	}
+	if e := v.Umount(mnt, 0, root); e != -defs.EBUSY {
+		t.Fatalf("umount while open returned %v", e)
+	}
+	fd.Close_panic(f)
+	fd.Close_panic(dfd)
+	if e := v.Umount(mnt, 0, user); e != -defs.EPERM {
+		t.Fatalf("umount by user returned %v", e)
+	}
+	if e := v.Umount(mnt, 0, root); e != 0 {
+		t.Fatalf("umount failed %v", e)
+	}
+	if e := v.Fs_stat(ustr.Ustr("/mnt/g"), st, root); e != -defs.ENOENT {
+		t.Fatalf("file visible after umount %v", e)
+	}
+	if e := v.Fs_unlink(mnt, root, true); e != 0 {
+		t.Fatalf("rmdir after umount failed %v", e)
+	}
+	tfs2.ahci.close()
+	ShutdownFS(tfs)
+
+	tfs2 = BootFS(dst2)
+	if _, e := tfs2.Stat(ustr.Ustr("/g")); e != 0 {
+		t.Fatalf("mounted fs lost file %v", e)
+	}
+	ShutdownFS(tfs2)
+}
+
+//
+// Test tmpfs
+//
+
+// returns the names in directory p of the file system fsys.
+func tmpNames(t *testing.T, fsys vfs.Fs_i, p string, cwd *fd.Cwd_t) []string {
+	f, e := fsys.Fs_open(ustr.Ustr(p), defs.O_RDONLY|defs.O_DIRECTORY, 0, cwd, 0, 0)
+	if e != 0 {
+		t.Fatalf("open dir %v failed %v", p, e)
+	}
+	defer fd.Close_panic(f)
+	var names []string
+	buf := make([]uint8, 64)
+	for {
+		ub := &vm.Fakeubuf_t{}
+		ub.Fake_init(buf)
+		n, e := f.Fops.Getdents(ub)
+		if e != 0 {
+			t.Fatalf("getdents %v failed %v", p, e)
+		}
+		if n == 0 {
+			return names
+		}
+		for off := 0; off < n; {
+			de, l, ok := fs.Dirent64(buf[off:n])
+			if !ok {
+				t.Fatalf("bad dirent")
+			}
+			names = append(names, string(de.Name))
+			off += l
+		}
+	}
+}
+
+/// TestTmpfs checks that a tmpfs keeps file data in pages of its own, honors
+/// its size and inode limits, hands its pages to mappings and can be mounted.
+func TestTmpfs(t *testing.T) {
+	fmt.Printf("Test Tmpfs ...\n")
+	pm := mkPagemem()
+	if _, e := tmpfs.MkTmpfs(pm, ustr.Ustr("size=1m,bogus"), 1); e != -defs.EINVAL {
+		t.Fatalf("bad option returned %v", e)
+	}
+	tfs, e := tmpfs.MkTmpfs(pm, ustr.Ustr("size=64k,nr_inodes=8,mode=755"), 1)
+	if e != 0 {
+		t.Fatalf("MkTmpfs failed %v", e)
+	}
+	root := tfs.MkRootCwd()
+	st := &stat.Stat_t{}
+	if e := tfs.Fs_stat(ustr.Ustr("/"), st, root); e != 0 || st.Mode() != 2<<16|0755 {
+		t.Fatalf("root mode %o %v", st.Mode(), e)
+	}
+
+	// writes beyond the end leave a hole that reads as zeros
+	f, e := tfs.Fs_open(ustr.Ustr("/f"), defs.O_CREAT|defs.O_RDWR, 0644, root, 0, 0)
+	if e != 0 {
+		t.Fatalf("open failed %v", e)
+	}
+	off := 2*mem.PGSIZE + 10
+	if n, e := f.Fops.Pwrite(mkData(7, 100), off); e != 0 || n != 100 {
+		t.Fatalf("pwrite %v %v", n, e)
+	}
+	if tfs.Pages() != 1 {
+		t.Fatalf("hole has pages %v", tfs.Pages())
+	}
+	buf := make([]uint8, off+200)
+	ub := &vm.Fakeubuf_t{}
+	ub.Fake_init(buf)
+	if n, e := f.Fops.Read(ub); e != 0 || n != off+100 {
+		t.Fatalf("read %v %v", n, e)
+	}
+	for i := 0; i < off+100; i++ {
+		if (i < off && buf[i] != 0) || (i >= off && buf[i] != 7) {
+			t.Fatalf("bad byte %v: %v", i, buf[i])
+		}
+	}
+
+	// mappings fill holes and take a reference on each page
+	mmi, e := f.Fops.Mmapi(0, -1, true)
+	if e != 0 || len(mmi) != 3 || tfs.Pages() != 3 {
+		t.Fatalf("mmapi %v %v %v", len(mmi), e, tfs.Pages())
+	}
+	for _, m := range mmi {
+		if pm.Refcnt(m.Phys) != 2 {
+			t.Fatalf("mapped page ref count %v", pm.Refcnt(m.Phys))
+		}
+	}
+	mem.Pg2bytes(mmi[0].Pg)[5] = 9
+	ub.Fake_init(buf[:10])
+	if n, e := f.Fops.Pread(ub, 0); e != 0 || n != 10 || buf[5] != 9 {
+		t.Fatalf("write through mapping not visible %v %v %v", n, e, buf[5])
+	}
+	if _, e := f.Fops.Mmapi(off+100, -1, true); e != -defs.EINVAL {
+		t.Fatalf("mmapi beyond end returned %v", e)
+	}
+
+	// directories
+	if e := tfs.Fs_mkdir(ustr.Ustr("/d"), 0755, root); e != 0 {
+		t.Fatalf("mkdir failed %v", e)
+	}
+	if e := tfs.Fs_mkdir(ustr.Ustr("/d"), 0755, root); e != -defs.EEXIST {
+		t.Fatalf("second mkdir returned %v", e)
+	}
+	for _, n := range []string{"/d/a", "/d/b"} {
+		nf, e := tfs.Fs_open(ustr.Ustr(n), defs.O_CREAT|defs.O_EXCL|defs.O_WRONLY, 0644, root, 0, 0)
+		if e != 0 {
+			t.Fatalf("create %v failed %v", n, e)
+		}
+		fd.Close_panic(nf)
+	}
+	if e := tfs.Fs_rename(ustr.Ustr("/d/a"), ustr.Ustr("/d/c"), root); e != 0 {
+		t.Fatalf("rename failed %v", e)
+	}
+	if e := tfs.Fs_rename(ustr.Ustr("/d"), ustr.Ustr("/d/e"), root); e != -defs.EINVAL {
+		t.Fatalf("rename into self returned %v", e)
+	}
+	if e := tfs.Fs_unlink(ustr.Ustr("/d"), root, true); e != -defs.ENOTEMPTY {
+		t.Fatalf("rmdir of non-empty dir returned %v", e)
+	}
+	if e := tfs.Fs_symlink(ustr.Ustr("d/c"), ustr.Ustr("/l"), root); e != 0 {
+		t.Fatalf("symlink failed %v", e)
+	}
+	if e := tfs.Fs_stat(ustr.Ustr("/l"), st, root); e != 0 || st.Mode()>>16 != fs.I_FILE {
+		t.Fatalf("stat through link %v %v", e, st.Mode())
+	}
+	names := tmpNames(t, tfs, "/d", root)
+	if strings.Join(names, " ") != ". .. b c" {
+		t.Fatalf("bad dir %v", names)
+	}
+
+	// the size limit
+	if e := tfs.Fs_link(ustr.Ustr("/f"), ustr.Ustr("/d/f"), root); e != 0 {
+		t.Fatalf("link failed %v", e)
+	}
+	big, e := tfs.Fs_open(ustr.Ustr("/big"), defs.O_CREAT|defs.O_RDWR, 0644, root, 0, 0)
+	if e != 0 {
+		t.Fatalf("open failed %v", e)
+	}
+	if n, e := big.Fops.Write(mkData(1, 16*mem.PGSIZE)); e != -defs.ENOSPC || n != 13*mem.PGSIZE {
+		t.Fatalf("write beyond size %v %v", n, e)
+	}
+	sfs := &stat.Statfs_t{}
+	if e := tfs.Fs_statfs(ustr.Ustr("/"), sfs, root); e != 0 || sfs.Blocks() != 16 ||
+		sfs.Bfree() != 0 || sfs.Files() != 8 || sfs.Ffree() != 1 {
+		t.Fatalf("statfs %v %v", e, sfs)
+	}
+	if e := big.Fops.Truncate(0); e != 0 || tfs.Pages() != 3 {
+		t.Fatalf("truncate %v %v", e, tfs.Pages())
+	}
+	// a write stops at the largest file size, 1<<40
+	if n, e := big.Fops.Pwrite(mkData(2, 2), 1<<40-1); e != 0 || n != 1 {
+		t.Fatalf("write up to the largest file %v %v", n, e)
+	}
+	if n, e := big.Fops.Pwrite(mkData(2, 1), 1<<40); e != -defs.EFBIG || n != 0 {
+		t.Fatalf("write past the largest file %v %v", n, e)
+	}
+	if e := big.Fops.Fstat(st); e != 0 || st.Size() != 1<<40 {
+		t.Fatalf("size of the largest file %v %v", e, st.Size())
+	}
+	if e := big.Fops.Truncate(0); e != 0 || tfs.Pages() != 3 {
+		t.Fatalf("truncate %v %v", e, tfs.Pages())
+	}
+	fd.Close_panic(big)
+	for i := 0; ; i++ {
+		nf, e := tfs.Fs_open(ustr.Ustr("/n"+strconv.Itoa(i)), defs.O_CREAT, 0644, root, 0, 0)
+		if e == -defs.ENOSPC && i == 1 {
+			break
+		} else if e != 0 {
+			t.Fatalf("create %v returned %v", i, e)
+		}
+		fd.Close_panic(nf)
+	}
+
+	// an unlinked file keeps its pages until it is closed and they stay
+	// mapped until they are unmapped
+	for _, n := range []string{"/f", "/d/f"} {
+		if e := tfs.Fs_unlink(ustr.Ustr(n), root, false); e != 0 {
+			t.Fatalf("unlink %v failed %v", n, e)
+		}
+	}
+	if tfs.Pages() != 3 {
+		t.Fatalf("unlinked open file lost pages %v", tfs.Pages())
+	}
+	fd.Close_panic(f)
+	if tfs.Pages() != 0 || pm.Inuse() != 3 {
+		t.Fatalf("closed file kept pages %v %v", tfs.Pages(), pm.Inuse())
+	}
+	for _, m := range mmi {
+		pm.Refdown(m.Phys)
+	}
+	if pm.Inuse() != 0 {
+		t.Fatalf("unmapped pages not freed %v", pm.Inuse())
+	}
+
+	// mounted through the mount table
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+	defer os.Remove(dst)
+	ufs := BootFS(dst)
+	if e := ufs.MkDir(ustr.Ustr("/tmp")); e != 0 {
+		t.Fatalf("MkDir failed %v", e)
+	}
+	vfs.Register("tmpfstest", func(src ustr.Ustr, flags int, data ustr.Ustr) (vfs.Fs_i, defs.Err_t) {
+		tfs, err := tmpfs.MkTmpfs(pm, data, 1)
+		if err != 0 {
+			return nil, err
+		}
+		return tfs, 0
+	})
+	v := vfs.MkVfs(ufs.fs, "biscuitfs", ustr.Ustr(dst))
+	if e := v.Mount(nil, ustr.Ustr("/tmp"), "tmpfstest", 0, ustr.Ustr("size=-1"), ufs.cwd); e != -defs.EINVAL {
+		t.Fatalf("mount with bad size returned %v", e)
+	}
+	if e := v.Mount(nil, ustr.Ustr("/tmp"), "tmpfstest", 0, ustr.Ustr("size=1m"), ufs.cwd); e != 0 {
+		t.Fatalf("mount failed %v", e)
+	}
+	if e := v.Fs_statfs(ustr.Ustr("/tmp"), sfs, ufs.cwd); e != 0 || sfs.Blocks() != 256 || sfs.Loglen() != 0 {
+		t.Fatalf("statfs of tmpfs %v %v", e, sfs)
+	}
+	mf, e := v.Fs_open(ustr.Ustr("/tmp/x"), defs.O_CREAT|defs.O_WRONLY, 0644, ufs.cwd, 0, 0)
+	if e != 0 {
+		t.Fatalf("open in tmpfs failed %v", e)
+	}
+	if _, e := mf.Fops.Write(mkData(3, SMALL)); e != 0 || pm.Inuse() != 1 {
+		t.Fatalf("write in tmpfs %v %v", e, pm.Inuse())
+	}
+	if _, e := ufs.Stat(ustr.Ustr("/tmp/x")); e != -defs.ENOENT {
+		t.Fatalf("tmpfs file on disk %v", e)
+	}
+	// ".." in the root of the tmpfs leaves it
+	if e := v.Fs_mkdir(ustr.Ustr("/tmp/../tmp/d"), 0755, ufs.cwd); e != 0 {
+		t.Fatalf("mkdir across mount failed %v", e)
+	}
+	if e := v.Fs_rename(ustr.Ustr("/tmp/x"), ustr.Ustr("/tmp/d/../../x"), ufs.cwd); e != -defs.EXDEV {
+		t.Fatalf("rename out of tmpfs returned %v", e)
+	}
+	if e := v.Fs_unlink(ustr.Ustr("/tmp/d/../../tmp/d"), ufs.cwd, true); e != 0 {
+		t.Fatalf("rmdir across mount failed %v", e)
+	}
+	fd.Close_panic(mf)
+	if e := v.Umount(ustr.Ustr("/tmp"), 0, ufs.cwd); e != 0 {
+		t.Fatalf("umount failed %v", e)
+	}
+	if pm.Inuse() != 0 {
+		t.Fatalf("umount kept pages %v", pm.Inuse())
+	}
+	ShutdownFS(ufs)
+}
+
+//
+// Test procfs
+//
+
+// returns the contents of the file p in the file system fsys.
+func readAll(t *testing.T, fsys vfs.Fs_i, p string, cwd *fd.Cwd_t) string {
+	f, e := fsys.Fs_open(ustr.Ustr(p), defs.O_RDONLY, 0, cwd, 0, 0)
+	if e != 0 {
+		t.Fatalf("open %v failed %v", p, e)
+	}
+	defer fd.Close_panic(f)
+	s := ""
+	buf := make([]uint8, 7)
+	for {
+		ub := &vm.Fakeubuf_t{}
+		ub.Fake_init(buf)
+		n, e := f.Fops.Read(ub)
+		if e != 0 {
+			t.Fatalf("read %v failed %v", p, e)
+		}
+		if n == 0 {
+			return s
+		}
+		s += string(buf[:n])
+	}
+}
+
+/// TestProcfs checks the global files of a procfs and the files that
+/// describe a process, and that a procfs cannot be modified.
+func TestProcfs(t *testing.T) {
+	fmt.Printf("Test Procfs ...\n")
+	si := &procfs.Sysinfo_t{Pages: func() (int, int) { return 1024, 256 },
+		Ncpu: 2, Vendor: "GenuineIntel", Family: 6, Model: 85,
+		Boot: time.Now().Add(-90 * time.Second),
+		Fsstats: func() fs.Fsstats_t {
+			return fs.Fsstats_t{Log: fs.Logstats_t{Ncommit: 3}}
+		}}
+	pfs := procfs.MkProcfs(si)
+	root := pfs.MkRootCwd()
+
+	if s := readAll(t, pfs, "/meminfo", root); !strings.HasPrefix(s,
+		"MemTotal:\t4096 kB\nMemFree:\t1024 kB\nKernelHeap:\t") {
+		t.Fatalf("bad meminfo %q", s)
+	}
+	if s := readAll(t, pfs, "/cpuinfo", root); strings.Count(s, "processor") != 2 ||
+		!strings.Contains(s, "vendor_id\t: GenuineIntel\ncpu family\t: 6\nmodel\t\t: 85\n") {
+		t.Fatalf("bad cpuinfo %q", s)
+	}
+	if s := readAll(t, pfs, "/uptime", root); !strings.HasPrefix(s, "90.") {
+		t.Fatalf("bad uptime %q", s)
+	}
+	if s := readAll(t, pfs, "/fsstats", root); !strings.Contains(s,
+		"\nLog.Ncommit:\t3\nLog.Nblkcommitted:\t0\n") {
+		t.Fatalf("bad fsstats %q", s)
+	}
+
+	// a process with a file open and three mappings
+	pm := mkPagemem()
+	tfs, e := tmpfs.MkTmpfs(pm, nil, 16)
+	if e != 0 {
+		t.Fatalf("MkTmpfs failed %v", e)
+	}
+	f, e := tfs.Fs_open(ustr.Ustr("/f"), defs.O_CREAT|defs.O_RDWR, 0644, tfs.MkRootCwd(), 0, 0)
+	if e != 0 {
+		t.Fatalf("open failed %v", e)
+	}
+	f.Perms = fd.FD_READ | fd.FD_WRITE
+	rf, e := tfs.Fs_open(ustr.Ustr("/"), defs.O_RDONLY|defs.O_DIRECTORY, 0, tfs.MkRootCwd(), 0, 0)
+	if e != 0 {
+		t.Fatalf("open root failed %v", e)
+	}
+	p, ok := proc.Proc_new(ustr.Ustr("prog"), fd.MkRootCwd(rf), []*fd.Fd_t{nil, f}, nil)
+	if !ok {
+		t.Fatalf("Proc_new failed")
+	}
+	fd.Close_panic(f)
+	pid := strconv.Itoa(p.Pid)
+	p.Args = []ustr.Ustr{ustr.Ustr("prog"), ustr.Ustr("-x")}
+	anon := mem.USERMIN
+	file := anon + 4*mem.PGSIZE
+	shanon := file + 4*mem.PGSIZE
+	p.Vm.Vmadd_anon(anon, 2*mem.PGSIZE, vm.PTE_U|vm.PTE_W)
+	p.Vm.Vmadd_file(file, mem.PGSIZE, vm.PTE_U, p.Fds[1].Fops, mem.PGSIZE)
+	p.Vm.Vmadd_shareanon(shanon, mem.PGSIZE, vm.PTE_U|vm.PTE_W)
+
+	names := tmpNames(t, pfs, "/", root)
+	if strings.Join(names[:5], " ") != ". .. cpuinfo meminfo uptime" ||
+		!strings.Contains(strings.Join(names, " "), " "+pid) {
+		t.Fatalf("bad root %v", names)
+	}
+	names = tmpNames(t, pfs, "/"+pid, root)
+	if strings.Join(names, " ") != ". .. cmdline fd limits maps status" {
+		t.Fatalf("bad process dir %v", names)
+	}
+	if s := readAll(t, pfs, "/"+pid+"/cmdline", root); s != "prog\x00-x\x00" {
+		t.Fatalf("bad cmdline %q", s)
+	}
+	s := readAll(t, pfs, "/"+pid+"/status", root)
+	for _, l := range []string{"Name:\tprog\n", "Pid:\t" + pid + "\n",
+		"State:\trunning\n", "Threads:\t1\n", "Fds:\t1\n", "VmPages:\t4\n",
+		"VmAreas:\t3\n"} {
+		if !strings.Contains(s, l) {
+			t.Fatalf("status lacks %q: %q", l, s)
+		}
+	}
+	want := fmt.Sprintf("%012x-%012x rw-p %08x anon\n", anon, anon+2*mem.PGSIZE, 0) +
+		fmt.Sprintf("%012x-%012x r--p %08x file\n", file, file+mem.PGSIZE, mem.PGSIZE) +
+		fmt.Sprintf("%012x-%012x rw-s %08x shanon\n", shanon, shanon+mem.PGSIZE, 0)
+	if s := readAll(t, pfs, "/"+pid+"/maps", root); s != want {
+		t.Fatalf("bad maps %q, want %q", s, want)
+	}
+	st := &stat.Stat_t{}
+	tfs.Fs_stat(ustr.Ustr("/f"), st, tfs.MkRootCwd())
+	want = fmt.Sprintf("1 rw- %#x %v 0\n", st.Mode(), st.Rino())
+	if s := readAll(t, pfs, "/"+pid+"/fd", root); s != want {
+		t.Fatalf("bad fd %q, want %q", s, want)
+	}
+	if s := readAll(t, pfs, "/"+pid+"/limits", root); !strings.Contains(s,
+		"nofile\tunlimited\n") || !strings.Contains(s, "noproc\t1024\n") {
+		t.Fatalf("bad limits %q", s)
+	}
+
+	// paths relative to a process directory
+	d, e := pfs.Fs_open(ustr.Ustr("/"+pid), defs.O_RDONLY|defs.O_DIRECTORY, 0, root, 0, 0)
+	if e != 0 {
+		t.Fatalf("open dir failed %v", e)
+	}
+	pcwd := fd.MkRootCwd(d)
+	if s := readAll(t, pfs, "cmdline", pcwd); s != "prog\x00-x\x00" {
+		t.Fatalf("bad relative cmdline %q", s)
+	}
+	if e := pfs.Fs_stat(ustr.Ustr("../meminfo"), st, pcwd); e != 0 || st.Mode() != 1<<16|0444 {
+		t.Fatalf("stat meminfo %v %o", e, st.Mode())
+	}
+
+	// nothing can be changed
+	if _, e := pfs.Fs_open(ustr.Ustr("/meminfo"), defs.O_WRONLY, 0, root, 0, 0); e != -defs.EROFS {
+		t.Fatalf("open for writing returned %v", e)
+	}
+	if _, e := pfs.Fs_open(ustr.Ustr("/new"), defs.O_CREAT|defs.O_WRONLY, 0644, root, 0, 0); e != -defs.EROFS {
+		t.Fatalf("create returned %v", e)
+	}
+	if e := pfs.Fs_mkdir(ustr.Ustr("/d"), 0755, root); e != -defs.EROFS {
+		t.Fatalf("mkdir returned %v", e)
+	}
+	if e := pfs.Fs_unlink(ustr.Ustr("/uptime"), root, false); e != -defs.EROFS {
+		t.Fatalf("unlink returned %v", e)
+	}
+	if e := pfs.Fs_access(ustr.Ustr("/uptime"), root, fs.A_WRITE); e != -defs.EROFS {
+		t.Fatalf("access for writing returned %v", e)
+	}
+	if _, e := pfs.Fs_open(ustr.Ustr("/uptime/x"), defs.O_RDONLY, 0, root, 0, 0); e != -defs.ENOTDIR {
+		t.Fatalf("open below a file returned %v", e)
+	}
+	for _, bad := range []string{"/0", "/01", "/999999999", "/" + pid + "/x"} {
+		if e := pfs.Fs_stat(ustr.Ustr(bad), st, root); e != -defs.ENOENT {
+			t.Fatalf("stat %v returned %v", bad, e)
+		}
+	}
+
+	// an open file keeps its contents after the process exits, but the
+	// process's directory disappears
+	sf, e := pfs.Fs_open(ustr.Ustr("/"+pid+"/status"), defs.O_RDONLY, 0, root, 0, 0)
+	if e != 0 {
+		t.Fatalf("open status failed %v", e)
+	}
+	proc.Proc_del(p.Pid)
+	buf := make([]uint8, 5)
+	ub := &vm.Fakeubuf_t{}
+	ub.Fake_init(buf)
+	if n, e := sf.Fops.Read(ub); e != 0 || string(buf[:n]) != "Name:" {
+		t.Fatalf("read of exited process's status %v %q", e, buf[:n])
+	}
+	fd.Close_panic(sf)
+	if _, e := pfs.Fs_open(ustr.Ustr("/"+pid+"/status"), defs.O_RDONLY, 0, root, 0, 0); e != -defs.ENOENT {
+		t.Fatalf("open status of exited process returned %v", e)
+	}
+	if _, e := pfs.Fs_open(ustr.Ustr("status"), defs.O_RDONLY, 0, pcwd, 0, 0); e != -defs.ENOENT {
+		t.Fatalf("open in dir of exited process returned %v", e)
+	}
+	fd.Close_panic(d)
+	names = tmpNames(t, pfs, "/", root)
+	if strings.Contains(strings.Join(names, " "), " "+pid) {
+		t.Fatalf("exited process listed %v", names)
+	}
+}
+
+//
+// Test devfs
+//
+
+/// TestDevfs checks that a devfs shows the registered devices, that their
+/// drivers open them, and that its files cannot be changed.
+func TestDevfs(t *testing.T) {
+	fmt.Printf("Test Devfs ...\n")
+	dfs := devfs.MkDevfs()
+	root := dfs.MkRootCwd()
+
+	// a device appears once its driver adds it. the test device opens a
+	// tmpfs file.
+	tfs, e := tmpfs.MkTmpfs(mkPagemem(), nil, 16)
+	if e != 0 {
+		t.Fatalf("MkTmpfs failed %v", e)
+	}
+	troot := tfs.MkRootCwd()
+	f, e := tfs.Fs_open(ustr.Ustr("/f"), defs.O_CREAT|defs.O_RDWR, 0644, troot, 0, 0)
+	if e != 0 {
+		t.Fatalf("open failed %v", e)
+	}
+	ub := &vm.Fakeubuf_t{}
+	ub.Fake_init([]uint8("device"))
+	if _, e := f.Fops.Write(ub); e != 0 {
+		t.Fatalf("write failed %v", e)
+	}
+	fd.Close_panic(f)
+	tmaj, ok := dev.Major("testdev")
+	if !ok {
+		tmaj = dev.Register("testdev", func(maj, min int) (fdops.Fdops_i, defs.Err_t) {
+			f, e := tfs.Fs_open(ustr.Ustr("/f"), defs.O_RDONLY, 0, troot, 0, 0)
+			if e != 0 {
+				return nil, e
+			}
+			return f.Fops, 0
+		})
+		if _, e := dev.Add("test0", tmaj); e != 0 {
+			t.Fatalf("Add failed %v", e)
+		}
+	}
+	if _, e := dev.Add("test0", tmaj); e != -defs.EEXIST {
+		t.Fatalf("second Add returned %v", e)
+	}
+	if _, e := dev.Add("test1", 1000); e != -defs.ENODEV {
+		t.Fatalf("Add to unknown major returned %v", e)
+	}
+	// the kernel's drivers have fixed majors and the others get majors
+	// above them
+	if tmaj <= dev.D_LAST {
+		t.Fatalf("test driver has fixed major %v", tmaj)
+	}
+	for n, maj := range map[string]int{"console": dev.D_CONSOLE, "null": dev.D_DEVNULL,
+		"zero": dev.D_ZERO, "stat": dev.D_STAT, "prof": dev.D_PROF} {
+		if m, ok := dev.Major(n); !ok || m != maj {
+			t.Fatalf("major of %v is %v", n, m)
+		}
+	}
+	if _, e := dev.Add("test1", dev.D_RAWDISK); e != -defs.ENODEV {
+		t.Fatalf("Add to unregistered fixed major returned %v", e)
+	}
+	names := tmpNames(t, dfs, "/", root)
+	if strings.Join(names, " ") != ". .. console null prof stats test0 zero" {
+		t.Fatalf("bad root %v", names)
+	}
+	if s := readAll(t, dfs, "/test0", root); s != "device" {
+		t.Fatalf("bad test device %q", s)
+	}
+
+	st := &stat.Stat_t{}
+	nmaj, _ := dev.Major("null")
+	if e := dfs.Fs_stat(ustr.Ustr("null"), st, root); e != 0 ||
+		st.Mode() != defs.Mkdev(nmaj, 0)|0666 || st.Rdev() != defs.Mkdev(nmaj, 0) {
+		t.Fatalf("stat null %v %x", e, st.Mode())
+	}
+	if e := dfs.Fs_stat(ustr.Ustr("/"), st, root); e != 0 || st.Mode() != 2<<16|0755 {
+		t.Fatalf("stat root %v %o", e, st.Mode())
+	}
+
+	// the null device discards writes and reads nothing; the zero device
+	// reads zeros
+	nf, e := dfs.Fs_open(ustr.Ustr("/null"), defs.O_RDWR, 0, root, 0, 0)
+	if e != 0 {
+		t.Fatalf("open null failed %v", e)
+	}
+	ub = &vm.Fakeubuf_t{}
+	ub.Fake_init(make([]uint8, 100))
+	if n, e := nf.Fops.Write(ub); e != 0 || n != 100 {
+		t.Fatalf("write null %v %v", n, e)
+	}
+	if s := readAll(t, dfs, "/null", root); s != "" {
+		t.Fatalf("read null %q", s)
+	}
+	fd.Close_panic(nf)
+	zf, e := dfs.Fs_open(ustr.Ustr("/zero"), defs.O_RDONLY, 0, root, 0, 0)
+	if e != 0 {
+		t.Fatalf("open zero failed %v", e)
+	}
+	buf := []uint8("not zero, not at all")
+	ub = &vm.Fakeubuf_t{}
+	ub.Fake_init(buf)
+	if n, e := zf.Fops.Read(ub); e != 0 || n != len(buf) ||
+		string(buf) != string(make([]uint8, len(buf))) {
+		t.Fatalf("read zero %v %v %q", n, e, buf)
+	}
+	fd.Close_panic(zf)
+
+	// the stat device shows what its hook returns when it is opened
+	fs.Devstats = func() string { return "some stats\n" }
+	if s := readAll(t, dfs, "/stats", root); s != "some stats\n" {
+		t.Fatalf("bad stats %q", s)
+	}
+	fs.Devstats = nil
+
+	// a device file in another file system is opened by the driver as
+	// well, unless the driver has no open
+	if _, e := tfs.Fs_mknod(ustr.Ustr("/n"), defs.O_CREAT, troot, nmaj, 0); e != 0 {
+		t.Fatalf("mknod failed %v", e)
+	}
+	if s := readAll(t, tfs, "/n", troot); s != "" {
+		t.Fatalf("read null in tmpfs %q", s)
+	}
+	smaj, ok := dev.Major("testsock")
+	if !ok {
+		smaj = dev.Register("testsock", nil)
+	}
+	if _, e := tfs.Fs_mknod(ustr.Ustr("/s"), defs.O_CREAT, troot, smaj, 3); e != 0 {
+		t.Fatalf("mknod failed %v", e)
+	}
+	if _, e := tfs.Fs_open(ustr.Ustr("/s"), defs.O_RDWR, 0, troot, 0, 0); e != -defs.EPERM {
+		t.Fatalf("open socket returned %v", e)
+	}
+
+	// nothing can be changed
+	if _, e := dfs.Fs_mknod(ustr.Ustr("/new"), defs.O_CREAT, root, nmaj, 1); e != -defs.EPERM {
+		t.Fatalf("mknod returned %v", e)
+	}
+	if _, e := dfs.Fs_mknod(ustr.Ustr("/null"), defs.O_CREAT, root, nmaj, 0); e != -defs.EEXIST {
+		t.Fatalf("mknod of existing returned %v", e)
+	}
+	if _, e := dfs.Fs_open(ustr.Ustr("/new"), defs.O_CREAT|defs.O_WRONLY, 0644, root, 0, 0); e != -defs.EPERM {
+		t.Fatalf("create returned %v", e)
+	}
+	if e := dfs.Fs_unlink(ustr.Ustr("/null"), root, false); e != -defs.EPERM {
+		t.Fatalf("unlink returned %v", e)
+	}
+	if e := dfs.Fs_rename(ustr.Ustr("/null"), ustr.Ustr("/void"), root); e != -defs.EPERM {
+		t.Fatalf("rename returned %v", e)
+	}
+	if e := dfs.Fs_mkdir(ustr.Ustr("/d"), 0755, root); e != -defs.EPERM {
+		t.Fatalf("mkdir returned %v", e)
+	}
+	if _, e := dfs.Fs_open(ustr.Ustr("/null/x"), defs.O_RDONLY, 0, root, 0, 0); e != -defs.ENOTDIR {
+		t.Fatalf("open below a device returned %v", e)
+	}
+	if e := dfs.Fs_stat(ustr.Ustr("/nope"), st, root); e != -defs.ENOENT {
+		t.Fatalf("stat of missing device returned %v", e)
+	}
+}
+
+//
+// Test eviction
+
+/// TestEvict verifies eviction of cached data.
+func TestEvict(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test Evict %v ...\n", dst)
+	d := ustr.Ustr("d/")
+	tfs := BootFS(dst)
+	s := doTestSimple(tfs, d)
+	if s != "" {
+		t.Fatalf("doTestSimple failed %s\n", s)
+	}
+	ni, nb := tfs.Sizes()
+	tfs.Evict()
+	ni1, nb1 := tfs.Sizes()
+	if ni1 >= ni {
+		t.Fatalf("No inodes evicted %d %d\n", ni, ni1)
+	}
+	if nb1 >= nb {
+		t.Fatalf("No blocks evicted %d %d\n", nb, nb1)
+	}
+	fmt.Printf("inode %d %d\n", ni, ni1)
+	fmt.Printf("blks %d %d\n", nb, nb1)
+
+	// make sure we can still read what we created after eviction
+	doCheckSimple(tfs, d, t)
+}
+
+// waits for the evictor to shrink the inode cache to at most ni inodes and the
+// block cache to at most nb blocks
+func waitEvicted(t *testing.T, tfs *Ufs_t, ni, nb int) {
+	for i := 0; ; i++ {
+		ni1, nb1 := tfs.Sizes()
+		if ni1 <= ni && nb1 <= nb {
+			return
+		}
+		if i == 500 {
+			t.Fatalf("caches not shrunk: %v inodes %v blocks", ni1, nb1)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+/// TestEvictBackground checks that the caches are shrunk in the background,
+/// but not emptied, once they near their limits.
+func TestEvictBackground(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, ManyLogBlks, ManyInodeBlks, ManyDataBlks)
+
+	fmt.Printf("Test EvictBackground %v ...\n", dst)
+	nblks := 300
+	hole := -1
+	data := make([]uint8, nblks*fs.BSIZE)
+	for i := range data {
+		data[i] = uint8(i / fs.BSIZE)
+	}
+	f := ustr.Ustr("f")
+	nfile := 300
+	tfs := BootFS(dst)
+	ub := &vm.Fakeubuf_t{}
+	ub.Fake_init(data)
+	if e := tfs.MkFile(f, ub); e != 0 {
+		t.Fatalf("MkFile failed %v", e)
+	}
+	for i := 0; i < nfile; i++ {
+		if e := tfs.MkFile(ustr.Ustr(uniqfile(i)), nil); e != 0 {
+			t.Fatalf("MkFile %v failed %v", i, e)
+		}
+	}
+	ShutdownFS(tfs)
+
+	tfs = BootFS(dst)
+	defer ShutdownFS(tfs)
+	limit := 64
+	limits.Syslimit.Blocks = limit
+	limits.Syslimit.Vnodes = limit
+	for i := 0; i < nfile; i++ {
+		if _, e := tfs.Stat(ustr.Ustr(uniqfile(i))); e != 0 {
+			t.Fatalf("Stat %v failed %v", i, e)
+		}
+	}
+	offs := make([]int, nblks)
+	for i := range offs {
+		offs[i] = i * fs.BSIZE
+	}
+	readBlocks(t, tfs, f, offs, fs.BSIZE, hole)
+	waitEvicted(t, tfs, limit*7/8, limit*7/8)
+	if ni, nb := tfs.Sizes(); ni < limit/2 || nb < limit/2 {
+		t.Fatalf("caches emptied: %v inodes %v blocks", ni, nb)
+	}
+
+	// the evicted files and blocks are read again
+	readBlocks(t, tfs, f, offs, fs.BSIZE, hole)
+	for i := 0; i < nfile; i++ {
+		if _, e := tfs.Stat(ustr.Ustr(uniqfile(i))); e != 0 {
+			t.Fatalf("Stat %v failed %v", i, e)
+		}
+	}
+	waitEvicted(t, tfs, limit*7/8, limit*7/8)
+}
+
+//
+// Test that inode are reused after freeing
+//
+
+func doTestInodeReuse(tfs *Ufs_t, n int, t *testing.T) {
+	for i := 0; i < n; i++ {
+		e := tfs.MkFile(ustr.Ustr(uniqfile(i)), nil)
+		if e != 0 {
+			t.Fatalf("mkFile %v failed", i)
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		e := tfs.Unlink(ustr.Ustr(uniqfile(i)))
+		if e != 0 {
+			t.Fatalf("Unlink %v failed", i)
+		}
+	}
+}
+
+/// TestFSInodeReuse ensures freed inodes are reused.
+func TestFSInodeReuse(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test FSInodeReuce %v ...\n", dst)
+
+	tfs := BootFS(dst)
+	n := ninodeblks * (fs.BSIZE / fs.ISIZE)
+	for i := 0; i < n; i++ {
+		doTestInodeReuse(tfs, 10, t)
+	}
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+func doTestInodeReuseRename(tfs *Ufs_t, n int, t *testing.T) {
+	for i := 0; i < n; i++ {
+		f := ustr.Ustr(uniqfile(i))
+		g := ustr.Ustr("g" + uniqfile(i))
+		e := tfs.MkFile(f, nil)
+		if e != 0 {
+			t.Fatalf("mkFile %v failed", i)
+		}
+		e = tfs.Rename(f, g)
+		if e != 0 {
+			t.Fatalf("rename %v failed", i)
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		g := ustr.Ustr("g" + uniqfile(i))
+		e := tfs.Unlink(g)
+		if e != 0 {
+			t.Fatalf("Unlink %v failed", i)
+		}
+	}
+}
+
+/// TestFSInodeReuseRename checks inode reuse after rename operations.
+func TestFSInodeReuseRename(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test FSInodeReuseRename %v ...\n", dst)
+
+	tfs := BootFS(dst)
+	n := ninodeblks * (fs.BSIZE / fs.ISIZE)
+	for i := 0; i < n; i++ {
+		doTestInodeReuseRename(tfs, 10, t)
+	}
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+//
+// Test that inode are reused after freeing
+//
+
+func doTestBlockReuse(tfs *Ufs_t, n int, t *testing.T) {
+	for i := 0; i < n; i++ {
+		ub := mkData(uint8(i), SMALL)
+		f := ustr.Ustr(uniqfile(i))
+		e := tfs.MkFile(f, ub)
+		if e != 0 {
+			t.Fatalf("mkFile %v failed", i)
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		f := ustr.Ustr(uniqfile(i))
+		e := tfs.Unlink(f)
+		if e != 0 {
+			t.Fatalf("Unlink %v failed", i)
+		}
+	}
+}
+
+/// TestFSBlockReuse ensures freed blocks are reused.
+func TestFSBlockReuse(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test FSBlockReuce %v ...\n", dst)
+
+	tfs := BootFS(dst)
+	n := ndatablks
+	fmt.Printf("max #blks %v\n", n)
+	for i := 0; i < n*2; i++ {
+		doTestBlockReuse(tfs, 5, t)
+	}
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+/// TestFSLargeFile writes a file that needs the double-indirect block and
+/// checks that removing it frees all of its data and indirect blocks.
+func TestFSLargeFile(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, ManyLogBlks, ninodeblks, ManyDataBlks)
+
+	fmt.Printf("Test FSLargeFile %v ...\n", dst)
+
+	tfs := BootFS(dst)
+	_, nblock := tfs.fs.Fs_size()
+	nblks := fs.NIADDRS + fs.INDADDR + 2*fs.INDADDR/3
+	f := ustr.Ustr("big")
+	if e := tfs.MkFile(f, mkData(7, nblks*fs.BSIZE)); e != 0 {
+		t.Fatalf("MkFile failed %v", e)
+	}
+	ShutdownFS(tfs)
+
+	tfs = BootFS(dst)
+	d, e := tfs.Read(f)
+	if e != 0 || len(d) != nblks*fs.BSIZE {
+		t.Fatalf("Read failed %v %v", e, len(d))
+	}
+	for i := 0; i < len(d); i += fs.BSIZE {
+		if d[i] != 7 {
+			t.Fatalf("bad data at %v", i)
+		}
+	}
+
+	if e := tfs.Unlink(f); e != 0 {
+		t.Fatalf("Unlink failed %v", e)
+	}
+	ShutdownFS(tfs)
+
+	tfs = BootFS(dst)
+	_, nblock1 := tfs.fs.Fs_size()
+	if nblock1 != nblock {
+		t.Fatalf("blocks not freed: before %v after %v", nblock, nblock1)
+	}
+
+	// the last byte of the largest file can be written, but not the next.
+	// the blocks before it are left as a hole.
+	maxsz := fs.BI_DBLOCKS * fs.BSIZE
+	fd, e := tfs.fs.Fs_open(f, defs.O_RDWR|defs.O_CREAT, 0644, tfs.cwd, 0, 0)
+	if e != 0 {
+		t.Fatalf("open failed %v", e)
+	}
+	if n, e := fd.Fops.Pwrite(mkData(8, 2), maxsz-1); e != 0 || n != 1 {
+		t.Fatalf("Pwrite at the last byte returned %v %v", n, e)
+	}
+	if n, e := fd.Fops.Pwrite(mkData(8, 1), maxsz); e != -defs.EFBIG || n != 0 {
+		t.Fatalf("Pwrite past the largest file returned %v %v", n, e)
+	}
+	if e := fd.Fops.Truncate(uint(maxsz) + 1); e != -defs.EFBIG {
+		t.Fatalf("Truncate past the largest file returned %v", e)
+	}
+	if st, e := tfs.Stat(f); e != 0 || int(st.Size()) != maxsz {
+		t.Fatalf("Stat returned %v", e)
+	}
+	buf := make([]uint8, 2)
+	ub := &vm.Fakeubuf_t{}
+	ub.Fake_init(buf)
+	if n, e := fd.Fops.Pread(ub, maxsz-2); e != 0 || n != 2 || buf[0] != 0 || buf[1] != 8 {
+		t.Fatalf("Pread of the last bytes returned %v %v %v", n, e, buf)
+	}
+	fd.Fops.Close()
+	if e := tfs.Unlink(f); e != 0 {
+		t.Fatalf("Unlink failed %v", e)
+	}
+	ShutdownFS(tfs)
+
+	tfs = BootFS(dst)
+	if _, nblock2 := tfs.fs.Fs_size(); nblock2 != nblock {
+		t.Fatalf("blocks not freed: before %v after %v", nblock, nblock2)
+	}
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+// returns the size of image dst and the number of 512-byte blocks the host
+// allocated for it.
+func imgBlocks(t *testing.T, dst string) (int64, int64) {
+	fi, err := os.Stat(dst)
+	if err != nil {
+		t.Fatalf("stat %v: %v", dst, err)
+	}
+	return fi.Size(), fi.Sys().(*syscall.Stat_t).Blocks
+}
+
+/// TestFSDiscard checks that the blocks of a removed file are discarded once
+/// the removal is durable, which shrinks the image, and that blocks allocated
+/// again before the removal commits keep their data.
+func TestFSDiscard(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, ManyLogBlks, ninodeblks, ManyDataBlks)
+
+	fmt.Printf("Test FSDiscard %v ...\n", dst)
+
+	nblks := 2 * fs.NIADDRS
+	f := ustr.Ustr("f")
+	tfs := BootFS(dst)
+	if e := tfs.MkFile(f, mkData(7, nblks*fs.BSIZE)); e != 0 {
+		t.Fatalf("MkFile failed %v", e)
+	}
+	if e := tfs.Sync(); e != 0 {
+		t.Fatalf("Sync failed %v", e)
+	}
+	size, full := imgBlocks(t, dst)
+	n0 := tfs.ahci.ndiscard
+	if e := tfs.Unlink(f); e != 0 {
+		t.Fatalf("Unlink failed %v", e)
+	}
+	if n := tfs.ahci.ndiscard - n0; n != 0 {
+		t.Fatalf("%v blocks discarded before the unlink committed", n)
+	}
+	if e := tfs.Sync(); e != 0 {
+		t.Fatalf("Sync failed %v", e)
+	}
+	if n := tfs.ahci.ndiscard - n0; n < nblks {
+		t.Fatalf("discarded %v blocks, not %v", n, nblks)
+	}
+	size1, empty := imgBlocks(t, dst)
+	if size1 != size {
+		t.Fatalf("image size changed from %v to %v", size, size1)
+	}
+	if empty >= full {
+		t.Fatalf("image did not shrink: %v blocks, before %v", empty, full)
+	}
+
+	ShutdownFS(tfs)
+
+	// on a small disk, h needs blocks of g, which the transaction that
+	// frees them allocates again
+	MkDisk(dst, nil, ManyLogBlks, ninodeblks, ndatablks)
+	nblks = fs.NIADDRS + 3
+	g := ustr.Ustr("g")
+	h := ustr.Ustr("h")
+	tfs = BootFS(dst)
+	if e := tfs.MkFile(g, mkData(8, nblks*fs.BSIZE)); e != 0 {
+		t.Fatalf("MkFile failed %v", e)
+	}
+	if e := tfs.Sync(); e != 0 {
+		t.Fatalf("Sync failed %v", e)
+	}
+	if e := tfs.Unlink(g); e != 0 {
+		t.Fatalf("Unlink failed %v", e)
+	}
+	if e := tfs.MkFile(h, mkData(9, nblks*fs.BSIZE)); e != 0 {
+		t.Fatalf("MkFile failed %v", e)
+	}
+	ShutdownFS(tfs)
+
+	tfs = BootFS(dst)
+	d, e := tfs.Read(h)
+	if e != 0 || len(d) != nblks*fs.BSIZE {
+		t.Fatalf("Read failed %v %v", e, len(d))
+	}
+	for i, v := range d {
+		if v != 9 {
+			t.Fatalf("byte %v of reused blocks is %v", i, v)
+		}
+	}
+	ShutdownFS(tfs)
+
+	rep := Fsck(dst, false)
+	if len(rep.Errs) != 0 {
+		t.Fatalf("image has errors: %v", rep.Errs[0].String())
+	}
+	os.Remove(dst)
+}
+
+// reads file p of tfs with reads of n bytes at the offsets offs and checks
+// that byte i of the file is i / BSIZE, except in block hole, which must read
+// as zeros.
+func readBlocks(t *testing.T, tfs *Ufs_t, p ustr.Ustr, offs []int, n, hole int) {
+	f, e := tfs.fs.Fs_open(p, defs.O_RDONLY, 0, tfs.cwd, 0, 0)
+	if e != 0 {
+		t.Fatalf("open failed %v", e)
+	}
+	defer fd.Close_panic(f)
+	buf := make([]uint8, n)
+	for _, off := range offs {
+		ub := &vm.Fakeubuf_t{}
+		ub.Fake_init(buf)
+		c, e := f.Fops.Pread(ub, off)
+		if e != 0 || c != n {
+			t.Fatalf("read at %v failed %v %v", off, c, e)
+		}
+		for i, v := range buf {
+			want := uint8((off + i) / fs.BSIZE)
+			if (off+i)/fs.BSIZE == hole {
+				want = 0
+			}
+			if v != want {
+				t.Fatalf("byte %v is %v, not %v", off+i, v, want)
+			}
+		}
+	}
+}
+
+/// TestReadahead checks that sequential reads of a file read its blocks ahead
+/// with few disk requests and that read-ahead does not change what reads
+/// return.
+func TestReadahead(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, ManyLogBlks, ninodeblks, ManyDataBlks)
+
+	fmt.Printf("Test Readahead %v ...\n", dst)
+
+	// byte i of the file is i / BSIZE, except for a hole in block 20
+	nblks := fs.NIADDRS + 100
+	hole := 20
+	data := make([]uint8, nblks*fs.BSIZE)
+	for i := range data {
+		data[i] = uint8(i / fs.BSIZE)
+	}
+	f := ustr.Ustr("f")
+	tfs := BootFS(dst)
+	ub := &vm.Fakeubuf_t{}
+	ub.Fake_init(data)
+	if e := tfs.MkFile(f, ub); e != 0 {
+		t.Fatalf("MkFile failed %v", e)
+	}
+	if e := tfs.Fallocate(f, defs.FALLOC_FL_PUNCH_HOLE|defs.FALLOC_FL_KEEP_SIZE,
+		hole*fs.BSIZE, fs.BSIZE); e != 0 {
+		t.Fatalf("punch failed %v", e)
+	}
+	ShutdownFS(tfs)
+
+	// small sequential reads: each read of a block not in the cache would
+	// be a request of its own
+	var seq []int
+	for off := 0; off+1000 <= nblks*fs.BSIZE; off += 1000 {
+		seq = append(seq, off)
+	}
+	tfs = BootFS(dst)
+	r0 := tfs.ahci.nreads
+	readBlocks(t, tfs, f, seq, 1000, hole)
+	if reqs := tfs.ahci.nreads - r0; reqs > nblks/4 {
+		t.Fatalf("%v requests for %v blocks", reqs, nblks)
+	}
+	ShutdownFS(tfs)
+
+	// one large read
+	tfs = BootFS(dst)
+	r0 = tfs.ahci.nreads
+	readBlocks(t, tfs, f, []int{0}, nblks*fs.BSIZE, hole)
+	if reqs := tfs.ahci.nreads - r0; reqs > nblks/4 {
+		t.Fatalf("%v requests for one read of %v blocks", reqs, nblks)
+	}
+	ShutdownFS(tfs)
+
+	// random reads see the same data, and read-ahead does not read much
+	// more than they need
+	var rnd []int
+	for b := nblks - 1; b >= 0; b -= 7 {
+		rnd = append(rnd, b*fs.BSIZE+100)
+	}
+	tfs = BootFS(dst)
+	r0 = tfs.ahci.nreadblk
+	readBlocks(t, tfs, f, rnd, 1000, hole)
+	if blks := tfs.ahci.nreadblk - r0; blks > 2*len(rnd)+16 {
+		t.Fatalf("%v blocks read for %v random reads", blks, len(rnd))
+	}
+
+	// blocks that were read ahead see later writes
+	readBlocks(t, tfs, f, []int{0, 1000}, 1000, hole)
+	if e := tfs.Update(f, mkData(0, 10*fs.BSIZE)); e != 0 {
+		t.Fatalf("Update failed %v", e)
+	}
+	d, e := tfs.Read(f)
+	if e != 0 || len(d) != nblks*fs.BSIZE {
+		t.Fatalf("Read failed %v %v", e, len(d))
+	}
+	for i, v := range d {
+		want := byte(i / fs.BSIZE)
+		if i < 10*fs.BSIZE || i/fs.BSIZE == hole {
+			want = 0
+		}
+		if v != want {
+			t.Fatalf("byte %v is %v, not %v", i, v, want)
+		}
+	}
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
+
+// counts the blocks that the disk releases
+type countrelse_t struct {
+	n int32
+}
+
+func (cr *countrelse_t) Relse(b *fs.Bdev_block_t, s string) {
+	atomic.AddInt32(&cr.n, 1)
+}
+
+/// TestQueuedisk reads through a disk that queues requests and combines
+/// them, as the AHCI driver does while its command slots are busy, and checks
+/// that a synchronous read is not combined with read-ahead, which would leave
+/// its reader waiting forever.
+func TestQueuedisk(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, ManyLogBlks, ninodeblks, ManyDataBlks)
+	defer os.Remove(dst)
+
+	fmt.Printf("Test Queuedisk %v ...\n", dst)
+
+	// byte i of the file is i / BSIZE
+	nblks := fs.NIADDRS + 100
+	data := make([]uint8, nblks*fs.BSIZE)
+	for i := range data {
+		data[i] = uint8(i / fs.BSIZE)
+	}
+	f := ustr.Ustr("f")
+	tfs := BootFS(dst)
+	ub := &vm.Fakeubuf_t{}
+	ub.Fake_init(data)
+	if e := tfs.MkFile(f, ub); e != 0 {
+		t.Fatalf("MkFile failed %v", e)
+	}
+	ShutdownFS(tfs)
+
+	tfs, qd := BootQueueFS(dst, 100*time.Microsecond)
+	// read-ahead of blocks 100 and 101, a synchronous read of block 102
+	// and read-ahead of blocks 103 and 104 wait in the queue. only the
+	// read-ahead of 103 and 104 is combined.
+	qd.Stop()
+	cr := &countrelse_t{}
+	readahead := func(blks ...int) {
+		l := fs.MkBlkList()
+		for _, n := range blks {
+			l.PushBack(fs.MkBlock_newpage(n, "readahead", blockmem, qd, cr))
+		}
+		qd.Start(fs.MkRequest(l, fs.BDEV_READ, false))
+	}
+	readahead(100, 101)
+	done := make(chan defs.Err_t)
+	go func() {
+		b := fs.MkBlock_newpage(102, "sync", blockmem, qd, &keeprelse_t{})
+		done <- b.Read()
+	}()
+	for i := 0; qd.Len() != 2; i++ {
+		if i == 10000 {
+			t.Fatalf("synchronous read combined with read-ahead")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	readahead(103)
+	readahead(104)
+	if qd.Len() != 3 || qd.Ncoalesce() != 1 {
+		t.Fatalf("%v requests queued, %v combined", qd.Len(), qd.Ncoalesce())
+	}
+	qd.Resume()
+	select {
+	case e := <-done:
+		if e != 0 {
+			t.Fatalf("synchronous read failed %v", e)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("synchronous read next to read-ahead never finished")
+	}
+	for i := 0; atomic.LoadInt32(&cr.n) != 4; i++ {
+		if i == 10000 {
+			t.Fatalf("%v read-ahead blocks released", atomic.LoadInt32(&cr.n))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// sequential reads with read-ahead and a read of the whole file at
+	// the same time see the file's data
+	got := make(chan []byte)
+	go func() {
+		d, e := tfs.Read(f)
+		if e != 0 {
+			d = nil
+		}
+		got <- d
+	}()
+	var seq []int
+	for off := 0; off+1000 <= nblks*fs.BSIZE; off += 1000 {
+		seq = append(seq, off)
+	}
+	readBlocks(t, tfs, f, seq, 1000, -1)
+	select {
+	case d := <-got:
+		if len(d) != len(data) {
+			t.Fatalf("Read returned %v bytes", len(d))
+		}
+		for i, v := range d {
+			if v != data[i] {
+				t.Fatalf("byte %v is %v, not %v", i, v, data[i])
+			}
+		}
+	case <-time.After(time.Minute):
+		t.Fatalf("Read through the queue never finished")
+	}
+	ShutdownFS(tfs)
+	qd.Close()
+}
+
+// rawBlock reads block n of the image through disk, bypassing the file system.
+func rawBlock(disk fs.Disk_i, n int) []byte {
+	b := fs.MkBlock_newpage(n, "raw", blockmem, disk, &keeprelse_t{})
+	if b.Read() != 0 {
+		panic("raw read failed")
+	}
+	return bytepg2byte(b.Data)
+}
+
+func rawWrite(disk fs.Disk_i, n int, b []byte) {
+	blk := fs.MkBlock_newpage(n, "raw", blockmem, disk, &keeprelse_t{})
+	copy(blk.Data[:], b)
+	if blk.Write() != 0 {
+		panic("raw write failed")
+	}
+}
+
+// corrupt the image behind the file system's back: bump the link count of
+// inode inum, mark its first data block free, and mark the last data block
+// of the disk as used.
+func corruptImage(disk string, inum int) {
+	a := openDisk(disk)
+	defer a.close()
+	f := unlock(a)
+	boot := rawBlock(f, 0)
+	sbn := util.Readn(boot, 4, fs.FSOFF)
+	sb := fs.Superblock_t{Data: blk2bytepg(rawBlock(f, sbn))}
+	istart := sb.Freeblock() + sb.Freeblocklen()
+	first := istart + sb.Inodelen()
+
+	ib := istart + inum/(fs.BSIZE/fs.ISIZE)
+	off := (inum % (fs.BSIZE / fs.ISIZE)) * fs.ISIZE
+	b := rawBlock(f, ib)
+	util.Writen(b, 8, off+1*8, util.Readn(b, 8, off+1*8)+2)
+	addr := util.Readn(b, 8, off+7*8)
+	rawWrite(f, ib, b)
+
+	flip := func(bit int) {
+		n := sb.Freeblock() + bit/(fs.BSIZE*8)
+		b := rawBlock(f, n)
+		b[(bit%(fs.BSIZE*8))/8] ^= 1 << uint(bit%8)
+		rawWrite(f, n, b)
+	}
+	flip(addr - first)
+	flip(sb.Lastblock() - 1 - first)
+	a.f.Sync()
+}
+
+// rewrites the on-disk inode inum of the image behind the file system's back;
+// patch gets the inode block and the offset of the inode in it.
+func patchInode(disk string, inum int, patch func(b []byte, off int)) {
+	a := openDisk(disk)
+	defer a.close()
+	f := unlock(a)
+	boot := rawBlock(f, 0)
+	sbn := util.Readn(boot, 4, fs.FSOFF)
+	sb := fs.Superblock_t{Data: blk2bytepg(rawBlock(f, sbn))}
+	istart := sb.Freeblock() + sb.Freeblocklen()
+	ib := istart + inum/(fs.BSIZE/fs.ISIZE)
+	b := rawBlock(f, ib)
+	patch(b, (inum%(fs.BSIZE/fs.ISIZE))*fs.ISIZE)
+	rawWrite(f, ib, b)
+	a.f.Sync()
+}
+
+/// TestFSFsck checks that fsck finds nothing wrong with a cleanly shut down
+/// image and that it detects and repairs a damaged one.
+func TestFSFsck(t *testing.T) {
+	dst := "tmp.img"
+	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+
+	fmt.Printf("Test FSFsck %v ...\n", dst)
+
+	tfs := BootFS(dst)
+	d := ustr.Ustr("d")
+	f := ustr.Ustr("d/f")
+	if e := tfs.MkDir(d); e != 0 {
+		t.Fatalf("MkDir failed %v", e)
+	}
+	if e := tfs.MkFile(f, mkData(3, SMALL)); e != 0 {
+		t.Fatalf("MkFile failed %v", e)
+	}
+	if e := tfs.Symlink(f, ustr.Ustr("l")); e != 0 {
+		t.Fatalf("Symlink failed %v", e)
+	}
+	st, e := tfs.Stat(f)
+	if e != 0 {
+		t.Fatalf("Stat failed %v", e)
+	}
+	ShutdownFS(tfs)
+
+	rep := Fsck(dst, false)
+	if len(rep.Errs) != 0 {
+		t.Fatalf("clean image has errors: %v", rep.Errs[0].String())
+	}
+	if rep.Ninodes != 4 {
+		t.Fatalf("expected 4 inodes, got %v", rep.Ninodes)
+	}
+
+	corruptImage(dst, int(st.Rino()))
+	rep = Fsck(dst, false)
+	if rep.Count(fs.FSCK_LINKS) != 1 || rep.Count(fs.FSCK_FREEBLK) != 1 ||
+		rep.Count(fs.FSCK_LEAKBLK) != 1 || len(rep.Errs) != 3 {
+		t.Fatalf("unexpected report %v", rep.Errs)
+	}
+	if rep.Clean() {
+		t.Fatalf("check only run repaired the image")
+	}
+	rep = Fsck(dst, true)
+	if !rep.Clean() || len(rep.Errs) != 3 {
+		t.Fatalf("repair failed %v", rep.Errs)
+	}
+	rep = Fsck(dst, false)
+	if len(rep.Errs) != 0 {
+		t.Fatalf("repaired image has errors: %v", rep.Errs[0].String())
+	}
+
+	tfs = BootFS(dst)
+	if b, e := tfs.Read(f); e != 0 || len(b) != SMALL || b[0] != 3 {
+		t.Fatalf("Read after repair failed %v", e)
+	}
+	if e := tfs.Unlink(f); e != 0 {
+		t.Fatalf("Unlink failed %v", e)
+	}
+	g, h := ustr.Ustr("g"), ustr.Ustr("h")
+	for _, p := range []ustr.Ustr{g, h} {
+		if e := tfs.MkFile(p, mkData(4, SMALL)); e != 0 {
+			t.Fatalf("MkFile failed %v", e)
+		}
+	}
+	sg, e := tfs.Stat(g)
+	if e != 0 {
+		t.Fatalf("Stat failed %v", e)
+	}
+	sh, e := tfs.Stat(h)
+	if e != 0 {
+		t.Fatalf("Stat failed %v", e)
+	}
+	ShutdownFS(tfs)
+
+	img := "fsck.img"
+	defer os.Remove(img)
+	// checks img, expecting the given number of inconsistencies of each
+	// kind, then repairs it.
+	chk := func(what string, want map[fs.Fsckkind_t]int, fixable bool) {
+		n := 0
+		for k, c := range want {
+			n += c
+			if rep.Count(k) != c {
+				t.Fatalf("%v: %v %v, not %v: %v", what, rep.Count(k), k, c, rep.Errs)
+			}
+		}
+		if len(rep.Errs) != n {
+			t.Fatalf("%v: unexpected report %v", what, rep.Errs)
+		}
+		rep = Fsck(img, true)
+		if rep.Clean() != fixable || len(rep.Errs) != n {
+			t.Fatalf("%v: repair returned %v", what, rep.Errs)
+		}
+	}
+
+	// an entry whose inode was freed dangles; the inode's data block leaks
+	if err := copyDisk(dst, img); err != nil {
+		t.Fatalf("copy failed %v", err)
+	}
+	patchInode(img, int(sg.Rino()), func(b []byte, off int) {
+		for i := 0; i < fs.ISIZE; i++ {
+			b[off+i] = 0
+		}
+	})
+	rep = Fsck(img, false)
+	chk("dangling entry", map[fs.Fsckkind_t]int{fs.FSCK_DANGLE: 1,
+		fs.FSCK_IMAP: 1, fs.FSCK_LEAKBLK: 1}, true)
+	if rep = Fsck(img, false); len(rep.Errs) != 0 {
+		t.Fatalf("repaired image has errors: %v", rep.Errs[0].String())
+	}
+	tfs = BootFS(img)
+	if _, e := tfs.Stat(g); e != -defs.ENOENT {
+		t.Fatalf("Stat of dangling entry returned %v", e)
+	}
+	ShutdownFS(tfs)
+
+	// a block claimed by two inodes cannot be repaired; the block that one
+	// of them lost leaks
+	if err := copyDisk(dst, img); err != nil {
+		t.Fatalf("copy failed %v", err)
+	}
+	var addr int
+	patchInode(img, int(sg.Rino()), func(b []byte, off int) {
+		addr = util.Readn(b, 8, off+7*8)
+	})
+	patchInode(img, int(sh.Rino()), func(b []byte, off int) {
+		util.Writen(b, 8, off+7*8, addr)
+	})
+	rep = Fsck(img, false)
+	chk("duplicate block", map[fs.Fsckkind_t]int{fs.FSCK_DUPBLK: 1,
+		fs.FSCK_LEAKBLK: 1}, false)
+
+	// committed transactions that a crash left in the log are installed
+	// before the rest of the image is checked. the log must be large enough
+	// that the sync doesn't install them.
+	os.Remove(dst)
+	MkDisk(dst, nil, ManyLogBlks, ninodeblks, ndatablks)
+	tfs = BootFS(dst)
+	if e := tfs.MkFile(g, mkData(5, SMALL)); e != 0 {
+		t.Fatalf("MkFile failed %v", e)
+	}
+	if e := tfs.Sync(); e != 0 {
+		t.Fatalf("Sync failed %v", e)
+	}
+	if err := copyDisk(dst, img); err != nil {
+		t.Fatalf("copy failed %v", err)
+	}
+	ShutdownFS(tfs)
+	if rep = Fsck(img, false); rep.Count(fs.FSCK_LOG) != 1 || rep.Clean() {
+		t.Fatalf("unexpected report %v", rep.Errs)
+	}
+	rep = Fsck(img, true)
+	if rep.Count(fs.FSCK_LOG) != 1 || len(rep.Errs) != 1 || !rep.Clean() {
+		t.Fatalf("replay returned %v", rep.Errs)
+	}
+	if rep = Fsck(img, false); len(rep.Errs) != 0 {
+		t.Fatalf("replayed image has errors: %v", rep.Errs[0].String())
+	}
+	tfs = BootFS(img)
+	if b, e := tfs.Read(g); e != 0 || len(b) != SMALL || b[0] != 5 {
+		t.Fatalf("Read after replay failed %v", e)
 	}
+	ShutdownFS(tfs)
+	os.Remove(dst)
+}
 
-	ub = mkData(3, SMALL)
-	e = tfs.Append(d.ExtendStr("f1"), ub)
-	if e != 0 {
-		return fmt.Sprintf("Append failed")
-	}
+/// TestReplaylog checks that Readlog decodes the transactions that a crash
+/// left in the log and that Replaylog installs only the first of them.
+func TestReplaylog(t *testing.T) {
+	dst := "tmp.img"
+	crash := "crash.img"
+	MkDisk(dst, nil, ManyLogBlks, ninodeblks, ndatablks)
+	defer os.Remove(dst)
+	defer os.Remove(crash)
 
-	e = tfs.Unlink(d.ExtendStr("f2"))
-	if e != 0 {
-		return fmt.Sprintf("Unlink failed")
+	fmt.Printf("Test Replaylog %v ...\n", dst)
+
+	// each sync commits a transaction, which stays in the log
+	names := []ustr.Ustr{ustr.Ustr("a"), ustr.Ustr("b"), ustr.Ustr("c")}
+	tfs := BootFS(dst)
+	for i, n := range names {
+		if e := tfs.MkFile(n, mkData(uint8(i), SMALL)); e != 0 {
+			t.Fatalf("MkFile failed %v", e)
+		}
+		if e := tfs.Sync(); e != 0 {
+			t.Fatalf("Sync failed %v", e)
+		}
 	}
-	return ""
-}
+	if err := copyDisk(dst, crash); err != nil {
+		t.Fatalf("copy failed %v", err)
+	}
+	ShutdownFS(tfs)
 
-func doCheckSimple(tfs *Ufs_t, d ustr.Ustr, t *testing.T) {
-	res, e := tfs.Ls(d)
+	ld, e := Readlog(crash)
 	if e != 0 {
-		t.Fatalf("doLs failed")
+		t.Fatalf("Readlog failed %v", e)
 	}
-	st, ok := res["f1"]
-	if !ok {
-		t.Fatalf("%s/f1 not present", d)
+	if len(ld.Trans) != len(names) || ld.Tail == ld.Head ||
+		ld.Trans[0].Start != ld.Tail || ld.Trans[len(ld.Trans)-1].End != ld.Head {
+		t.Fatalf("bad log %+v", ld)
 	}
-	if st.Size() != 1024 {
-		t.Fatalf("f1 wrong size")
+	for i, tr := range ld.Trans {
+		if i > 0 && tr.Start != ld.Trans[i-1].End {
+			t.Fatalf("transaction %v starts at %v, not at %v", i, tr.Start,
+				ld.Trans[i-1].End)
+		}
+		if len(tr.Blks) == 0 || tr.End != tr.Start+1+len(tr.Blks) ||
+			tr.Descriptor != ld.Logstart+1+tr.Start%ld.Loglen {
+			t.Fatalf("bad transaction %v: %+v", i, tr)
+		}
 	}
 
-	st, ok = res["f2"]
-	if ok {
-		t.Fatalf("f2 present")
+	if e := Replaylog(crash, len(ld.Trans)+1); e != -defs.EINVAL {
+		t.Fatalf("Replaylog past the log returned %v", e)
 	}
-	st, ok = res["d0"]
-	if !ok {
-		t.Fatalf("d0 not present")
+	if e := Replaylog(crash, 1); e != 0 {
+		t.Fatalf("Replaylog failed %v", e)
 	}
-	st, ok = res["e0"]
-	if !ok {
-		t.Fatalf("e0 not present")
+	if ld, e := Readlog(crash); e != 0 || len(ld.Trans) != 0 || ld.Tail != ld.Head {
+		t.Fatalf("log not empty after replay %+v %v", ld, e)
 	}
-	res, e = tfs.Ls(d.ExtendStr("d0"))
-	if e != 0 {
-		t.Fatalf("doLs d0 failed")
+	if rep := Fsck(crash, false); len(rep.Errs) != 0 {
+		t.Fatalf("replayed image has errors: %v", rep.Errs[0].String())
 	}
-	st, ok = res["e0"]
-	if ok {
-		t.Fatalf("e0 present in d0")
+	tfs = BootFS(crash)
+	if b, e := tfs.Read(names[0]); e != 0 || len(b) != SMALL {
+		t.Fatalf("Read of %v failed %v", names[0], e)
 	}
+	for _, n := range names[1:] {
+		if _, e := tfs.Stat(n); e != -defs.ENOENT {
+			t.Fatalf("%v of a dropped transaction exists: %v", n, e)
+		}
+	}
+	ShutdownFS(tfs)
 }
 
-//
-// Util
-//
-
-func uniqdir(id int) string {
-	return "d" + strconv.Itoa(id)
-}
-
-func uniqfile(id int) string {
-	return "f" + strconv.Itoa(id)
-}
-
-//
-// Simple test
-//
-
-/// TestFSSimple exercises simple filesystem operations.
-func TestFSSimple(t *testing.T) {
+/// TestFSBadDirent checks that a malformed directory record fails the
+/// lookups and getdents of its directory with EIO.
+func TestFSBadDirent(t *testing.T) {
 	dst := "tmp.img"
 	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+	defer os.Remove(dst)
 
-	fmt.Printf("Test FSSimple %v ...\n", dst)
-	d := ustr.Ustr("d/")
+	fmt.Printf("Test FSBadDirent %v ...\n", dst)
+
+	d := ustr.Ustr("d")
+	f := ustr.Ustr("d/f")
 	tfs := BootFS(dst)
-	s := doTestSimple(tfs, d)
-	if s != "" {
-		t.Fatalf("doTestSimple failed %s\n", s)
+	if e := tfs.MkDir(d); e != 0 {
+		t.Fatalf("MkDir failed %v", e)
+	}
+	if e := tfs.MkFile(f, mkData(1, SMALL)); e != 0 {
+		t.Fatalf("MkFile failed %v", e)
+	}
+	st, e := tfs.Stat(d)
+	if e != 0 {
+		t.Fatalf("Stat failed %v", e)
 	}
-	doCheckSimple(tfs, d, t)
 	ShutdownFS(tfs)
 
+	// a zero record length would never end the scan of the block
+	var addr int
+	patchInode(dst, int(st.Rino()), func(b []byte, off int) {
+		addr = util.Readn(b, 8, off+7*8)
+	})
+	a := openDisk(dst)
+	disk := unlock(a)
+	b := rawBlock(disk, addr)
+	util.Writen(b, 2, 8, 0)
+	rawWrite(disk, addr, b)
+	a.f.Sync()
+	a.close()
+
 	tfs = BootFS(dst)
-	doCheckSimple(tfs, d, t)
+	if _, e := tfs.Stat(f); e != -defs.EIO {
+		t.Fatalf("Stat in bad directory returned %v", e)
+	}
+	if _, e := tfs.Readdir(d, 4096); e != -defs.EIO {
+		t.Fatalf("Readdir of bad directory returned %v", e)
+	}
+	if _, e := tfs.Stat(ustr.Ustr("/")); e != 0 {
+		t.Fatalf("Stat of root failed %v", e)
+	}
 	ShutdownFS(tfs)
-	os.Remove(dst)
 }
 
-//
-// Test eviction
-
-/// TestEvict verifies eviction of cached data.
-func TestEvict(t *testing.T) {
+/// TestFaultDisk checks that disk errors reach system calls as EIO, that a
+/// failed write makes the file system read-only and that the image survives
+/// failed and torn writes.
+func TestFaultDisk(t *testing.T) {
 	dst := "tmp.img"
 	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
 
-	fmt.Printf("Test Evict %v ...\n", dst)
-	d := ustr.Ustr("d/")
+	fmt.Printf("Test FaultDisk %v ...\n", dst)
+
+	f := ustr.Ustr("f")
 	tfs := BootFS(dst)
-	s := doTestSimple(tfs, d)
-	if s != "" {
-		t.Fatalf("doTestSimple failed %s\n", s)
+	if e := tfs.MkFile(f, mkData(7, LARGE)); e != 0 {
+		t.Fatalf("MkFile failed %v", e)
 	}
-	ni, nb := tfs.Sizes()
-	tfs.Evict()
-	ni1, nb1 := tfs.Sizes()
-	if ni1 >= ni {
-		t.Fatalf("No inodes evicted %d %d\n", ni, ni1)
+	ShutdownFS(tfs)
+
+	// a failed read of file data fails the read, and the next read tries
+	// the disk again. slow requests are fine.
+	tfs, disk := BootFaultFS(dst)
+	if _, e := tfs.Stat(f); e != 0 {
+		t.Fatalf("Stat failed %v", e)
 	}
-	if nb1 >= nb {
-		t.Fatalf("No blocks evicted %d %d\n", nb, nb1)
+	disk.Setall(Fault_t{Rfail: true})
+	if _, e := tfs.Read(f); e != -defs.EIO {
+		t.Fatalf("Read of unreadable file returned %v", e)
+	}
+	if nr, _ := disk.Nfail(); nr == 0 {
+		t.Fatalf("no failed reads")
+	}
+	disk.Setall(Fault_t{Delay: time.Millisecond})
+	if b, e := tfs.Read(f); e != 0 || len(b) != LARGE || b[LARGE-1] != 7 {
+		t.Fatalf("Read after failure failed %v", e)
+	}
+	if e := tfs.MkDir(ustr.Ustr("d")); e != 0 {
+		t.Fatalf("MkDir after failed read failed %v", e)
+	}
+	if e := tfs.Sync(); e != 0 {
+		t.Fatalf("Sync failed %v", e)
 	}
-	fmt.Printf("inode %d %d\n", ni, ni1)
-	fmt.Printf("blks %d %d\n", nb, nb1)
-
-	// make sure we can still read what we created after eviction
-	doCheckSimple(tfs, d, t)
-}
 
-//
-// Test that inode are reused after freeing
-//
+	// a failed write makes the file system read-only; what is cached can
+	// still be read
+	disk.Setall(Fault_t{Wfail: true})
+	if e := tfs.MkFile(ustr.Ustr("g"), mkData(1, SMALL)); e != 0 {
+		t.Fatalf("MkFile failed %v", e)
+	}
+	if e := tfs.Sync(); e != -defs.EIO {
+		t.Fatalf("Sync with failing writes returned %v", e)
+	}
+	if e := tfs.MkDir(ustr.Ustr("e")); e != -defs.EROFS {
+		t.Fatalf("MkDir on read-only file system returned %v", e)
+	}
+	if e := tfs.Update(f, mkData(8, SMALL)); e != -defs.EROFS {
+		t.Fatalf("Update on read-only file system returned %v", e)
+	}
+	if b, e := tfs.Read(f); e != 0 || len(b) != LARGE || b[0] != 7 {
+		t.Fatalf("Read on read-only file system failed %v", e)
+	}
+	disk.Clear()
+	if e := tfs.Sync(); e != -defs.EIO {
+		t.Fatalf("Sync after failure returned %v", e)
+	}
+	ShutdownFS(tfs)
 
-func doTestInodeReuse(tfs *Ufs_t, n int, t *testing.T) {
-	for i := 0; i < n; i++ {
-		e := tfs.MkFile(ustr.Ustr(uniqfile(i)), nil)
-		if e != 0 {
-			t.Fatalf("mkFile %v failed", i)
-		}
+	// torn writes of a commit leave the previous state
+	tfs, disk = BootFaultFS(dst)
+	disk.Setall(Fault_t{Torn: 100})
+	if e := tfs.MkDir(ustr.Ustr("t")); e != 0 {
+		t.Fatalf("MkDir failed %v", e)
 	}
+	if e := tfs.Sync(); e != -defs.EIO {
+		t.Fatalf("Sync with torn writes returned %v", e)
+	}
+	ShutdownFS(tfs)
 
-	for i := 0; i < n; i++ {
-		e := tfs.Unlink(ustr.Ustr(uniqfile(i)))
-		if e != 0 {
-			t.Fatalf("Unlink %v failed", i)
+	rep := Fsck(dst, false)
+	if len(rep.Errs) != 0 {
+		t.Fatalf("image has errors after failures: %v", rep.Errs[0].String())
+	}
+	tfs = BootFS(dst)
+	for _, p := range []string{"g", "e", "t"} {
+		if _, e := tfs.Stat(ustr.Ustr(p)); e != -defs.ENOENT {
+			t.Fatalf("%v exists after failed commit: %v", p, e)
 		}
 	}
-}
-
-/// TestFSInodeReuse ensures freed inodes are reused.
-func TestFSInodeReuse(t *testing.T) {
-	dst := "tmp.img"
-	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
-
-	fmt.Printf("Test FSInodeReuce %v ...\n", dst)
-
-	tfs := BootFS(dst)
-	n := ninodeblks * (fs.BSIZE / fs.ISIZE)
-	for i := 0; i < n; i++ {
-		doTestInodeReuse(tfs, 10, t)
+	if _, e := tfs.Stat(ustr.Ustr("d")); e != 0 {
+		t.Fatalf("Stat of committed dir failed %v", e)
+	}
+	if b, e := tfs.Read(f); e != 0 || len(b) != LARGE || b[0] != 7 {
+		t.Fatalf("Read after reboot failed %v", e)
 	}
 	ShutdownFS(tfs)
 	os.Remove(dst)
 }
 
-func doTestInodeReuseRename(tfs *Ufs_t, n int, t *testing.T) {
-	for i := 0; i < n; i++ {
-		f := ustr.Ustr(uniqfile(i))
-		g := ustr.Ustr("g" + uniqfile(i))
-		e := tfs.MkFile(f, nil)
-		if e != 0 {
-			t.Fatalf("mkFile %v failed", i)
-		}
-		e = tfs.Rename(f, g)
-		if e != 0 {
-			t.Fatalf("rename %v failed", i)
-		}
+/// TestCryptDisk checks that an encrypted image keeps the data of its files
+/// secret, cannot be unlocked with a wrong passphrase and works like a plain
+/// image.
+func TestCryptDisk(t *testing.T) {
+	saved := Passphrase
+	Passphrase = []byte("open sesame")
+	defer func() { Passphrase = saved }()
+
+	// the key is expanded from PBKDF2-HMAC-SHA256, whose output for this
+	// passphrase, salt and count is a test vector of RFC 7914
+	m, _ := hex.DecodeString("c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a")
+	expand := func(label string) []byte {
+		h := hmac.New(sha256.New, m)
+		h.Write([]byte(label))
+		return h.Sum(nil)
 	}
-
-	for i := 0; i < n; i++ {
-		g := ustr.Ustr("g" + uniqfile(i))
-		e := tfs.Unlink(g)
-		if e != 0 {
-			t.Fatalf("Unlink %v failed", i)
-		}
+	key, check := fs.Cryptkey([]uint8("password"), []uint8("salt"), 4096)
+	if !bytes.Equal(key, append(expand("biscuit data key"), expand("biscuit tweak key")...)) ||
+		!bytes.Equal(check, expand("biscuit key check")[:fs.CRYPT_SALTLEN]) {
+		t.Fatalf("bad key %x check %x", key, check)
 	}
-}
 
-/// TestFSInodeReuseRename checks inode reuse after rename operations.
-func TestFSInodeReuseRename(t *testing.T) {
 	dst := "tmp.img"
 	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
 
-	fmt.Printf("Test FSInodeReuseRename %v ...\n", dst)
+	fmt.Printf("Test CryptDisk %v ...\n", dst)
 
+	secret := "the combination is 12345"
+	f := ustr.Ustr("f")
 	tfs := BootFS(dst)
-	n := ninodeblks * (fs.BSIZE / fs.ISIZE)
-	for i := 0; i < n; i++ {
-		doTestInodeReuseRename(tfs, 10, t)
+	if e := tfs.MkFile(f, MkBuf([]byte(secret))); e != 0 {
+		t.Fatalf("MkFile failed %v", e)
 	}
 	ShutdownFS(tfs)
-	os.Remove(dst)
-}
 
-//
-// Test that inode are reused after freeing
-//
+	img, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatalf("read %v: %v", dst, err)
+	}
+	if strings.Contains(string(img), secret) {
+		t.Fatalf("image holds the plain data")
+	}
+	a := openDisk(dst)
+	_, e := fs.Unlockdisk(blockmem, a, func() []uint8 {
+		return []uint8("open barley")
+	})
+	a.close()
+	if e != -defs.EACCES {
+		t.Fatalf("unlocked with a wrong passphrase: %v", e)
+	}
 
-func doTestBlockReuse(tfs *Ufs_t, n int, t *testing.T) {
-	for i := 0; i < n; i++ {
-		ub := mkData(uint8(i), SMALL)
-		f := ustr.Ustr(uniqfile(i))
-		e := tfs.MkFile(f, ub)
-		if e != 0 {
-			t.Fatalf("mkFile %v failed", i)
-		}
+	// the superblock records the iterations of the key derivation
+	a = openDisk(dst)
+	sbn := util.Readn(rawBlock(a, 0), 4, fs.FSOFF)
+	sb := fs.Superblock_t{Data: blk2bytepg(rawBlock(a, sbn))}
+	a.close()
+	if sb.Crypt() != fs.CRYPT_AESXTS || sb.Cryptiters() != Cryptiters {
+		t.Fatalf("superblock records cipher %v iterations %v", sb.Crypt(), sb.Cryptiters())
 	}
 
-	for i := 0; i < n; i++ {
-		f := ustr.Ustr(uniqfile(i))
-		e := tfs.Unlink(f)
-		if e != 0 {
-			t.Fatalf("Unlink %v failed", i)
-		}
+	tfs = BootFS(dst)
+	d, e := tfs.Read(f)
+	if e != 0 || string(d) != secret {
+		t.Fatalf("Read failed %v %q", e, d)
 	}
+	ShutdownFS(tfs)
+	rep := Fsck(dst, false)
+	if len(rep.Errs) != 0 {
+		t.Fatalf("image has errors: %v", rep.Errs[0].String())
+	}
+	os.Remove(dst)
+
+	t.Run("FSSimple", TestFSSimple)
+	t.Run("FSLargeFile", TestFSLargeFile)
+	t.Run("Readahead", TestReadahead)
+	t.Run("FSDiscard", TestFSDiscard)
+	t.Run("FaultDisk", TestFaultDisk)
+	t.Run("FSFsck", TestFSFsck)
 }
 
-/// TestFSBlockReuse ensures freed blocks are reused.
-func TestFSBlockReuse(t *testing.T) {
+/// TestMkDiskGeometry checks that MkDisk lays out an image whose inode map
+/// spans several blocks according to MkSuperBlock.
+func TestMkDiskGeometry(t *testing.T) {
 	dst := "tmp.img"
-	MkDisk(dst, nil, nlogblks, ninodeblks, ndatablks)
+	niblks := 5000
+	MkDisk(dst, nil, nlogblks, niblks, ndatablks)
 
-	fmt.Printf("Test FSBlockReuce %v ...\n", dst)
+	fmt.Printf("Test MkDiskGeometry %v ...\n", dst)
 
-	tfs := BootFS(dst)
-	n := ndatablks
-	fmt.Printf("max #blks %v\n", n)
-	for i := 0; i < n*2; i++ {
-		doTestBlockReuse(tfs, 5, t)
+	sb := MkSuperBlock(SuperStart(nil), nlogblks, niblks, ndatablks)
+	if sb.Imaplen() != 3 {
+		t.Fatalf("expected 3 inode map blocks, got %v", sb.Imaplen())
+	}
+	st, err := os.Stat(dst)
+	if err != nil || int(st.Size()) != sb.Lastblock()*fs.BSIZE {
+		t.Fatalf("image size %v, expected %v blocks", st.Size(), sb.Lastblock())
+	}
+	rep := Fsck(dst, false)
+	if len(rep.Errs) != 0 {
+		t.Fatalf("new image has errors: %v", rep.Errs[0].String())
 	}
-	ShutdownFS(tfs)
 	os.Remove(dst)
 }
 
@@ -1173,6 +3991,56 @@ func TestTracesAtomic(t *testing.T) {
 	os.Remove(disk)
 }
 
+const crashscript = `
+setup create f 8192 1
+create tmp 8192 2
+fsync tmp
+rename tmp f
+check file f 1 | file f 2
+check fsck
+sync
+check file f 2
+check absent tmp
+`
+
+/// TestCrashExplore checks an atomic rename with the crash explorer and that a
+/// check claiming durability too early yields a minimized counterexample.
+func TestCrashExplore(t *testing.T) {
+	fmt.Printf("Test CrashExplore ...\n")
+	opts := &Crashopts_t{Dir: ".", Nlog: nlogblks, Ninode: ninodeblks,
+		Ndata: ndatablks, Max: 1000}
+	cs, err := ParseCrashScript(strings.NewReader(crashscript))
+	if err != nil {
+		t.Fatalf("ParseCrashScript failed %v", err)
+	}
+	rep, err := ExploreCrashes(cs, opts)
+	if err != nil {
+		t.Fatalf("ExploreCrashes failed %v", err)
+	}
+	if rep.Fail != nil || rep.Nepochs == 0 || rep.Nsampled != 0 {
+		t.Fatalf("unexpected report %v %v", rep, rep.Fail)
+	}
+
+	// the rename is not durable before the sync
+	bad := strings.Replace(crashscript, "rename tmp f\n",
+		"rename tmp f\ncheck file f 2\n", 1)
+	cs, err = ParseCrashScript(strings.NewReader(bad))
+	if err != nil {
+		t.Fatalf("ParseCrashScript failed %v", err)
+	}
+	rep, err = ExploreCrashes(cs, opts)
+	if err != nil {
+		t.Fatalf("ExploreCrashes failed %v", err)
+	}
+	if rep.Fail == nil || rep.Fail.Line != 6 || len(rep.Fail.Landed) != 0 {
+		t.Fatalf("unexpected failure %v", rep.Fail)
+	}
+
+	if _, err := ParseCrashScript(strings.NewReader("write f 1\n")); err == nil {
+		t.Fatalf("bad op accepted")
+	}
+}
+
 //
 // Test: big ifree (i.e., several ops, spanning several transactions)
 //
@@ -1252,47 +4120,19 @@ func blk2bytepg(d []byte) *mem.Bytepg_t {
 // several transactions.
 /// FillDisk pre-allocates most blocks in the filesystem image.
 func FillDisk(disk string) {
-	f, err := os.OpenFile(disk, os.O_RDWR, 0755)
-	if err != nil {
-		panic(err)
-	}
-	_, err = f.Seek(fs.BSIZE, 0)
-	if err != nil {
-		panic(err)
-	}
-
-	super := mkBlock()
-	_, err = f.Read(super)
-	if err != nil {
-		panic(err)
-	}
-	blk := blk2bytepg(super)
-	sb := fs.Superblock_t{blk}
-	_, err = f.Seek(int64(fs.BSIZE*sb.Freeblock()), 0)
-	if err != nil {
-		panic(err)
-	}
+	a := openDisk(disk)
+	defer a.close()
+	f := unlock(a)
+	sbn := util.Readn(rawBlock(f, 0), 4, fs.FSOFF)
+	sb := fs.Superblock_t{Data: blk2bytepg(rawBlock(f, sbn))}
 	for i := 0; i < sb.Freeblocklen(); i++ {
-		b := mkBlock()
-		_, err = f.Read(b)
-		if err != nil {
-			panic(err)
-		}
+		b := rawBlock(f, sb.Freeblock()+i)
 		for j := 1; j < fs.BSIZE; j++ {
 			b[j] = 0xFF // mark as allocated
 		}
-		_, err = f.Seek(int64(-fs.BSIZE), 1)
-		if err != nil {
-			panic(err)
-		}
-
-		_, err = f.Write(b)
-		if err != nil {
-			panic(err)
-		}
+		rawWrite(f, sb.Freeblock()+i, b)
 	}
-	f.Sync()
-	f.Close()
+	a.f.Sync()
 }
 
 func genSyncTraces(trace trace_t, t *testing.T, disk string, apply bool, check func(*Ufs_t) (string, bool)) int {
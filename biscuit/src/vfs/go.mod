@@ -0,0 +1,3 @@
+module vfs
+
+go 1.24.0
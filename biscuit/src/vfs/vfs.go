@@ -0,0 +1,741 @@
+package vfs
+
+import "strconv"
+import "sync"
+import "sync/atomic"
+
+import "bpath"
+import "defs"
+import "fd"
+import "fdops"
+import "fs"
+import "mem"
+import "stat"
+import "stats"
+import "ustr"
+
+/// Fs_i is implemented by file systems that can be mounted. Paths handed to
+/// an Fs_i are either absolute paths from the root of that file system or
+/// paths relative to the cwd's directory, which then is in that file system.
+type Fs_i interface {
+	Fs_open(ustr.Ustr, defs.Fdopt_t, int, *fd.Cwd_t, int, int) (*fd.Fd_t, defs.Err_t)
+	Fs_mknod(ustr.Ustr, defs.Fdopt_t, *fd.Cwd_t, int, int) (defs.Inum_t, defs.Err_t)
+	Fs_access(ustr.Ustr, *fd.Cwd_t, int) defs.Err_t
+	Fs_stat(ustr.Ustr, *stat.Stat_t, *fd.Cwd_t) defs.Err_t
+	Fs_lstat(ustr.Ustr, *stat.Stat_t, *fd.Cwd_t) defs.Err_t
+	Fs_statfs(ustr.Ustr, *stat.Statfs_t, *fd.Cwd_t) defs.Err_t
+	Statfs(*stat.Statfs_t)
+	Fs_utimens(ustr.Ustr, *fd.Cwd_t, int, int) defs.Err_t
+	Fs_futimens(*fd.Fd_t, int, int) defs.Err_t
+	Fs_chmod(ustr.Ustr, *fd.Cwd_t, int) defs.Err_t
+	Fs_fchmod(*fd.Fd_t, *fd.Cred_t, int) defs.Err_t
+	Fs_chown(ustr.Ustr, *fd.Cwd_t, int, int) defs.Err_t
+	Fs_fchown(*fd.Fd_t, *fd.Cred_t, int, int) defs.Err_t
+	Fs_mkdir(ustr.Ustr, int, *fd.Cwd_t) defs.Err_t
+	Fs_unlink(ustr.Ustr, *fd.Cwd_t, bool) defs.Err_t
+	Fs_link(ustr.Ustr, ustr.Ustr, *fd.Cwd_t) defs.Err_t
+	Fs_rename(ustr.Ustr, ustr.Ustr, *fd.Cwd_t) defs.Err_t
+	Fs_symlink(ustr.Ustr, ustr.Ustr, *fd.Cwd_t) defs.Err_t
+	Fs_readlink(ustr.Ustr, *fd.Cwd_t) (ustr.Ustr, defs.Err_t)
+	Fs_sync() defs.Err_t
+	// releases a page pinned by a shared file mapping
+	Unpin(mem.Pa_t)
+	// returns the file system's statistics and resets them
+	Fs_statistics() string
+	// called once the file system has been unmounted
+	StopFS()
+}
+
+/// Mkfs_t creates an instance of a file system type from the mount source,
+/// flags and the file system specific options in data, which may be empty.
+type Mkfs_t func(source ustr.Ustr, flags int, data ustr.Ustr) (Fs_i, defs.Err_t)
+
+var fstypes = map[string]Mkfs_t{}
+var fstypesl sync.Mutex
+
+/// Register makes file systems of type fstype mountable; mkfs creates them.
+func Register(fstype string, mkfs Mkfs_t) {
+	fstypesl.Lock()
+	defer fstypesl.Unlock()
+	if _, ok := fstypes[fstype]; ok {
+		panic("fstype registered twice")
+	}
+	fstypes[fstype] = mkfs
+}
+
+func mkfsfor(fstype string) (Mkfs_t, bool) {
+	fstypesl.Lock()
+	defer fstypesl.Unlock()
+	mkfs, ok := fstypes[fstype]
+	return mkfs, ok
+}
+
+// per-mount statistics
+type mntstats_t struct {
+	Nlookup stats.Counter_t
+	// lookups that entered the mount from another one
+	Ncross stats.Counter_t
+	Nopen  stats.Counter_t
+}
+
+type mount_t struct {
+	path   ustr.Ustr // canonical
+	fstype string
+	source ustr.Ustr
+	fs     Fs_i
+	// the mount that holds the mount point; nil for the root
+	parent *mount_t
+	// the mount point as the parent's file system opened it, and its inode
+	// number
+	mpfd   *fd.Fd_t
+	mpinum defs.Inum_t
+	// the inode numbers of the directories of fs that are mount points
+	mntpts map[defs.Inum_t]bool
+	// number of open fds that refer to the mount
+	nopen int64
+	stats mntstats_t
+}
+
+// the mount-local path of the canonical path full, which is in m.
+func (m *mount_t) local(full ustr.Ustr) ustr.Ustr {
+	if len(m.path) == 1 {
+		return full
+	}
+	rest := full[len(m.path):]
+	if len(rest) == 0 {
+		return ustr.MkUstrRoot()
+	}
+	return rest
+}
+
+/// Mntinfo_t describes an entry of the mount table.
+type Mntinfo_t struct {
+	Path   ustr.Ustr
+	Fstype string
+	Source ustr.Ustr
+}
+
+/// Vfs_t is the mount table. A path operation runs in the file system that
+/// holds the start of the path. The lookups of a file system stop where the
+/// path leaves it: at a directory that is a mount point, at ".." in the root
+/// of a mounted file system and at a symbolic link to an absolute path in a
+/// mounted file system. The operation then continues in the next file system
+/// with the rest of the path, so that each component is looked up once, by
+/// the file system that holds it. The fds of mounted file systems are wrapped
+/// so that a file system with open files cannot be unmounted.
+type Vfs_t struct {
+	// the read lock is held during path operations so that mounts do not
+	// change underneath them
+	sync.RWMutex
+	// mounts[0] is the root
+	mounts []*mount_t
+}
+
+/// MkVfs returns a mount table with root mounted at "/".
+func MkVfs(root Fs_i, fstype string, source ustr.Ustr) *Vfs_t {
+	vfs := &Vfs_t{}
+	m := &mount_t{path: ustr.MkUstrRoot(), fstype: fstype, source: source,
+		fs: root, mntpts: make(map[defs.Inum_t]bool)}
+	vfs.mounts = []*mount_t{m}
+	return vfs
+}
+
+// returns the mount on the directory inum of m.
+func (vfs *Vfs_t) child(m *mount_t, inum defs.Inum_t) *mount_t {
+	for _, o := range vfs.mounts[1:] {
+		if o.parent == m && o.mpinum == inum {
+			return o
+		}
+	}
+	panic("no mount on mount point")
+}
+
+// splits the first component off p. the rest keeps the slash that follows
+// the component, so that it is empty only if nothing follows.
+func firstcomp(p ustr.Ustr) (ustr.Ustr, ustr.Ustr) {
+	for len(p) > 0 && p[0] == '/' {
+		p = p[1:]
+	}
+	i := p.IndexByte('/')
+	if i == -1 {
+		return p, nil
+	}
+	return p[:i], p[i:]
+}
+
+// returns the canonical path of c in the canonical directory dir in a new
+// buffer.
+func join(dir, c ustr.Ustr) ustr.Ustr {
+	ret := make(ustr.Ustr, 0, len(dir)+1+len(c))
+	ret = append(ret, dir...)
+	if len(dir) > 1 {
+		ret = append(ret, '/')
+	}
+	return append(ret, c...)
+}
+
+// returns the parent of the canonical directory dir; the root is its own
+// parent.
+func parent(dir ustr.Ustr) ustr.Ustr {
+	for i := len(dir) - 1; i > 0; i-- {
+		if dir[i] == '/' {
+			return dir[:i]
+		}
+	}
+	return ustr.MkUstrRoot()
+}
+
+// returns the canonical path of p relative to the canonical directory dir. p
+// holds no symbolic links and its ".." do not leave dir's mount, so that ".."
+// names the parent of the path before it.
+func canonical(dir, p ustr.Ustr) ustr.Ustr {
+	ret := dir
+	for rest := p; ; {
+		var c ustr.Ustr
+		c, rest = firstcomp(rest)
+		switch {
+		case len(c) == 0:
+			return ret
+		case c.Isdot():
+		case c.Isdotdot():
+			ret = parent(ret)
+		default:
+			ret = join(ret, c)
+		}
+	}
+}
+
+// returns s followed by rest in a new buffer.
+func prepend(s string, rest ustr.Ustr) ustr.Ustr {
+	ret := make(ustr.Ustr, 0, len(s)+len(rest))
+	ret = append(ret, s...)
+	return append(ret, rest...)
+}
+
+// where a path operation ended
+type where_t struct {
+	m *mount_t
+	// the path that m's file system resolved, with symbolic links replaced
+	// by their targets, and the canonical directory that it is relative to
+	// if it is relative; only recorded if the caller asked for it
+	path ustr.Ustr
+	base ustr.Ustr
+}
+
+// returns the canonical path that the operation resolved.
+func (w *where_t) canonical() ustr.Ustr {
+	if w.path.IsAbsolute() {
+		return canonical(w.m.path, w.path)
+	}
+	return canonical(w.base, w.path)
+}
+
+// a path operation on p in mount m. relative paths start at the directory of
+// cwd, whose Mnt lets the lookups of m's file system stop where p leaves m.
+type op_t func(m *mount_t, p ustr.Ustr, cwd *fd.Cwd_t) defs.Err_t
+
+// returns the mount in which the lookup of p starts and the cwd for the
+// operations on p in it.
+func (vfs *Vfs_t) start(p ustr.Ustr, cwd *fd.Cwd_t) (*mount_t, *fd.Cwd_t) {
+	m := vfs.mounts[0]
+	c := &fd.Cwd_t{Fd: cwd.Fd, Path: cwd.Path, Cred: cwd.Cred,
+		Mnt: &fd.Mntwalk_t{}}
+	if !p.IsAbsolute() {
+		m, c.Fd = vfs.unwrap(cwd.Fd)
+	}
+	return m, c
+}
+
+// runs op on p in the mount in which the lookup of p starts and, each time
+// op fails with ECROSS, on the rest of p in the mount that p continues in.
+// the caller must hold the read lock. with only the root mounted, op runs on
+// p and cwd as they are, unless canon is set, which records the path that op
+// resolved for where_t.canonical.
+func (vfs *Vfs_t) run(p ustr.Ustr, cwd *fd.Cwd_t, canon bool, op op_t) (where_t, defs.Err_t) {
+	root := vfs.mounts[0]
+	if len(vfs.mounts) == 1 && !canon {
+		root.stats.Nlookup.Inc()
+		return where_t{m: root}, op(root, p, cwd)
+	}
+	m, c := vfs.start(p, cwd)
+	mw := c.Mnt
+	base := root.path
+	if !p.IsAbsolute() {
+		base = cwd.Path
+	}
+	first := m
+	for {
+		mw.Mntpts = m.mntpts
+		mw.Sub = m != root
+		err := op(m, p, c)
+		if err != -defs.ECROSS {
+			m.stats.Nlookup.Inc()
+			if m != first {
+				m.stats.Ncross.Inc()
+			}
+			return where_t{m: m, path: mw.Path, base: base}, err
+		}
+		if mw.Nlinks > fs.MAXSYMLINKS {
+			return where_t{}, -defs.ELOOP
+		}
+		switch mw.How {
+		case fd.MNT_DOWN:
+			m = vfs.child(m, mw.Inum)
+			p = prepend("/", mw.Rest)
+		case fd.MNT_UP:
+			// ".." of the mount point
+			base = m.path
+			c.Fd = m.mpfd
+			p = prepend("..", mw.Rest)
+			m = m.parent
+		case fd.MNT_ROOT:
+			m = root
+			p = mw.Rest
+		default:
+			panic("bad crossing")
+		}
+	}
+}
+
+// a path operation on the paths oldp and newp in mount m
+type op2_t func(m *mount_t, oldp, newp ustr.Ustr, cwd *fd.Cwd_t) defs.Err_t
+
+// runs op on the two paths of link(2) and rename(2), which must be in the
+// same mount. the caller must hold the read lock. op first runs in the mount
+// in which both lookups start. if either path leaves that mount, the
+// directories of both are resolved and op runs on the mount-local paths of
+// their entries.
+func (vfs *Vfs_t) run2(oldp, newp ustr.Ustr, cwd *fd.Cwd_t, op op2_t) defs.Err_t {
+	root := vfs.mounts[0]
+	if len(vfs.mounts) == 1 {
+		root.stats.Nlookup.Inc()
+		return op(root, oldp, newp, cwd)
+	}
+	m, c := vfs.start(oldp, cwd)
+	if nm, _ := vfs.start(newp, cwd); nm == m {
+		c.Mnt.Mntpts = m.mntpts
+		c.Mnt.Sub = m != root
+		if err := op(m, oldp, newp, c); err != -defs.ECROSS {
+			m.stats.Nlookup.Inc()
+			return err
+		}
+	}
+	odirs, ofn := bpath.Sdirname(oldp)
+	ndirs, nfn := bpath.Sdirname(newp)
+	ow, err := vfs.run(odirs, cwd, true, opstat)
+	if err != 0 {
+		return err
+	}
+	nw, err := vfs.run(ndirs, cwd, true, opstat)
+	if err != 0 {
+		return err
+	}
+	if ow.m != nw.m {
+		return -defs.EXDEV
+	}
+	m = ow.m
+	oldp = join(m.local(ow.canonical()), ofn)
+	newp = join(m.local(nw.canonical()), nfn)
+	c = &fd.Cwd_t{Fd: cwd.Fd, Path: cwd.Path, Cred: cwd.Cred,
+		Mnt: &fd.Mntwalk_t{Mntpts: m.mntpts, Sub: m != root}}
+	m.stats.Nlookup.Inc()
+	m.stats.Ncross.Inc()
+	if err := op(m, oldp, newp, c); err != -defs.ECROSS {
+		return err
+	}
+	// ".." in the last component leaves the mount
+	return -defs.EXDEV
+}
+
+// stats p, which must exist, to find the mount that holds it
+func opstat(m *mount_t, p ustr.Ustr, cwd *fd.Cwd_t) defs.Err_t {
+	return m.fs.Fs_stat(p, &stat.Stat_t{}, cwd)
+}
+
+// wraps the fds of a mounted file system so that the mount knows whether it
+// is busy.
+type mntfops_t struct {
+	fdops.Fdops_i
+	m *mount_t
+}
+
+func (mf *mntfops_t) Reopen() defs.Err_t {
+	err := mf.Fdops_i.Reopen()
+	if err == 0 {
+		atomic.AddInt64(&mf.m.nopen, 1)
+	}
+	return err
+}
+
+func (mf *mntfops_t) Close() defs.Err_t {
+	err := mf.Fdops_i.Close()
+	if err == 0 {
+		atomic.AddInt64(&mf.m.nopen, -1)
+	}
+	return err
+}
+
+// returns the mount of the open file f and f as its file system created it.
+// fds that do not belong to a mount, such as pipes, belong to the root.
+func (vfs *Vfs_t) unwrap(f *fd.Fd_t) (*mount_t, *fd.Fd_t) {
+	if mf, ok := f.Fops.(*mntfops_t); ok {
+		return mf.m, &fd.Fd_t{Fops: mf.Fdops_i, Perms: f.Perms}
+	}
+	return vfs.mounts[0], f
+}
+
+/// Fs_open opens a path in the file system mounted there. A symbolic link in
+/// the last component is followed unless O_CREAT and O_EXCL are both set.
+func (vfs *Vfs_t) Fs_open(p ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, major, minor int) (*fd.Fd_t, defs.Err_t) {
+	vfs.RLock()
+	defer vfs.RUnlock()
+	f, _, err := vfs.open(p, flags, mode, cwd, major, minor, false)
+	return f, err
+}
+
+/// Fs_opendir opens the directory p for chdir(2) and returns it with its
+/// canonical path, in which no component is a symbolic link, ".." or ".".
+func (vfs *Vfs_t) Fs_opendir(p ustr.Ustr, cwd *fd.Cwd_t) (*fd.Fd_t, ustr.Ustr, defs.Err_t) {
+	vfs.RLock()
+	defer vfs.RUnlock()
+	f, w, err := vfs.open(p, defs.O_RDONLY|defs.O_DIRECTORY, 0, cwd, 0, 0, true)
+	if err != 0 {
+		return nil, nil, err
+	}
+	return f, w.canonical(), 0
+}
+
+// opens p and wraps the fd if it belongs to a mount other than the root. the
+// caller must hold the read lock.
+func (vfs *Vfs_t) open(p ustr.Ustr, flags defs.Fdopt_t, mode int, cwd *fd.Cwd_t, major, minor int, canon bool) (*fd.Fd_t, where_t, defs.Err_t) {
+	var f *fd.Fd_t
+	w, err := vfs.run(p, cwd, canon, func(m *mount_t, p ustr.Ustr, c *fd.Cwd_t) defs.Err_t {
+		var err defs.Err_t
+		f, err = m.fs.Fs_open(p, flags, mode, c, major, minor)
+		return err
+	})
+	if w.m != nil {
+		w.m.stats.Nopen.Inc()
+	}
+	if err != 0 || w.m == vfs.mounts[0] {
+		return f, w, err
+	}
+	atomic.AddInt64(&w.m.nopen, 1)
+	f.Fops = &mntfops_t{Fdops_i: f.Fops, m: w.m}
+	return f, w, 0
+}
+
+/// Fs_mknod creates a special file and returns its inode number.
+func (vfs *Vfs_t) Fs_mknod(p ustr.Ustr, flags defs.Fdopt_t, cwd *fd.Cwd_t, major, minor int) (defs.Inum_t, defs.Err_t) {
+	vfs.RLock()
+	defer vfs.RUnlock()
+	var inum defs.Inum_t
+	_, err := vfs.run(p, cwd, false, func(m *mount_t, p ustr.Ustr, c *fd.Cwd_t) defs.Err_t {
+		var err defs.Err_t
+		inum, err = m.fs.Fs_mknod(p, flags, c, major, minor)
+		return err
+	})
+	return inum, err
+}
+
+/// Fs_access checks whether cwd's credentials grant want on path.
+func (vfs *Vfs_t) Fs_access(p ustr.Ustr, cwd *fd.Cwd_t, want int) defs.Err_t {
+	vfs.RLock()
+	defer vfs.RUnlock()
+	_, err := vfs.run(p, cwd, false, func(m *mount_t, p ustr.Ustr, c *fd.Cwd_t) defs.Err_t {
+		return m.fs.Fs_access(p, c, want)
+	})
+	return err
+}
+
+/// Fs_stat retrieves file information for path.
+func (vfs *Vfs_t) Fs_stat(p ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t) defs.Err_t {
+	vfs.RLock()
+	defer vfs.RUnlock()
+	_, err := vfs.run(p, cwd, false, func(m *mount_t, p ustr.Ustr, c *fd.Cwd_t) defs.Err_t {
+		return m.fs.Fs_stat(p, st, c)
+	})
+	return err
+}
+
+/// Fs_lstat is Fs_stat without following a symbolic link in the last
+/// component.
+func (vfs *Vfs_t) Fs_lstat(p ustr.Ustr, st *stat.Stat_t, cwd *fd.Cwd_t) defs.Err_t {
+	vfs.RLock()
+	defer vfs.RUnlock()
+	_, err := vfs.run(p, cwd, false, func(m *mount_t, p ustr.Ustr, c *fd.Cwd_t) defs.Err_t {
+		return m.fs.Fs_lstat(p, st, c)
+	})
+	return err
+}
+
+/// Fs_statfs fills st with the statistics of the file system that contains
+/// path.
+func (vfs *Vfs_t) Fs_statfs(p ustr.Ustr, st *stat.Statfs_t, cwd *fd.Cwd_t) defs.Err_t {
+	vfs.RLock()
+	defer vfs.RUnlock()
+	_, err := vfs.run(p, cwd, false, func(m *mount_t, p ustr.Ustr, c *fd.Cwd_t) defs.Err_t {
+		return m.fs.Fs_statfs(p, st, c)
+	})
+	return err
+}
+
+/// Fs_fstatfs fills st with the statistics of the file system of the open
+/// file f.
+func (vfs *Vfs_t) Fs_fstatfs(f *fd.Fd_t, st *stat.Statfs_t) {
+	m, _ := vfs.unwrap(f)
+	m.fs.Statfs(st)
+}
+
+/// Fs_utimens sets the access and modification times of path.
+func (vfs *Vfs_t) Fs_utimens(p ustr.Ustr, cwd *fd.Cwd_t, atime, mtime int) defs.Err_t {
+	vfs.RLock()
+	defer vfs.RUnlock()
+	_, err := vfs.run(p, cwd, false, func(m *mount_t, p ustr.Ustr, c *fd.Cwd_t) defs.Err_t {
+		return m.fs.Fs_utimens(p, c, atime, mtime)
+	})
+	return err
+}
+
+/// Fs_futimens is Fs_utimens for an open file.
+func (vfs *Vfs_t) Fs_futimens(f *fd.Fd_t, atime, mtime int) defs.Err_t {
+	m, uf := vfs.unwrap(f)
+	return m.fs.Fs_futimens(uf, atime, mtime)
+}
+
+/// Fs_chmod sets the permission bits of path.
+func (vfs *Vfs_t) Fs_chmod(p ustr.Ustr, cwd *fd.Cwd_t, mode int) defs.Err_t {
+	vfs.RLock()
+	defer vfs.RUnlock()
+	_, err := vfs.run(p, cwd, false, func(m *mount_t, p ustr.Ustr, c *fd.Cwd_t) defs.Err_t {
+		return m.fs.Fs_chmod(p, c, mode)
+	})
+	return err
+}
+
+/// Fs_fchmod is Fs_chmod for an open file.
+func (vfs *Vfs_t) Fs_fchmod(f *fd.Fd_t, cred *fd.Cred_t, mode int) defs.Err_t {
+	m, uf := vfs.unwrap(f)
+	return m.fs.Fs_fchmod(uf, cred, mode)
+}
+
+/// Fs_chown sets the owner and group of path.
+func (vfs *Vfs_t) Fs_chown(p ustr.Ustr, cwd *fd.Cwd_t, uid, gid int) defs.Err_t {
+	vfs.RLock()
+	defer vfs.RUnlock()
+	_, err := vfs.run(p, cwd, false, func(m *mount_t, p ustr.Ustr, c *fd.Cwd_t) defs.Err_t {
+		return m.fs.Fs_chown(p, c, uid, gid)
+	})
+	return err
+}
+
+/// Fs_fchown is Fs_chown for an open file.
+func (vfs *Vfs_t) Fs_fchown(f *fd.Fd_t, cred *fd.Cred_t, uid, gid int) defs.Err_t {
+	m, uf := vfs.unwrap(f)
+	return m.fs.Fs_fchown(uf, cred, uid, gid)
+}
+
+/// Fs_mkdir creates the directory path.
+func (vfs *Vfs_t) Fs_mkdir(p ustr.Ustr, mode int, cwd *fd.Cwd_t) defs.Err_t {
+	vfs.RLock()
+	defer vfs.RUnlock()
+	_, err := vfs.run(p, cwd, false, func(m *mount_t, p ustr.Ustr, c *fd.Cwd_t) defs.Err_t {
+		return m.fs.Fs_mkdir(p, mode, c)
+	})
+	return err
+}
+
+/// Fs_unlink removes path, which must be a directory if wantdir is set. A
+/// mount point cannot be removed.
+func (vfs *Vfs_t) Fs_unlink(p ustr.Ustr, cwd *fd.Cwd_t, wantdir bool) defs.Err_t {
+	vfs.RLock()
+	defer vfs.RUnlock()
+	_, err := vfs.run(p, cwd, false, func(m *mount_t, p ustr.Ustr, c *fd.Cwd_t) defs.Err_t {
+		return m.fs.Fs_unlink(p, c, wantdir)
+	})
+	return err
+}
+
+/// Fs_symlink creates a symbolic link at linkp that refers to target.
+func (vfs *Vfs_t) Fs_symlink(target, linkp ustr.Ustr, cwd *fd.Cwd_t) defs.Err_t {
+	vfs.RLock()
+	defer vfs.RUnlock()
+	_, err := vfs.run(linkp, cwd, false, func(m *mount_t, p ustr.Ustr, c *fd.Cwd_t) defs.Err_t {
+		return m.fs.Fs_symlink(target, p, c)
+	})
+	return err
+}
+
+/// Fs_readlink returns the target of the symbolic link at path.
+func (vfs *Vfs_t) Fs_readlink(p ustr.Ustr, cwd *fd.Cwd_t) (ustr.Ustr, defs.Err_t) {
+	vfs.RLock()
+	defer vfs.RUnlock()
+	var target ustr.Ustr
+	_, err := vfs.run(p, cwd, false, func(m *mount_t, p ustr.Ustr, c *fd.Cwd_t) defs.Err_t {
+		var err defs.Err_t
+		target, err = m.fs.Fs_readlink(p, c)
+		return err
+	})
+	return target, err
+}
+
+/// Fs_link creates the hard link newp to oldp. Both must be in the same
+/// mount.
+func (vfs *Vfs_t) Fs_link(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) defs.Err_t {
+	vfs.RLock()
+	defer vfs.RUnlock()
+	return vfs.run2(oldp, newp, cwd, func(m *mount_t, oldp, newp ustr.Ustr, c *fd.Cwd_t) defs.Err_t {
+		return m.fs.Fs_link(oldp, newp, c)
+	})
+}
+
+/// Fs_rename moves oldp to newp. Both must be in the same mount, and neither
+/// may be a mount point or contain one.
+func (vfs *Vfs_t) Fs_rename(oldp, newp ustr.Ustr, cwd *fd.Cwd_t) defs.Err_t {
+	vfs.RLock()
+	defer vfs.RUnlock()
+	return vfs.run2(oldp, newp, cwd, func(m *mount_t, oldp, newp ustr.Ustr, c *fd.Cwd_t) defs.Err_t {
+		return m.fs.Fs_rename(oldp, newp, c)
+	})
+}
+
+/// Fs_sync flushes every mounted file system.
+func (vfs *Vfs_t) Fs_sync() defs.Err_t {
+	vfs.RLock()
+	defer vfs.RUnlock()
+	for _, m := range vfs.mounts {
+		if err := m.fs.Fs_sync(); err != 0 {
+			return err
+		}
+	}
+	return 0
+}
+
+/// Unpinner returns the file system that releases the pages that a shared
+/// mapping of the open file f pins.
+func (vfs *Vfs_t) Unpinner(f *fd.Fd_t) mem.Unpin_i {
+	m, _ := vfs.unwrap(f)
+	return m.fs
+}
+
+/// Mount mounts a new file system of type fstype, created from source, flags
+/// and data, on the directory target. Only the superuser may mount.
+func (vfs *Vfs_t) Mount(source, target ustr.Ustr, fstype string, flags int, data ustr.Ustr, cwd *fd.Cwd_t) defs.Err_t {
+	if !cwd.Cred.Root() {
+		return -defs.EPERM
+	}
+	mkfs, ok := mkfsfor(fstype)
+	if !ok {
+		return -defs.ENODEV
+	}
+
+	vfs.Lock()
+	defer vfs.Unlock()
+	// the mount point stays open while it is mounted on, so that the mount
+	// can be left through its ".."
+	var mpfd *fd.Fd_t
+	w, err := vfs.run(target, cwd, true, func(m *mount_t, p ustr.Ustr, c *fd.Cwd_t) defs.Err_t {
+		var err defs.Err_t
+		mpfd, err = m.fs.Fs_open(p, defs.O_RDONLY|defs.O_DIRECTORY, 0, c, 0, 0)
+		return err
+	})
+	if err != 0 {
+		return err
+	}
+	full := w.canonical()
+	// the root of a mount is already mounted on
+	if full.Eq(w.m.path) {
+		fd.Close_panic(mpfd)
+		return -defs.EBUSY
+	}
+	nfs, err := mkfs(source, flags, data)
+	if err != 0 {
+		fd.Close_panic(mpfd)
+		return err
+	}
+	inum := mpfd.Fops.Pathi()
+	w.m.mntpts[inum] = true
+	vfs.mounts = append(vfs.mounts, &mount_t{path: full, fstype: fstype,
+		source: source, fs: nfs, parent: w.m, mpfd: mpfd, mpinum: inum,
+		mntpts: make(map[defs.Inum_t]bool)})
+	return 0
+}
+
+/// Umount unmounts the file system mounted at target, which fails with EBUSY
+/// while files in it are open or other file systems are mounted in it. flags
+/// must be zero.
+func (vfs *Vfs_t) Umount(target ustr.Ustr, flags int, cwd *fd.Cwd_t) defs.Err_t {
+	if !cwd.Cred.Root() {
+		return -defs.EPERM
+	}
+	if flags != 0 {
+		return -defs.EINVAL
+	}
+
+	vfs.Lock()
+	w, err := vfs.run(target, cwd, true, opstat)
+	if err != 0 {
+		vfs.Unlock()
+		return err
+	}
+	m := w.m
+	if m == vfs.mounts[0] || !w.canonical().Eq(m.path) {
+		vfs.Unlock()
+		return -defs.EINVAL
+	}
+	idx := 0
+	for i, o := range vfs.mounts {
+		if o == m {
+			idx = i
+		} else if o.parent == m {
+			vfs.Unlock()
+			return -defs.EBUSY
+		}
+	}
+	if atomic.LoadInt64(&m.nopen) != 0 {
+		vfs.Unlock()
+		return -defs.EBUSY
+	}
+	copy(vfs.mounts[idx:], vfs.mounts[idx+1:])
+	vfs.mounts = vfs.mounts[:len(vfs.mounts)-1]
+	delete(m.parent.mntpts, m.mpinum)
+	vfs.Unlock()
+
+	fd.Close_panic(m.mpfd)
+	m.fs.Fs_sync()
+	m.fs.StopFS()
+	return 0
+}
+
+/// Mounts returns the mount table, the root first.
+func (vfs *Vfs_t) Mounts() []Mntinfo_t {
+	vfs.RLock()
+	defer vfs.RUnlock()
+	ret := make([]Mntinfo_t, len(vfs.mounts))
+	for i, m := range vfs.mounts {
+		ret[i] = Mntinfo_t{Path: m.path, Fstype: m.fstype, Source: m.source}
+	}
+	return ret
+}
+
+/// Stats returns the statistics of each mount and resets them. They include
+/// the statistics of each mounted file system other than the root.
+func (vfs *Vfs_t) Stats() string {
+	// path operations count under the read lock
+	vfs.Lock()
+	defer vfs.Unlock()
+	s := ""
+	for i, m := range vfs.mounts {
+		s += "mount " + m.path.String() + " " + m.fstype + " open " +
+			strconv.FormatInt(atomic.LoadInt64(&m.nopen), 10)
+		s += stats.Stats2String(m.stats)
+		if !stats.Stats {
+			s += "\n"
+		}
+		m.stats = mntstats_t{}
+		if i != 0 {
+			s += m.fs.Fs_statistics()
+		}
+	}
+	return s
+}
@@ -95,6 +95,18 @@ func (vmi *Vminfo_t) Filepage(va uintptr) (*mem.Pg_t, mem.Pa_t, defs.Err_t) {
 	return mmapi[0].Pg, mmapi[0].Phys, 0
 }
 
+/// Fileoff returns the file offset at which a file mapping starts and zero
+/// for other mappings.
+func (vmi *Vminfo_t) Fileoff() int {
+	return vmi.file.foff
+}
+
+/// Shared reports whether the mapping's pages are shared with other mappings
+/// of the same memory instead of being copied on write.
+func (vmi *Vminfo_t) Shared() bool {
+	return vmi.Mtype == VSANON || (vmi.Mtype == VFILE && vmi.file.shared)
+}
+
 /// Ptefor returns the page table entry pointer for `va` in `pmap`,
 /// allocating intermediate tables as necessary.
 
@@ -0,0 +1,23 @@
+#include <litc.h>
+
+int main(int argc, char **argv)
+{
+	char *p = "/";
+	if (argc == 2)
+		p = argv[1];
+	else if (argc > 2)
+		errx(-1, "usage: %s [path]\n", argv[0]);
+
+	struct statfs st;
+	if (statfs(p, &st))
+		err(-1, "statfs");
+	ulong kb = st.f_bsize / 1024;
+	printf("%10s %10s %10s %10s %10s %10s\n", "1K-blocks", "Used",
+	    "Available", "Inodes", "IUsed", "IFree");
+	printf("%10lu %10lu %10lu %10lu %10lu %10lu\n", st.f_blocks*kb,
+	    (st.f_blocks - st.f_bfree)*kb, st.f_bavail*kb, st.f_files,
+	    st.f_files - st.f_ffree, st.f_ffree);
+	printf("block size %lu, log %lu blocks, names up to %lu bytes\n",
+	    st.f_bsize, st.f_loglen, st.f_namelen);
+	return 0;
+}
@@ -37,8 +37,10 @@ extern "C" {
 #define		EINVAL		22
 #define		ENFILE		23
 #define		EMFILE		24
+#define		EFBIG		27
 #define		ENOSPC		28
 #define		ESPIPE		29
+#define		EROFS		30
 #define		EPIPE		32
 #define		ERANGE		34
 #define		ENAMETOOLONG	36
@@ -236,6 +238,22 @@ struct stat {
 	blkcnt_t	st_blocks;
 	time_t		st_mtime;
 	ulong		st_mtimensec;
+	time_t		st_atime;
+	ulong		st_atimensec;
+	time_t		st_ctime;
+	ulong		st_ctimensec;
+	gid_t		st_gid;
+};
+
+struct statfs {
+	ulong		f_bsize;
+	ulong		f_blocks;
+	ulong		f_bfree;
+	ulong		f_bavail;
+	ulong		f_files;
+	ulong		f_ffree;
+	ulong		f_namelen;
+	ulong		f_loglen;
 };
 
 #define		S_IFMT		(0xffff0000ul)
@@ -287,6 +305,7 @@ int access(const char *, int);
 int bind(int, const struct sockaddr *, socklen_t);
 int connect(int, const struct sockaddr *, socklen_t);
 int chmod(const char *, mode_t);
+int fchmod(int, mode_t);
 int close(int);
 int chdir(const char *);
 int dup(int);
@@ -296,8 +315,12 @@ void _exit(int)
 int execv(const char *, char * const[]);
 int execve(const char *, char * const[], char * const[]);
 int execvp(const char *, char * const[]);
+int fallocate(int, int, off_t, off_t);
+#define		FALLOC_FL_KEEP_SIZE	0x1
+#define		FALLOC_FL_PUNCH_HOLE	0x2
 pid_t fork(void);
 int fstat(int, struct stat *);
+int fstatfs(int, struct statfs *);
 int ftruncate(int, off_t);
 int futex(const int, void *, void *, int, const struct timespec *);
 #define		FUTEX_SLEEP	1
@@ -305,6 +328,7 @@ int futex(const int, void *, void *, int, const struct timespec *);
 #define		FUTEX_CNDGIVE	3
 
 char *getcwd(char *, size_t);
+ssize_t getdents64(int, void *, size_t);
 pid_t getpid(void);
 pid_t getppid(void);
 
@@ -337,6 +361,7 @@ int kill(int, int);
 int link(const char *, const char *);
 int listen(int, int);
 off_t lseek(int, off_t, int);
+int lstat(const char *, struct stat *);
 #define		SEEK_SET	1
 #define		SEEK_CUR	2
 #define		SEEK_END	4
@@ -344,6 +369,7 @@ off_t lseek(int, off_t, int);
 int mkdir(const char *, long);
 int mknod(const char *, mode_t, dev_t);
 void *mmap(void *, size_t, int, int, int, long);
+int mount(const char *, const char *, const char *, ulong, const void *);
 int munmap(void *, size_t);
 int nanosleep(const struct timespec *, struct timespec *);
 int open(const char *, int, ...);
@@ -365,6 +391,7 @@ int poll(struct pollfd *, nfds_t, int);
 ssize_t pread(int, void *, size_t, off_t);
 ssize_t pwrite(int, const void *, size_t, off_t);
 ssize_t read(int, void*, size_t);
+ssize_t readlink(const char *, char *, size_t);
 ssize_t readv(int, const struct iovec *, int);
 int reboot(void);
 ssize_t recv(int, void *, size_t, int);
@@ -470,6 +497,8 @@ int socket(int, int, int);
 #define		SOCK_NONBLOCK	(1 << 5)
 
 int stat(const char *, struct stat *);
+int statfs(const char *, struct statfs *);
+int symlink(const char *, const char *);
 int sync(void);
 long sys_prof(long, long, long, long);
 #define		PROF_DISABLE   (1ul << 0)
@@ -515,7 +544,14 @@ long sys_info(long);
 #define		SINFO_PROCLIST				11l
 
 int truncate(const char *, off_t);
+int umount(const char *);
+int umount2(const char *, int);
 int unlink(const char *);
+int utimensat(int, const char *, const struct timespec[2], int);
+#define		AT_FDCWD	(-100)
+#define		UTIME_NOW	((1l << 30) - 1)
+#define		UTIME_OMIT	((1l << 30) - 2)
+int futimens(int, const struct timespec[2]);
 pid_t wait(int *);
 pid_t waitpid(pid_t, int *, int);
 pid_t wait3(int *, int, struct rusage *);
@@ -671,16 +707,25 @@ int posix_spawn_file_actions_init(posix_spawn_file_actions_t *);
 #define		atof(s)		strtod(s, NULL)
 
 #define		_POSIX_NAME_MAX	14
+#define		NAME_MAX	512
 struct dirent {
 	ino_t d_ino;
-	char d_name[_POSIX_NAME_MAX];
+	off_t d_off;
+	unsigned char d_type;
+	char d_name[NAME_MAX + 1];
 };
+#define		DT_UNKNOWN	0
+#define		DT_CHR		2
+#define		DT_DIR		4
+#define		DT_REG		8
+#define		DT_LNK		10
 
 typedef struct {
 	int fd;
-	uint cent;
-	uint nent;
-	struct dirent dents[];
+	uint bpos;	// offset of the next record in buf
+	uint blen;	// bytes of records in buf
+	long loc;	// cookie of the next entry
+	char buf[4096];
 } DIR;
 
 extern __thread int errno;
@@ -757,6 +802,7 @@ FILE *fdopen(int, const char *);
 FILE *fopen(const char *, const char *);
 int fprintf(FILE *, const char *, ...)
     __attribute__((format(printf, 2, 3)));
+int fdatasync(int);
 int fsync(int);
 //int fputs(const char *, FILE *); /*REDIS*/
 size_t fread(void *, size_t, size_t, FILE *);
@@ -820,6 +866,7 @@ char *readline(const char *);
 void rewinddir(DIR *);
 //int scanf(const char *, ...) /*REDIS*/
 //    __attribute__((format(scanf, 1, 2))); /*REDIS*/
+void seekdir(DIR *, long);
 int setenv(const char *, const char *, int);
 char *setlocale(int, const char *);
 #define		LC_COLLATE	1
@@ -871,6 +918,7 @@ void syslog(int, const char *, ...);
 #define		LOG_LOCAL7	(1ull << 15)
 #define		LOG_USER	(1ull << 16)
 #define		LOG_ALL		(0x1ffff)
+long telldir(DIR *);
 time_t time(time_t*);
 int tolower(int);
 int toupper(int);
@@ -927,6 +975,7 @@ struct hostent {
 
 struct hostent *gethostbyname(const char *);
 int chown(const char *, uid_t, gid_t);
+int fchown(int, uid_t, gid_t);
 time_t mktime(struct tm *);
 int getpeername(int, struct sockaddr *, socklen_t *);
 int getsockname(int, struct sockaddr *, socklen_t *);
@@ -980,6 +1029,7 @@ int sigsuspend(const sigset_t *);
 int setpriority(int, int, int);
 #define		PRIO_PROCESS	1
 
+gid_t getgid(void);
 uid_t getuid(void);
 int setuid(uid_t);
 int setgid(gid_t);
@@ -988,7 +1038,6 @@ int initgroups(const char *, gid_t);
 #define		MSG_PEEK	1
 
 char *realpath(const char *, char *);
-int lstat(const char *, struct stat *);
 
 //static inline pid_t
 //getppid(void)
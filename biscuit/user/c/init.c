@@ -45,24 +45,18 @@ int main(int argc, char **argv)
 
 	printf("init starting...\n");
 
-	// create dev nodes
-	mkdir("/dev", 0);
-	int ret;
-	ret = mknod("/dev/console", 0, MKDEV(1, 0));
-	if (ret != 0 && errno != EEXIST)
-		err(-1, "mknod");
-	ret = mknod("/dev/null", 0, MKDEV(4, 0));
-	if (ret != 0 && errno != EEXIST)
-		err(-1, "mknod");
-	ret = mknod("/dev/rsd0c", 0, MKDEV(5, 0));
-	if (ret != 0 && errno != EEXIST)
-		err(-1, "mknod");
-	ret = mknod("/dev/stats", 0, MKDEV(6, 0));
-	if (ret != 0 && errno != EEXIST)
-		err(-1, "mknod");
-	ret = mknod("/dev/prof", 0, MKDEV(7, 0));
-	if (ret != 0 && errno != EEXIST)
-		err(-1, "mknod");
+	// device files are made by the kernel
+	mkdir("/dev", 0755);
+	if (mount("dev", "/dev", "devfs", 0, NULL) == -1)
+		err(-1, "mount /dev");
+
+	// temporary files live in memory
+	mkdir("/tmp", 01777);
+	if (mount("tmpfs", "/tmp", "tmpfs", 0, NULL) == -1)
+		err(-1, "mount /tmp");
+	mkdir("/proc", 0555);
+	if (mount("proc", "/proc", "proc", 0, NULL) == -1)
+		err(-1, "mount /proc");
 
 	char * const largs [] = {"/bin/bmgc", "-l", "512", NULL};
 	fexec(largs);
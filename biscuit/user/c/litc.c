@@ -7,6 +7,7 @@
 #define SYS_CLOSE        3
 #define SYS_STAT         4
 #define SYS_FSTAT        5
+#define SYS_LSTAT        6
 #define SYS_POLL         7
 #define SYS_LSEEK        8
 #define SYS_MMAP         9
@@ -38,6 +39,8 @@
 #define SYS_WAIT4        61
 #define SYS_KILL         62
 #define SYS_FCNTL        72
+#define SYS_FSYNC        74
+#define SYS_FDATASYNC    75
 #define SYS_TRUNC        76
 #define SYS_FTRUNC       77
 #define SYS_GETCWD       79
@@ -46,14 +49,31 @@
 #define SYS_MKDIR        83
 #define SYS_LINK         86
 #define SYS_UNLINK       87
+#define SYS_SYMLINK      88
+#define SYS_READLINK     89
+#define SYS_CHMOD        90
+#define SYS_FCHMOD       91
+#define SYS_CHOWN        92
+#define SYS_FCHOWN       93
 #define SYS_GETTOD       96
 #define SYS_GETRLIMIT    97
 #define SYS_GETRUSAGE    98
+#define SYS_GETUID       102
+#define SYS_GETGID       104
+#define SYS_SETUID       105
+#define SYS_SETGID       106
 #define SYS_MKNOD        133
+#define SYS_STATFS       137
+#define SYS_FSTATFS      138
 #define SYS_SETRLIMIT    160
 #define SYS_SYNC         162
+#define SYS_MOUNT        165
+#define SYS_UMOUNT2      166
 #define SYS_REBOOT       169
+#define SYS_GETDENTS64   217
 #define SYS_NANOSLEEP    230
+#define SYS_UTIMENSAT    280
+#define SYS_FALLOCATE    285
 #define SYS_PIPE2        293
 #define SYS_PROF         31337
 #define SYS_THREXIT      31338
@@ -185,8 +205,17 @@ connect(int fd, const struct sockaddr *sa, socklen_t salen)
 int
 chmod(const char *path, mode_t mode)
 {
-	printf("warning: chmod is a no-op\n");
-	return 0;
+	int ret = syscall(SA(path), SA(mode), 0, 0, 0, SYS_CHMOD);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
+int
+chown(const char *path, uid_t uid, gid_t gid)
+{
+	int ret = syscall(SA(path), SA(uid), SA(gid), 0, 0, SYS_CHOWN);
+	ERRNO_NZ(ret);
+	return ret;
 }
 
 int
@@ -288,6 +317,31 @@ fcntl(int fd, int cmd, ...)
 	return ret;
 }
 
+int
+fallocate(int fd, int mode, off_t off, off_t len)
+{
+	int ret = syscall(SA(fd), SA(mode), SA(off), SA(len), 0,
+	    SYS_FALLOCATE);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
+int
+fchmod(int fd, mode_t mode)
+{
+	int ret = syscall(SA(fd), SA(mode), 0, 0, 0, SYS_FCHMOD);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
+int
+fchown(int fd, uid_t uid, gid_t gid)
+{
+	int ret = syscall(SA(fd), SA(uid), SA(gid), 0, 0, SYS_FCHOWN);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 pid_t
 fork(void)
 {
@@ -305,6 +359,14 @@ fstat(int fd, struct stat *buf)
 	return ret;
 }
 
+int
+fstatfs(int fd, struct statfs *buf)
+{
+	int ret = syscall(SA(fd), SA(buf), 0, 0, 0, SYS_FSTATFS);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 char *
 getcwd(char *buf, size_t sz)
 {
@@ -315,6 +377,14 @@ getcwd(char *buf, size_t sz)
 	return buf;
 }
 
+ssize_t
+getdents64(int fd, void *buf, size_t sz)
+{
+	ssize_t ret = syscall(SA(fd), SA(buf), SA(sz), 0, 0, SYS_GETDENTS64);
+	ERRNO_NEG(ret);
+	return ret;
+}
+
 pid_t
 getpid(void)
 {
@@ -327,6 +397,18 @@ getppid(void)
 	return syscall(0, 0, 0, 0, 0, SYS_GETPPID);
 }
 
+gid_t
+getgid(void)
+{
+	return syscall(0, 0, 0, 0, 0, SYS_GETGID);
+}
+
+uid_t
+getuid(void)
+{
+	return syscall(0, 0, 0, 0, 0, SYS_GETUID);
+}
+
 int
 getsockopt(int fd, int level, int opt, void *optv, socklen_t *optlen)
 {
@@ -422,6 +504,14 @@ lseek(int fd, off_t off, int whence)
 	return ret;
 }
 
+int
+lstat(const char *path, struct stat *st)
+{
+	int ret = syscall(SA(path), SA(st), 0, 0, 0, SYS_LSTAT);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 int
 mkdir(const char *p, long mode)
 {
@@ -455,6 +545,16 @@ mmap(void *addr, size_t len, int prot, int flags, int fd, long offset)
 	return (void *)ret;
 }
 
+int
+mount(const char *src, const char *target, const char *fstype, ulong flags,
+    const void *data)
+{
+	int ret = syscall(SA(src), SA(target), SA(fstype), SA(flags), SA(data),
+	    SYS_MOUNT);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 int
 munmap(void *addr, size_t len)
 {
@@ -546,6 +646,14 @@ read(int fd, void *buf, size_t c)
 	return ret;
 }
 
+ssize_t
+readlink(const char *path, char *buf, size_t sz)
+{
+	ssize_t ret = syscall(SA(path), SA(buf), SA(sz), 0, 0, SYS_READLINK);
+	ERRNO_NEG(ret);
+	return ret;
+}
+
 int
 reboot(void)
 {
@@ -721,6 +829,22 @@ stat(const char *path, struct stat *st)
 	return ret;
 }
 
+int
+statfs(const char *path, struct statfs *buf)
+{
+	int ret = syscall(SA(path), SA(buf), 0, 0, 0, SYS_STATFS);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
+int
+symlink(const char *target, const char *link)
+{
+	int ret = syscall(SA(target), SA(link), 0, 0, 0, SYS_SYMLINK);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 int
 sync(void)
 {
@@ -753,6 +877,20 @@ truncate(const char *p, off_t newlen)
 	return ret;
 }
 
+int
+umount(const char *target)
+{
+	return umount2(target, 0);
+}
+
+int
+umount2(const char *target, int flags)
+{
+	int ret = syscall(SA(target), SA(flags), 0, 0, 0, SYS_UMOUNT2);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 static int
 _unlink(const char *path, int wantdir)
 {
@@ -773,6 +911,22 @@ rmdir(const char *path)
 	return _unlink(path, 1);
 }
 
+int
+utimensat(int dirfd, const char *path, const struct timespec times[2],
+    int flags)
+{
+	int ret = syscall(SA(dirfd), SA(path), SA(times), SA(flags), 0,
+	    SYS_UTIMENSAT);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
+int
+futimens(int fd, const struct timespec times[2])
+{
+	return utimensat(fd, NULL, times, 0);
+}
+
 pid_t
 wait(int *status)
 {
@@ -1871,11 +2025,20 @@ futex(const int op, void *fut, void *fut2, int aux, const struct timespec *ts)
 	return ret;
 }
 
+int
+fdatasync(int fd)
+{
+	int ret = syscall(SA(fd), 0, 0, 0, 0, SYS_FDATASYNC);
+	ERRNO_NZ(ret);
+	return ret;
+}
+
 int
 fsync(int fd)
 {
-	sync();
-	return 0;
+	int ret = syscall(SA(fd), 0, 0, 0, 0, SYS_FSYNC);
+	ERRNO_NZ(ret);
+	return ret;
 }
 
 static void
@@ -2178,8 +2341,6 @@ mkdtemp(char *t)
 DIR *
 fdopendir(int fd)
 {
-        #define BSIZE 4096
-  
 	struct stat st;
 	if (fstat(fd, &st) == -1)
 		return NULL;
@@ -2187,59 +2348,16 @@ fdopendir(int fd)
 		errno = ENOTDIR;
 		return NULL;
 	}
-	// allocate enough space for all dirents; count them.
 	if (lseek(fd, 0, SEEK_SET) == -1)
 		return NULL;
-	// on disk format of directory entries
-	struct  __attribute__((packed)) _dirent_t {
-		char	name[_POSIX_NAME_MAX];
-		ulong	inum;
-	};
-	const int nde = BSIZE/sizeof(struct _dirent_t);
-	size_t c = 0;
-	char buf[BSIZE];
-	ssize_t r;
-	while ((r = read(fd, buf, sizeof(buf))) > 0) {
-		int i;
-		for (i = 0; i < nde; i++) {
-			struct _dirent_t *de = (struct _dirent_t *)buf + i;
-			if (de->name[0] != '\0')
-				c++;
-		}
-	}
-	if (r == -1)
-		return NULL;
-	if (c > (ULONG_MAX - sizeof(DIR))/sizeof(struct dirent))
-		errx(-1, "very fat dir");
-	DIR *ret = malloc(sizeof(DIR) + c*sizeof(struct dirent));
+	DIR *ret = malloc(sizeof(DIR));
 	if (!ret)
 		return NULL;
-
-	// copy dirents into ret
 	ret->fd = fd;
-	ret->nent = (int)c;
-	ret->cent = 0;
-	if (lseek(fd, 0, SEEK_SET) == -1)
-		goto out;
-	struct dirent *p = &ret->dents[0];
-	while ((r = read(fd, buf, sizeof(buf))) > 0) {
-		int i;
-		for (i = 0; i < nde; i++) {
-			struct _dirent_t *de = (struct _dirent_t *)buf + i;
-			if (de->name[0] != '\0') {
-				p->d_ino = de->inum;
-				strncpy(p->d_name, de->name,
-				    sizeof(p->d_name));
-				p++;
-			}
-		}
-	}
-	if (r == -1)
-		goto out;
+	ret->bpos = 0;
+	ret->blen = 0;
+	ret->loc = 0;
 	return ret;
-out:
-	free(ret);
-	return NULL;
 }
 
 DIR *
@@ -2264,7 +2382,11 @@ readdir(DIR *d)
 {
 	static struct dirent _ret;
 	struct dirent *ret;
-	readdir_r(d, &_ret, &ret);
+	int r;
+	if ((r = readdir_r(d, &_ret, &ret)) != 0) {
+		errno = r;
+		return NULL;
+	}
 	return ret;
 }
 
@@ -2272,12 +2394,33 @@ readdir(DIR *d)
 int
 readdir_r(DIR *d, struct dirent *entry, struct dirent **ret)
 {
-	if (d->cent == d->nent) {
-		*ret = NULL;
-		return 0;
+	// records as returned by getdents64(2)
+	struct __attribute__((packed)) _dirent64_t {
+		ulong	inum;
+		long	off;
+		ushort	reclen;
+		uchar	type;
+		char	name[];
+	};
+	if (d->bpos == d->blen) {
+		ssize_t r = getdents64(d->fd, d->buf, sizeof(d->buf));
+		if (r == -1)
+			return errno;
+		d->bpos = 0;
+		d->blen = r;
+		if (r == 0) {
+			*ret = NULL;
+			return 0;
+		}
 	}
-	struct dirent *src = &d->dents[d->cent++];
-	*entry = *src;
+	struct _dirent64_t *de = (struct _dirent64_t *)(d->buf + d->bpos);
+	d->bpos += de->reclen;
+	entry->d_ino = de->inum;
+	entry->d_off = de->off;
+	d->loc = de->off;
+	entry->d_type = de->type;
+	strncpy(entry->d_name, de->name, sizeof(entry->d_name) - 1);
+	entry->d_name[sizeof(entry->d_name) - 1] = '\0';
 	*ret = entry;
 	return 0;
 }
@@ -2285,7 +2428,21 @@ readdir_r(DIR *d, struct dirent *entry, struct dirent **ret)
 void
 rewinddir(DIR *d)
 {
-	d->cent = 0;
+	seekdir(d, 0);
+}
+
+void
+seekdir(DIR *d, long loc)
+{
+	d->bpos = d->blen = 0;
+	d->loc = loc;
+	lseek(d->fd, loc, SEEK_SET);
+}
+
+long
+telldir(DIR *d)
+{
+	return d->loc;
 }
 
 struct {
@@ -3062,8 +3219,10 @@ static const char * const _errstr[] = {
 	[EINVAL] = "Invalid argument",
 	[ENFILE] = "Too many open files in system",
 	[EMFILE] = "Too many open files",
+	[EFBIG] = "File too large",
 	[ENOSPC] = "No space left on device",
 	[ESPIPE] = "Illegal seek",
+	[EROFS] = "Read-only file system",
 	[EPIPE] = "Broken pipe",
 	[ERANGE] = "Result too large",
 	[ENAMETOOLONG] = "File name too long",
@@ -3602,7 +3761,7 @@ getenv(char *name)
 uid_t
 geteuid(void)
 {
-	HACK(666);
+	return getuid();
 }
 
 struct passwd *
@@ -3632,15 +3791,6 @@ gethostbyname(const char *a)
 	FAIL;
 }
 
-int
-chown(const char *a, uid_t b, gid_t c)
-{
-	if (b != 666 || c != -1)
-		errx(-1, "unexpected chown");
-	errno = 0;
-	HACK(0);
-}
-
 time_t
 mktime(struct tm *a)
 {
@@ -3695,7 +3845,15 @@ gmtime(const time_t *a)
 int
 utimes(const char *a, const struct timeval b[2])
 {
-	FAIL;
+	if (b == NULL)
+		return utimensat(AT_FDCWD, a, NULL, 0);
+	struct timespec ts[2];
+	int i;
+	for (i = 0; i < 2; i++) {
+		ts[i].tv_sec = b[i].tv_sec;
+		ts[i].tv_nsec = b[i].tv_usec * 1000;
+	}
+	return utimensat(AT_FDCWD, a, ts, 0);
 }
 
 int
@@ -3761,22 +3919,20 @@ setpriority(int a, int b, int c)
 	FAIL;
 }
 
-uid_t
-getuid(void)
-{
-	FAIL;
-}
-
 int
-setuid(uid_t a)
+setuid(uid_t uid)
 {
-	FAIL;
+	int ret = syscall(SA(uid), 0, 0, 0, 0, SYS_SETUID);
+	ERRNO_NZ(ret);
+	return ret;
 }
 
 int
-setgid(gid_t a)
+setgid(gid_t gid)
 {
-	FAIL;
+	int ret = syscall(SA(gid), 0, 0, 0, 0, SYS_SETGID);
+	ERRNO_NZ(ret);
+	return ret;
 }
 
 int
@@ -3791,21 +3947,6 @@ realpath(const char *a, char *b)
 	FAIL;
 }
 
-int
-lstat(const char *a, struct stat *b)
-{
-	// will some applications break because they expect lstat to be a
-	// system call?
-	// XXX yes, if it has maximum open fds already
-	int fd = open(a, O_RDONLY);
-	if (fd == -1)
-		return -1;
-	int ret = fstat(fd, b);
-	if (close(fd) == -1)
-		fprintf(stderr, "lstat close failed\n");
-	return ret;
-}
-
 /* LMBENCH STUFF */
 unsigned int
 alarm(unsigned int sec)
@@ -37,16 +37,26 @@ replace caller => ./biscuit/src/caller
 
 replace circbuf => ./biscuit/src/circbuf
 
+replace crashexplore => ./biscuit/src/crashexplore
+
 replace defs => ./biscuit/src/defs
 
+replace dev => ./biscuit/src/dev
+
+replace devfs => ./biscuit/src/devfs
+
 replace fd => ./biscuit/src/fd
 
 replace fdops => ./biscuit/src/fdops
 
 replace fs => ./biscuit/src/fs
 
+replace fsck => ./biscuit/src/fsck
+
 replace hashtable => ./biscuit/src/hashtable
 
+replace imgtool => ./biscuit/src/imgtool
+
 replace inet => ./biscuit/src/inet
 
 replace ixgbe => ./biscuit/src/ixgbe
@@ -55,6 +65,8 @@ replace kernel => ./biscuit/src/kernel
 
 replace limits => ./biscuit/src/limits
 
+replace logtool => ./biscuit/src/logtool
+
 replace mem => ./biscuit/src/mem
 
 replace msi => ./biscuit/src/msi
@@ -65,6 +77,8 @@ replace pci => ./biscuit/src/pci
 
 replace proc => ./biscuit/src/proc
 
+replace procfs => ./biscuit/src/procfs
+
 replace res => ./biscuit/src/res
 
 replace stat => ./biscuit/src/stat
@@ -73,6 +87,8 @@ replace stats => ./biscuit/src/stats
 
 replace tinfo => ./biscuit/src/tinfo
 
+replace tmpfs => ./biscuit/src/tmpfs
+
 replace ufs => ./biscuit/src/ufs
 
 replace unet => ./biscuit/src/unet
@@ -81,4 +97,6 @@ replace ustr => ./biscuit/src/ustr
 
 replace util => ./biscuit/src/util
 
+replace vfs => ./biscuit/src/vfs
+
 replace vm => ./biscuit/src/vm